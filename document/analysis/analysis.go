@@ -0,0 +1,122 @@
+package analysis
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// names of builtin analyzers
+const (
+	// Whitespace splits text by white space only
+	Whitespace = "whitespace"
+	// Simple splits text into words of letters and digits, and lowercases them
+	Simple = "simple"
+	// English is Simple plus removal of english stop words and porter stemming
+	English = "english"
+	// Default analyzer of text index
+	Default = English
+)
+
+type (
+	// Tokenizer splits text into tokens
+	Tokenizer func(text string) []string
+	// TokenFilter transforms tokens, tokens can be removed by returning less
+	TokenFilter func(tokens []string) []string
+	// Analyzer turns text into terms by a Tokenizer followed by TokenFilters
+	Analyzer struct {
+		Tokenizer Tokenizer
+		Filters   []TokenFilter
+	}
+)
+
+// Analyze returns the terms of text
+func (a *Analyzer) Analyze(text string) (terms []string) {
+	terms = a.Tokenizer(text)
+	for _, filter := range a.Filters {
+		terms = filter(terms)
+	}
+	return
+}
+
+var (
+	mu        sync.RWMutex
+	analyzers = map[string]*Analyzer{
+		Whitespace: &Analyzer{Tokenizer: WhitespaceTokenizer},
+		Simple:     &Analyzer{Tokenizer: WordTokenizer, Filters: []TokenFilter{Lowercase}},
+		English:    &Analyzer{Tokenizer: WordTokenizer, Filters: []TokenFilter{Lowercase, StopWords(EnglishStopWords), PorterStem}},
+	}
+)
+
+// Register an analyzer by name, an existing one is replaced.
+// Analyzers are not persisted, so every process must register the same analyzers before use.
+func Register(name string, a *Analyzer) {
+	mu.Lock()
+	analyzers[name] = a
+	mu.Unlock()
+}
+
+// Get an analyzer by name, empty name means Default, nil is returned if not found
+func Get(name string) *Analyzer {
+	if name == "" {
+		name = Default
+	}
+
+	mu.RLock()
+	a := analyzers[name]
+	mu.RUnlock()
+	return a
+}
+
+// WhitespaceTokenizer splits text by white space
+func WhitespaceTokenizer(text string) []string {
+	return strings.Fields(text)
+}
+
+// WordTokenizer splits text into words of letters and digits
+func WordTokenizer(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Lowercase all tokens
+func Lowercase(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = strings.ToLower(token)
+	}
+	return tokens
+}
+
+// StopWords returns a TokenFilter that removes the given words
+func StopWords(words []string) TokenFilter {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+
+	return func(tokens []string) []string {
+		result := tokens[:0]
+		for _, token := range tokens {
+			if !set[token] {
+				result = append(result, token)
+			}
+		}
+		return result
+	}
+}
+
+// PorterStem stems all tokens by the porter algorithm
+func PorterStem(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = Stem(token)
+	}
+	return tokens
+}
+
+// EnglishStopWords are common english words removed by English
+var EnglishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into", "is", "it",
+	"no", "not", "of", "on", "or", "such", "that", "the", "their", "then", "there", "these",
+	"they", "this", "to", "was", "will", "with",
+}
@@ -0,0 +1,49 @@
+package analysis
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestStem(t *testing.T) {
+	for word, stem := range map[string]string{
+		"caresses":       "caress",
+		"ponies":         "poni",
+		"cats":           "cat",
+		"feed":           "feed",
+		"agreed":         "agre",
+		"plastered":      "plaster",
+		"motoring":       "motor",
+		"sing":           "sing",
+		"hopping":        "hop",
+		"falling":        "fall",
+		"filing":         "file",
+		"happy":          "happi",
+		"relational":     "relat",
+		"conditional":    "condit",
+		"generalization": "gener",
+		"hopefulness":    "hope",
+		"electrical":     "electr",
+		"adjustment":     "adjust",
+		"adoption":       "adopt",
+		"controlling":    "control",
+		"running":        "run",
+		"runs":           "run",
+		"is":             "is",
+		"naïve":          "naïve",
+	} {
+		assert.Equal(t, Stem(word), stem, word)
+	}
+}
+
+func TestAnalyzer(t *testing.T) {
+	text := "The Quick brown-fox is RUNNING, foxes ran!"
+	assert.DeepEqual(t, Get(Whitespace).Analyze(text), []string{"The", "Quick", "brown-fox", "is", "RUNNING,", "foxes", "ran!"})
+	assert.DeepEqual(t, Get(Simple).Analyze(text), []string{"the", "quick", "brown", "fox", "is", "running", "foxes", "ran"})
+	assert.DeepEqual(t, Get("").Analyze(text), []string{"quick", "brown", "fox", "run", "fox", "ran"})
+	assert.Assert(t, Get("unknown") == nil)
+
+	Register("keyword", &Analyzer{Tokenizer: func(text string) []string { return []string{text} }})
+	assert.DeepEqual(t, Get("keyword").Analyze("a b"), []string{"a b"})
+}
@@ -0,0 +1,248 @@
+package bson
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// TypeOrder returns the Order of bson type t,
+// types not listed by mongo are treated as regular expressions.
+func TypeOrder(t bsontype.Type) Order {
+	switch t {
+	case bsontype.MinKey:
+		return MinKeyOrder
+	case 0, bsontype.Null, bsontype.Undefined:
+		return NullOrder
+	case bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128:
+		return NumberOrder
+	case bsontype.String, bsontype.Symbol:
+		return StringOrder
+	case bsontype.EmbeddedDocument:
+		return ObjectOrder
+	case bsontype.Array:
+		return ArrayOrder
+	case bsontype.Binary:
+		return BinDataOrder
+	case bsontype.ObjectID:
+		return ObjectIDOrder
+	case bsontype.Boolean:
+		return BooleanOrder
+	case bsontype.DateTime:
+		return DateOrder
+	case bsontype.Timestamp:
+		return TimestampOrder
+	case bsontype.MaxKey:
+		return MaxKeyOrder
+	default:
+		return REOrder
+	}
+}
+
+// Compare returns -1, 0, 1 if a is less than, equal to or greater than b,
+// values of different types are compared by TypeOrder first.
+func Compare(a, b bson.RawValue) int {
+	oa, ob := TypeOrder(a.Type), TypeOrder(b.Type)
+	if oa != ob {
+		if oa < ob {
+			return -1
+		}
+		return 1
+	}
+
+	switch oa {
+	case MinKeyOrder, NullOrder, MaxKeyOrder:
+		return 0
+	case NumberOrder:
+		return compareNumber(a, b)
+	case StringOrder:
+		return strings.Compare(stringValue(a), stringValue(b))
+	case ObjectOrder:
+		return compareDocument(a.Document(), b.Document(), true)
+	case ArrayOrder:
+		return compareDocument(a.Array(), b.Array(), false)
+	case BinDataOrder:
+		sa, da := a.Binary()
+		sb, db := b.Binary()
+		if len(da) != len(db) {
+			return compareInt64(int64(len(da)), int64(len(db)))
+		}
+		if sa != sb {
+			return compareInt64(int64(sa), int64(sb))
+		}
+		return bytes.Compare(da, db)
+	case ObjectIDOrder:
+		ia, ib := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(ia[:], ib[:])
+	case BooleanOrder:
+		ba, bb := a.Boolean(), b.Boolean()
+		switch {
+		case ba == bb:
+			return 0
+		case bb:
+			return -1
+		default:
+			return 1
+		}
+	case DateOrder:
+		return compareInt64(a.DateTime(), b.DateTime())
+	case TimestampOrder:
+		ta, ia := a.Timestamp()
+		tb, ib := b.Timestamp()
+		if ta != tb {
+			return compareInt64(int64(ta), int64(tb))
+		}
+		return compareInt64(int64(ia), int64(ib))
+	default:
+		if a.Type == bsontype.Regex && b.Type == bsontype.Regex {
+			pa, oa := a.Regex()
+			pb, ob := b.Regex()
+			if c := strings.Compare(pa, pb); c != 0 {
+				return c
+			}
+			return strings.Compare(oa, ob)
+		}
+		if a.Type != b.Type {
+			return compareInt64(int64(a.Type), int64(b.Type))
+		}
+		return bytes.Compare(a.Value, b.Value)
+	}
+}
+
+// Equal is short for Compare(a, b) == 0
+func Equal(a, b bson.RawValue) bool {
+	return Compare(a, b) == 0
+}
+
+func stringValue(v bson.RawValue) string {
+	if v.Type == bsontype.Symbol {
+		return v.Symbol()
+	}
+	return v.StringValue()
+}
+
+// compareDocument compares element by element,
+// for documents the field name is compared right after the type order of value.
+func compareDocument(a, b bson.Raw, withKey bool) int {
+	ea, _ := a.Elements()
+	eb, _ := b.Elements()
+	for i := 0; i < len(ea) && i < len(eb); i++ {
+		va, vb := ea[i].Value(), eb[i].Value()
+		oa, ob := TypeOrder(va.Type), TypeOrder(vb.Type)
+		if oa != ob {
+			if oa < ob {
+				return -1
+			}
+			return 1
+		}
+		if withKey {
+			if c := strings.Compare(ea[i].Key(), eb[i].Key()); c != 0 {
+				return c
+			}
+		}
+		if c := Compare(va, vb); c != 0 {
+			return c
+		}
+	}
+	return compareInt64(int64(len(ea)), int64(len(eb)))
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareNumber compares int32, int64, double and decimal128 in a unified space,
+// NaN is less than any other number as mongo does.
+func compareNumber(a, b bson.RawValue) int {
+	ia, aIsInt := intValue(a)
+	ib, bIsInt := intValue(b)
+	switch {
+	case aIsInt && bIsInt:
+		return compareInt64(ia, ib)
+	case aIsInt:
+		return compareInt64Float64(ia, floatValue(b))
+	case bIsInt:
+		return -compareInt64Float64(ib, floatValue(a))
+	default:
+		return compareFloat64(floatValue(a), floatValue(b))
+	}
+}
+
+func intValue(v bson.RawValue) (int64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	default:
+		return 0, false
+	}
+}
+
+func floatValue(v bson.RawValue) float64 {
+	if v.Type == bsontype.Decimal128 {
+		d := v.Decimal128()
+		if d.IsNaN() {
+			return math.NaN()
+		}
+		if inf := d.IsInf(); inf != 0 {
+			return math.Inf(inf)
+		}
+		f, err := strconv.ParseFloat(d.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return v.Double()
+}
+
+func compareFloat64(a, b float64) int {
+	aNaN, bNaN := math.IsNaN(a), math.IsNaN(b)
+	switch {
+	case aNaN && bNaN:
+		return 0
+	case aNaN:
+		return -1
+	case bNaN:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareInt64Float64 compares without losing precision of large integers
+func compareInt64Float64(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 1
+	case f >= math.MaxInt64:
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+
+	floor := math.Floor(f)
+	if c := compareInt64(i, int64(floor)); c != 0 {
+		return c
+	}
+	if f > floor {
+		return -1
+	}
+	return 0
+}
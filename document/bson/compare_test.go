@@ -0,0 +1,72 @@
+package bson
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func rawValue(t *testing.T, v interface{}) bson.RawValue {
+	rv, err := ToRawValue(v)
+	assert.Assert(t, err == nil)
+	return rv
+}
+
+func TestCompare(t *testing.T) {
+	// in ascending order
+	ordered := []interface{}{
+		primitive.MinKey{},
+		nil,
+		math.NaN(),
+		int64(math.MinInt64),
+		-1.5,
+		int32(-1),
+		0.0,
+		int64(1),
+		1.5,
+		int32(2),
+		int64(math.MaxInt64),
+		"",
+		"a",
+		"ab",
+		bson.D{{Key: "a", Value: 1}},
+		bson.D{{Key: "b", Value: 0}},
+		// type of value is compared before field name
+		bson.D{{Key: "a", Value: "x"}},
+		bson.A{1},
+		bson.A{1, 2},
+		bson.A{2},
+		primitive.Binary{Data: []byte{9}},
+		primitive.Binary{Data: []byte{1, 2}},
+		primitive.ObjectID{1},
+		primitive.ObjectID{2},
+		false,
+		true,
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+		primitive.Timestamp{T: 1, I: 2},
+		primitive.Timestamp{T: 2, I: 1},
+		primitive.Regex{Pattern: "a"},
+		primitive.MaxKey{},
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			a, b := rawValue(t, ordered[i]), rawValue(t, ordered[j])
+			expected := compareInt64(int64(i), int64(j))
+			assert.Equal(t, Compare(a, b), expected, "%v vs %v", ordered[i], ordered[j])
+		}
+	}
+
+	// numbers of different types
+	assert.Assert(t, Equal(rawValue(t, int32(1)), rawValue(t, 1.0)))
+	assert.Assert(t, Equal(rawValue(t, int64(1)), rawValue(t, int32(1))))
+	assert.Assert(t, Compare(rawValue(t, int64(1<<53+1)), rawValue(t, float64(1<<53))) > 0)
+	// null and undefined are the same
+	assert.Assert(t, Equal(rawValue(t, nil), bson.RawValue{Type: bsontype.Undefined}))
+}
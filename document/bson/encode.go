@@ -0,0 +1,328 @@
+package bson
+
+import (
+	"errors"
+	"math"
+
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	// ErrTypeNotSupported when a bson type can not be encoded
+	ErrTypeNotSupported = errors.New("bson type not supported")
+	// ErrNotDecodable when the original value can not be recovered from the encoded form
+	ErrNotDecodable = errors.New("bson value not decodable")
+)
+
+// number classes, NaN is less than any other number
+const (
+	nanClass    byte = 0
+	numberClass byte = 1
+)
+
+// end marker of documents and arrays, elements start with their type order plus 1
+const endMarker byte = 0
+
+// Encode appends the memcomparable-format of v to buf,
+// the byte order of encoded values is the same as Compare.
+// It starts with the type order of v, numbers of all types share the same space.
+func Encode(buf []byte, v bson.RawValue) ([]byte, error) {
+	return encoder{}.encode(buf, v)
+}
+
+// EncodeDesc is like Encode, but in descending order
+func EncodeDesc(buf []byte, v bson.RawValue) ([]byte, error) {
+	return encoder{desc: true}.encode(buf, v)
+}
+
+// Decode decodes a value encoded by Encode, t is the type of the original value,
+// 0 means missing for values of NullOrder.
+func Decode(b []byte, t bsontype.Type) ([]byte, bson.RawValue, error) {
+	return encoder{}.decode(b, t)
+}
+
+// DecodeDesc decodes a value encoded by EncodeDesc
+func DecodeDesc(b []byte, t bsontype.Type) ([]byte, bson.RawValue, error) {
+	return encoder{desc: true}.decode(b, t)
+}
+
+type encoder struct {
+	desc bool
+}
+
+func (e encoder) uint8(buf []byte, v uint8) []byte {
+	if e.desc {
+		return memcomparable.EncodeUint8Desc(buf, v)
+	}
+	return memcomparable.EncodeUint8(buf, v)
+}
+
+func (e encoder) uint64(buf []byte, v uint64) []byte {
+	if e.desc {
+		return memcomparable.EncodeUint64Desc(buf, v)
+	}
+	return memcomparable.EncodeUint64(buf, v)
+}
+
+func (e encoder) int64(buf []byte, v int64) []byte {
+	if e.desc {
+		return memcomparable.EncodeInt64Desc(buf, v)
+	}
+	return memcomparable.EncodeInt64(buf, v)
+}
+
+func (e encoder) float64(buf []byte, v float64) []byte {
+	if e.desc {
+		return memcomparable.EncodeFloat64Desc(buf, v)
+	}
+	return memcomparable.EncodeFloat64(buf, v)
+}
+
+func (e encoder) bytes(buf []byte, v []byte) []byte {
+	if e.desc {
+		return memcomparable.EncodeBytesDesc(buf, v)
+	}
+	return memcomparable.EncodeBytes(buf, v)
+}
+
+func (e encoder) decodeUint8(b []byte) ([]byte, uint8, error) {
+	if e.desc {
+		return memcomparable.DecodeUint8Desc(b)
+	}
+	return memcomparable.DecodeUint8(b)
+}
+
+func (e encoder) decodeUint64(b []byte) ([]byte, uint64, error) {
+	if e.desc {
+		return memcomparable.DecodeUint64Desc(b)
+	}
+	return memcomparable.DecodeUint64(b)
+}
+
+func (e encoder) decodeInt64(b []byte) ([]byte, int64, error) {
+	if e.desc {
+		return memcomparable.DecodeInt64Desc(b)
+	}
+	return memcomparable.DecodeInt64(b)
+}
+
+func (e encoder) decodeFloat64(b []byte) ([]byte, float64, error) {
+	if e.desc {
+		return memcomparable.DecodeFloat64Desc(b)
+	}
+	return memcomparable.DecodeFloat64(b)
+}
+
+func (e encoder) decodeBytes(b []byte) ([]byte, []byte, error) {
+	if e.desc {
+		return memcomparable.DecodeBytesDesc(b, nil)
+	}
+	return memcomparable.DecodeBytes(b, nil)
+}
+
+func (e encoder) encode(buf []byte, v bson.RawValue) ([]byte, error) {
+	buf = e.uint8(buf, uint8(TypeOrder(v.Type)))
+	return e.encodeBody(buf, v)
+}
+
+// encodeBody encodes v without its type order
+func (e encoder) encodeBody(buf []byte, v bson.RawValue) (_ []byte, err error) {
+	switch TypeOrder(v.Type) {
+	case MinKeyOrder, NullOrder, MaxKeyOrder:
+	case NumberOrder:
+		buf = e.encodeNumber(buf, v)
+	case StringOrder:
+		buf = e.bytes(buf, []byte(stringValue(v)))
+	case ObjectOrder:
+		buf, err = e.encodeElements(buf, v.Document(), true)
+	case ArrayOrder:
+		buf, err = e.encodeElements(buf, v.Array(), false)
+	case BinDataOrder:
+		subtype, data := v.Binary()
+		buf = e.uint64(buf, uint64(len(data)))
+		buf = e.uint8(buf, subtype)
+		buf = e.bytes(buf, data)
+	case ObjectIDOrder:
+		oid := v.ObjectID()
+		for _, b := range oid {
+			buf = e.uint8(buf, b)
+		}
+	case BooleanOrder:
+		if v.Boolean() {
+			buf = e.uint8(buf, 1)
+		} else {
+			buf = e.uint8(buf, 0)
+		}
+	case DateOrder:
+		buf = e.int64(buf, v.DateTime())
+	case TimestampOrder:
+		t, i := v.Timestamp()
+		buf = e.uint64(buf, uint64(t)<<32|uint64(i))
+	default:
+		if v.Type != bsontype.Regex {
+			err = ErrTypeNotSupported
+			return
+		}
+		pattern, options := v.Regex()
+		buf = e.bytes(buf, []byte(pattern))
+		buf = e.bytes(buf, []byte(options))
+	}
+	return buf, err
+}
+
+// encodeNumber encodes a number as a float64 no larger than it plus the integral remainder,
+// so that int64 values beyond the precision of float64 are still ordered correctly.
+func (e encoder) encodeNumber(buf []byte, v bson.RawValue) []byte {
+	i, isInt := intValue(v)
+	if !isInt {
+		f := floatValue(v)
+		if math.IsNaN(f) {
+			return e.uint8(buf, nanClass)
+		}
+		buf = e.uint8(buf, numberClass)
+		buf = e.float64(buf, f)
+		return e.uint64(buf, 0)
+	}
+
+	f := float64(i)
+	if compareInt64Float64(i, f) < 0 {
+		f = math.Nextafter(f, math.Inf(-1))
+	}
+	buf = e.uint8(buf, numberClass)
+	buf = e.float64(buf, f)
+	return e.uint64(buf, uint64(i)-uint64(int64(f)))
+}
+
+// encodeElements encodes documents and arrays element by element,
+// for documents the field name follows the type order of value as Compare does.
+func (e encoder) encodeElements(buf []byte, doc bson.Raw, withKey bool) (_ []byte, err error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	for _, element := range elements {
+		value := element.Value()
+		buf = e.uint8(buf, uint8(TypeOrder(value.Type))+1)
+		if withKey {
+			buf = e.bytes(buf, []byte(element.Key()))
+		}
+		buf, err = e.encodeBody(buf, value)
+		if err != nil {
+			return
+		}
+	}
+	return e.uint8(buf, endMarker), nil
+}
+
+func (e encoder) decode(b []byte, t bsontype.Type) (leftover []byte, v bson.RawValue, err error) {
+	b, order, err := e.decodeUint8(b)
+	if err != nil {
+		return
+	}
+	if Order(order) != TypeOrder(t) {
+		err = ErrNotDecodable
+		return
+	}
+
+	v.Type = t
+	switch Order(order) {
+	case MinKeyOrder, NullOrder, MaxKeyOrder:
+		leftover = b
+	case NumberOrder:
+		leftover, v.Value, err = e.decodeNumber(b, t)
+	case StringOrder:
+		var data []byte
+		leftover, data, err = e.decodeBytes(b)
+		v.Value = bsoncore.AppendString(nil, string(data))
+	case BinDataOrder:
+		var (
+			subtype uint8
+			data    []byte
+		)
+		leftover, _, err = e.decodeUint64(b)
+		if err != nil {
+			return
+		}
+		leftover, subtype, err = e.decodeUint8(leftover)
+		if err != nil {
+			return
+		}
+		leftover, data, err = e.decodeBytes(leftover)
+		v.Value = bsoncore.AppendBinary(nil, subtype, data)
+	case ObjectIDOrder:
+		var oid primitive.ObjectID
+		leftover = b
+		for i := range oid {
+			leftover, oid[i], err = e.decodeUint8(leftover)
+			if err != nil {
+				return
+			}
+		}
+		v.Value = bsoncore.AppendObjectID(nil, oid)
+	case BooleanOrder:
+		var u uint8
+		leftover, u, err = e.decodeUint8(b)
+		v.Value = bsoncore.AppendBoolean(nil, u == 1)
+	case DateOrder:
+		var ms int64
+		leftover, ms, err = e.decodeInt64(b)
+		v.Value = bsoncore.AppendDateTime(nil, ms)
+	case TimestampOrder:
+		var u uint64
+		leftover, u, err = e.decodeUint64(b)
+		v.Value = bsoncore.AppendTimestamp(nil, uint32(u>>32), uint32(u))
+	default:
+		// documents and arrays lose the types of their elements
+		err = ErrNotDecodable
+	}
+	if err != nil {
+		leftover = nil
+		v = bson.RawValue{}
+	}
+	return
+}
+
+func (e encoder) decodeNumber(b []byte, t bsontype.Type) (leftover []byte, value []byte, err error) {
+	leftover, class, err := e.decodeUint8(b)
+	if err != nil {
+		return
+	}
+	if class == nanClass {
+		if t != bsontype.Double {
+			err = ErrNotDecodable
+			return
+		}
+		value = bsoncore.AppendDouble(nil, math.NaN())
+		return
+	}
+
+	var (
+		f float64
+		r uint64
+	)
+	leftover, f, err = e.decodeFloat64(leftover)
+	if err != nil {
+		return
+	}
+	leftover, r, err = e.decodeUint64(leftover)
+	if err != nil {
+		return
+	}
+
+	switch t {
+	case bsontype.Int32:
+		value = bsoncore.AppendInt32(nil, int32(int64(f)+int64(r)))
+	case bsontype.Int64:
+		value = bsoncore.AppendInt64(nil, int64(uint64(int64(f))+r))
+	case bsontype.Double:
+		value = bsoncore.AppendDouble(nil, f)
+	default:
+		err = ErrNotDecodable
+	}
+	return
+}
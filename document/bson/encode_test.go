@@ -0,0 +1,178 @@
+package bson
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+// randomValue generates values of all encodable types,
+// values are picked from small domains so that equal values show up often.
+func randomValue(r *rand.Rand, depth int) interface{} {
+	n := 14
+	if depth > 1 {
+		// no more nesting
+		n = 12
+	}
+
+	switch r.Intn(n) {
+	case 0:
+		return primitive.MinKey{}
+	case 1:
+		return primitive.MaxKey{}
+	case 2:
+		if r.Intn(2) == 0 {
+			return nil
+		}
+		return primitive.Undefined{}
+	case 3:
+		return int32(r.Intn(7) - 3)
+	case 4:
+		edges := []int64{math.MinInt64, math.MaxInt64, 1 << 53, 1<<53 + 1, -(1<<53 + 1), math.MaxInt64 - 1}
+		if r.Intn(2) == 0 {
+			return edges[r.Intn(len(edges))]
+		}
+		return int64(r.Intn(7) - 3)
+	case 5:
+		specials := []float64{math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1), 1 << 53, 1<<63 - 1, -1 << 63, 0.5, -2.5}
+		if r.Intn(2) == 0 {
+			return specials[r.Intn(len(specials))]
+		}
+		return float64(r.Intn(7)-3) / 2
+	case 6:
+		alphabet := []string{"", "a", "b", "\x00", "\xff"}
+		s := ""
+		for i := r.Intn(4); i > 0; i-- {
+			s += alphabet[r.Intn(len(alphabet))]
+		}
+		return s
+	case 7:
+		return r.Intn(2) == 0
+	case 8:
+		return primitive.DateTime(r.Intn(5) - 2)
+	case 9:
+		return primitive.ObjectID{byte(r.Intn(3)), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(r.Intn(3))}
+	case 10:
+		return primitive.Timestamp{T: uint32(r.Intn(3)), I: uint32(r.Intn(3))}
+	case 11:
+		data := make([]byte, r.Intn(3))
+		r.Read(data)
+		return primitive.Binary{Subtype: byte(r.Intn(2)), Data: data}
+	case 12:
+		d := bson.D{}
+		for i := r.Intn(3); i > 0; i-- {
+			d = append(d, bson.E{Key: []string{"a", "b"}[r.Intn(2)], Value: randomValue(r, depth+1)})
+		}
+		return d
+	default:
+		a := bson.A{}
+		for i := r.Intn(3); i > 0; i-- {
+			a = append(a, randomValue(r, depth+1))
+		}
+		return a
+	}
+}
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestEncodeOrder(t *testing.T) {
+	seed := time.Now().UnixNano()
+	r := rand.New(rand.NewSource(seed))
+
+	n := 300
+	values := make([]bson.RawValue, n)
+	asc := make([][]byte, n)
+	desc := make([][]byte, n)
+	for i := range values {
+		var err error
+		values[i] = rawValue(t, randomValue(r, 0))
+		asc[i], err = Encode(nil, values[i])
+		assert.Assert(t, err == nil)
+		desc[i], err = EncodeDesc(nil, values[i])
+		assert.Assert(t, err == nil)
+	}
+
+	for i := range values {
+		for j := range values {
+			expected := Compare(values[i], values[j])
+			msg := fmt.Sprintf("seed %d: %v vs %v", seed, values[i], values[j])
+			assert.Equal(t, sign(bytes.Compare(asc[i], asc[j])), expected, msg)
+			assert.Equal(t, sign(bytes.Compare(desc[i], desc[j])), -expected, msg)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, v := range []interface{}{
+		nil,
+		primitive.MinKey{},
+		primitive.MaxKey{},
+		int32(-7),
+		int64(math.MinInt64),
+		int64(math.MaxInt64),
+		int64(1<<53 + 1),
+		-0.5,
+		math.Inf(1),
+		"ab\x00c",
+		true,
+		primitive.DateTime(-12345),
+		primitive.NewObjectID(),
+		primitive.Timestamp{T: 3, I: 4},
+		primitive.Binary{Subtype: 2, Data: []byte{1, 2, 3}},
+	} {
+		rv := rawValue(t, v)
+		for _, desc := range []bool{false, true} {
+			encode, decode := Encode, Decode
+			if desc {
+				encode, decode = EncodeDesc, DecodeDesc
+			}
+			encoded, err := encode(nil, rv)
+			assert.Assert(t, err == nil)
+			// followed by other data
+			encoded = append(encoded, 0xaa)
+
+			leftover, decoded, err := decode(encoded, rv.Type)
+			assert.Assert(t, err == nil, "%v", v)
+			assert.DeepEqual(t, leftover, []byte{0xaa})
+			assert.Equal(t, decoded.Type, rv.Type)
+			assert.Assert(t, bytes.Equal(decoded.Value, rv.Value), "%v", v)
+		}
+	}
+
+	// missing values are encoded as null
+	encoded, err := Encode(nil, bson.RawValue{})
+	assert.Assert(t, err == nil)
+	_, decoded, err := Decode(encoded, 0)
+	assert.Assert(t, err == nil && decoded.Type == 0)
+
+	// numbers are decoded to the original type
+	encoded, err = Encode(nil, rawValue(t, 3.0))
+	assert.Assert(t, err == nil)
+	_, decoded, err = Decode(encoded, bsontype.Int32)
+	assert.Assert(t, err == nil && decoded.Int32() == 3)
+
+	encoded, err = Encode(nil, rawValue(t, bson.A{1}))
+	assert.Assert(t, err == nil)
+	_, _, err = Decode(encoded, bsontype.Array)
+	assert.Assert(t, err == ErrNotDecodable)
+
+	_, err = Encode(nil, bson.RawValue{Type: bsontype.JavaScript, Value: []byte{1, 0, 0, 0, 0}})
+	assert.Assert(t, err == ErrTypeNotSupported)
+}
@@ -1,8 +1,25 @@
 package bson
 
-import "go.mongodb.org/mongo-driver/bson/bsontype"
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
 
 // Value for bson
 type Value struct {
 	Type bsontype.Type
 }
+
+// ToRawValue converts a go value into bson.RawValue, nil is converted to null
+func ToRawValue(v interface{}) (rv bson.RawValue, err error) {
+	if v == nil {
+		rv.Type = bsontype.Null
+		return
+	}
+	if rv, ok := v.(bson.RawValue); ok {
+		return rv, nil
+	}
+
+	rv.Type, rv.Value, err = bson.MarshalValue(v)
+	return
+}
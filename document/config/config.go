@@ -6,6 +6,20 @@ import "time"
 type Value struct {
 	WorkerMaxTickInterval time.Duration
 	Lease                 time.Duration
+	// TTLMonitorInterval is the interval of deleting expired documents, 0 disables it
+	TTLMonitorInterval time.Duration
+	// TTLBatchSize is the max number of expired documents deleted in a transaction
+	TTLBatchSize int
+	// TTLMaxBatches is the max number of batches per collection in each round
+	TTLMaxBatches int
+	// ChangeLogRetention is how long change events are kept
+	ChangeLogRetention time.Duration
+	// ChangeLogGCInterval is the interval of truncating expired change events, 0 disables it
+	ChangeLogGCInterval time.Duration
+	// ChangeLogGCBatchSize is the max number of change events truncated in a transaction
+	ChangeLogGCBatchSize int
+	// AggregateMemoryLimit is the bytes a $sort or $group stage can use before spilling to the kv
+	AggregateMemoryLimit int
 }
 
 // Load config
@@ -5,4 +5,11 @@ import "time"
 var config = Value{
 	WorkerMaxTickInterval: time.Second,
 	Lease:                 0,
+	TTLMonitorInterval:    time.Minute,
+	TTLBatchSize:          100,
+	TTLMaxBatches:         10,
+	ChangeLogRetention:    24 * time.Hour,
+	ChangeLogGCInterval:   time.Minute,
+	ChangeLogGCBatchSize:  1000,
+	AggregateMemoryLimit:  100 << 20,
 }
@@ -18,6 +18,8 @@ var (
 	ErrJobsInQueueExceeded = errors.New("ddl jobs in queue exceeded")
 	// ErrDBAlreadyExists used by DDL
 	ErrDBAlreadyExists = errors.New("db already exists")
+	// ErrCollectionAlreadyExists used by DDL
+	ErrCollectionAlreadyExists = errors.New("collection already exists")
 	// ErrCollectionNotExists used by DDL
 	ErrCollectionNotExists = errors.New("collection not exists")
 	// ErrDBNotExists used by DDL
@@ -7,6 +7,7 @@ import (
 	"github.com/zhiqiangxu/mondis/document/meta"
 	"github.com/zhiqiangxu/mondis/document/model"
 	"github.com/zhiqiangxu/mondis/util"
+	"github.com/zhiqiangxu/util/osc"
 )
 
 // CreateSchema for create db
@@ -16,7 +17,10 @@ func (d *DDL) CreateSchema(ctx context.Context, input CreateSchemaInput) (job *m
 		return
 	}
 
-	n := 2 + len(input.Collections) + len(input.Indices)
+	n := 2 + len(input.Collections)
+	for _, indexInfos := range input.Indices {
+		n += len(indexInfos)
+	}
 	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
 		m := meta.NewMeta(txn)
 		queueLength, err := m.DDLJobQueueLen()
@@ -53,8 +57,10 @@ func (d *DDL) CreateSchema(ctx context.Context, input CreateSchemaInput) (job *m
 			collectInfo := dbInfo.Collections[cn]
 			if collectInfo == nil {
 				collectInfo = &model.CollectionInfo{
-					ID:   nextID + 1,
-					Name: cn,
+					ID:      nextID + 1,
+					Name:    cn,
+					Indices: make(map[string]*model.IndexInfo),
+					IDType:  input.IDTypes[cn],
 				}
 				nextID++
 				dbInfo.Collections[cn] = collectInfo
@@ -92,6 +98,154 @@ func (d *DDL) CreateSchema(ctx context.Context, input CreateSchemaInput) (job *m
 	return
 }
 
+// CreateCollection for create collection
+func (d *DDL) CreateCollection(ctx context.Context, input CreateCollectionInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, err := getDbInfo(m, input.DB)
+		if err != nil {
+			return
+		}
+		if dbi == nil || dbi.State != osc.StatePublic {
+			err = ErrDBNotExists
+			return
+		}
+		if dbi.CollectionExists(input.Collection) {
+			err = ErrCollectionAlreadyExists
+			return
+		}
+
+		start, _, err := m.GenGlobalIDs(2 + len(input.Indices))
+		if err != nil {
+			return
+		}
+
+		nextID := start + 1
+		ci := &model.CollectionInfo{
+			ID:   nextID,
+			Name: input.Collection,
+			JobRedundant: &model.CollectionInfoRedundant{
+				DB:   input.DB,
+				DBID: dbi.ID,
+			},
+			Indices: make(map[string]*model.IndexInfo),
+			IDType:  input.IDType,
+		}
+		if input.Capped != nil {
+			capped := *input.Capped
+			ci.Capped = &capped
+		}
+		for _, indexInfo := range input.Indices {
+			if ci.IndexExists(indexInfo.Name) {
+				err = ErrIndexAlreadyExists
+				return
+			}
+			iif := indexInfo.ToModel()
+			iif.ID = nextID + 1
+			nextID++
+			ci.AddIndexInfo(iif)
+		}
+
+		job = &model.Job{
+			ID:   nextID + 1,
+			Type: model.ActionCreateCollection,
+			Arg:  ci,
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
+
+// DropCollection for drop collection
+func (d *DDL) DropCollection(ctx context.Context, input DropCollectionInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, err := getDbInfo(m, input.DB)
+		if err != nil {
+			return
+		}
+		if dbi == nil || dbi.State != osc.StatePublic {
+			err = ErrDBNotExists
+			return
+		}
+		ci := dbi.CollectionInfo(input.Collection)
+		if ci == nil || ci.State != osc.StatePublic {
+			err = ErrCollectionNotExists
+			return
+		}
+
+		jobID, err := m.GenGlobalID()
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   jobID,
+			Type: model.ActionDropCollection,
+			Arg: &model.CollectionInfo{
+				ID:   ci.ID,
+				Name: ci.Name,
+				JobRedundant: &model.CollectionInfoRedundant{
+					DB:   input.DB,
+					DBID: dbi.ID,
+				},
+			},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
+
 // AddIndex for add index
 func (d *DDL) AddIndex(ctx context.Context, input AddIndexInput) (job *model.Job, err error) {
 	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
@@ -139,7 +293,55 @@ func (d *DDL) AddIndex(ctx context.Context, input AddIndexInput) (job *model.Job
 }
 
 // DropSchema for drop db
-func (d *DDL) DropSchema(ctx context.Context, input DropSchemaInput) (err error) {
+func (d *DDL) DropSchema(ctx context.Context, input DropSchemaInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, err := getDbInfo(m, input.DB)
+		if err != nil {
+			return
+		}
+		if dbi == nil || dbi.State != osc.StatePublic {
+			err = ErrDBNotExists
+			return
+		}
+
+		jobID, err := m.GenGlobalID()
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   jobID,
+			Type: model.ActionDropSchema,
+			Arg:  &model.DBInfo{ID: dbi.ID, Name: dbi.Name},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
 	return
 }
 
@@ -154,3 +356,252 @@ func (d *DDL) GetHistoryJob(jobID int64) (job *model.Job, err error) {
 
 	return
 }
+
+// DropIndex for drop index
+func (d *DDL) DropIndex(ctx context.Context, input DropIndexInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, err := getDbInfo(m, input.DB)
+		if err != nil {
+			return
+		}
+		if dbi == nil || dbi.State != osc.StatePublic {
+			err = ErrDBNotExists
+			return
+		}
+		ci := dbi.CollectionInfo(input.Collection)
+		if ci == nil || ci.State != osc.StatePublic {
+			err = ErrCollectionNotExists
+			return
+		}
+		iif := ci.IndexInfo(input.IndexName)
+		if iif == nil || iif.State != osc.StatePublic {
+			err = ErrIndexNotExists
+			return
+		}
+
+		jobID, err := m.GenGlobalID()
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   jobID,
+			Type: model.ActionDropIndex,
+			Arg: &model.IndexInfo{
+				ID:   iif.ID,
+				Name: iif.Name,
+				JobRedundant: &model.IndexInfoRedundant{
+					DB:         input.DB,
+					Collection: input.Collection,
+					CID:        ci.ID,
+				},
+			},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
+
+// TruncateCollection for truncate collection,
+// a new collection id is swapped in and data of the old one is deleted by the job afterwards.
+func (d *DDL) TruncateCollection(ctx context.Context, input TruncateCollectionInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, ci, err := getPublicCollectionInfo(m, input.DB, input.Collection)
+		if err != nil {
+			return
+		}
+
+		start, _, err := m.GenGlobalIDs(2)
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   start + 2,
+			Type: model.ActionTruncateCollection,
+			Arg: &model.CollectionInfo{
+				ID:   start + 1,
+				Name: ci.Name,
+				JobRedundant: &model.CollectionInfoRedundant{
+					DB:    input.DB,
+					DBID:  dbi.ID,
+					OldID: ci.ID,
+					NewID: start + 1,
+				},
+			},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
+
+// RenameCollection for rename collection
+func (d *DDL) RenameCollection(ctx context.Context, input RenameCollectionInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, ci, err := getPublicCollectionInfo(m, input.DB, input.Collection)
+		if err != nil {
+			return
+		}
+		if dbi.CollectionExists(input.NewName) {
+			err = ErrCollectionAlreadyExists
+			return
+		}
+
+		jobID, err := m.GenGlobalID()
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   jobID,
+			Type: model.ActionRenameCollection,
+			Arg: &model.CollectionInfo{
+				ID:   ci.ID,
+				Name: input.NewName,
+				JobRedundant: &model.CollectionInfoRedundant{
+					DB:      input.DB,
+					DBID:    dbi.ID,
+					OldName: ci.Name,
+				},
+			},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
+
+// SetValidator for set or remove the validator of collection,
+// existing documents are not checked, use dml.Collection.Validate for that.
+func (d *DDL) SetValidator(ctx context.Context, input SetValidatorInput) (job *model.Job, err error) {
+	err = input.Validate()
+	if err != nil {
+		return
+	}
+
+	err = util.RunInNewUpdateTxn(d.kvdb, func(txn mondis.ProviderTxn) (err error) {
+		m := meta.NewMeta(txn)
+		queueLength, err := m.DDLJobQueueLen()
+		if err != nil {
+			return
+		}
+		if queueLength > maxJobsInQueue {
+			err = ErrJobsInQueueExceeded
+			return
+		}
+
+		dbi, ci, err := getPublicCollectionInfo(m, input.DB, input.Collection)
+		if err != nil {
+			return
+		}
+
+		jobID, err := m.GenGlobalID()
+		if err != nil {
+			return
+		}
+
+		job = &model.Job{
+			ID:   jobID,
+			Type: model.ActionSetValidator,
+			Arg: &model.CollectionInfo{
+				ID:        ci.ID,
+				Name:      ci.Name,
+				Validator: input.ToModel(),
+				JobRedundant: &model.CollectionInfoRedundant{
+					DB:   input.DB,
+					DBID: dbi.ID,
+				},
+			},
+		}
+
+		err = m.EnQueueDDLJob(job)
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	d.notifyWorker(job.Type)
+
+	err = d.checkJob(ctx, job)
+	return
+}
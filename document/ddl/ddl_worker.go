@@ -10,6 +10,7 @@ import (
 	"github.com/zhiqiangxu/mondis/document/dml"
 	"github.com/zhiqiangxu/mondis/document/meta"
 	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv"
 	"github.com/zhiqiangxu/mondis/util"
 	util2 "github.com/zhiqiangxu/util"
 	"github.com/zhiqiangxu/util/logger"
@@ -92,14 +93,14 @@ func (w *worker) handleJobQueue() (err error) {
 			}
 
 			util2.RunWithRecovery(func() {
-				schemaVersion, afterCommitFunc4Job, failNow, runJobErr = w.runJob(m, job)
+				schemaVersion, afterCommitFunc4Job, failNow, runJobErr = w.runJob(txn, m, job)
 			}, func(interface{}) {
 				job.State = model.JobStateCancelling
 			})
 
 			if runJobErr != nil {
 				job.ErrorCount++
-				job.Error = runJobErr
+				job.Error = model.NewJobError(runJobErr)
 				logger.Instance().Error("runJob", zap.Any("job", job), zap.Error(runJobErr))
 				if failNow || job.ErrorCount >= jobMaxErrorCount {
 					err = w.finishJob(m, job)
@@ -143,7 +144,7 @@ func (w *worker) handleJobQueue() (err error) {
 	}
 }
 
-func (w *worker) runJob(m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+func (w *worker) runJob(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
 	if job.IsFinished() {
 		return
 	}
@@ -155,8 +156,22 @@ func (w *worker) runJob(m *meta.Meta, job *model.Job) (schemaVersion int64, afte
 	switch job.Type {
 	case model.ActionCreateSchema:
 		schemaVersion, afterCommitFunc4Job, failNow, err = w.onCreateSchema(m, job)
+	case model.ActionDropSchema:
+		schemaVersion, afterCommitFunc4Job, failNow, err = w.onDropSchema(txn, m, job)
+	case model.ActionCreateCollection:
+		schemaVersion, afterCommitFunc4Job, failNow, err = w.onCreateCollection(m, job)
+	case model.ActionDropCollection:
+		schemaVersion, afterCommitFunc4Job, failNow, err = w.onDropCollection(txn, m, job)
+	case model.ActionTruncateCollection:
+		schemaVersion, afterCommitFunc4Job, failNow, err = w.onTruncateCollection(txn, m, job)
+	case model.ActionRenameCollection:
+		schemaVersion, failNow, err = w.onRenameCollection(m, job)
+	case model.ActionSetValidator:
+		schemaVersion, failNow, err = w.onSetValidator(m, job)
 	case model.ActionAddIndex:
-		schemaVersion, afterCommitFunc4Job, failNow, err = w.onAddIndex(m, job)
+		schemaVersion, afterCommitFunc4Job, failNow, err = w.onAddIndex(txn, m, job)
+	case model.ActionDropIndex:
+		schemaVersion, failNow, err = w.onDropIndex(txn, m, job)
 	default:
 		// Invalid job, cancel it.
 		job.State = model.JobStateCancelled
@@ -186,7 +201,7 @@ func (w *worker) getFirstJob(m *meta.Meta) (job *model.Job, err error) {
 	return
 }
 
-func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+func (w *worker) onAddIndex(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
 	indexInfo := &model.IndexInfo{}
 	if err = job.DecodeArg(indexInfo); err != nil {
 		job.State = model.JobStateCancelled
@@ -213,6 +228,11 @@ func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64,
 
 	iif := ci.IndexInfo(indexInfo.Name)
 
+	if job.IsRollingback() {
+		schemaVersion, err = w.onRollbackAddIndex(txn, m, job, dbi, ci, iif)
+		return
+	}
+
 	switch job.SchemaState {
 	case osc.StateAbsent:
 		// absent -> delete only
@@ -231,17 +251,16 @@ func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64,
 			panic("AddIndexInfo: bug happened")
 		}
 
-		schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+		schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, clone)
 		if err != nil {
 			return
 		}
 
-		job.RawArg = nil // will encode job.Arg into job.RawArg
 		job.SchemaState = osc.StateDeleteOnly
 
 	case osc.StateDeleteOnly:
 		// delete only -> write only
-		if ci == nil {
+		if iif == nil {
 			err = ErrIndexNotExists
 			failNow = true
 			return
@@ -251,14 +270,14 @@ func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64,
 		if !ok {
 			panic("UpdateIndexInfo: bug happened")
 		}
-		schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+		schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
 		if err != nil {
 			return
 		}
 		job.SchemaState = osc.StateWriteOnly
 	case osc.StateWriteOnly:
 		// write only -> reorganization
-		if ci == nil {
+		if iif == nil {
 			err = ErrIndexNotExists
 			failNow = true
 			return
@@ -268,12 +287,43 @@ func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64,
 		if !ok {
 			panic("UpdateIndexInfo: bug happened")
 		}
-		schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+		schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
 		if err != nil {
 			return
 		}
 		job.SchemaState = osc.StateWriteReorganization
 	case osc.StateWriteReorganization:
+		// reorganization -> public
+		if iif == nil {
+			err = ErrIndexNotExists
+			failNow = true
+			return
+		}
+
+		var done bool
+		done, err = w.runReorgJob(txn, m, job, ci, iif)
+		if dupErr, ok := err.(*dml.DuplicateKeyError); ok {
+			schemaVersion, err = convertAddIndexJob2RollbackJob(m, job, dbi, ci, iif, dupErr)
+			return
+		}
+		if err != nil || !done {
+			return
+		}
+
+		iif.State = osc.StatePublic
+		ok := ci.UpdateIndexInfo(iif)
+		if !ok {
+			panic("UpdateIndexInfo: bug happened")
+		}
+		schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
+		if err != nil {
+			return
+		}
+		err = m.RemoveDDLReorgHandle(job)
+		if err != nil {
+			return
+		}
+		job.FinishCollectionJob(model.JobStateDone, osc.StatePublic, schemaVersion, ci)
 	default:
 		err = ErrInvalidDDLState
 		failNow = true
@@ -283,6 +333,166 @@ func (w *worker) onAddIndex(m *meta.Meta, job *model.Job) (schemaVersion int64,
 	return
 }
 
+// convertAddIndexJob2RollbackJob makes the index delete only,
+// its data will be removed by onRollbackAddIndex afterwards.
+func convertAddIndexJob2RollbackJob(m *meta.Meta, job *model.Job, dbi *model.DBInfo, ci *model.CollectionInfo, iif *model.IndexInfo, cause error) (schemaVersion int64, err error) {
+	iif.State = osc.StateDeleteOnly
+	ok := ci.UpdateIndexInfo(iif)
+	if !ok {
+		panic("UpdateIndexInfo: bug happened")
+	}
+	schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
+	if err != nil {
+		return
+	}
+
+	job.State = model.JobStateRollingback
+	job.SchemaState = osc.StateDeleteOnly
+	job.Error = model.NewJobError(cause)
+	return
+}
+
+// onRollbackAddIndex removes the partial index data in batches, then the index itself.
+func (w *worker) onRollbackAddIndex(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job, dbi *model.DBInfo, ci *model.CollectionInfo, iif *model.IndexInfo) (schemaVersion int64, err error) {
+	if iif == nil {
+		job.State = model.JobStateRollbackDone
+		return
+	}
+
+	switch job.SchemaState {
+	case osc.StateDeleteOnly:
+		var done bool
+		done, err = dml.DeleteIndexData(txn, ci.ID, iif.ID, reorgBatchSize)
+		if err != nil || !done {
+			return
+		}
+
+		ok := ci.RemoveIndexInfo(iif.Name)
+		if !ok {
+			panic("RemoveIndexInfo: bug happened")
+		}
+		iif.State = osc.StateAbsent
+		schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
+		if err != nil {
+			return
+		}
+		err = m.RemoveDDLReorgHandle(job)
+		if err != nil {
+			return
+		}
+		dml.ForgetIndex(iif.ID)
+		job.FinishCollectionJob(model.JobStateRollbackDone, osc.StateAbsent, schemaVersion, ci)
+	default:
+		err = ErrInvalidDDLState
+	}
+	return
+}
+
+// onDropIndex makes the index public -> write only -> delete only -> absent,
+// after that its data is deleted in batches, one batch per job txn so that it's resumable.
+func (w *worker) onDropIndex(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, failNow bool, err error) {
+	arg := &model.IndexInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	if job.SchemaState == osc.StateDeleteReorganization {
+		// the index is already absent from meta
+		var done bool
+		done, err = dml.DeleteIndexData(txn, arg.JobRedundant.CID, arg.ID, reorgBatchSize)
+		if err != nil || !done {
+			return
+		}
+		dml.ForgetIndex(arg.ID)
+		job.FinishCollectionJob(model.JobStateDone, osc.StateAbsent, 0, nil)
+		return
+	}
+
+	dbi, err := getDbInfo(m, arg.JobRedundant.DB)
+	if err != nil {
+		return
+	}
+	if dbi == nil || dbi.State != osc.StatePublic {
+		err = ErrDBNotExists
+		failNow = true
+		return
+	}
+	ci := dbi.CollectionInfo(arg.JobRedundant.Collection)
+	if ci == nil || ci.ID != arg.JobRedundant.CID {
+		err = ErrCollectionNotExists
+		failNow = true
+		return
+	}
+	iif := ci.IndexInfo(arg.Name)
+	if iif == nil || iif.ID != arg.ID {
+		err = ErrIndexNotExists
+		failNow = true
+		return
+	}
+
+	switch iif.State {
+	case osc.StatePublic:
+		// public -> write only
+		iif.State = osc.StateWriteOnly
+	case osc.StateWriteOnly:
+		// write only -> delete only
+		iif.State = osc.StateDeleteOnly
+	case osc.StateDeleteOnly:
+		// delete only -> absent
+		iif.State = osc.StateAbsent
+	default:
+		err = ErrInvalidDDLState
+		failNow = true
+		return
+	}
+
+	var ok bool
+	if iif.State == osc.StateAbsent {
+		ok = ci.RemoveIndexInfo(iif.Name)
+	} else {
+		ok = ci.UpdateIndexInfo(iif)
+	}
+	if !ok {
+		panic("UpdateIndexInfo: bug happened")
+	}
+	schemaVersion, err = updateSchemaVersionAndIndexInfo(m, job, dbi, ci, iif)
+	if err != nil {
+		return
+	}
+
+	if iif.State == osc.StateAbsent {
+		job.SchemaState = osc.StateDeleteReorganization
+	} else {
+		job.SchemaState = iif.State
+	}
+	return
+}
+
+const (
+	reorgBatchSize = 1000
+)
+
+// runReorgJob backfills a batch of documents into index,
+// the progress is saved as the key of the next document so that a restarted worker resumes from it.
+func (w *worker) runReorgJob(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job, ci *model.CollectionInfo, iif *model.IndexInfo) (done bool, err error) {
+	start, err := m.GetDDLReorgStartKey(job)
+	if err == kv.ErrKeyNotFound {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	next, done, err := dml.BackfillIndex(txn, ci, iif, start, reorgBatchSize)
+	if err != nil || done {
+		return
+	}
+
+	err = m.UpdateDDLReorgStartKey(job, next)
+	return
+}
+
 func (w *worker) onCreateSchema(m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
 
 	dbInfo := &model.DBInfo{}
@@ -319,6 +529,7 @@ func (w *worker) onCreateSchema(m *meta.Meta, job *model.Job) (schemaVersion int
 		}
 	}
 
+	job.RawArg = nil // will encode job.Arg into job.RawArg
 	schemaVersion, err = updateSchemaVersion(m, job)
 	if err != nil {
 		return
@@ -340,6 +551,474 @@ func (w *worker) onCreateSchema(m *meta.Meta, job *model.Job) (schemaVersion int
 
 }
 
+// onDropSchema makes the db public -> write only -> delete only -> absent,
+// after that data of its collections is deleted in batches, one batch per job txn so that it's resumable.
+func (w *worker) onDropSchema(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+	arg := &model.DBInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	if job.SchemaState == osc.StateDeleteReorganization {
+		// the db is already absent from meta
+		cids := make([]int64, 0, len(arg.CollectionOrder))
+		for _, name := range arg.CollectionOrder {
+			if ci := arg.Collections[name]; ci != nil {
+				cids = append(cids, ci.ID)
+			}
+		}
+		var done bool
+		done, err = w.runDeleteCollectionsJob(txn, m, job, cids)
+		if err != nil || !done {
+			return
+		}
+		job.FinishDBJob(model.JobStateDone, osc.StateAbsent, 0, nil)
+		return
+	}
+
+	dbInfo, err := m.GetDatabase(arg.ID)
+	if err != nil {
+		if err == meta.ErrDBNotExists {
+			failNow = true
+			err = ErrDBNotExists
+		}
+		return
+	}
+
+	switch dbInfo.State {
+	case osc.StatePublic:
+		// public -> write only
+		dbInfo.State = osc.StateWriteOnly
+		err = m.UpdateDatabase(dbInfo)
+		if err != nil {
+			return
+		}
+		job.SchemaState = osc.StateWriteOnly
+	case osc.StateWriteOnly:
+		// write only -> delete only
+		dbInfo.State = osc.StateDeleteOnly
+		err = m.UpdateDatabase(dbInfo)
+		if err != nil {
+			return
+		}
+		job.SchemaState = osc.StateDeleteOnly
+	case osc.StateDeleteOnly:
+		// delete only -> absent
+		err = m.DropDatabase(dbInfo.ID)
+		if err != nil {
+			return
+		}
+		dbInfo.State = osc.StateAbsent
+	default:
+		err = fmt.Errorf("invalid db state %v", dbInfo.State)
+		return
+	}
+
+	job.Arg = dbInfo
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+	schemaVersion, err = updateSchemaVersion(m, job)
+	if err != nil {
+		return
+	}
+
+	if dbInfo.State != osc.StateAbsent {
+		return
+	}
+
+	job.SchemaState = osc.StateDeleteReorganization
+
+	// the persisted sequences are cleared with the db, only the local ones are left
+	afterCommitFunc4Job = func() {
+		for _, collection := range dbInfo.Collections {
+			err := dml.DropSequenceIfExists(collection.ID)
+			if err != nil {
+				logger.Instance().Error("DropSequenceIfExists", zap.Int64("cid", collection.ID), zap.Error(err))
+			}
+			forgetCollection(collection)
+		}
+	}
+	return
+}
+
+func (w *worker) onCreateCollection(m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+	collectionInfo := &model.CollectionInfo{}
+	if err = job.DecodeArg(collectionInfo); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	dbi, err := getPublicDbInfoByID(m, collectionInfo.JobRedundant.DBID)
+	if err != nil {
+		failNow = err == ErrDBNotExists
+		return
+	}
+	if dbi.CollectionExists(collectionInfo.Name) {
+		failNow = true
+		err = ErrCollectionAlreadyExists
+		return
+	}
+
+	collectionInfo.State = osc.StatePublic
+	for _, index := range collectionInfo.Indices {
+		index.State = osc.StatePublic
+	}
+	ci := collectionInfo.Clone()
+	ci.JobRedundant = nil
+	err = m.CreateCollection(dbi.ID, ci)
+	if err != nil {
+		return
+	}
+	ok := dbi.AddCollectionInfo(ci)
+	if !ok {
+		panic("AddCollectionInfo: bug happened")
+	}
+	err = m.UpdateDatabase(dbi)
+	if err != nil {
+		return
+	}
+
+	job.Arg = collectionInfo
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+	schemaVersion, err = updateSchemaVersion(m, job)
+	if err != nil {
+		return
+	}
+	job.FinishCollectionJob(model.JobStateDone, osc.StatePublic, schemaVersion, ci)
+
+	afterCommitFunc4Job = func() {
+		util2.TryUntilSuccess(func() bool {
+			err := dml.CreateSequence(w.d.kvdb, dbi.ID, ci.ID, 0)
+			if err != nil {
+				logger.Instance().Error("CreateSequence", zap.Int64("dbid", dbi.ID), zap.Int64("cid", ci.ID), zap.Error(err))
+			}
+			return err == nil
+		}, time.Second)
+	}
+	return
+}
+
+// onDropCollection makes the collection public -> write only -> delete only -> absent,
+// after that its data is deleted in batches, one batch per job txn so that it's resumable.
+func (w *worker) onDropCollection(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+	arg := &model.CollectionInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	if job.SchemaState == osc.StateDeleteReorganization {
+		// the collection is already absent from meta
+		var done bool
+		done, err = w.runDeleteCollectionsJob(txn, m, job, []int64{arg.ID})
+		if err != nil || !done {
+			return
+		}
+		job.FinishCollectionJob(model.JobStateDone, osc.StateAbsent, 0, nil)
+		return
+	}
+
+	dbi, err := getPublicDbInfoByID(m, arg.JobRedundant.DBID)
+	if err != nil {
+		failNow = err == ErrDBNotExists
+		return
+	}
+	ci := dbi.CollectionInfo(arg.Name)
+	if ci == nil || ci.ID != arg.ID {
+		failNow = true
+		err = ErrCollectionNotExists
+		return
+	}
+
+	switch ci.State {
+	case osc.StatePublic:
+		// public -> write only
+		ci.State = osc.StateWriteOnly
+	case osc.StateWriteOnly:
+		// write only -> delete only
+		ci.State = osc.StateDeleteOnly
+	case osc.StateDeleteOnly:
+		// delete only -> absent
+		ci.State = osc.StateAbsent
+	default:
+		err = ErrInvalidDDLState
+		failNow = true
+		return
+	}
+
+	// the diff carries the whole collection info in its new state
+	jobArg := ci.Clone()
+	jobArg.JobRedundant = arg.JobRedundant
+	job.Arg = jobArg
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+
+	if ci.State != osc.StateAbsent {
+		schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+		if err != nil {
+			return
+		}
+		job.SchemaState = ci.State
+		return
+	}
+
+	err = m.DropCollection(dbi.ID, ci.ID, true)
+	if err != nil {
+		return
+	}
+	ok := dbi.RemoveCollectionInfo(ci.Name)
+	if !ok {
+		panic("RemoveCollectionInfo: bug happened")
+	}
+	err = m.UpdateDatabase(dbi)
+	if err != nil {
+		return
+	}
+	schemaVersion, err = updateSchemaVersion(m, job)
+	if err != nil {
+		return
+	}
+	job.SchemaState = osc.StateDeleteReorganization
+
+	// the persisted sequence is deleted with the collection, only the local one is left
+	afterCommitFunc4Job = func() {
+		err := dml.DropSequenceIfExists(ci.ID)
+		if err != nil {
+			logger.Instance().Error("DropSequenceIfExists", zap.Int64("cid", ci.ID), zap.Error(err))
+		}
+		forgetCollection(ci)
+	}
+	return
+}
+
+// onTruncateCollection makes the collection public -> write only -> delete only under the old id,
+// then public under the new id, after that data of the old id is deleted in batches,
+// one batch per job txn so that it's resumable.
+func (w *worker) onTruncateCollection(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job) (schemaVersion int64, afterCommitFunc4Job func(), failNow bool, err error) {
+	arg := &model.CollectionInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	oldID := arg.JobRedundant.OldID
+	if job.SchemaState == osc.StateDeleteReorganization {
+		// the old id is already absent from meta
+		var done bool
+		done, err = w.runDeleteCollectionsJob(txn, m, job, []int64{oldID})
+		if err != nil || !done {
+			return
+		}
+		job.FinishCollectionJob(model.JobStateDone, osc.StatePublic, 0, nil)
+		return
+	}
+
+	dbi, err := getPublicDbInfoByID(m, arg.JobRedundant.DBID)
+	if err != nil {
+		failNow = err == ErrDBNotExists
+		return
+	}
+	ci := dbi.CollectionInfo(arg.Name)
+	if ci == nil || ci.ID != oldID {
+		failNow = true
+		err = ErrCollectionNotExists
+		return
+	}
+
+	if ci.State != osc.StateDeleteOnly {
+		switch ci.State {
+		case osc.StatePublic:
+			// public -> write only
+			ci.State = osc.StateWriteOnly
+		case osc.StateWriteOnly:
+			// write only -> delete only
+			ci.State = osc.StateDeleteOnly
+		default:
+			err = ErrInvalidDDLState
+			failNow = true
+			return
+		}
+
+		jobArg := ci.Clone()
+		jobArg.JobRedundant = arg.JobRedundant
+		job.Arg = jobArg
+		job.RawArg = nil // will encode job.Arg into job.RawArg
+		schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+		if err != nil {
+			return
+		}
+		job.SchemaState = ci.State
+		return
+	}
+
+	// delete only -> public under the new id
+	newID := arg.JobRedundant.NewID
+	err = m.DropCollection(dbi.ID, oldID, true)
+	if err != nil {
+		return
+	}
+	ci.ID = newID
+	ci.State = osc.StatePublic
+	err = m.CreateCollection(dbi.ID, ci)
+	if err != nil {
+		return
+	}
+	ok := dbi.UpdateCollectionInfo(ci)
+	if !ok {
+		panic("UpdateCollectionInfo: bug happened")
+	}
+	err = m.UpdateDatabase(dbi)
+	if err != nil {
+		return
+	}
+
+	jobArg := ci.Clone()
+	jobArg.JobRedundant = arg.JobRedundant
+	job.Arg = jobArg
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+	schemaVersion, err = updateSchemaVersion(m, job)
+	if err != nil {
+		return
+	}
+	job.SchemaState = osc.StateDeleteReorganization
+
+	afterCommitFunc4Job = func() {
+		err := dml.DropSequenceIfExists(oldID)
+		if err != nil {
+			logger.Instance().Error("DropSequenceIfExists", zap.Int64("cid", oldID), zap.Error(err))
+		}
+		// the indices are kept under the new id
+		dml.ForgetCollection(oldID)
+		util2.TryUntilSuccess(func() bool {
+			err := dml.CreateSequence(w.d.kvdb, dbi.ID, ci.ID, 0)
+			if err != nil {
+				logger.Instance().Error("CreateSequence", zap.Int64("dbid", dbi.ID), zap.Int64("cid", ci.ID), zap.Error(err))
+			}
+			return err == nil
+		}, time.Second)
+	}
+	return
+}
+
+func (w *worker) onRenameCollection(m *meta.Meta, job *model.Job) (schemaVersion int64, failNow bool, err error) {
+	arg := &model.CollectionInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	dbi, err := getPublicDbInfoByID(m, arg.JobRedundant.DBID)
+	if err != nil {
+		failNow = err == ErrDBNotExists
+		return
+	}
+	ci := dbi.CollectionInfo(arg.JobRedundant.OldName)
+	if ci == nil || ci.ID != arg.ID || ci.State != osc.StatePublic {
+		failNow = true
+		err = ErrCollectionNotExists
+		return
+	}
+	if dbi.CollectionExists(arg.Name) {
+		failNow = true
+		err = ErrCollectionAlreadyExists
+		return
+	}
+
+	ok := dbi.RenameCollectionInfo(ci.Name, arg.Name)
+	if !ok {
+		panic("RenameCollectionInfo: bug happened")
+	}
+	err = m.UpdateCollection(dbi.ID, ci)
+	if err != nil {
+		return
+	}
+	err = m.UpdateDatabase(dbi)
+	if err != nil {
+		return
+	}
+
+	jobArg := ci.Clone()
+	jobArg.JobRedundant = arg.JobRedundant
+	job.Arg = jobArg
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+	schemaVersion, err = updateSchemaVersion(m, job)
+	if err != nil {
+		return
+	}
+	job.FinishCollectionJob(model.JobStateDone, osc.StatePublic, schemaVersion, ci)
+	return
+}
+
+func (w *worker) onSetValidator(m *meta.Meta, job *model.Job) (schemaVersion int64, failNow bool, err error) {
+	arg := &model.CollectionInfo{}
+	if err = job.DecodeArg(arg); err != nil {
+		job.State = model.JobStateCancelled
+		return
+	}
+
+	dbi, err := getPublicDbInfoByID(m, arg.JobRedundant.DBID)
+	if err != nil {
+		failNow = err == ErrDBNotExists
+		return
+	}
+	ci := dbi.CollectionInfo(arg.Name)
+	if ci == nil || ci.ID != arg.ID || ci.State != osc.StatePublic {
+		failNow = true
+		err = ErrCollectionNotExists
+		return
+	}
+
+	ci.Validator = arg.Validator
+	jobArg := ci.Clone()
+	jobArg.JobRedundant = arg.JobRedundant
+	job.Arg = jobArg
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+	schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbi, ci)
+	if err != nil {
+		return
+	}
+	job.FinishCollectionJob(model.JobStateDone, osc.StatePublic, schemaVersion, ci)
+	return
+}
+
+// runDeleteCollectionsJob deletes a batch of data of the dropped collections cids,
+// the position in cids is saved by reorg handle so that a restarted worker resumes from it.
+func (w *worker) runDeleteCollectionsJob(txn mondis.ProviderTxn, m *meta.Meta, job *model.Job, cids []int64) (done bool, err error) {
+	pos, _, err := m.GetDDLReorgHandle(job)
+	if err == kv.ErrKeyNotFound {
+		pos, err = 0, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if pos < int64(len(cids)) {
+		var collectionDone bool
+		collectionDone, err = dml.DeleteCollectionData(txn, cids[pos], reorgBatchSize)
+		if err != nil || !collectionDone {
+			return
+		}
+		pos++
+	}
+
+	if pos < int64(len(cids)) {
+		err = m.UpdateDDLReorgHandle(job, pos, int64(len(cids)), cids[pos])
+		return
+	}
+
+	err = m.RemoveDDLReorgHandle(job)
+	done = err == nil
+	return
+}
+
+// forgetCollection drops what dml parsed from the meta of the dropped collection ci
+func forgetCollection(ci *model.CollectionInfo) {
+	iids := make([]int64, 0, len(ci.Indices))
+	for _, iif := range ci.Indices {
+		iids = append(iids, iif.ID)
+	}
+	dml.ForgetCollection(ci.ID, iids...)
+}
+
 func updateSchemaVersionAndCollectionInfo(m *meta.Meta, job *model.Job, dbInfo *model.DBInfo, ci *model.CollectionInfo) (schemaVersion int64, err error) {
 	err = m.UpdateCollection(dbInfo.ID, ci)
 	if err != nil {
@@ -360,6 +1039,22 @@ func updateSchemaVersionAndCollectionInfo(m *meta.Meta, job *model.Job, dbInfo *
 	return
 }
 
+// updateSchemaVersionAndIndexInfo is like updateSchemaVersionAndCollectionInfo,
+// but the diff carries iif in its new state, which may be absent.
+func updateSchemaVersionAndIndexInfo(m *meta.Meta, job *model.Job, dbInfo *model.DBInfo, ci *model.CollectionInfo, iif *model.IndexInfo) (schemaVersion int64, err error) {
+	jobArg := iif.Clone()
+	jobArg.JobRedundant = &model.IndexInfoRedundant{
+		DB:         dbInfo.Name,
+		Collection: ci.Name,
+		CID:        ci.ID,
+	}
+	job.Arg = jobArg
+	job.RawArg = nil // will encode job.Arg into job.RawArg
+
+	schemaVersion, err = updateSchemaVersionAndCollectionInfo(m, job, dbInfo, ci)
+	return
+}
+
 // updateSchemaVersion increments the schema version by 1 and sets SchemaDiff.
 func updateSchemaVersion(m *meta.Meta, job *model.Job) (schemaVersion int64, err error) {
 	schemaVersion, err = m.GenSchemaVersion()
@@ -437,6 +1132,11 @@ func (d *DDL) notifyWorker(jobTp model.ActionType) {
 }
 
 func (w *worker) waitSchemaChanged(schemaVersion int64, job *model.Job) {
+	// no schema change, e.g. a reorg batch
+	if schemaVersion == 0 {
+		return
+	}
+
 	lease := config.Load().Lease
 	if lease == 0 {
 		return
@@ -452,7 +1152,17 @@ func job2CollectionIDs(job *model.Job) (collectionIDs []int64) {
 		for _, c := range dbInfo.Collections {
 			collectionIDs = append(collectionIDs, c.ID)
 		}
-	case model.ActionAddIndex:
+	case model.ActionDropSchema:
+		dbInfo := job.Arg.(*model.DBInfo)
+		for _, c := range dbInfo.Collections {
+			collectionIDs = append(collectionIDs, c.ID)
+		}
+	case model.ActionCreateCollection, model.ActionDropCollection, model.ActionRenameCollection, model.ActionSetValidator:
+		collectionIDs = []int64{job.Arg.(*model.CollectionInfo).ID}
+	case model.ActionTruncateCollection:
+		ci := job.Arg.(*model.CollectionInfo)
+		collectionIDs = []int64{ci.JobRedundant.OldID, ci.ID}
+	case model.ActionAddIndex, model.ActionDropIndex:
 		collectionIDs = []int64{job.Arg.(*model.IndexInfo).JobRedundant.CID}
 	default:
 	}
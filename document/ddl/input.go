@@ -2,7 +2,10 @@ package ddl
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/zhiqiangxu/mondis/document/analysis"
+	"github.com/zhiqiangxu/mondis/document/dml"
 	"github.com/zhiqiangxu/mondis/document/model"
 )
 
@@ -11,6 +14,8 @@ type CreateSchemaInput struct {
 	DB          string
 	Collections []string
 	Indices     map[string][]IndexInfo
+	// IDTypes of collections, model.IDTypeAuto if absent
+	IDTypes map[string]model.IDType
 }
 
 // Validate CreateSchemaInput
@@ -25,6 +30,12 @@ func (in *CreateSchemaInput) Validate() (err error) {
 			return
 		}
 	}
+	for _, idType := range in.IDTypes {
+		err = validateIDType(idType)
+		if err != nil {
+			return
+		}
+	}
 	for _, indexInfos := range in.Indices {
 		for _, indexInfo := range indexInfos {
 			err = indexInfo.Validate()
@@ -55,6 +66,9 @@ type CreateCollectionInput struct {
 	DB         string
 	Collection string
 	Indices    []IndexInfo
+	IDType     model.IDType
+	// Capped is nil or bounds the number and total size of documents
+	Capped *model.CappedInfo
 }
 
 // Validate CreateCollectionInput
@@ -67,6 +81,25 @@ func (in *CreateCollectionInput) Validate() (err error) {
 		err = fmt.Errorf("collection empty")
 		return
 	}
+	err = validateIDType(in.IDType)
+	if err != nil {
+		return
+	}
+	if in.Capped != nil {
+		if in.Capped.MaxDocs < 0 || in.Capped.MaxBytes < 0 {
+			err = fmt.Errorf("capped limit negative")
+			return
+		}
+		if in.Capped.MaxDocs == 0 && in.Capped.MaxBytes == 0 {
+			err = fmt.Errorf("capped limit empty")
+			return
+		}
+		// documents of capped collection are kept in insertion order by did
+		if in.IDType != model.IDTypeAuto {
+			err = fmt.Errorf("capped collection requires auto id")
+			return
+		}
+	}
 
 	for _, indexInfo := range in.Indices {
 		err = indexInfo.Validate()
@@ -77,6 +110,15 @@ func (in *CreateCollectionInput) Validate() (err error) {
 	return
 }
 
+func validateIDType(idType model.IDType) (err error) {
+	switch idType {
+	case model.IDTypeAuto, model.IDTypeObjectID, model.IDTypeString, model.IDTypeBytes:
+	default:
+		err = fmt.Errorf("unknown id type %d", idType)
+	}
+	return
+}
+
 // DropCollectionInput for DropCollection
 type DropCollectionInput struct {
 	DB         string
@@ -96,6 +138,90 @@ func (in *DropCollectionInput) Validate() (err error) {
 	return
 }
 
+// TruncateCollectionInput for TruncateCollection
+type TruncateCollectionInput struct {
+	DB         string
+	Collection string
+}
+
+// Validate TruncateCollectionInput
+func (in *TruncateCollectionInput) Validate() (err error) {
+	if in.DB == "" {
+		err = fmt.Errorf("db empty")
+		return
+	}
+	if in.Collection == "" {
+		err = fmt.Errorf("collection empty")
+		return
+	}
+	return
+}
+
+// RenameCollectionInput for RenameCollection
+type RenameCollectionInput struct {
+	DB         string
+	Collection string
+	NewName    string
+}
+
+// Validate RenameCollectionInput
+func (in *RenameCollectionInput) Validate() (err error) {
+	if in.DB == "" {
+		err = fmt.Errorf("db empty")
+		return
+	}
+	if in.Collection == "" {
+		err = fmt.Errorf("collection empty")
+		return
+	}
+	if in.NewName == "" {
+		err = fmt.Errorf("new name empty")
+		return
+	}
+	return
+}
+
+// SetValidatorInput for SetValidator
+type SetValidatorInput struct {
+	DB         string
+	Collection string
+	// Schema is a json schema document like bson.M{"bsonType": "object", "required": bson.A{"a"}},
+	// nil removes the validator.
+	Schema interface{}
+	Action model.ValidationAction
+}
+
+// Validate SetValidatorInput
+func (in *SetValidatorInput) Validate() (err error) {
+	if in.DB == "" {
+		err = fmt.Errorf("db empty")
+		return
+	}
+	if in.Collection == "" {
+		err = fmt.Errorf("collection empty")
+		return
+	}
+	if in.Action != model.ValidationStrict && in.Action != model.ValidationWarn {
+		err = fmt.Errorf("unknown validation action %d", in.Action)
+		return
+	}
+	if in.Schema != nil {
+		_, err = dml.ValidatorSchema(in.Schema)
+	}
+	return
+}
+
+// ToModel converts SetValidatorInput to *model.ValidatorInfo, nil if Schema is nil
+func (in *SetValidatorInput) ToModel() *model.ValidatorInfo {
+	if in.Schema == nil {
+		return nil
+	}
+
+	// already checked by Validate
+	schema, _ := dml.ValidatorSchema(in.Schema)
+	return &model.ValidatorInfo{Schema: schema, Action: in.Action}
+}
+
 // AddIndexInput for AddIndex
 type AddIndexInput struct {
 	DB         string
@@ -146,7 +272,20 @@ func (in *DropIndexInput) Validate() (err error) {
 type IndexInfo struct {
 	Name    string
 	Columns []string
-	Unique  bool
+	// Desc is empty or marks the descending columns
+	Desc   []bool
+	Unique bool
+	// TTL index expires documents whose date column is older than ExpireAfter
+	TTL         bool
+	ExpireAfter time.Duration
+	// Sparse index skips documents missing all columns
+	Sparse bool
+	// PartialFilter like bson.M{"a": bson.M{"$gt": 1}} limits the indexed documents,
+	// only $and, equality, ranges and $exists: true are supported.
+	PartialFilter interface{}
+	Kind          model.IndexKind
+	// Analyzer of text index by name, empty means analysis.Default
+	Analyzer string
 }
 
 // Validate IndexInfo
@@ -159,14 +298,62 @@ func (ii *IndexInfo) Validate() (err error) {
 		err = fmt.Errorf("index columns empty")
 		return
 	}
+	if len(ii.Desc) > 0 && len(ii.Desc) != len(ii.Columns) {
+		err = fmt.Errorf("index desc should match columns")
+		return
+	}
+	if ii.TTL && len(ii.Columns) != 1 {
+		err = fmt.Errorf("ttl index should have a single column")
+		return
+	}
+	if ii.ExpireAfter < 0 || ii.ExpireAfter > 0 && !ii.TTL {
+		err = fmt.Errorf("invalid expire after")
+		return
+	}
+	switch ii.Kind {
+	case model.IndexKindRegular:
+		if ii.Analyzer != "" {
+			err = fmt.Errorf("analyzer is only for text index")
+			return
+		}
+	case model.IndexKindText:
+		if ii.Unique || len(ii.Desc) > 0 || ii.TTL {
+			err = fmt.Errorf("text index can't be unique, descending or ttl")
+			return
+		}
+		if analysis.Get(ii.Analyzer) == nil {
+			err = fmt.Errorf("analyzer %s not found", ii.Analyzer)
+			return
+		}
+	case model.IndexKindGeo2d:
+		if len(ii.Columns) != 1 || ii.Unique || len(ii.Desc) > 0 || ii.TTL || ii.Analyzer != "" {
+			err = fmt.Errorf("2d index should be a single column and can't be unique, descending or ttl")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown index kind %d", ii.Kind)
+		return
+	}
+	if ii.PartialFilter != nil {
+		_, err = dml.PartialFilter(ii.PartialFilter)
+	}
 	return
 }
 
 // ToModel converts IndexInfo to *model.IndexInfo
 func (ii *IndexInfo) ToModel() *model.IndexInfo {
 	mii := &model.IndexInfo{
-		Name:   ii.Name,
-		Unique: ii.Unique,
+		Name:        ii.Name,
+		Unique:      ii.Unique,
+		TTL:         ii.TTL,
+		ExpireAfter: ii.ExpireAfter,
+		Sparse:      ii.Sparse,
+		Kind:        ii.Kind,
+		Analyzer:    ii.Analyzer,
+	}
+	if ii.PartialFilter != nil {
+		// already checked by Validate
+		mii.PartialFilter, _ = dml.PartialFilter(ii.PartialFilter)
 	}
 	if len(ii.Columns) > 0 {
 		mii.Columns = make([]string, len(ii.Columns))
@@ -174,6 +361,10 @@ func (ii *IndexInfo) ToModel() *model.IndexInfo {
 			mii.Columns[i] = column
 		}
 	}
+	if len(ii.Desc) > 0 {
+		mii.Desc = make([]bool, len(ii.Desc))
+		copy(mii.Desc, ii.Desc)
+	}
 
 	return mii
 }
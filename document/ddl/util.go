@@ -3,6 +3,7 @@ package ddl
 import (
 	"github.com/zhiqiangxu/mondis/document/meta"
 	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/util/osc"
 )
 
 func checkDBNameNotExists(m *meta.Meta, dbName string) (exists bool, err error) {
@@ -52,3 +53,37 @@ func checkIndexNameNotExists(m *meta.Meta, dbName, collectionName, indexName str
 	exists = ci.IndexExists(indexName)
 	return
 }
+
+func getPublicDbInfoByID(m *meta.Meta, dbID int64) (dbInfo *model.DBInfo, err error) {
+	dbInfo, err = m.GetDatabase(dbID)
+	if err == meta.ErrDBNotExists {
+		err = ErrDBNotExists
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if dbInfo.State != osc.StatePublic {
+		dbInfo = nil
+		err = ErrDBNotExists
+	}
+	return
+}
+
+func getPublicCollectionInfo(m *meta.Meta, dbName, collectionName string) (dbInfo *model.DBInfo, ci *model.CollectionInfo, err error) {
+	dbInfo, err = getDbInfo(m, dbName)
+	if err != nil {
+		return
+	}
+	if dbInfo == nil || dbInfo.State != osc.StatePublic {
+		err = ErrDBNotExists
+		return
+	}
+
+	ci = dbInfo.CollectionInfo(collectionName)
+	if ci == nil || ci.State != osc.StatePublic {
+		err = ErrCollectionNotExists
+	}
+	return
+}
@@ -0,0 +1,724 @@
+package dml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zhiqiangxu/mondis"
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/config"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// stages of aggregation pipeline
+const (
+	stageMatch   = "$match"
+	stageProject = "$project"
+	stageGroup   = "$group"
+	stageSort    = "$sort"
+	stageSkip    = "$skip"
+	stageLimit   = "$limit"
+	stageUnwind  = "$unwind"
+	stageCount   = "$count"
+)
+
+// estimated memory used by each document besides its bytes
+const docOverhead = 64
+
+var (
+	// ErrInvalidPipeline when the pipeline is not an array of stages
+	ErrInvalidPipeline = errors.New("pipeline must be an array of single field documents")
+	// ErrSearchNotFirstStage when $match with $text or $near is not the first stage
+	ErrSearchNotFirstStage = errors.New("$match with $text or $near must be the first stage")
+)
+
+// AggregateOptions for Aggregate
+type AggregateOptions struct {
+	// MemoryLimit is the bytes a $sort or $group stage can use before spilling to the kv,
+	// 0 means config.AggregateMemoryLimit
+	MemoryLimit int
+}
+
+// Aggregate runs pipeline like bson.A{bson.M{"$match": ...}, bson.M{"$group": ...}} on the collection,
+// the returned cursor must be closed after use.
+// The leading $match, $sort and $project are used to choose an index like Find does.
+func (c *Collection) Aggregate(pipeline interface{}, opts *AggregateOptions, t *txn.Txn) (cursor *Cursor, err error) {
+	if opts == nil {
+		opts = &AggregateOptions{}
+	}
+
+	p, err := parsePipeline(pipeline)
+	if err != nil {
+		return
+	}
+
+	origT := t
+
+	a := &aggregation{kvdb: c.kvdb, memoryLimit: opts.MemoryLimit}
+	if a.memoryLimit <= 0 {
+		a.memoryLimit = config.Load().AggregateMemoryLimit
+	}
+	var discard func()
+	if t == nil {
+		t = c.Txn(false)
+		discard = t.Discard
+	}
+	onClose := func() {
+		a.close()
+		if discard != nil {
+			discard()
+		}
+	}
+	defer func() {
+		if err != nil {
+			onClose()
+		}
+	}()
+
+	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	if origT != nil {
+		origT.ReferredCollections(ci.ID)
+	}
+
+	plan, rejected, err := planQuery(t, ci, p.filter, p.proj, p.sortKeys, &FindOptions{})
+	if err != nil {
+		return
+	}
+	stats := &execStats{}
+	fetch := plan.fetch(t, ci, p.filter, stats)
+	stages := p.stages
+	if len(p.sortKeys) > 0 && plan.sortFromIndex {
+		// the leading $sort is done by index
+		stages = stages[1:]
+	}
+	for _, s := range stages {
+		fetch = s.apply(a, fetch)
+	}
+
+	cursor = newCursor(fetch, 0, 0, nil, onClose)
+	cursor.plan, cursor.rejected, cursor.stats = plan, rejected, stats
+	cursor.idType = ci.IDType
+	return
+}
+
+// ExplainAggregate runs the pipeline and returns how the leading $match is executed
+func (c *Collection) ExplainAggregate(pipeline interface{}, opts *AggregateOptions, t *txn.Txn) (ex *Explanation, err error) {
+	cursor, err := c.Aggregate(pipeline, opts, t)
+	if err != nil {
+		return
+	}
+
+	ex, err = explainCursor(cursor)
+	return
+}
+
+// aggregation holds the resources of a running pipeline
+type aggregation struct {
+	kvdb        mondis.KVDB
+	memoryLimit int
+	spills      []*spill
+}
+
+func (a *aggregation) newSpill() *spill {
+	s := newSpill(a.kvdb)
+	a.spills = append(a.spills, s)
+	return s
+}
+
+func (a *aggregation) close() {
+	for _, s := range a.spills {
+		s.drop()
+	}
+	a.spills = nil
+}
+
+// aggregateStage transforms documents of the previous stage
+type aggregateStage interface {
+	apply(a *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error)
+}
+
+type pipeline struct {
+	// filter of the leading $match
+	filter *filter
+	// sortKeys of the leading $sort, the $sort stage is stages[0]
+	sortKeys []sortKey
+	// proj of the leading $project, only used for covered queries
+	proj   *projection
+	stages []aggregateStage
+}
+
+func parsePipeline(p interface{}) (result *pipeline, err error) {
+	raw, err := bson.Marshal(bson.D{{Key: "pipeline", Value: p}})
+	if err != nil {
+		return
+	}
+	arr, ok := bson.Raw(raw).Lookup("pipeline").ArrayOK()
+	if !ok {
+		err = ErrInvalidPipeline
+		return
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return
+	}
+
+	result = &pipeline{filter: &filter{op: opAnd}}
+	leading := true
+	for i, v := range values {
+		doc, ok := v.DocumentOK()
+		if !ok {
+			err = ErrInvalidPipeline
+			return
+		}
+		var elements []bson.RawElement
+		elements, err = doc.Elements()
+		if err != nil {
+			return
+		}
+		if len(elements) != 1 {
+			err = ErrInvalidPipeline
+			return
+		}
+
+		name, arg := elements[0].Key(), elements[0].Value()
+		var s aggregateStage
+		switch name {
+		case stageMatch:
+			var f *filter
+			f, err = parseFilterValue(arg)
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				result.filter = f
+				continue
+			}
+			if f.has(opText) || f.has(opNear) {
+				err = ErrSearchNotFirstStage
+				return
+			}
+			s = &matchStage{f: f}
+		case stageProject:
+			var proj *projection
+			proj, err = parseStageProjection(arg)
+			if err != nil {
+				return
+			}
+			if leading {
+				result.proj = proj
+			}
+			s = &projectStage{proj: proj}
+		case stageSort:
+			var keys []sortKey
+			keys, err = parseSortValue(arg)
+			if err != nil {
+				return
+			}
+			if len(keys) == 0 {
+				err = fmt.Errorf("%s needs at least one key", stageSort)
+				return
+			}
+			if len(result.stages) == 0 {
+				result.sortKeys = keys
+			}
+			s = &sortStage{keys: keys}
+		case stageSkip, stageLimit:
+			n, ok := intOf(arg)
+			if !ok && arg.Type == bsontype.Double && arg.Double() == float64(int64(arg.Double())) {
+				n, ok = int64(arg.Double()), true
+			}
+			if !ok || n < 0 || name == stageLimit && n == 0 {
+				err = fmt.Errorf("%s needs a positive integer", name)
+				return
+			}
+			if name == stageSkip {
+				s = &skipStage{n: n}
+			} else {
+				s = &limitStage{n: n}
+			}
+		case stageUnwind:
+			s, err = parseUnwind(arg)
+		case stageCount:
+			s, err = parseCount(arg)
+		case stageGroup:
+			s, err = parseGroup(arg)
+		default:
+			err = fmt.Errorf("unknown stage %s", name)
+		}
+		if err != nil {
+			return
+		}
+
+		if _, ok := s.(*sortStage); !ok || len(result.stages) > 0 {
+			leading = false
+		}
+		result.stages = append(result.stages, s)
+	}
+	return
+}
+
+func parseFilterValue(v bson.RawValue) (*filter, error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("%s needs a document", stageMatch)
+	}
+	return parseFilterDoc(doc)
+}
+
+func parseSortValue(v bson.RawValue) ([]sortKey, error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("%s needs a document", stageSort)
+	}
+	return parseSort(doc)
+}
+
+// parseStageProjection only supports inclusion and exclusion
+func parseStageProjection(v bson.RawValue) (proj *projection, err error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		err = fmt.Errorf("%s needs a document", stageProject)
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+	if len(elements) == 0 {
+		err = fmt.Errorf("%s needs at least one field", stageProject)
+		return
+	}
+	for _, e := range elements {
+		if !e.Value().IsNumber() && e.Value().Type != bsontype.Boolean {
+			err = fmt.Errorf("%s only supports inclusion and exclusion", stageProject)
+			return
+		}
+	}
+
+	proj, err = parseProjection(doc)
+	return
+}
+
+// eachDoc returns a fetch function that calls fn for each input document,
+// fn appends the output documents to out.
+func eachDoc(in func() ([]cursorDoc, error), fn func(d cursorDoc, out []cursorDoc) ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	return func() (out []cursorDoc, err error) {
+		var batch []cursorDoc
+		for len(out) == 0 {
+			batch, err = in()
+			if err != nil || len(batch) == 0 {
+				return
+			}
+			for _, d := range batch {
+				out, err = fn(d, out)
+				if err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+}
+
+type matchStage struct {
+	f *filter
+}
+
+func (s *matchStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	return eachDoc(in, func(d cursorDoc, out []cursorDoc) ([]cursorDoc, error) {
+		if s.f.match(d.doc) {
+			out = append(out, d)
+		}
+		return out, nil
+	})
+}
+
+type projectStage struct {
+	proj *projection
+}
+
+func (s *projectStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	return eachDoc(in, func(d cursorDoc, out []cursorDoc) ([]cursorDoc, error) {
+		doc, err := s.proj.apply(d.doc)
+		if err != nil {
+			return nil, err
+		}
+		d.doc = doc
+		return append(out, d), nil
+	})
+}
+
+type skipStage struct {
+	n int64
+}
+
+func (s *skipStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	skipped := int64(0)
+	return eachDoc(in, func(d cursorDoc, out []cursorDoc) ([]cursorDoc, error) {
+		if skipped < s.n {
+			skipped++
+			return out, nil
+		}
+		return append(out, d), nil
+	})
+}
+
+type limitStage struct {
+	n int64
+}
+
+func (s *limitStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	left := s.n
+	return func() (out []cursorDoc, err error) {
+		if left <= 0 {
+			return
+		}
+		out, err = in()
+		if int64(len(out)) > left {
+			out = out[:left]
+		}
+		left -= int64(len(out))
+		return
+	}
+}
+
+type unwindStage struct {
+	path              []string
+	includeArrayIndex []string
+	preserve          bool
+}
+
+// parseUnwind parses "$path" or {path: "$path", includeArrayIndex: "field", preserveNullAndEmptyArrays: true}
+func parseUnwind(v bson.RawValue) (s *unwindStage, err error) {
+	s = &unwindStage{}
+	var path string
+	switch v.Type {
+	case bsontype.String:
+		path = v.StringValue()
+	case bsontype.EmbeddedDocument:
+		var elements []bson.RawElement
+		elements, err = v.Document().Elements()
+		if err != nil {
+			return
+		}
+		for _, e := range elements {
+			switch e.Key() {
+			case "path":
+				path, _ = e.Value().StringValueOK()
+			case "includeArrayIndex":
+				field, ok := e.Value().StringValueOK()
+				if !ok || field == "" || strings.HasPrefix(field, "$") {
+					err = fmt.Errorf("includeArrayIndex of %s must be a field name", stageUnwind)
+					return
+				}
+				s.includeArrayIndex = strings.Split(field, ".")
+			case "preserveNullAndEmptyArrays":
+				var ok bool
+				s.preserve, ok = e.Value().BooleanOK()
+				if !ok {
+					err = fmt.Errorf("preserveNullAndEmptyArrays of %s must be a bool", stageUnwind)
+					return
+				}
+			default:
+				err = fmt.Errorf("unknown %s option %s", stageUnwind, e.Key())
+				return
+			}
+		}
+	}
+	if len(path) < 2 || path[0] != '$' {
+		err = fmt.Errorf("path of %s must be a field path prefixed with $", stageUnwind)
+		return
+	}
+	s.path = strings.Split(path[1:], ".")
+	return
+}
+
+func (s *unwindStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	return eachDoc(in, func(d cursorDoc, out []cursorDoc) ([]cursorDoc, error) {
+		v, err := d.doc.LookupErr(s.path...)
+		var elements []bson.RawValue
+		switch {
+		case err != nil || v.Type == bsontype.Null || v.Type == bsontype.Undefined:
+			if !s.preserve {
+				return out, nil
+			}
+			doc, err := s.unwound(d.doc, nil, -1)
+			if err != nil {
+				return nil, err
+			}
+			d.doc = doc
+			return append(out, d), nil
+		case v.Type == bsontype.Array:
+			elements, err = v.Array().Values()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			// non array values are treated as single element arrays without index
+			doc, err := s.unwound(d.doc, nil, -1)
+			if err != nil {
+				return nil, err
+			}
+			d.doc = doc
+			return append(out, d), nil
+		}
+
+		if len(elements) == 0 {
+			if !s.preserve {
+				return out, nil
+			}
+			doc, err := s.unwound(d.doc, nil, -1)
+			if err != nil {
+				return nil, err
+			}
+			d.doc = doc
+			return append(out, d), nil
+		}
+		for i := range elements {
+			doc, err := s.unwound(d.doc, &elements[i], i)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cursorDoc{did: d.did, doc: doc, score: d.score})
+		}
+		return out, nil
+	})
+}
+
+// unwound returns doc with the array replaced by element, i < 0 means no index,
+// the array field is removed if element is nil and the original value is an empty array.
+func (s *unwindStage) unwound(doc bson.Raw, element *bson.RawValue, i int) (result bson.Raw, err error) {
+	if element == nil && len(s.includeArrayIndex) == 0 {
+		v, _ := doc.LookupErr(s.path...)
+		if v.Type != bsontype.Array {
+			return doc, nil
+		}
+	}
+
+	var d bson.D
+	err = bson.Unmarshal(doc, &d)
+	if err != nil {
+		return
+	}
+	var node interface{} = d
+	if element != nil {
+		node, err = setValue(node, s.path, *element)
+	} else {
+		node, err = updatePath(node, s.path, false, func(old interface{}, _ bool) (interface{}, bool, error) {
+			arr, ok := old.(bson.A)
+			return old, ok && len(arr) == 0, nil
+		})
+	}
+	if err != nil {
+		return
+	}
+	if len(s.includeArrayIndex) > 0 {
+		var index interface{}
+		if i >= 0 {
+			index = int64(i)
+		}
+		node, err = setValue(node, s.includeArrayIndex, index)
+		if err != nil {
+			return
+		}
+	}
+	return bson.Marshal(node)
+}
+
+type countStage struct {
+	field string
+}
+
+func parseCount(v bson.RawValue) (s *countStage, err error) {
+	field, ok := v.StringValueOK()
+	if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+		err = fmt.Errorf("%s needs a field name", stageCount)
+		return
+	}
+	s = &countStage{field: field}
+	return
+}
+
+func (s *countStage) apply(_ *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	var done bool
+	return func() (out []cursorDoc, err error) {
+		if done {
+			return
+		}
+
+		var (
+			batch []cursorDoc
+			n     int
+		)
+		for {
+			batch, err = in()
+			if err != nil {
+				return
+			}
+			if len(batch) == 0 {
+				break
+			}
+			n += len(batch)
+		}
+		done = true
+		if n == 0 {
+			return
+		}
+
+		doc, err := bson.Marshal(bson.D{{Key: s.field, Value: n}})
+		if err != nil {
+			return
+		}
+		out = []cursorDoc{{doc: doc}}
+		return
+	}
+}
+
+type sortStage struct {
+	keys []sortKey
+	// limit is the number of leading documents needed, 0 means all,
+	// only the top limit documents are kept when it's set.
+	limit int
+}
+
+func (s *sortStage) apply(a *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	var out func() ([]cursorDoc, error)
+	return func() ([]cursorDoc, error) {
+		if out == nil {
+			var err error
+			out, err = s.sort(a, in)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out()
+	}
+}
+
+// sort sorts all the input in memory, documents are spilled to the kv in the order of encoded sort keys
+// when exceeding the memory limit. With limit set, the documents in memory are cut to the top limit
+// whenever they double it.
+func (s *sortStage) sort(a *aggregation, in func() ([]cursorDoc, error)) (out func() ([]cursorDoc, error), err error) {
+	var (
+		docs  []cursorDoc
+		size  int
+		batch []cursorDoc
+		sp    *spill
+	)
+	spillDocs := func() (err error) {
+		if sp == nil {
+			sp = a.newSpill()
+		}
+		for _, d := range docs {
+			var key []byte
+			key, err = s.encodeKey(d.doc)
+			if err != nil {
+				return
+			}
+			value := memcomparable.EncodeBytes(nil, d.did)
+			err = sp.put(key, append(value, d.doc...))
+			if err != nil {
+				return
+			}
+		}
+		docs, size = nil, 0
+		return
+	}
+
+	for {
+		batch, err = in()
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, d := range batch {
+			docs = append(docs, d)
+			size += len(d.doc) + docOverhead
+		}
+		if s.limit > 0 && len(docs) >= 2*s.limit {
+			docs, size = s.top(docs)
+		}
+		if size > a.memoryLimit {
+			err = spillDocs()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if sp == nil {
+		if s.limit > 0 && len(docs) > s.limit {
+			docs, _ = s.top(docs)
+		} else {
+			sortDocs(docs, s.keys)
+		}
+		out = batchOf(docs)
+		return
+	}
+
+	err = spillDocs()
+	if err != nil {
+		return
+	}
+	err = sp.flush()
+	if err != nil {
+		return
+	}
+
+	read := sp.reader()
+	out = func() (docs []cursorDoc, err error) {
+		entries, err := read()
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			var d cursorDoc
+			var doc []byte
+			doc, d.did, err = memcomparable.DecodeBytes(e.value, nil)
+			if err != nil {
+				return
+			}
+			d.doc = doc
+			docs = append(docs, d)
+		}
+		return
+	}
+	return
+}
+
+// top returns the first limit documents of docs in order with their size
+func (s *sortStage) top(docs []cursorDoc) (top []cursorDoc, size int) {
+	sortDocs(docs, s.keys)
+	// copied so that the rest can be collected
+	top = append([]cursorDoc(nil), docs[:s.limit]...)
+	for _, d := range top {
+		size += len(d.doc) + docOverhead
+	}
+	return
+}
+
+func (s *sortStage) encodeKey(doc bson.Raw) (key []byte, err error) {
+	for _, k := range s.keys {
+		v := sortValue(doc, k)
+		if k.asc {
+			key, err = dbson.Encode(key, v)
+		} else {
+			key, err = dbson.EncodeDesc(key, v)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
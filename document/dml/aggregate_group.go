@@ -0,0 +1,608 @@
+package dml
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// accumulators of $group
+const (
+	accSum   = "$sum"
+	accAvg   = "$avg"
+	accMin   = "$min"
+	accMax   = "$max"
+	accCount = "$count"
+	accPush  = "$push"
+)
+
+// expression is a field path like "$a.b", a document of expressions or a constant
+type expression struct {
+	path   []string
+	doc    bool
+	fields []namedExpression
+	value  bson.RawValue
+}
+
+type namedExpression struct {
+	name string
+	expr *expression
+}
+
+func parseExpression(v bson.RawValue) (e *expression, err error) {
+	e = &expression{}
+	switch v.Type {
+	case bsontype.String:
+		s := v.StringValue()
+		if strings.HasPrefix(s, "$$") {
+			err = fmt.Errorf("variable %s not supported", s)
+			return
+		}
+		if strings.HasPrefix(s, "$") {
+			if len(s) == 1 {
+				err = fmt.Errorf("empty field path")
+				return
+			}
+			e.path = strings.Split(s[1:], ".")
+			return
+		}
+	case bsontype.EmbeddedDocument:
+		var elements []bson.RawElement
+		elements, err = v.Document().Elements()
+		if err != nil {
+			return
+		}
+		if len(elements) == 0 {
+			break
+		}
+		e.doc = true
+		for _, elem := range elements {
+			if strings.HasPrefix(elem.Key(), "$") {
+				err = fmt.Errorf("expression operator %s not supported", elem.Key())
+				return
+			}
+			var child *expression
+			child, err = parseExpression(elem.Value())
+			if err != nil {
+				return
+			}
+			e.fields = append(e.fields, namedExpression{name: elem.Key(), expr: child})
+		}
+		return
+	}
+
+	e.value = v
+	return
+}
+
+// eval returns the value of e for doc, ok is false if missing
+func (e *expression) eval(doc bson.Raw) (v bson.RawValue, ok bool) {
+	switch {
+	case e.path != nil:
+		return lookupField(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}, e.path)
+	case e.doc:
+		idx, dst := bsoncore.AppendDocumentStart(nil)
+		for _, f := range e.fields {
+			fv, ok := f.expr.eval(doc)
+			if ok {
+				dst = bsoncore.AppendValueElement(dst, f.name, bsoncore.Value{Type: fv.Type, Data: fv.Value})
+			}
+		}
+		dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+		return bson.RawValue{Type: bsontype.EmbeddedDocument, Value: dst}, true
+	default:
+		return e.value, true
+	}
+}
+
+// lookupField resolves parts in v like mongo field paths, arrays of documents result in arrays of the fields.
+func lookupField(v bson.RawValue, parts []string) (bson.RawValue, bool) {
+	if len(parts) == 0 {
+		return v, true
+	}
+
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		child, err := v.Document().LookupErr(parts[0])
+		if err != nil {
+			return bson.RawValue{}, false
+		}
+		return lookupField(child, parts[1:])
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return bson.RawValue{}, false
+		}
+		idx, dst := bsoncore.AppendArrayStart(nil)
+		i := 0
+		for _, e := range values {
+			if e.Type != bsontype.EmbeddedDocument && e.Type != bsontype.Array {
+				continue
+			}
+			ev, ok := lookupField(e, parts)
+			if !ok {
+				continue
+			}
+			dst = bsoncore.AppendValueElement(dst, fmt.Sprint(i), bsoncore.Value{Type: ev.Type, Data: ev.Value})
+			i++
+		}
+		dst, _ = bsoncore.AppendArrayEnd(dst, idx)
+		return bson.RawValue{Type: bsontype.Array, Value: dst}, true
+	default:
+		return bson.RawValue{}, false
+	}
+}
+
+type groupStage struct {
+	id     *expression
+	fields []groupField
+}
+
+type groupField struct {
+	name string
+	op   string
+	arg  *expression
+}
+
+// parseGroup parses {_id: <expression>, <field>: {<accumulator>: <expression>}, ...}
+func parseGroup(v bson.RawValue) (s *groupStage, err error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		err = fmt.Errorf("%s needs a document", stageGroup)
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	s = &groupStage{}
+	for _, e := range elements {
+		name := e.Key()
+		if name == "_id" {
+			s.id, err = parseExpression(e.Value())
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+			err = fmt.Errorf("invalid %s field name %s", stageGroup, name)
+			return
+		}
+
+		acc, ok := e.Value().DocumentOK()
+		var accElements []bson.RawElement
+		if ok {
+			accElements, err = acc.Elements()
+			if err != nil {
+				return
+			}
+		}
+		if len(accElements) != 1 {
+			err = fmt.Errorf("%s field %s needs a single accumulator", stageGroup, name)
+			return
+		}
+
+		f := groupField{name: name, op: accElements[0].Key()}
+		arg := accElements[0].Value()
+		switch f.op {
+		case accSum, accAvg, accMin, accMax, accPush:
+			f.arg, err = parseExpression(arg)
+			if err != nil {
+				return
+			}
+		case accCount:
+			if argDoc, ok := arg.DocumentOK(); !ok || !isEmptyDoc(argDoc) {
+				err = fmt.Errorf("%s takes no arguments", accCount)
+				return
+			}
+			// same as {$sum: 1}
+			f.op = accSum
+			f.arg = &expression{value: bson.RawValue{Type: bsontype.Int32, Value: bsoncore.AppendInt32(nil, 1)}}
+		default:
+			err = fmt.Errorf("unknown accumulator %s", f.op)
+			return
+		}
+		s.fields = append(s.fields, f)
+	}
+	if s.id == nil {
+		err = fmt.Errorf("%s needs _id", stageGroup)
+		return
+	}
+	return
+}
+
+func isEmptyDoc(doc bson.Raw) bool {
+	elements, err := doc.Elements()
+	return err == nil && len(elements) == 0
+}
+
+func (s *groupStage) apply(a *aggregation, in func() ([]cursorDoc, error)) func() ([]cursorDoc, error) {
+	var out func() ([]cursorDoc, error)
+	return func() ([]cursorDoc, error) {
+		if out == nil {
+			var err error
+			out, err = s.group(a, in)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out()
+	}
+}
+
+// group accumulates all the input in memory, partial groups are spilled to the kv in the order of encoded _id
+// when exceeding the memory limit, and merged when read back. Groups are returned in the order of _id.
+func (s *groupStage) group(a *aggregation, in func() ([]cursorDoc, error)) (out func() ([]cursorDoc, error), err error) {
+	var (
+		groups = make(map[string]*group)
+		size   int
+		batch  []cursorDoc
+		sp     *spill
+	)
+	spillGroups := func() (err error) {
+		if sp == nil {
+			sp = a.newSpill()
+		}
+		for key, g := range groups {
+			var value []byte
+			value, err = g.marshal()
+			if err != nil {
+				return
+			}
+			err = sp.put([]byte(key), value)
+			if err != nil {
+				return
+			}
+		}
+		groups, size = make(map[string]*group), 0
+		return
+	}
+
+	for {
+		batch, err = in()
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, d := range batch {
+			id, ok := s.id.eval(d.doc)
+			if !ok {
+				id = bson.RawValue{Type: bsontype.Null}
+			}
+			var key []byte
+			key, err = dbson.Encode(nil, id)
+			if err != nil {
+				return
+			}
+			g := groups[string(key)]
+			if g == nil {
+				id.Value = append([]byte(nil), id.Value...)
+				g = &group{id: id, accs: make([]accumulator, len(s.fields))}
+				groups[string(key)] = g
+				size += 2*len(key) + docOverhead*(1+len(s.fields))
+			}
+			for i, f := range s.fields {
+				v, ok := f.arg.eval(d.doc)
+				size += g.accs[i].accumulate(f.op, v, ok)
+			}
+		}
+		if size > a.memoryLimit {
+			err = spillGroups()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if sp == nil {
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		docs := make([]cursorDoc, 0, len(keys))
+		for _, key := range keys {
+			var doc bson.Raw
+			doc, err = s.result(groups[key])
+			if err != nil {
+				return
+			}
+			docs = append(docs, cursorDoc{doc: doc})
+		}
+		out = batchOf(docs)
+		return
+	}
+
+	err = spillGroups()
+	if err != nil {
+		return
+	}
+	err = sp.flush()
+	if err != nil {
+		return
+	}
+
+	read := sp.reader()
+	var (
+		pending    *group
+		pendingKey []byte
+		finished   bool
+	)
+	out = func() (docs []cursorDoc, err error) {
+		emit := func() (err error) {
+			doc, err := s.result(pending)
+			if err != nil {
+				return
+			}
+			docs = append(docs, cursorDoc{doc: doc})
+			pending = nil
+			return
+		}
+
+		for len(docs) == 0 && !finished {
+			var entries []spillEntry
+			entries, err = read()
+			if err != nil {
+				return
+			}
+			if len(entries) == 0 {
+				finished = true
+				if pending != nil {
+					err = emit()
+				}
+				return
+			}
+			for _, e := range entries {
+				var g *group
+				g, err = unmarshalGroup(e.value, len(s.fields))
+				if err != nil {
+					return
+				}
+				if pending != nil && bytes.Equal(pendingKey, e.key) {
+					for i, f := range s.fields {
+						pending.accs[i].merge(f.op, &g.accs[i])
+					}
+					continue
+				}
+				if pending != nil {
+					err = emit()
+					if err != nil {
+						return
+					}
+				}
+				pending, pendingKey = g, e.key
+			}
+		}
+		return
+	}
+	return
+}
+
+func (s *groupStage) result(g *group) (bson.Raw, error) {
+	d := make(bson.D, 0, 1+len(s.fields))
+	d = append(d, bson.E{Key: "_id", Value: g.id})
+	for i, f := range s.fields {
+		d = append(d, bson.E{Key: f.name, Value: g.accs[i].result(f.op)})
+	}
+	return bson.Marshal(d)
+}
+
+type group struct {
+	id   bson.RawValue
+	accs []accumulator
+}
+
+// accumulator is the state of an accumulator of $group
+type accumulator struct {
+	// sum and n are for $sum and $avg
+	sum numberSum
+	n   int64
+	// value is for $min and $max, Type is 0 if not set
+	value bson.RawValue
+	// values is for $push
+	values []bson.RawValue
+}
+
+// accumulate v into acc and returns the estimated bytes added, ok is false if v is missing
+func (acc *accumulator) accumulate(op string, v bson.RawValue, ok bool) int {
+	if !ok {
+		return 0
+	}
+
+	switch op {
+	case accSum, accAvg:
+		if isArithNumber(v) {
+			acc.sum.add(v)
+			acc.n++
+		}
+	case accMin, accMax:
+		if v.Type == bsontype.Null || v.Type == bsontype.Undefined {
+			return 0
+		}
+		replace := acc.value.Type == 0
+		if !replace {
+			c := dbson.Compare(v, acc.value)
+			replace = op == accMin && c < 0 || op == accMax && c > 0
+		}
+		if replace {
+			size := len(v.Value) - len(acc.value.Value)
+			acc.value = bson.RawValue{Type: v.Type, Value: append([]byte(nil), v.Value...)}
+			if size > 0 {
+				return size
+			}
+		}
+	case accPush:
+		acc.values = append(acc.values, bson.RawValue{Type: v.Type, Value: append([]byte(nil), v.Value...)})
+		return len(v.Value) + docOverhead
+	}
+	return 0
+}
+
+// merge the partial state other into acc
+func (acc *accumulator) merge(op string, other *accumulator) {
+	switch op {
+	case accSum, accAvg:
+		acc.sum.merge(other.sum)
+		acc.n += other.n
+	case accMin, accMax:
+		if other.value.Type != 0 {
+			acc.accumulate(op, other.value, true)
+		}
+	case accPush:
+		acc.values = append(acc.values, other.values...)
+	}
+}
+
+func (acc *accumulator) result(op string) interface{} {
+	switch op {
+	case accSum:
+		return acc.sum.value()
+	case accAvg:
+		if acc.n == 0 {
+			return nil
+		}
+		return acc.sum.float() / float64(acc.n)
+	case accMin, accMax:
+		if acc.value.Type == 0 {
+			return nil
+		}
+		return acc.value
+	default:
+		values := make(bson.A, 0, len(acc.values))
+		for _, v := range acc.values {
+			values = append(values, v)
+		}
+		return values
+	}
+}
+
+// numberSum sums numbers like mongo, ints are promoted to longs and then doubles when overflowed
+type numberSum struct {
+	i int64
+	f float64
+	// kind of the sum, 0 means int32
+	kind bsontype.Type
+}
+
+func (s *numberSum) add(v bson.RawValue) {
+	switch v.Type {
+	case bsontype.Double:
+		s.addFloat(v.Double())
+	case bsontype.Int64:
+		s.addInt(v.Int64(), true)
+	default:
+		s.addInt(int64(v.Int32()), false)
+	}
+}
+
+func (s *numberSum) merge(o numberSum) {
+	if o.kind == bsontype.Double {
+		s.addFloat(o.f)
+		return
+	}
+	s.addInt(o.i, o.kind == bsontype.Int64)
+}
+
+func (s *numberSum) addInt(x int64, long bool) {
+	if s.kind == bsontype.Double {
+		s.f += float64(x)
+		return
+	}
+
+	r := s.i + x
+	if (x > 0 && r < s.i) || (x < 0 && r > s.i) {
+		s.f, s.kind = float64(s.i)+float64(x), bsontype.Double
+		return
+	}
+	s.i = r
+	if long || r < math.MinInt32 || r > math.MaxInt32 {
+		s.kind = bsontype.Int64
+	}
+}
+
+func (s *numberSum) addFloat(x float64) {
+	if s.kind != bsontype.Double {
+		s.f, s.kind = float64(s.i), bsontype.Double
+	}
+	s.f += x
+}
+
+func (s *numberSum) float() float64 {
+	if s.kind == bsontype.Double {
+		return s.f
+	}
+	return float64(s.i)
+}
+
+func (s *numberSum) value() interface{} {
+	switch s.kind {
+	case bsontype.Double:
+		return s.f
+	case bsontype.Int64:
+		return s.i
+	default:
+		return int32(s.i)
+	}
+}
+
+// spilledGroup is how partial groups are stored in spill
+type spilledGroup struct {
+	ID   bson.RawValue        `bson:"_id"`
+	Accs []spilledAccumulator `bson:"a"`
+}
+
+type spilledAccumulator struct {
+	I    int64   `bson:"i"`
+	F    float64 `bson:"f"`
+	Kind int32   `bson:"k"`
+	N    int64   `bson:"n"`
+	// Value has at most one element
+	Value  []bson.RawValue `bson:"v"`
+	Values []bson.RawValue `bson:"p"`
+}
+
+func (g *group) marshal() ([]byte, error) {
+	sg := spilledGroup{ID: g.id, Accs: make([]spilledAccumulator, len(g.accs))}
+	for i, acc := range g.accs {
+		sa := &sg.Accs[i]
+		sa.I, sa.F, sa.Kind, sa.N, sa.Values = acc.sum.i, acc.sum.f, int32(acc.sum.kind), acc.n, acc.values
+		if acc.value.Type != 0 {
+			sa.Value = []bson.RawValue{acc.value}
+		}
+	}
+	return bson.Marshal(sg)
+}
+
+func unmarshalGroup(data []byte, n int) (g *group, err error) {
+	var sg spilledGroup
+	err = bson.Unmarshal(data, &sg)
+	if err != nil {
+		return
+	}
+	if len(sg.Accs) != n {
+		err = fmt.Errorf("expect %d accumulators, got %d", n, len(sg.Accs))
+		return
+	}
+
+	g = &group{id: sg.ID, accs: make([]accumulator, n)}
+	for i, sa := range sg.Accs {
+		acc := &g.accs[i]
+		acc.sum = numberSum{i: sa.I, f: sa.F, kind: bsontype.Type(sa.Kind)}
+		acc.n, acc.values = sa.N, sa.Values
+		if len(sa.Value) > 0 {
+			acc.value = sa.Value[0]
+		}
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package dml
+
+import (
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"gotest.tools/assert"
+)
+
+func TestParsePipeline(t *testing.T) {
+	p, err := parsePipeline(bson.A{
+		bson.M{"$match": bson.M{"a": 1}},
+		bson.M{"$sort": bson.D{{Key: "b", Value: -1}}},
+		bson.M{"$project": bson.M{"a": 1, "b": 1}},
+		bson.M{"$limit": 10},
+	})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, p.filter.match(mustMarshal(t, bson.M{"a": 1})) && !p.filter.match(mustMarshal(t, bson.M{"a": 2})))
+	assert.Assert(t, len(p.sortKeys) == 1 && !p.sortKeys[0].asc && p.proj != nil)
+	assert.Equal(t, len(p.stages), 3)
+
+	p, err = parsePipeline([]bson.M{{"$skip": 1}, {"$sort": bson.M{"b": 1}}, {"$project": bson.M{"a": 0}}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(p.filter.children) == 0 && p.sortKeys == nil && p.proj == nil)
+
+	_, err = parsePipeline(bson.A{bson.M{"$skip": 1}, bson.M{"$match": bson.M{"$text": bson.M{"$search": "a"}}}})
+	assert.Assert(t, err == ErrSearchNotFirstStage)
+	for _, invalid := range []interface{}{
+		bson.M{"$match": bson.M{}},
+		bson.A{1},
+		bson.A{bson.M{"$match": bson.M{}, "$limit": 1}},
+		bson.A{bson.M{"$lookup": bson.M{}}},
+		bson.A{bson.M{"$limit": 0}},
+		bson.A{bson.M{"$skip": -1}},
+		bson.A{bson.M{"$sort": bson.M{}}},
+		bson.A{bson.M{"$project": bson.M{"a": "$b"}}},
+		bson.A{bson.M{"$unwind": "a"}},
+		bson.A{bson.M{"$count": "$n"}},
+		bson.A{bson.M{"$group": bson.M{"n": bson.M{"$sum": 1}}}},
+		bson.A{bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$first": 1}}}},
+		bson.A{bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$count": 1}}}},
+		bson.A{bson.M{"$group": bson.M{"_id": bson.M{"$add": bson.A{1, 2}}}}},
+	} {
+		_, err = parsePipeline(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+}
+
+func runStages(t *testing.T, pipeline bson.A, docs ...bson.M) (result []bson.M) {
+	p, err := parsePipeline(pipeline)
+	assert.Assert(t, err == nil, err)
+
+	var input []cursorDoc
+	for i, d := range docs {
+		doc, err := bson.Marshal(d)
+		assert.Assert(t, err == nil)
+		if p.filter.match(doc) {
+			input = append(input, cursorDoc{did: encodeDid(int64(i + 1)), doc: doc})
+		}
+	}
+
+	fetch := batchOf(input)
+	a := &aggregation{memoryLimit: math.MaxInt32}
+	for _, s := range p.stages {
+		fetch = s.apply(a, fetch)
+	}
+	output, err := fetchAll(fetch)
+	assert.Assert(t, err == nil, err)
+	for _, d := range output {
+		var m bson.M
+		assert.Assert(t, bson.Unmarshal(d.doc, &m) == nil)
+		result = append(result, m)
+	}
+	return
+}
+
+func TestAggregateStages(t *testing.T) {
+	docs := []bson.M{
+		{"k": "a", "n": 1, "tags": bson.A{"x", "y"}},
+		{"k": "b", "n": 2.5, "tags": bson.A{}},
+		{"k": "a", "n": int64(3), "tags": "z"},
+		{"k": "b", "n": "not a number"},
+		{"n": 4},
+	}
+
+	result := runStages(t, bson.A{
+		bson.M{"$group": bson.M{
+			"_id":   "$k",
+			"sum":   bson.M{"$sum": "$n"},
+			"avg":   bson.M{"$avg": "$n"},
+			"min":   bson.M{"$min": "$n"},
+			"max":   bson.M{"$max": "$n"},
+			"count": bson.M{"$count": bson.M{}},
+			"ns":    bson.M{"$push": "$n"},
+		}},
+	}, docs...)
+	assert.DeepEqual(t, result, []bson.M{
+		{"_id": nil, "sum": int32(4), "avg": 4.0, "min": int32(4), "max": int32(4), "count": int32(1), "ns": bson.A{int32(4)}},
+		{"_id": "a", "sum": int64(4), "avg": 2.0, "min": int32(1), "max": int64(3), "count": int32(2), "ns": bson.A{int32(1), int64(3)}},
+		{"_id": "b", "sum": 2.5, "avg": 2.5, "min": 2.5, "max": "not a number", "count": int32(2), "ns": bson.A{2.5, "not a number"}},
+	})
+
+	result = runStages(t, bson.A{
+		bson.M{"$match": bson.M{"k": "a"}},
+		bson.M{"$unwind": bson.M{"path": "$tags", "includeArrayIndex": "i"}},
+		bson.M{"$project": bson.M{"tags": 1, "i": 1}},
+	}, docs...)
+	assert.DeepEqual(t, result, []bson.M{{"tags": "x", "i": int64(0)}, {"tags": "y", "i": int64(1)}, {"tags": "z", "i": nil}})
+
+	result = runStages(t, bson.A{
+		bson.M{"$unwind": bson.M{"path": "$tags", "preserveNullAndEmptyArrays": true}},
+		bson.M{"$sort": bson.D{{Key: "n", Value: -1}, {Key: "tags", Value: 1}}},
+		bson.M{"$skip": 1},
+		bson.M{"$limit": 3},
+		bson.M{"$project": bson.M{"k": 0}},
+	}, docs...)
+	assert.DeepEqual(t, result, []bson.M{{"n": int32(4)}, {"n": int64(3), "tags": "z"}, {"n": 2.5}})
+
+	result = runStages(t, bson.A{bson.M{"$match": bson.M{"k": "a"}}, bson.M{"$count": "n"}}, docs...)
+	assert.DeepEqual(t, result, []bson.M{{"n": int32(2)}})
+	result = runStages(t, bson.A{bson.M{"$match": bson.M{"k": "c"}}, bson.M{"$count": "n"}}, docs...)
+	assert.Assert(t, len(result) == 0)
+
+	result = runStages(t, bson.A{
+		bson.M{"$group": bson.M{"_id": bson.M{"k": "$k", "int": bson.M{"i": "$n"}}, "n": bson.M{"$count": bson.M{}}}},
+		bson.M{"$match": bson.M{"_id.k": "b"}},
+	}, docs...)
+	assert.DeepEqual(t, result, []bson.M{
+		{"_id": bson.M{"k": "b", "int": bson.M{"i": 2.5}}, "n": int32(1)},
+		{"_id": bson.M{"k": "b", "int": bson.M{"i": "not a number"}}, "n": int32(1)},
+	})
+}
+
+func TestGroupMerge(t *testing.T) {
+	s, err := parseGroup(bson.RawValue{})
+	assert.Assert(t, err != nil && s == nil)
+
+	var sum numberSum
+	sum.add(bson.RawValue{Type: bsontype.Int32, Value: bsoncore.AppendInt32(nil, math.MaxInt32)})
+	assert.Equal(t, sum.value(), int32(math.MaxInt32))
+	sum.merge(numberSum{i: 1})
+	assert.Equal(t, sum.value(), int64(math.MaxInt32)+1)
+	sum.merge(numberSum{i: math.MaxInt64, kind: bsontype.Int64})
+	assert.Equal(t, sum.value(), float64(math.MaxInt32)+1+math.MaxInt64)
+
+	// partial groups survive a round trip through the spill format
+	gs, err := parseGroup(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: mustMarshal(t, bson.M{
+		"_id": "$k", "min": bson.M{"$min": "$n"}, "avg": bson.M{"$avg": "$n"}, "ns": bson.M{"$push": "$n"},
+	})})
+	assert.Assert(t, err == nil)
+	null := bson.RawValue{Type: bsontype.Null}
+	a, b := &group{id: null, accs: make([]accumulator, 3)}, &group{id: null, accs: make([]accumulator, 3)}
+	for i, n := range []interface{}{3, 1.5, "s", 2} {
+		g := a
+		if i%2 == 1 {
+			g = b
+		}
+		doc := mustMarshal(t, bson.M{"n": n})
+		for j, f := range gs.fields {
+			v, ok := f.arg.eval(doc)
+			g.accs[j].accumulate(f.op, v, ok)
+		}
+	}
+	data, err := b.marshal()
+	assert.Assert(t, err == nil)
+	b, err = unmarshalGroup(data, 3)
+	assert.Assert(t, err == nil)
+	for j, f := range gs.fields {
+		a.accs[j].merge(f.op, &b.accs[j])
+	}
+	doc, err := gs.result(a)
+	assert.Assert(t, err == nil)
+	var m bson.M
+	assert.Assert(t, bson.Unmarshal(doc, &m) == nil)
+	assert.DeepEqual(t, m, bson.M{"_id": nil, "min": 1.5, "avg": 6.5 / 3, "ns": bson.A{int32(3), "s", 1.5, int32(2)}})
+}
+
+func TestSortLimit(t *testing.T) {
+	// one document per batch so that the top is cut several times
+	var batches [][]cursorDoc
+	for i, n := range []int{5, 3, 9, 1, 3, 7, 2, 8, 3} {
+		batches = append(batches, []cursorDoc{{did: encodeDid(int64(i + 1)), doc: mustMarshal(t, bson.M{"n": n})}})
+	}
+	in := func() (batch []cursorDoc, err error) {
+		if len(batches) > 0 {
+			batch, batches = batches[0], batches[1:]
+		}
+		return
+	}
+
+	s := &sortStage{keys: []sortKey{{path: "n", asc: true}}, limit: 3}
+	out, err := s.sort(&aggregation{memoryLimit: math.MaxInt32}, in)
+	assert.Assert(t, err == nil)
+	docs, err := fetchAll(out)
+	assert.Assert(t, err == nil && len(docs) == 3)
+	// ties keep the input order
+	for i, did := range []int64{4, 7, 2} {
+		n, err := decodeDid(docs[i].did)
+		assert.Assert(t, err == nil && n == did)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) bson.Raw {
+	doc, err := bson.Marshal(v)
+	assert.Assert(t, err == nil)
+	return doc
+}
@@ -0,0 +1,331 @@
+package dml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// inserts into the same capped collection conflict on its state
+	cappedInsertRetries     = 10
+	cappedEvictBatchSize    = 100
+	defaultTailBatchSize    = 100
+	defaultTailPollInterval = time.Second
+)
+
+var (
+	// ErrCappedOutOfOrder when a document is inserted into capped collection with a did not greater than the last one
+	ErrCappedOutOfOrder = errors.New("capped collection only accepts increasing did")
+	// ErrNotCapped when tailing a collection that's not capped
+	ErrNotCapped = errors.New("collection not capped")
+	// ErrTailCursorClosed when TailCursor is closed
+	ErrTailCursorClosed = errors.New("tail cursor closed")
+)
+
+// cappedState is the state of a capped collection, stored at c[cid]_cs
+type cappedState struct {
+	lastDid int64
+	count   int64
+	bytes   int64
+	// firstDid is not greater than the oldest did left, eviction scans from it
+	// instead of stepping over the deleted documents again.
+	firstDid int64
+}
+
+func (s *cappedState) exceeds(capped *model.CappedInfo) bool {
+	return (capped.MaxDocs > 0 && s.count > capped.MaxDocs) || (capped.MaxBytes > 0 && s.bytes > capped.MaxBytes)
+}
+
+func getCappedState(t *txn.Txn, cid int64) (s cappedState, err error) {
+	value, _, err := t.Get(EncodeCollectionCappedStateKey(nil, cid))
+	if err == kv.ErrKeyNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	value, s.lastDid, err = memcomparable.DecodeInt64(value)
+	if err != nil {
+		return
+	}
+	value, s.count, err = memcomparable.DecodeInt64(value)
+	if err != nil {
+		return
+	}
+	value, s.bytes, err = memcomparable.DecodeInt64(value)
+	if err != nil || len(value) == 0 {
+		// states written before firstDid have 0
+		return
+	}
+	_, s.firstDid, err = memcomparable.DecodeInt64(value)
+	return
+}
+
+func setCappedState(t *txn.Txn, cid int64, s cappedState) error {
+	value := memcomparable.EncodeInt64(nil, s.lastDid)
+	value = memcomparable.EncodeInt64(value, s.count)
+	value = memcomparable.EncodeInt64(value, s.bytes)
+	value = memcomparable.EncodeInt64(value, s.firstDid)
+	return t.Set(EncodeCollectionCappedStateKey(nil, cid), value, nil)
+}
+
+// nextCappedDid returns the did for the next document inserted into capped collection,
+// dids are not from the sequence so that they increase in commit order.
+func nextCappedDid(t *txn.Txn, cid int64) (did int64, err error) {
+	s, err := getCappedState(t, cid)
+	if err != nil {
+		return
+	}
+	did = s.lastDid + 1
+	return
+}
+
+// capDoc accounts a write of did to capped collection,
+// and evicts the oldest documents other than did until the limits are met.
+// Capped collections only have auto ids.
+func capDoc(t *txn.Txn, ci *model.CollectionInfo, did []byte, oldDoc, newDoc bson.Raw) (err error) {
+	s, err := getCappedState(t, ci.ID)
+	if err != nil {
+		return
+	}
+	if oldDoc == nil {
+		var n int64
+		n, err = decodeDid(did)
+		if err != nil {
+			return
+		}
+		if n <= s.lastDid {
+			err = ErrCappedOutOfOrder
+			return
+		}
+		s.lastDid = n
+		s.count++
+	}
+	s.bytes += int64(len(newDoc) - len(oldDoc))
+	err = setCappedState(t, ci.ID, s)
+	if err != nil {
+		return
+	}
+
+	if !s.exceeds(ci.Capped) {
+		return
+	}
+
+	prefix := AppendCollectionDocumentPrefix(nil, ci.ID)
+	next := kv.Key(EncodeCollectionDocumentKey(nil, ci.ID, encodeDid(s.firstDid)))
+	f, _ := parseFilter(nil)
+	firstDid, skipped := s.firstDid, false
+	for next != nil && s.exceeds(ci.Capped) {
+		var docs []cursorDoc
+		docs, next, err = scanBatch(t, prefix, next, f, cappedEvictBatchSize, &execStats{})
+		if err != nil {
+			return
+		}
+		for _, doc := range docs {
+			if !s.exceeds(ci.Capped) {
+				break
+			}
+			if bytes.Equal(doc.did, did) {
+				skipped = true
+				continue
+			}
+			// deleteDoc updates the stored state the same way
+			err = deleteDoc(t, ci, doc.did, doc.doc)
+			if err != nil {
+				return
+			}
+			s.count--
+			s.bytes -= int64(len(doc.doc))
+			if !skipped {
+				firstDid, err = decodeDid(doc.did)
+				if err != nil {
+					return
+				}
+				firstDid++
+			}
+		}
+	}
+
+	if firstDid != s.firstDid {
+		// reloaded since deleteDoc has stored the counts
+		s, err = getCappedState(t, ci.ID)
+		if err != nil {
+			return
+		}
+		s.firstDid = firstDid
+		err = setCappedState(t, ci.ID, s)
+	}
+	return
+}
+
+// uncapDoc accounts a deletion from capped collection
+func uncapDoc(t *txn.Txn, ci *model.CollectionInfo, doc bson.Raw) (err error) {
+	s, err := getCappedState(t, ci.ID)
+	if err != nil {
+		return
+	}
+	s.count--
+	s.bytes -= int64(len(doc))
+	err = setCappedState(t, ci.ID, s)
+	return
+}
+
+// TailOptions for Tail
+type TailOptions struct {
+	// AfterDid starts tailing after the document with this id, 0 means from the oldest document
+	AfterDid int64
+	// BatchSize is the max number of documents read from kv each time
+	BatchSize int
+	// PollInterval is the max time to wait before checking for new documents again,
+	// commits of this process wake up cursors immediately
+	PollInterval time.Duration
+}
+
+// TailCursor iterates over documents of a capped collection in insertion order and waits for new ones, typical usage:
+//
+//	for tc.Next(ctx) {
+//		err = tc.Decode(&v)
+//	}
+//	err = tc.Err()
+//	tc.Close()
+type TailCursor struct {
+	// Did is the id of Current
+	Did int64
+	// Current is the document Next moved to
+	Current bson.Raw
+
+	c         *Collection
+	cid       int64
+	opts      TailOptions
+	after     []byte
+	batch     []cursorDoc
+	err       error
+	ctxErr    error
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Tail returns a TailCursor over the documents of a capped collection after opts.AfterDid.
+// Documents evicted before being read are skipped.
+func (c *Collection) Tail(opts *TailOptions) (tc *TailCursor, err error) {
+	tc = &TailCursor{c: c, closing: make(chan struct{})}
+	if opts != nil {
+		tc.opts = *opts
+	}
+	if tc.opts.BatchSize <= 0 {
+		tc.opts.BatchSize = defaultTailBatchSize
+	}
+	if tc.opts.PollInterval <= 0 {
+		tc.opts.PollInterval = defaultTailPollInterval
+	}
+	tc.after = encodeDid(tc.opts.AfterDid)
+
+	ci := c.handle.Get().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+	if ci.Capped == nil {
+		err = ErrNotCapped
+		return
+	}
+	tc.cid = ci.ID
+	return
+}
+
+// Next moves to the next document, it blocks until a document is available, ctx is done or an error happened
+func (tc *TailCursor) Next(ctx context.Context) bool {
+	tc.ctxErr = nil
+	for {
+		if tc.err != nil {
+			return false
+		}
+		select {
+		case <-tc.closing:
+			tc.err = ErrTailCursorClosed
+			return false
+		default:
+		}
+
+		if len(tc.batch) > 0 {
+			tc.Did, tc.Current = publicDid(model.IDTypeAuto, tc.batch[0].did), tc.batch[0].doc
+			tc.batch = tc.batch[1:]
+			return true
+		}
+
+		// inserts are logged as change events, so commits wake up the cursor
+		changed := getChangeLog(tc.cid).wait()
+		tc.batch, tc.err = tc.fetch()
+		if tc.err != nil || len(tc.batch) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(tc.opts.PollInterval)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-tc.closing:
+		case <-ctx.Done():
+			timer.Stop()
+			tc.ctxErr = ctx.Err()
+			return false
+		}
+		timer.Stop()
+	}
+}
+
+// fetch reads the next batch of documents after tc.after
+func (tc *TailCursor) fetch() (docs []cursorDoc, err error) {
+	t := tc.c.Txn(false)
+	defer t.Discard()
+
+	ci := t.StartMetaCache().CollectionInfo(tc.c.dbName, tc.c.collectionName)
+	if ci == nil || ci.ID != tc.cid {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	prefix := AppendCollectionDocumentPrefix(nil, tc.cid)
+	offset := kv.Key(EncodeCollectionDocumentKey(nil, tc.cid, tc.after)).Next()
+	f, _ := parseFilter(nil)
+	docs, _, err = scanBatch(t, prefix, offset, f, tc.opts.BatchSize, &execStats{})
+	if err != nil {
+		return
+	}
+
+	if len(docs) > 0 {
+		tc.after = docs[len(docs)-1].did
+	}
+	return
+}
+
+// Decode unmarshals Current into v
+func (tc *TailCursor) Decode(v interface{}) error {
+	return bson.Unmarshal(tc.Current, v)
+}
+
+// Err returns the error happened during iteration, or the error of ctx if Next returned because of it
+func (tc *TailCursor) Err() error {
+	if tc.err != nil {
+		return tc.err
+	}
+	return tc.ctxErr
+}
+
+// Close stops the cursor, it's safe to call it multiple times or concurrently with Next
+func (tc *TailCursor) Close() {
+	tc.closeOnce.Do(func() {
+		close(tc.closing)
+	})
+}
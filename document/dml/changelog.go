@@ -0,0 +1,592 @@
+package dml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/meta"
+	"github.com/zhiqiangxu/mondis/document/meta/sequence"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// operations of ChangeEvent
+const (
+	ChangeInsert  = "insert"
+	ChangeUpdate  = "update"
+	ChangeReplace = "replace"
+	ChangeDelete  = "delete"
+)
+
+const (
+	defaultWatchBatchSize    = 100
+	defaultWatchPollInterval = time.Second
+)
+
+var (
+	// ErrInvalidResumeToken when the resume token is not returned by ChangeStream
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	// ErrResumeTokenExpired when the events after the resume token are truncated by retention
+	ErrResumeTokenExpired = errors.New("resume token expired")
+	// ErrChangeStreamInvalidated when the watched collection is dropped, truncated or renamed
+	ErrChangeStreamInvalidated = errors.New("change stream invalidated")
+	// ErrChangeStreamClosed used by ChangeStream
+	ErrChangeStreamClosed = errors.New("change stream closed")
+)
+
+// ResumeToken identifies a change event, a stream resumed by it starts right after the event
+type ResumeToken []byte
+
+func resumeTokenOf(seq int64) ResumeToken {
+	return ResumeToken(memcomparable.EncodeInt64(nil, seq))
+}
+
+func (rt ResumeToken) seq() (seq int64, err error) {
+	if len(rt) != 8 {
+		err = ErrInvalidResumeToken
+		return
+	}
+	_, seq, err = memcomparable.DecodeInt64(rt)
+	return
+}
+
+// ChangeEvent is a change of document
+type ChangeEvent struct {
+	Op string `bson:"op"`
+	// Did of the document, 0 for typed ids
+	Did int64 `bson:"did"`
+	// ID is the _id of the document for typed ids
+	ID   interface{} `bson:"id,omitempty"`
+	Time time.Time   `bson:"ts"`
+	// FullDocument is the document after the change,
+	// nil for delete or when WatchOptions.FullDocument is false
+	FullDocument bson.Raw `bson:"doc,omitempty"`
+	// Token resumes the stream right after this event
+	Token ResumeToken `bson:"-"`
+}
+
+// changeLog is the state of the change log of a collection in this process.
+// Seqs are allocated from the persisted sequence of the collection right before commit,
+// so they may become visible out of order, streams only read events below the first in-flight seq.
+type changeLog struct {
+	mu       sync.Mutex
+	seq      *sequence.Hash
+	inflight map[int64]struct{} // first seq of each committing txn
+
+	changedMu sync.Mutex
+	changed   chan struct{}
+}
+
+var changeLogs sync.Map // cid => *changeLog
+
+func getChangeLog(cid int64) *changeLog {
+	cl, _ := changeLogs.LoadOrStore(cid, &changeLog{inflight: make(map[int64]struct{}), changed: make(chan struct{})})
+	return cl.(*changeLog)
+}
+
+func createChangeLogSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (err error) {
+	seq, err := meta.NewChangeLogSequence(kvdb, dbID, cid, bandwidth)
+	if err != nil {
+		return
+	}
+
+	cl := getChangeLog(cid)
+	cl.mu.Lock()
+	cl.seq = seq
+	cl.mu.Unlock()
+	return
+}
+
+func dropChangeLogSequence(cid int64) (err error) {
+	v, ok := changeLogs.Load(cid)
+	if !ok {
+		return
+	}
+	changeLogs.Delete(cid)
+
+	cl := v.(*changeLog)
+	cl.mu.Lock()
+	seq := cl.seq
+	cl.seq = nil
+	cl.mu.Unlock()
+	// wake up streams so that they find out the collection is gone
+	cl.notify()
+
+	if seq != nil {
+		err = seq.Close(false)
+	}
+	return
+}
+
+// allocate returns n seqs in ascending order, they are in-flight until release is called with the first one
+func (cl *changeLog) allocate(n int) (seqs []int64, err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.seq == nil {
+		err = ErrSequenceNotExists
+		return
+	}
+
+	seqs = make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		var seq int64
+		seq, err = cl.seq.Next()
+		if err != nil {
+			seqs = nil
+			return
+		}
+		seqs = append(seqs, seq)
+	}
+	cl.inflight[seqs[0]] = struct{}{}
+	return
+}
+
+func (cl *changeLog) release(first int64) {
+	cl.mu.Lock()
+	delete(cl.inflight, first)
+	cl.mu.Unlock()
+}
+
+// snapshot returns a read only txn along with the seq bound of it,
+// events below bound are all committed before the txn starts and won't appear later.
+func (cl *changeLog) snapshot(c *Collection) (t *txn.Txn, bound int64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// seqs allocated after t starts are greater than those in-flight or committed
+	t = c.Txn(false)
+	bound = cl.boundLocked()
+	return
+}
+
+// boundLocked returns the first in-flight seq, must be called with mu held
+func (cl *changeLog) boundLocked() (bound int64) {
+	bound = math.MaxInt64
+	for seq := range cl.inflight {
+		if seq < bound {
+			bound = seq
+		}
+	}
+	return
+}
+
+// wait returns a channel closed on the next commit with changes
+func (cl *changeLog) wait() <-chan struct{} {
+	cl.changedMu.Lock()
+	defer cl.changedMu.Unlock()
+	return cl.changed
+}
+
+func (cl *changeLog) notify() {
+	cl.changedMu.Lock()
+	defer cl.changedMu.Unlock()
+	close(cl.changed)
+	cl.changed = make(chan struct{})
+}
+
+// lastChangeSeq returns the max seq below bound of events appended to the change log,
+// including the truncated ones.
+func lastChangeSeq(t mondis.ProviderKVOP, cid, bound int64) (last int64, err error) {
+	prefix := AppendCollectionChangeLogPrefix(nil, cid)
+	scanErr := t.Scan(mondis.ProviderScanOption{Reverse: true, Offset: EncodeCollectionChangeLogKey(nil, cid, bound)}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return bytes.Compare(key, prefix) > 0
+		}
+		var seq int64
+		seq, err = DecodeCollectionChangeLogKeySeq(key)
+		if err != nil {
+			return false
+		}
+		if seq >= bound {
+			return true
+		}
+		last = seq
+		return false
+	})
+	if err != nil {
+		return
+	}
+	if scanErr != nil {
+		err = scanErr
+		return
+	}
+
+	// seq must not go back even if all events are truncated
+	truncated, err := changeLogTruncated(t, cid)
+	if err != nil {
+		return
+	}
+	if truncated > last {
+		last = truncated
+	}
+	return
+}
+
+// changeLogTruncated returns the max seq of truncated events
+func changeLogTruncated(t mondis.ProviderKVOP, cid int64) (seq int64, err error) {
+	value, _, err := t.Get(EncodeCollectionChangeLogTruncatedKey(nil, cid))
+	if err == kv.ErrKeyNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	_, seq, err = memcomparable.DecodeInt64(value)
+	return
+}
+
+type pendingChangesKey struct{}
+
+type pendingChange struct {
+	cid int64
+	op  string
+	did int64
+	id  interface{}
+	doc bson.Raw
+}
+
+// pendingChanges are changes of a txn, appended to the change log when committing
+type pendingChanges struct {
+	t       *txn.Txn
+	changes []pendingChange
+}
+
+// logChange records a change of document did in t, doc is the document after the change
+func logChange(t *txn.Txn, ci *model.CollectionInfo, op string, did []byte, doc bson.Raw) (err error) {
+	c := pendingChange{cid: ci.ID, op: op, did: publicDid(ci.IDType, did), doc: doc}
+	if ci.IDType != model.IDTypeAuto {
+		c.id, err = idOf(ci, did)
+		if err != nil {
+			return
+		}
+	}
+
+	pc, _ := t.Value(pendingChangesKey{}).(*pendingChanges)
+	if pc == nil {
+		pc = &pendingChanges{t: t}
+		t.SetValue(pendingChangesKey{}, pc)
+		t.AddCommitFunc(pc.commit)
+	}
+	pc.changes = append(pc.changes, c)
+	return
+}
+
+func (pc *pendingChanges) commit() (done func(), err error) {
+	var cids []int64
+	counts := make(map[int64]int)
+	for _, c := range pc.changes {
+		if counts[c.cid] == 0 {
+			cids = append(cids, c.cid)
+		}
+		counts[c.cid]++
+	}
+
+	type allocated struct {
+		cl    *changeLog
+		first int64
+		seqs  []int64
+	}
+	allocs := make(map[int64]*allocated, len(cids))
+	done = func() {
+		for _, a := range allocs {
+			a.cl.release(a.first)
+			a.cl.notify()
+		}
+	}
+
+	for _, cid := range cids {
+		cl := getChangeLog(cid)
+		var seqs []int64
+		seqs, err = cl.allocate(counts[cid])
+		if err != nil {
+			return
+		}
+		allocs[cid] = &allocated{cl: cl, first: seqs[0], seqs: seqs}
+	}
+
+	now := time.Now()
+	for _, c := range pc.changes {
+		var value []byte
+		value, err = bson.Marshal(ChangeEvent{Op: c.op, Did: c.did, ID: c.id, Time: now, FullDocument: c.doc})
+		if err != nil {
+			return
+		}
+		a := allocs[c.cid]
+		seq := a.seqs[0]
+		a.seqs = a.seqs[1:]
+		err = pc.t.Set(EncodeCollectionChangeLogKey(nil, c.cid, seq), value, nil)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WatchOptions for Watch
+type WatchOptions struct {
+	// FullDocument returns the document after the change for insert, update and replace
+	FullDocument bool
+	// BatchSize is the max number of events read from kv each time
+	BatchSize int
+	// PollInterval is the max time to wait before checking the change log again,
+	// commits of this process wake up streams immediately
+	PollInterval time.Duration
+}
+
+// ChangeStream iterates over change events of a collection, typical usage:
+//
+//	for cs.Next(ctx) {
+//		token = cs.Current.Token
+//	}
+//	err = cs.Err()
+//	cs.Close()
+type ChangeStream struct {
+	// Current is the event Next moved to
+	Current *ChangeEvent
+
+	c         *Collection
+	cid       int64
+	opts      WatchOptions
+	after     int64
+	batch     []*ChangeEvent
+	err       error
+	ctxErr    error
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Watch returns a ChangeStream of the events after resumeToken, nil resumeToken means events after now.
+// Events are kept for config.ChangeLogRetention.
+func (c *Collection) Watch(resumeToken ResumeToken, opts *WatchOptions) (cs *ChangeStream, err error) {
+	cs = &ChangeStream{c: c, closing: make(chan struct{})}
+	if opts != nil {
+		cs.opts = *opts
+	}
+	if cs.opts.BatchSize <= 0 {
+		cs.opts.BatchSize = defaultWatchBatchSize
+	}
+	if cs.opts.PollInterval <= 0 {
+		cs.opts.PollInterval = defaultWatchPollInterval
+	}
+
+	t := c.Txn(false)
+	defer t.Discard()
+
+	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+	cs.cid = ci.ID
+
+	if resumeToken == nil {
+		st, bound := getChangeLog(ci.ID).snapshot(c)
+		defer st.Discard()
+		cs.after, err = lastChangeSeq(st, ci.ID, bound)
+		return
+	}
+
+	cs.after, err = resumeToken.seq()
+	if err != nil {
+		return
+	}
+	truncated, err := changeLogTruncated(t, ci.ID)
+	if err != nil {
+		return
+	}
+	if cs.after < truncated {
+		err = ErrResumeTokenExpired
+		return
+	}
+	return
+}
+
+// Next moves to the next event, it blocks until an event is available, ctx is done or an error happened
+func (cs *ChangeStream) Next(ctx context.Context) bool {
+	cs.ctxErr = nil
+	for {
+		if cs.err != nil {
+			return false
+		}
+		select {
+		case <-cs.closing:
+			cs.err = ErrChangeStreamClosed
+			return false
+		default:
+		}
+
+		if len(cs.batch) > 0 {
+			cs.Current = cs.batch[0]
+			cs.batch = cs.batch[1:]
+			return true
+		}
+
+		changed := getChangeLog(cs.cid).wait()
+		cs.batch, cs.err = cs.fetch()
+		if cs.err != nil || len(cs.batch) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(cs.opts.PollInterval)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-cs.closing:
+		case <-ctx.Done():
+			timer.Stop()
+			cs.ctxErr = ctx.Err()
+			return false
+		}
+		timer.Stop()
+	}
+}
+
+// fetch reads the next batch of events from the change log
+func (cs *ChangeStream) fetch() (events []*ChangeEvent, err error) {
+	t, bound := getChangeLog(cs.cid).snapshot(cs.c)
+	defer t.Discard()
+
+	ci := t.StartMetaCache().CollectionInfo(cs.c.dbName, cs.c.collectionName)
+	if ci == nil || ci.ID != cs.cid {
+		err = ErrChangeStreamInvalidated
+		return
+	}
+	truncated, err := changeLogTruncated(t, cs.cid)
+	if err != nil {
+		return
+	}
+	if cs.after < truncated {
+		err = ErrResumeTokenExpired
+		return
+	}
+
+	prefix := AppendCollectionChangeLogPrefix(nil, cs.cid)
+	var seq int64
+	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: EncodeCollectionChangeLogKey(nil, cs.cid, cs.after+1)}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if len(events) >= cs.opts.BatchSize {
+			return false
+		}
+		var eventSeq int64
+		eventSeq, err = DecodeCollectionChangeLogKeySeq(key)
+		if err != nil || eventSeq >= bound {
+			return false
+		}
+		seq = eventSeq
+		event := &ChangeEvent{}
+		err = bson.Unmarshal(value, event)
+		if err != nil {
+			return false
+		}
+		if cs.opts.FullDocument {
+			event.FullDocument = append(bson.Raw(nil), event.FullDocument...)
+		} else {
+			event.FullDocument = nil
+		}
+		event.Token = resumeTokenOf(seq)
+		events = append(events, event)
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return
+	}
+
+	if len(events) > 0 {
+		cs.after = seq
+	}
+	return
+}
+
+// Err returns the error happened during iteration, or the error of ctx if Next returned because of it
+func (cs *ChangeStream) Err() error {
+	if cs.err != nil {
+		return cs.err
+	}
+	return cs.ctxErr
+}
+
+// Close stops the stream, it's safe to call it multiple times or concurrently with Next
+func (cs *ChangeStream) Close() {
+	cs.closeOnce.Do(func() {
+		close(cs.closing)
+	})
+}
+
+// TruncateChangeLog deletes at most limit change events committed before the given time,
+// resume tokens of them expire afterwards.
+func (c *Collection) TruncateChangeLog(before time.Time, limit int, t *txn.Txn) (n int, err error) {
+
+	origT := t
+
+	truncateFunc := func(t *txn.Txn) (err error) {
+		n = 0
+		ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+		if ci == nil {
+			err = ErrCollectionNotExists
+			return
+		}
+
+		if origT != nil {
+			origT.ReferredCollections(ci.ID)
+		}
+
+		var (
+			keys    [][]byte
+			lastSeq int64
+		)
+		prefix := AppendCollectionChangeLogPrefix(nil, ci.ID)
+		scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: prefix}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+			if len(keys) >= limit {
+				return false
+			}
+			ts, ok := bson.Raw(value).Lookup("ts").TimeOK()
+			if ok && !ts.Before(before) {
+				return false
+			}
+			lastSeq, err = DecodeCollectionChangeLogKeySeq(key)
+			if err != nil {
+				return false
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			return true
+		})
+		if err == nil {
+			err = scanErr
+		}
+		if err != nil || len(keys) == 0 {
+			return
+		}
+
+		for _, key := range keys {
+			err = t.Delete(key)
+			if err != nil {
+				return
+			}
+		}
+		err = t.Set(EncodeCollectionChangeLogTruncatedKey(nil, ci.ID), memcomparable.EncodeInt64(nil, lastSeq), nil)
+		if err != nil {
+			return
+		}
+		n = len(keys)
+		return
+	}
+
+	if t == nil {
+		err = c.RunInNewUpdateTxn(truncateFunc)
+	} else {
+		err = truncateFunc(t)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package dml
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestChangeLogKeys(t *testing.T) {
+	prefix := AppendCollectionChangeLogPrefix(nil, 1)
+	for _, seq := range []int64{1, 255, 256, 1 << 40} {
+		key := EncodeCollectionChangeLogKey(nil, 1, seq)
+		assert.Assert(t, bytes.HasPrefix(key, prefix))
+		decoded, err := DecodeCollectionChangeLogKeySeq(key)
+		assert.Assert(t, err == nil && decoded == seq)
+		assert.Assert(t, bytes.Compare(key, EncodeCollectionChangeLogKey(nil, 1, seq+1)) < 0)
+
+		decoded, err = resumeTokenOf(seq).seq()
+		assert.Assert(t, err == nil && decoded == seq)
+	}
+
+	// other keys of the collection are not in the change log
+	assert.Assert(t, !bytes.HasPrefix(EncodeCollectionChangeLogTruncatedKey(nil, 1), prefix))
+	assert.Assert(t, !bytes.HasPrefix(EncodeCollectionDocumentKey(nil, 1, encodeDid(1)), prefix))
+	assert.Assert(t, !bytes.HasPrefix(EncodeCollectionChangeLogKey(nil, 2, 1), prefix))
+
+	_, err := ResumeToken("bad").seq()
+	assert.Assert(t, err == ErrInvalidResumeToken)
+}
+
+func TestChangeLogAllocate(t *testing.T) {
+	kvdb, closeFunc := openTestKV(t)
+	defer closeFunc()
+
+	const cid = 100
+	assert.Assert(t, createChangeLogSequence(kvdb, 1, cid, 0) == nil)
+	cl := getChangeLog(cid)
+
+	seqs1, err := cl.allocate(2)
+	assert.Assert(t, err == nil && len(seqs1) == 2 && seqs1[0] < seqs1[1])
+	seqs2, err := cl.allocate(1)
+	assert.Assert(t, err == nil && seqs2[0] > seqs1[1])
+
+	// streams must not pass an in-flight seq
+	assert.Assert(t, cl.boundLocked() == seqs1[0])
+	cl.release(seqs1[0])
+	assert.Assert(t, cl.boundLocked() == seqs2[0])
+	cl.release(seqs2[0])
+	assert.Assert(t, cl.boundLocked() == math.MaxInt64)
+
+	// seqs keep growing after the sequence is reopened
+	assert.Assert(t, dropChangeLogSequence(cid) == nil)
+	_, err = getChangeLog(cid).allocate(1)
+	assert.Assert(t, err == ErrSequenceNotExists)
+	assert.Assert(t, createChangeLogSequence(kvdb, 1, cid, 0) == nil)
+	seqs3, err := getChangeLog(cid).allocate(1)
+	assert.Assert(t, err == nil && seqs3[0] > seqs2[0])
+	assert.Assert(t, dropChangeLogSequence(cid) == nil)
+}
@@ -1,8 +1,10 @@
 package dml
 
 import (
+	"bytes"
 	"errors"
 	"reflect"
+	"time"
 
 	"github.com/zhiqiangxu/mondis"
 	"github.com/zhiqiangxu/mondis/document/model"
@@ -43,80 +45,125 @@ func (c *Collection) Index(name string) (idx *Index, err error) {
 	return
 }
 
-// InsertOne for insert a document into collection
+// InsertOne for insert a document into collection,
+// the oldest documents of a capped collection are evicted in the same transaction when it's full.
+// did is 0 for collections with typed ids, whose _id is returned by InsertOneID.
 func (c *Collection) InsertOne(doc interface{}, t *txn.Txn) (did int64, err error) {
+	id, err := c.InsertOneID(doc, t)
+	if err != nil {
+		return
+	}
+	did, _ = id.(int64)
+	return
+}
+
+// InsertOneID is like InsertOne but returns _id of the inserted document, which is the did for auto ids,
+// *DuplicateKeyError is returned if _id is taken.
+func (c *Collection) InsertOneID(doc interface{}, t *txn.Txn) (id interface{}, err error) {
 	data, err := bson.Marshal(doc)
 	if err != nil {
 		return
 	}
 
 	origT := t
+	// capped collections allocate did in the txn, retried on conflict
+	var capped bool
 
 	insertFunc := func(t *txn.Txn) (ierr error) {
 		ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
 		if ci == nil {
-			err = ErrCollectionNotExists
+			ierr = ErrCollectionNotExists
 			return
 		}
 		if origT != nil {
 			origT.ReferredCollections(ci.ID)
 		}
 
-		seq := GetSequence(ci.ID)
-		if seq == nil {
-			ierr = ErrSequenceNotExists
-			return
+		var (
+			did    int64
+			encDid []byte
+			doc    = data
+		)
+		switch {
+		case ci.IDType != model.IDTypeAuto:
+			encDid, doc, ierr = prepareInsertID(t, ci, data)
+		case ci.Capped != nil:
+			capped = true
+			did, ierr = nextCappedDid(t, ci.ID)
+			encDid = encodeDid(did)
+		default:
+			did, ierr = nextSequenceDid(t, ci.ID)
+			encDid = encodeDid(did)
 		}
-
-		did, ierr = seq.Next()
 		if ierr != nil {
 			return
 		}
 
-		docKey := EncodeCollectionDocumentKey(nil, ci.ID, did)
-
-		ierr = t.Set(docKey, data, nil)
-		if err != nil {
+		ierr = writeDoc(t, ci, encDid, nil, doc, nil)
+		if ierr != nil {
 			return
 		}
-
-		t.AddCancelFunc(func() {
-			seq.PutBack(did)
-		})
+		id, ierr = idOf(ci, encDid)
 		return
 	}
 
 	if t != nil {
 		err = insertFunc(t)
-	} else {
+		return
+	}
+	for i := 0; ; i++ {
 		err = c.RunInNewUpdateTxn(insertFunc)
+		if err != kv.ErrConflict || !capped || i >= cappedInsertRetries {
+			return
+		}
+	}
+}
+
+// nextSequenceDid allocates a did from the sequence of collection, it's put back if t fails to commit
+func nextSequenceDid(t *txn.Txn, cid int64) (did int64, err error) {
+	seq := GetSequence(cid)
+	if seq == nil {
+		err = ErrSequenceNotExists
+		return
+	}
+
+	did, err = seq.Next()
+	if err != nil {
+		return
 	}
+
+	t.AddCancelFunc(func() {
+		seq.PutBack(did)
+	})
 	return
 }
 
-// InsertOneManaged for insert a new document with specified document id
-func (c *Collection) InsertOneManaged(did int64, doc interface{}, t *txn.Txn) (err error) {
+// InsertOneManaged for insert a new document with specified _id, which is the did for auto ids,
+// did must be greater than those inserted before for capped collection.
+func (c *Collection) InsertOneManaged(id interface{}, doc interface{}, t *txn.Txn) (err error) {
 
-	_, _, err = c.updateOne(did, doc, updateForInsert, t)
+	_, _, err = c.updateOne(id, doc, updateForInsert, t)
 	return
 }
 
-// UpdateOne for update an existing document in collection
-func (c *Collection) UpdateOne(did int64, doc interface{}, t *txn.Txn) (exists bool, err error) {
+// UpdateOne for update an existing document in collection by _id, which is the did for auto ids,
+// doc is either a replacement or an update document with operators like bson.M{"$set": bson.M{"a": 1}}.
+func (c *Collection) UpdateOne(id interface{}, doc interface{}, t *txn.Txn) (exists bool, err error) {
 
-	exists, _, err = c.updateOne(did, doc, updateForUpdate, t)
+	exists, _, err = c.updateOne(id, doc, updateForUpdate, t)
 	return
 }
 
-// UpsertOne for upsert an existing document in collection
-func (c *Collection) UpsertOne(did int64, doc interface{}, t *txn.Txn) (isNew bool, err error) {
+// UpsertOne for upsert an existing document in collection by _id, which is the did for auto ids,
+// update operators are applied to an empty document if not exists.
+func (c *Collection) UpsertOne(id interface{}, doc interface{}, t *txn.Txn) (isNew bool, err error) {
 
-	_, isNew, err = c.updateOne(did, doc, updateForUpsert, t)
+	_, isNew, err = c.updateOne(id, doc, updateForUpsert, t)
 	return
 }
 
-// DeleteOne for delete a document from collection
-func (c *Collection) DeleteOne(did int64, t *txn.Txn) (err error) {
+// DeleteOne for delete a document from collection by _id, which is the did for auto ids
+func (c *Collection) DeleteOne(id interface{}, t *txn.Txn) (err error) {
 
 	origT := t
 
@@ -131,8 +178,21 @@ func (c *Collection) DeleteOne(did int64, t *txn.Txn) (err error) {
 			origT.ReferredCollections(ci.ID)
 		}
 
+		did, err := marshalID(ci, id)
+		if err != nil {
+			return
+		}
 		docKey := EncodeCollectionDocumentKey(nil, ci.ID, did)
-		err = t.Delete(docKey)
+		oldData, _, err := t.Get(docKey)
+		if err == kv.ErrKeyNotFound {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		err = deleteDoc(t, ci, did, oldData)
 		return
 	}
 
@@ -150,8 +210,8 @@ const (
 	updateForInsert
 )
 
-func (c *Collection) updateOne(did int64, doc interface{}, updateFor int8, t *txn.Txn) (existsForUpdate, isNewForUpsert bool, err error) {
-	data, err := bson.Marshal(doc)
+func (c *Collection) updateOne(id interface{}, doc interface{}, updateFor int8, t *txn.Txn) (existsForUpdate, isNewForUpsert bool, err error) {
+	u, err := parseUpdate(doc)
 	if err != nil {
 		return
 	}
@@ -169,10 +229,19 @@ func (c *Collection) updateOne(did int64, doc interface{}, updateFor int8, t *tx
 			origT.ReferredCollections(ci.ID)
 		}
 
+		did, err := marshalID(ci, id)
+		if err != nil {
+			return
+		}
 		docKey := EncodeCollectionDocumentKey(nil, ci.ID, did)
 
-		existsForUpdate, err = t.Exists(docKey)
-		if err != nil {
+		oldData, _, err := t.Get(docKey)
+		switch err {
+		case nil:
+			existsForUpdate = true
+		case kv.ErrKeyNotFound:
+			err = nil
+		default:
 			return
 		}
 
@@ -190,11 +259,19 @@ func (c *Collection) updateOne(did int64, doc interface{}, updateFor int8, t *tx
 			}
 		}
 
-		err = t.Set(docKey, data, nil)
+		data, err := u.apply(oldData, time.Now())
 		if err != nil {
 			return
 		}
+		data, err = prepareDocID(ci, did, oldData, data)
+		if err != nil {
+			return
+		}
+		if oldData != nil && bytes.Equal(oldData, data) {
+			return
+		}
 
+		err = writeDoc(t, ci, did, oldData, data, u.paths())
 		return
 	}
 
@@ -207,8 +284,8 @@ func (c *Collection) updateOne(did int64, doc interface{}, updateFor int8, t *tx
 	return
 }
 
-// GetOne for get a document by document id
-func (c *Collection) GetOne(did int64, data interface{}, t *txn.Txn) (err error) {
+// GetOne for get a document by _id, which is the did for auto ids
+func (c *Collection) GetOne(id interface{}, data interface{}, t *txn.Txn) (err error) {
 
 	origT := t
 
@@ -227,6 +304,10 @@ func (c *Collection) GetOne(did int64, data interface{}, t *txn.Txn) (err error)
 		origT.ReferredCollections(ci.ID)
 	}
 
+	did, err := marshalID(ci, id)
+	if err != nil {
+		return
+	}
 	docKey := EncodeCollectionDocumentKey(nil, ci.ID, did)
 	v, _, err := t.Get(docKey)
 	if err == kv.ErrKeyNotFound {
@@ -241,12 +322,9 @@ func (c *Collection) GetOne(did int64, data interface{}, t *txn.Txn) (err error)
 	return
 }
 
-// GetMany for get many documents by document id list
+// GetMany for get many documents by document id list, it's only supported for auto ids
 func (c *Collection) GetMany(dids []int64, slicePtr interface{}, t *txn.Txn) (err error) {
 
-	et := reflect.TypeOf(slicePtr).Elem().Elem()
-	slice := reflect.Indirect(reflect.ValueOf(slicePtr))
-
 	origT := t
 
 	if t == nil {
@@ -264,9 +342,26 @@ func (c *Collection) GetMany(dids []int64, slicePtr interface{}, t *txn.Txn) (er
 		origT.ReferredCollections(ci.ID)
 	}
 
+	if ci.IDType != model.IDTypeAuto {
+		err = ErrAutoIDRequired
+		return
+	}
+	encDids := make([][]byte, len(dids))
+	for i, did := range dids {
+		encDids[i] = encodeDid(did)
+	}
+	err = getMany(t, ci.ID, encDids, slicePtr)
+	return
+}
+
+// getMany appends the documents of dids to slicePtr
+func getMany(t *txn.Txn, cid int64, dids [][]byte, slicePtr interface{}) (err error) {
+	et := reflect.TypeOf(slicePtr).Elem().Elem()
+	slice := reflect.Indirect(reflect.ValueOf(slicePtr))
+
 	var v []byte
 	for _, did := range dids {
-		docKey := EncodeCollectionDocumentKey(nil, ci.ID, did)
+		docKey := EncodeCollectionDocumentKey(nil, cid, did)
 		v, _, err = t.Get(docKey)
 		if err == kv.ErrKeyNotFound {
 			err = ErrDocNotFound
@@ -289,7 +384,7 @@ func (c *Collection) GetMany(dids []int64, slicePtr interface{}, t *txn.Txn) (er
 	return
 }
 
-// GetDidRange return doc id range
+// GetDidRange return doc id range, it's only supported for auto ids
 func (c *Collection) GetDidRange(t *txn.Txn) (min, max int64, err error) {
 
 	origT := t
@@ -309,9 +404,18 @@ func (c *Collection) GetDidRange(t *txn.Txn) (min, max int64, err error) {
 		origT.ReferredCollections(ci.ID)
 	}
 
+	if ci.IDType != model.IDTypeAuto {
+		err = ErrAutoIDRequired
+		return
+	}
+
+	var did []byte
 	collectionDocumentPrefix := AppendCollectionDocumentPrefix(nil, ci.ID)
 	scanErr := t.Scan(mondis.ProviderScanOption{Offset: collectionDocumentPrefix}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
-		_, min, err = DecodeCollectionDocumentKey(key)
+		_, did, err = DecodeCollectionDocumentKey(key)
+		if err == nil {
+			min, err = decodeDid(did)
+		}
 		return false
 	})
 	if err != nil {
@@ -322,7 +426,10 @@ func (c *Collection) GetDidRange(t *txn.Txn) (min, max int64, err error) {
 		return
 	}
 	scanErr = t.Scan(mondis.ProviderScanOption{Reverse: true, Offset: collectionDocumentPrefix.PrefixNext()}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
-		_, max, err = DecodeCollectionDocumentKey(key)
+		_, did, err = DecodeCollectionDocumentKey(key)
+		if err == nil {
+			max, err = decodeDid(did)
+		}
 		return false
 	})
 	if err != nil {
@@ -336,48 +443,14 @@ func (c *Collection) GetDidRange(t *txn.Txn) (min, max int64, err error) {
 	return
 }
 
-// GetAll returns all docs
+// GetAll returns all docs, read in batches by Scan when t is nil
 func (c *Collection) GetAll(slicePtr interface{}, t *txn.Txn) (err error) {
-	et := reflect.TypeOf(slicePtr).Elem().Elem()
-	slice := reflect.Indirect(reflect.ValueOf(slicePtr))
-
-	origT := t
-
-	if t == nil {
-		t = c.Txn(false)
-		defer t.Discard()
-	}
-
-	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
-	if ci == nil {
-		err = ErrCollectionNotExists
-		return
-	}
-
-	if origT != nil {
-		origT.ReferredCollections(ci.ID)
-	}
-
-	collectionDocumentPrefix := AppendCollectionDocumentPrefix(nil, ci.ID)
-	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: collectionDocumentPrefix}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
-		item := reflect.New(et)
-		ptr := item.Interface()
-		err = bson.Unmarshal(value, ptr)
-		if err != nil {
-			return false
-		}
-
-		slice.Set(reflect.Append(slice, reflect.Indirect(item)))
-		return true
-	})
+	cursor, err := c.Scan(nil, t)
 	if err != nil {
 		return
 	}
-	if scanErr != nil {
-		err = scanErr
-		return
-	}
 
+	err = cursor.All(slicePtr)
 	return
 }
 
@@ -435,9 +508,14 @@ func (c *Collection) deleteAllWithTxn(t *txn.Txn, mark bool) (n int, err error)
 		t.ReferredCollections(ci.ID)
 	}
 
+	var did []byte
 	collectionDocumentPrefix := AppendCollectionDocumentPrefix(nil, ci.ID)
 	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: collectionDocumentPrefix}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
-		err = t.Delete(append([]byte(nil), key...))
+		_, did, err = DecodeCollectionDocumentKey(key)
+		if err != nil {
+			return false
+		}
+		err = deleteDoc(t, ci, did, value)
 		if err != nil {
 			return false
 		}
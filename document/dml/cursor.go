@@ -0,0 +1,150 @@
+package dml
+
+import (
+	"errors"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrCursorClosed used by Cursor
+	ErrCursorClosed = errors.New("cursor closed")
+)
+
+// Cursor iterates over documents, typical usage:
+//
+//	for cursor.Next() {
+//		err = cursor.Decode(&v)
+//	}
+//	err = cursor.Err()
+//	cursor.Close()
+type Cursor struct {
+	// Current is the document Next moved to
+	Current bson.Raw
+	// Did is the id of Current, 0 for collections with typed ids whose _id is in Current
+	Did int64
+	// Score is the relevance of Current for $text queries
+	Score float64
+
+	// did of Current and the id type it's encoded by
+	did     []byte
+	idType  model.IDType
+	batch   []cursorDoc
+	pos     int
+	fetch   func() ([]cursorDoc, error)
+	done    bool
+	err     error
+	skip    int
+	limit   int
+	n       int
+	proj    *projection
+	closed  bool
+	onClose func()
+
+	// for Explain
+	plan     *queryPlan
+	rejected []*queryPlan
+	stats    *execStats
+}
+
+type cursorDoc struct {
+	did   []byte
+	doc   bson.Raw
+	score float64
+}
+
+// newCursor creates a Cursor, fetch returns the next batch of documents, an empty batch means the end.
+func newCursor(fetch func() ([]cursorDoc, error), skip, limit int, proj *projection, onClose func()) *Cursor {
+	return &Cursor{fetch: fetch, skip: skip, limit: limit, proj: proj, onClose: onClose}
+}
+
+// Next moves to the next document, returns false when exhausted or an error happened
+func (c *Cursor) Next() bool {
+	if c.closed {
+		c.err = ErrCursorClosed
+		return false
+	}
+
+	for {
+		if c.limit > 0 && c.n >= c.limit {
+			return false
+		}
+
+		if c.pos < len(c.batch) {
+			cd := c.batch[c.pos]
+			c.pos++
+			if c.skip > 0 {
+				c.skip--
+				continue
+			}
+
+			c.n++
+			c.did = cd.did
+			c.Did = publicDid(c.idType, cd.did)
+			c.Score = cd.score
+			c.Current = cd.doc
+			if c.proj != nil {
+				c.Current, c.err = c.proj.apply(cd.doc)
+				if c.err != nil {
+					return false
+				}
+			}
+			return true
+		}
+
+		if c.done || c.err != nil {
+			return false
+		}
+
+		c.batch, c.err = c.fetch()
+		c.pos = 0
+		if c.err != nil {
+			return false
+		}
+		if len(c.batch) == 0 {
+			c.done = true
+			return false
+		}
+	}
+}
+
+// Decode the current document into v
+func (c *Cursor) Decode(v interface{}) error {
+	return bson.Unmarshal(c.Current, v)
+}
+
+// Err returns the error happened during iteration
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases resources held by Cursor, it's safe to call it multiple times
+func (c *Cursor) Close() {
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	c.batch = nil
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// All decodes all remaining documents into slicePtr and closes the cursor
+func (c *Cursor) All(slicePtr interface{}) (err error) {
+	defer c.Close()
+
+	var docs []bson.Raw
+	for c.Next() {
+		docs = append(docs, c.Current)
+	}
+	err = c.Err()
+	if err != nil {
+		return
+	}
+
+	err = unmarshalDocs(docs, slicePtr)
+	return
+}
@@ -0,0 +1,229 @@
+package dml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const (
+	idField = "_id"
+)
+
+var (
+	// ErrInvalidID when _id doesn't match the id type of collection or the id the document is written by
+	ErrInvalidID = errors.New("_id does not match the id type of collection")
+	// ErrIDRequired when _id is missing for string or bytes id type
+	ErrIDRequired = errors.New("_id is required by the id type of collection")
+	// ErrIDImmutable when an update changes _id
+	ErrIDImmutable = errors.New("_id can not be changed")
+	// ErrAutoIDRequired when an API addressing documents by int64 did is used on a collection with typed ids
+	ErrAutoIDRequired = errors.New("only supported by collections with auto id")
+)
+
+// The document key ends with the did, which is the memcomparable int64 for auto ids,
+// or the memcomparable _id encoded by dbson.Encode for typed ids.
+
+// encodeDid returns the did of auto id collections
+func encodeDid(did int64) []byte {
+	return memcomparable.EncodeInt64(nil, did)
+}
+
+// decodeDid is reverse of encodeDid
+func decodeDid(b []byte) (did int64, err error) {
+	_, did, err = memcomparable.DecodeInt64(b)
+	return
+}
+
+// publicDid returns the int64 did returned by APIs, which is 0 for typed ids and documents without did
+func publicDid(idType model.IDType, did []byte) (n int64) {
+	if idType == model.IDTypeAuto && did != nil {
+		n, _ = decodeDid(did)
+	}
+	return
+}
+
+// idBSONType returns the bson type of _id for typed ids
+func idBSONType(idType model.IDType) bsontype.Type {
+	switch idType {
+	case model.IDTypeObjectID:
+		return bsontype.ObjectID
+	case model.IDTypeString:
+		return bsontype.String
+	case model.IDTypeBytes:
+		return bsontype.Binary
+	default:
+		return bsontype.Int64
+	}
+}
+
+// encodeID returns the did of the document whose _id is id, ErrInvalidID if it doesn't match the id type of ci
+func encodeID(ci *model.CollectionInfo, id bson.RawValue) (did []byte, err error) {
+	if ci.IDType == model.IDTypeAuto {
+		n, ok := intOf(id)
+		if !ok {
+			err = ErrInvalidID
+			return
+		}
+		did = encodeDid(n)
+		return
+	}
+
+	if id.Type != idBSONType(ci.IDType) {
+		err = ErrInvalidID
+		return
+	}
+	did, err = dbson.Encode(nil, id)
+	return
+}
+
+// marshalID is like encodeID but for _id passed to APIs
+func marshalID(ci *model.CollectionInfo, id interface{}) (did []byte, err error) {
+	tp, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return
+	}
+	did, err = encodeID(ci, bson.RawValue{Type: tp, Value: data})
+	return
+}
+
+// decodeID is reverse of encodeID
+func decodeID(ci *model.CollectionInfo, did []byte) (id bson.RawValue, err error) {
+	if ci.IDType == model.IDTypeAuto {
+		var n int64
+		n, err = decodeDid(did)
+		if err == nil {
+			id = bson.RawValue{Type: bsontype.Int64, Value: bsoncore.AppendInt64(nil, n)}
+		}
+		return
+	}
+
+	_, id, err = dbson.Decode(did, idBSONType(ci.IDType))
+	return
+}
+
+// idOf returns _id of document did as it's passed to APIs
+func idOf(ci *model.CollectionInfo, did []byte) (id interface{}, err error) {
+	v, err := decodeID(ci, did)
+	if err != nil {
+		return
+	}
+
+	switch v.Type {
+	case bsontype.ObjectID:
+		id = v.ObjectID()
+	case bsontype.String:
+		id = v.StringValue()
+	case bsontype.Binary:
+		_, id = v.Binary()
+	default:
+		id = v.Int64()
+	}
+	return
+}
+
+// splitDid returns the did at the start of b and the remaining bytes
+func splitDid(ci *model.CollectionInfo, b []byte) (did, rest []byte, err error) {
+	if ci.IDType == model.IDTypeAuto {
+		if len(b) < 8 {
+			err = fmt.Errorf("invalid did - %q", b)
+			return
+		}
+		did, rest = b[:8], b[8:]
+		return
+	}
+
+	rest, _, err = dbson.Decode(b, idBSONType(ci.IDType))
+	if err != nil {
+		return
+	}
+	did = b[:len(b)-len(rest)]
+	return
+}
+
+// prepareDocID returns newDoc with _id consistent with the id type of ci and did,
+// _id of oldDoc is kept when newDoc has none, and an ObjectID is generated when needed.
+// Only a newly supplied _id is checked for auto ids, an existing one is kept whatever its type.
+// did is nil when a document with typed id is inserted, otherwise _id is filled from did for typed ids.
+// It's idempotent so that callers needing the final document can call it before writeDoc.
+func prepareDocID(ci *model.CollectionInfo, did []byte, oldDoc, newDoc bson.Raw) (doc bson.Raw, err error) {
+	doc = newDoc
+	id, lookupErr := doc.LookupErr(idField)
+	hasID := lookupErr == nil
+
+	if oldDoc != nil {
+		oldID, lookupErr := oldDoc.LookupErr(idField)
+		if lookupErr == nil {
+			if !hasID {
+				id, hasID = oldID, true
+				doc = withID(doc, id)
+			} else if id.Type != oldID.Type || !bytes.Equal(id.Value, oldID.Value) {
+				err = ErrIDImmutable
+				return
+			}
+			// auto collections may hold any _id written before id types, it's kept as is
+			if ci.IDType == model.IDTypeAuto {
+				return
+			}
+		}
+	}
+
+	if !hasID {
+		switch {
+		case ci.IDType == model.IDTypeAuto:
+		case did != nil:
+			id, err = decodeID(ci, did)
+			if err == nil {
+				doc = withID(doc, id)
+			}
+		case ci.IDType == model.IDTypeObjectID:
+			doc = withID(doc, bson.RawValue{Type: bsontype.ObjectID, Value: bsoncore.AppendObjectID(nil, primitive.NewObjectID())})
+		default:
+			err = ErrIDRequired
+		}
+		return
+	}
+
+	expected, err := encodeID(ci, id)
+	if err != nil {
+		return
+	}
+	if did != nil && !bytes.Equal(expected, did) {
+		err = ErrInvalidID
+	}
+	return
+}
+
+// withID returns doc with id prepended as _id
+func withID(doc bson.Raw, id bson.RawValue) bson.Raw {
+	elem := bsoncore.AppendValueElement(nil, idField, bsoncore.Value{Type: id.Type, Data: id.Value})
+	return bsoncore.BuildDocument(nil, append(elem, doc[4:len(doc)-1]...))
+}
+
+// prepareInsertID prepares _id of data inserted into a collection with typed ids,
+// did is the encoded _id, *DuplicateKeyError is returned if it's taken.
+func prepareInsertID(t *txn.Txn, ci *model.CollectionInfo, data bson.Raw) (did []byte, doc bson.Raw, err error) {
+	doc, err = prepareDocID(ci, nil, nil, data)
+	if err != nil {
+		return
+	}
+	did, err = encodeID(ci, doc.Lookup(idField))
+	if err != nil {
+		return
+	}
+
+	exists, err := t.Exists(EncodeCollectionDocumentKey(nil, ci.ID, did))
+	if err == nil && exists {
+		err = newDuplicateKeyError(ci, idField, did)
+	}
+	return
+}
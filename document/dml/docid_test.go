@@ -0,0 +1,113 @@
+package dml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestPrepareDocID(t *testing.T) {
+	prepare := func(idType model.IDType, did []byte, oldDoc, newDoc interface{}) (bson.Raw, error) {
+		var old bson.Raw
+		if oldDoc != nil {
+			old = mustMarshal(t, oldDoc)
+		}
+		return prepareDocID(&model.CollectionInfo{IDType: idType}, did, old, mustMarshal(t, newDoc))
+	}
+
+	// auto accepts no _id or the did
+	_, err := prepare(model.IDTypeAuto, encodeDid(1), nil, bson.M{"a": 1})
+	assert.Assert(t, err == nil)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), nil, bson.M{"_id": int64(1)})
+	assert.Assert(t, err == nil)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), nil, bson.M{"_id": int64(2)})
+	assert.Assert(t, err == ErrInvalidID)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), nil, bson.M{"_id": "1"})
+	assert.Assert(t, err == ErrInvalidID)
+
+	// auto keeps an existing _id of any type, e.g. imported before id types
+	oid := primitive.NewObjectID()
+	doc, err := prepare(model.IDTypeAuto, encodeDid(1), bson.M{"_id": oid, "a": 1}, bson.M{"a": 2})
+	assert.Assert(t, err == nil && doc.Lookup("_id").ObjectID() == oid && doc.Lookup("a").Int32() == 2)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), bson.M{"_id": "x"}, bson.M{"_id": "x", "a": 2})
+	assert.Assert(t, err == nil)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), bson.M{"_id": "x"}, bson.M{"_id": "y"})
+	assert.Assert(t, err == ErrIDImmutable)
+	_, err = prepare(model.IDTypeAuto, encodeDid(1), bson.M{"a": 1}, bson.M{"_id": "x"})
+	assert.Assert(t, err == ErrInvalidID)
+
+	// ObjectID is generated as the first field on insert and kept by replacements
+	doc, err = prepare(model.IDTypeObjectID, nil, nil, bson.D{{Key: "a", Value: 1}})
+	assert.Assert(t, err == nil)
+	elements, err := doc.Elements()
+	assert.Assert(t, err == nil && len(elements) == 2 && elements[0].Key() == "_id" && elements[0].Value().Type == bsontype.ObjectID)
+	id := elements[0].Value().ObjectID()
+	again, err := prepareDocID(&model.CollectionInfo{IDType: model.IDTypeObjectID}, nil, nil, doc)
+	assert.Assert(t, err == nil && string(again) == string(doc))
+	did, err := marshalID(&model.CollectionInfo{IDType: model.IDTypeObjectID}, id)
+	assert.Assert(t, err == nil)
+	doc, err = prepare(model.IDTypeObjectID, did, doc, bson.M{"a": 2})
+	assert.Assert(t, err == nil && doc.Lookup("_id").ObjectID() == id && doc.Lookup("a").Int32() == 2)
+	_, err = prepare(model.IDTypeObjectID, did, doc, bson.M{"_id": primitive.NewObjectID()})
+	assert.Assert(t, err == ErrIDImmutable)
+	_, err = prepare(model.IDTypeObjectID, nil, nil, bson.M{"_id": 1})
+	assert.Assert(t, err == ErrInvalidID)
+
+	// string and bytes must be supplied on insert, and match the did written by
+	_, err = prepare(model.IDTypeString, nil, nil, bson.M{"_id": "a"})
+	assert.Assert(t, err == nil)
+	_, err = prepare(model.IDTypeString, nil, nil, bson.M{"a": 1})
+	assert.Assert(t, err == ErrIDRequired)
+	did, err = marshalID(&model.CollectionInfo{IDType: model.IDTypeString}, "a")
+	assert.Assert(t, err == nil)
+	doc, err = prepare(model.IDTypeString, did, nil, bson.M{"a": 1})
+	assert.Assert(t, err == nil && doc.Lookup("_id").StringValue() == "a")
+	_, err = prepare(model.IDTypeString, did, nil, bson.M{"_id": "b"})
+	assert.Assert(t, err == ErrInvalidID)
+	_, err = prepare(model.IDTypeBytes, nil, nil, bson.M{"_id": []byte("a")})
+	assert.Assert(t, err == nil)
+	_, err = prepare(model.IDTypeBytes, nil, nil, bson.M{"_id": "a"})
+	assert.Assert(t, err == ErrInvalidID)
+}
+
+func TestEncodeID(t *testing.T) {
+	oid := primitive.NewObjectID()
+	cases := []struct {
+		idType model.IDType
+		ids    []interface{}
+	}{
+		{model.IDTypeAuto, []interface{}{int64(1), int64(2), int64(300)}},
+		{model.IDTypeObjectID, []interface{}{oid, primitive.NewObjectIDFromTimestamp(oid.Timestamp().Add(1e9))}},
+		{model.IDTypeString, []interface{}{"", "a", "ab", "b"}},
+		// binary sorts by length first, like mongo
+		{model.IDTypeBytes, []interface{}{[]byte{0}, []byte{1}, []byte{0, 1}}},
+	}
+	for _, c := range cases {
+		ci := &model.CollectionInfo{IDType: c.idType}
+		var last []byte
+		for _, id := range c.ids {
+			did, err := marshalID(ci, id)
+			assert.Assert(t, err == nil)
+			// dids are ordered like the ids
+			assert.Assert(t, last == nil || bytes.Compare(last, did) < 0)
+			last = did
+
+			decoded, err := idOf(ci, did)
+			assert.Assert(t, err == nil)
+			assert.DeepEqual(t, decoded, id)
+
+			split, rest, err := splitDid(ci, append(append([]byte(nil), did...), 7))
+			assert.Assert(t, err == nil && bytes.Equal(split, did) && bytes.Equal(rest, []byte{7}))
+		}
+	}
+
+	_, err := marshalID(&model.CollectionInfo{IDType: model.IDTypeString}, 1)
+	assert.Assert(t, err == ErrInvalidID)
+	_, err = marshalID(&model.CollectionInfo{IDType: model.IDTypeAuto}, "1")
+	assert.Assert(t, err == ErrInvalidID)
+}
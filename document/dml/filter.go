@@ -0,0 +1,395 @@
+package dml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// operators supported by filter
+const (
+	opAnd    = "$and"
+	opOr     = "$or"
+	opEq     = "$eq"
+	opNe     = "$ne"
+	opGt     = "$gt"
+	opGte    = "$gte"
+	opLt     = "$lt"
+	opLte    = "$lte"
+	opIn     = "$in"
+	opNin    = "$nin"
+	opExists = "$exists"
+	opText   = "$text"
+
+	opNear        = "$near"
+	opMaxDistance = "$maxDistance"
+	opGeoWithin   = "$geoWithin"
+)
+
+// filter is the parsed form of a mongo style filter document,
+// it's either a logical node($and/$or) with children,
+// or a condition on a (possibly dotted) path.
+type filter struct {
+	op       string
+	children []*filter
+	path     string
+	value    bson.RawValue
+	values   []bson.RawValue
+	exists   bool
+	text     *textSearch
+	geo      *geoQuery
+}
+
+// parseFilter parses a filter document like bson.M or bson.D,
+// nil matches all documents.
+func parseFilter(f interface{}) (*filter, error) {
+	if f == nil {
+		return &filter{op: opAnd}, nil
+	}
+
+	doc, err := toRaw(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFilterDoc(doc)
+}
+
+// toRaw marshals a document, bson.Raw is returned as is
+func toRaw(doc interface{}) (bson.Raw, error) {
+	switch d := doc.(type) {
+	case bson.Raw:
+		return d, nil
+	case []byte:
+		return bson.Raw(d), nil
+	}
+
+	return bson.Marshal(doc)
+}
+
+func parseFilterDoc(doc bson.Raw) (f *filter, err error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	f = &filter{op: opAnd}
+	var child *filter
+	for _, e := range elements {
+		key := e.Key()
+		switch {
+		case key == opAnd || key == opOr:
+			child, err = parseLogical(key, e.Value())
+		case key == opText:
+			child, err = parseText(e.Value())
+		case strings.HasPrefix(key, "$"):
+			err = fmt.Errorf("unknown top level operator %s", key)
+		default:
+			err = parseField(f, key, e.Value())
+		}
+		if err != nil {
+			return
+		}
+		if child != nil {
+			f.children = append(f.children, child)
+			child = nil
+		}
+	}
+
+	if len(f.children) == 1 {
+		f = f.children[0]
+	}
+	return
+}
+
+func parseLogical(op string, v bson.RawValue) (f *filter, err error) {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		err = fmt.Errorf("%s must be an array", op)
+		return
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return
+	}
+	if len(values) == 0 {
+		err = fmt.Errorf("%s must be a nonempty array", op)
+		return
+	}
+
+	f = &filter{op: op}
+	var child *filter
+	for _, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			err = fmt.Errorf("%s entries must be documents", op)
+			return
+		}
+		child, err = parseFilterDoc(doc)
+		if err != nil {
+			return
+		}
+		if child.has(opText) {
+			err = ErrTextNotTopLevel
+			return
+		}
+		if child.has(opNear) {
+			err = ErrNearNotTopLevel
+			return
+		}
+		f.children = append(f.children, child)
+	}
+	return
+}
+
+// parseField appends the conditions of path to parent
+func parseField(parent *filter, path string, v bson.RawValue) (err error) {
+	if !isOperatorDoc(v) {
+		parent.children = append(parent.children, &filter{op: opEq, path: path, value: v})
+		return
+	}
+
+	elements, err := v.Document().Elements()
+	if err != nil {
+		return
+	}
+	var near, maxDistance *filter
+	for _, e := range elements {
+		cond := &filter{op: e.Key(), path: path, value: e.Value()}
+		switch cond.op {
+		case opEq, opNe, opGt, opGte, opLt, opLte:
+		case opIn, opNin:
+			arr, ok := cond.value.ArrayOK()
+			if !ok {
+				err = fmt.Errorf("%s needs an array", cond.op)
+				return
+			}
+			cond.values, err = arr.Values()
+			if err != nil {
+				return
+			}
+		case opExists:
+			cond.exists = truthy(cond.value)
+		case opNear:
+			cond.geo, err = parseNear(cond.value)
+			if err != nil {
+				return
+			}
+			near = cond
+		case opMaxDistance:
+			// applies to $near
+			maxDistance = cond
+			continue
+		case opGeoWithin:
+			cond.geo, err = parseGeoWithin(cond.value)
+			if err != nil {
+				return
+			}
+		default:
+			err = fmt.Errorf("unknown operator %s", cond.op)
+			return
+		}
+		parent.children = append(parent.children, cond)
+	}
+
+	if maxDistance != nil {
+		if near == nil || !isArithNumber(maxDistance.value) || floatOf(maxDistance.value) < 0 {
+			err = fmt.Errorf("%s needs %s and a non negative number", opMaxDistance, opNear)
+			return
+		}
+		near.geo.radius = floatOf(maxDistance.value)
+	}
+	return
+}
+
+// isOperatorDoc returns true for values like {$gt: 1}
+func isOperatorDoc(v bson.RawValue) bool {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return false
+	}
+	elements, err := doc.Elements()
+	if err != nil || len(elements) == 0 {
+		return false
+	}
+	return strings.HasPrefix(elements[0].Key(), "$")
+}
+
+func truthy(v bson.RawValue) bool {
+	switch v.Type {
+	case bsontype.Boolean:
+		return v.Boolean()
+	case bsontype.Int32:
+		return v.Int32() != 0
+	case bsontype.Int64:
+		return v.Int64() != 0
+	case bsontype.Double:
+		return v.Double() != 0
+	case bsontype.Null, bsontype.Undefined:
+		return false
+	default:
+		return true
+	}
+}
+
+// match returns true if doc satisfies f
+func (f *filter) match(doc bson.Raw) bool {
+	switch f.op {
+	case opAnd:
+		for _, child := range f.children {
+			if !child.match(doc) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, child := range f.children {
+			if child.match(doc) {
+				return true
+			}
+		}
+		return false
+	case opText:
+		// only documents from the text index are matched against f
+		return true
+	}
+
+	values := resolvePath(doc, f.path)
+	switch f.op {
+	case opEq:
+		return matchEq(values, f.value)
+	case opNe:
+		return !matchEq(values, f.value)
+	case opIn:
+		return matchIn(values, f.values)
+	case opNin:
+		return !matchIn(values, f.values)
+	case opExists:
+		return (len(values) > 0) == f.exists
+	case opNear, opGeoWithin:
+		return matchGeo(values, f.geo)
+	default:
+		return matchRange(values, f.op, f.value)
+	}
+}
+
+// resolvePath returns all values reachable by path,
+// like mongo, arrays are traversed implicitly and numeric components index into arrays.
+func resolvePath(doc bson.Raw, path string) (values []bson.RawValue) {
+	collectPath(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}, strings.Split(path, "."), &values)
+	return
+}
+
+func collectPath(v bson.RawValue, parts []string, values *[]bson.RawValue) {
+	if len(parts) == 0 {
+		*values = append(*values, v)
+		return
+	}
+
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		child, err := v.Document().LookupErr(parts[0])
+		if err == nil {
+			collectPath(child, parts[1:], values)
+		}
+	case bsontype.Array:
+		elements, err := v.Array().Values()
+		if err != nil {
+			return
+		}
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(elements) {
+			collectPath(elements[i], parts[1:], values)
+		}
+		for _, e := range elements {
+			if e.Type == bsontype.EmbeddedDocument {
+				collectPath(e, parts, values)
+			}
+		}
+	}
+}
+
+// candidates returns values plus the elements of array values,
+// since a condition on an array field matches if any element matches.
+func candidates(values []bson.RawValue) []bson.RawValue {
+	result := values
+	for _, v := range values {
+		if v.Type != bsontype.Array {
+			continue
+		}
+		elements, err := v.Array().Values()
+		if err != nil {
+			continue
+		}
+		if len(result) == len(values) {
+			result = append([]bson.RawValue(nil), values...)
+		}
+		result = append(result, elements...)
+	}
+	return result
+}
+
+func isNull(v bson.RawValue) bool {
+	return v.Type == bsontype.Null || v.Type == bsontype.Undefined
+}
+
+func matchEq(values []bson.RawValue, target bson.RawValue) bool {
+	// null matches missing fields
+	if len(values) == 0 {
+		return isNull(target)
+	}
+	for _, v := range candidates(values) {
+		if dbson.Equal(v, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIn(values []bson.RawValue, targets []bson.RawValue) bool {
+	for _, target := range targets {
+		if matchEq(values, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRange only compares values of the same type order as mongo does,
+// e.g. {$gt: 1} never matches a string.
+func matchRange(values []bson.RawValue, op string, target bson.RawValue) bool {
+	// null equals missing fields
+	if len(values) == 0 {
+		return isNull(target) && (op == opGte || op == opLte)
+	}
+
+	order := dbson.TypeOrder(target.Type)
+	for _, v := range candidates(values) {
+		if dbson.TypeOrder(v.Type) != order {
+			continue
+		}
+		c := dbson.Compare(v, target)
+		switch op {
+		case opGt:
+			if c > 0 {
+				return true
+			}
+		case opGte:
+			if c >= 0 {
+				return true
+			}
+		case opLt:
+			if c < 0 {
+				return true
+			}
+		case opLte:
+			if c <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
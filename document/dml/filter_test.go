@@ -0,0 +1,138 @@
+package dml
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestFilterMatch(t *testing.T) {
+	doc, err := bson.Marshal(bson.M{
+		"a":    int32(1),
+		"b":    "x",
+		"n":    nil,
+		"tags": bson.A{"red", "blue"},
+		"sub":  bson.D{{Key: "c", Value: 2.5}, {Key: "d", Value: bson.A{bson.M{"e": 1}, bson.M{"e": 2}}}},
+	})
+	assert.Assert(t, err == nil)
+
+	cases := []struct {
+		filter interface{}
+		match  bool
+	}{
+		{nil, true},
+		{bson.M{}, true},
+		{bson.M{"a": 1}, true},
+		{bson.M{"a": 1.0}, true},
+		{bson.M{"a": int64(2)}, false},
+		{bson.M{"a": bson.M{"$eq": 1}}, true},
+		{bson.M{"a": bson.M{"$ne": 1}}, false},
+		{bson.M{"a": bson.M{"$gt": 0, "$lt": 2}}, true},
+		{bson.M{"a": bson.M{"$gte": 1, "$lte": 1}}, true},
+		{bson.M{"a": bson.M{"$gt": 1}}, false},
+		// range operators only compare the same type order
+		{bson.M{"a": bson.M{"$lt": "z"}}, false},
+		{bson.M{"b": bson.M{"$lt": "z"}}, true},
+		{bson.M{"a": bson.M{"$in": bson.A{3, 1}}}, true},
+		{bson.M{"a": bson.M{"$nin": bson.A{3, 1}}}, false},
+		{bson.M{"tags": "red"}, true},
+		{bson.M{"tags": bson.A{"red", "blue"}}, true},
+		{bson.M{"tags": bson.M{"$in": bson.A{"green", "blue"}}}, true},
+		{bson.M{"tags": bson.M{"$ne": "red"}}, false},
+		{bson.M{"tags.1": "blue"}, true},
+		{bson.M{"sub.c": bson.M{"$gt": 2}}, true},
+		{bson.M{"sub.d.e": 2}, true},
+		{bson.M{"sub.d.e": 3}, false},
+		{bson.M{"sub.x": nil}, true},
+		{bson.M{"n": nil}, true},
+		{bson.M{"n": bson.M{"$exists": true}}, true},
+		{bson.M{"missing": bson.M{"$exists": false}}, true},
+		{bson.M{"sub.c": bson.M{"$exists": 1}}, true},
+		{bson.M{"missing": bson.M{"$ne": 1}}, true},
+		{bson.M{"$or": bson.A{bson.M{"a": 2}, bson.M{"b": "x"}}}, true},
+		{bson.M{"$or": bson.A{bson.M{"a": 2}, bson.M{"b": "y"}}}, false},
+		{bson.M{"$and": bson.A{bson.M{"a": 1}, bson.M{"b": "x"}}, "tags": "red"}, true},
+		{bson.M{"$and": bson.A{bson.M{"a": 1}, bson.M{"b": "y"}}}, false},
+		// embedded documents are compared in field order
+		{bson.M{"sub": bson.D{{Key: "c", Value: 2.5}, {Key: "d", Value: bson.A{bson.M{"e": 1}, bson.M{"e": 2}}}}}, true},
+		{bson.M{"sub": bson.D{{Key: "d", Value: bson.A{bson.M{"e": 1}, bson.M{"e": 2}}}, {Key: "c", Value: 2.5}}}, false},
+	}
+
+	for _, c := range cases {
+		f, err := parseFilter(c.filter)
+		assert.Assert(t, err == nil, "%v", c.filter)
+		assert.Equal(t, f.match(doc), c.match, "%v", c.filter)
+	}
+
+	for _, invalid := range []interface{}{
+		bson.M{"$nor": bson.A{}},
+		bson.M{"$or": bson.A{}},
+		bson.M{"$and": bson.M{"a": 1}},
+		bson.M{"a": bson.M{"$in": 1}},
+		bson.M{"a": bson.M{"$regex": "x"}},
+	} {
+		_, err = parseFilter(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+}
+
+func TestProjectionAndSort(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{Key: "a", Value: 1},
+		{Key: "b", Value: bson.D{{Key: "c", Value: 2}, {Key: "d", Value: 3}}},
+		{Key: "e", Value: bson.A{bson.D{{Key: "c", Value: 4}, {Key: "d", Value: 5}}}},
+	})
+	assert.Assert(t, err == nil)
+
+	project := func(p interface{}) bson.M {
+		proj, err := parseProjection(p)
+		assert.Assert(t, err == nil)
+		projected, err := proj.apply(doc)
+		assert.Assert(t, err == nil)
+		var m bson.M
+		assert.Assert(t, bson.Unmarshal(projected, &m) == nil)
+		return m
+	}
+
+	assert.DeepEqual(t, project(bson.M{"a": 1, "b.c": 1}), bson.M{"a": int32(1), "b": bson.M{"c": int32(2)}})
+	assert.DeepEqual(t, project(bson.M{"b": 0, "e.d": 0}), bson.M{"a": int32(1), "e": bson.A{bson.M{"c": int32(4)}}})
+	_, err = parseProjection(bson.M{"a": 1, "b": 0})
+	assert.Assert(t, err == ErrMixedProjection)
+
+	// _id is included by default and can be excluded along with inclusion
+	doc, err = bson.Marshal(bson.D{{Key: "_id", Value: "x"}, {Key: "a", Value: 1}, {Key: "b", Value: 2}})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, project(bson.M{"a": 1}), bson.M{"_id": "x", "a": int32(1)})
+	assert.DeepEqual(t, project(bson.M{"a": 1, "_id": 0}), bson.M{"a": int32(1)})
+	assert.DeepEqual(t, project(bson.M{"_id": 1}), bson.M{"_id": "x"})
+	assert.DeepEqual(t, project(bson.M{"_id": 0}), bson.M{"a": int32(1), "b": int32(2)})
+	assert.DeepEqual(t, project(bson.M{"b": 0, "_id": 1}), bson.M{"_id": "x", "a": int32(1)})
+
+	var docs []cursorDoc
+	for i, v := range []interface{}{int32(2), "s", nil, bson.A{int32(0), int32(5)}, int32(3)} {
+		doc, err := bson.Marshal(bson.M{"v": v})
+		assert.Assert(t, err == nil)
+		docs = append(docs, cursorDoc{did: encodeDid(int64(i)), doc: doc})
+	}
+	dids := func() (result []int64) {
+		for _, d := range docs {
+			did, err := decodeDid(d.did)
+			assert.Assert(t, err == nil)
+			result = append(result, did)
+		}
+		return
+	}
+
+	keys, err := parseSort(bson.D{{Key: "v", Value: 1}})
+	assert.Assert(t, err == nil)
+	sortDocs(docs, keys)
+	// null < 0(min of array) < 2 < 3 < "s"
+	assert.DeepEqual(t, dids(), []int64{2, 3, 0, 4, 1})
+
+	keys, err = parseSort(bson.D{{Key: "v", Value: -1}})
+	assert.Assert(t, err == nil)
+	sortDocs(docs, keys)
+	// "s" > 5(max of array) > 3 > 2 > null
+	assert.DeepEqual(t, dids(), []int64{1, 3, 4, 0, 2})
+}
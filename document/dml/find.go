@@ -0,0 +1,449 @@
+package dml
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/zhiqiangxu/mondis"
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/config"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const (
+	findBatchSize = 100
+)
+
+var (
+	// ErrMixedProjection used by Find
+	ErrMixedProjection = errors.New("projection can not mix inclusion and exclusion")
+)
+
+// FindOptions for Find
+type FindOptions struct {
+	// Projection like bson.M{"a": 1, "b.c": 1} or bson.M{"a": 0},
+	// _id is included unless excluded by bson.M{"_id": 0}
+	Projection interface{}
+	// Sort like bson.D{{"a", 1}, {"b", -1}}, use an ordered type for multiple keys,
+	// sorts not served by an index spill to the kv beyond config.AggregateMemoryLimit like $sort
+	Sort interface{}
+	Skip int
+	// Limit is the max number of documents returned, 0 means no limit
+	Limit int
+}
+
+// Find documents matching filter, the returned cursor must be closed after use.
+func (c *Collection) Find(filter interface{}, opts *FindOptions, t *txn.Txn) (cursor *Cursor, err error) {
+	if opts == nil {
+		opts = &FindOptions{}
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return
+	}
+	proj, err := parseProjection(opts.Projection)
+	if err != nil {
+		return
+	}
+	sortKeys, err := parseSort(opts.Sort)
+	if err != nil {
+		return
+	}
+
+	origT := t
+
+	a := &aggregation{kvdb: c.kvdb, memoryLimit: config.Load().AggregateMemoryLimit}
+	var discard func()
+	if t == nil {
+		t = c.Txn(false)
+		discard = t.Discard
+	}
+	onClose := func() {
+		a.close()
+		if discard != nil {
+			discard()
+		}
+	}
+	defer func() {
+		if err != nil {
+			onClose()
+		}
+	}()
+
+	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	if origT != nil {
+		origT.ReferredCollections(ci.ID)
+	}
+
+	plan, rejected, err := planQuery(t, ci, f, proj, sortKeys, opts)
+	if err != nil {
+		return
+	}
+	stats := &execStats{}
+	fetch := plan.fetch(t, ci, f, stats)
+	if len(sortKeys) > 0 && !plan.sortFromIndex {
+		s := &sortStage{keys: sortKeys}
+		if opts.Limit > 0 {
+			s.limit = opts.Skip + opts.Limit
+		}
+		fetch = s.apply(a, fetch)
+	}
+
+	cursor = newCursor(fetch, opts.Skip, opts.Limit, proj, onClose)
+	cursor.plan, cursor.rejected, cursor.stats = plan, rejected, stats
+	cursor.idType = ci.IDType
+	return
+}
+
+// scanDocs returns a fetch function that scans the documents of collection cid in batches
+func scanDocs(t mondis.ProviderKVOP, cid int64, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	prefix := AppendCollectionDocumentPrefix(nil, cid)
+	next := kv.Key(prefix)
+	return func() (docs []cursorDoc, err error) {
+		if next == nil {
+			return
+		}
+
+		docs, next, err = scanBatch(t, prefix, next, f, findBatchSize, stats)
+		return
+	}
+}
+
+// scanBatch scans at most batchSize documents matching f from offset,
+// next is where the following batch starts, nil when there's no more.
+func scanBatch(t mondis.ProviderKVOP, prefix, offset kv.Key, f *filter, batchSize int, stats *execStats) (docs []cursorDoc, next kv.Key, err error) {
+	var (
+		did     []byte
+		lastKey kv.Key
+	)
+	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: offset}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if len(docs) >= batchSize {
+			return false
+		}
+		lastKey = append(lastKey[:0], key...)
+		stats.keysExamined++
+		stats.docsExamined++
+		if !f.match(value) {
+			return true
+		}
+		_, did, err = DecodeCollectionDocumentKey(key)
+		if err != nil {
+			return false
+		}
+		docs = append(docs, cursorDoc{did: did, doc: append([]byte(nil), value...)})
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return
+	}
+
+	if len(docs) >= batchSize {
+		next = kv.Key(lastKey).Next()
+	}
+	return
+}
+
+func fetchAll(fetch func() ([]cursorDoc, error)) (docs []cursorDoc, err error) {
+	var batch []cursorDoc
+	for {
+		batch, err = fetch()
+		if err != nil || len(batch) == 0 {
+			return
+		}
+		docs = append(docs, batch...)
+	}
+}
+
+// batchOf returns docs as a single batch
+func batchOf(docs []cursorDoc) func() ([]cursorDoc, error) {
+	return func() (batch []cursorDoc, err error) {
+		batch, docs = docs, nil
+		return
+	}
+}
+
+func unmarshalDocs(docs []bson.Raw, slicePtr interface{}) (err error) {
+	et := reflect.TypeOf(slicePtr).Elem().Elem()
+	slice := reflect.Indirect(reflect.ValueOf(slicePtr))
+
+	for _, doc := range docs {
+		item := reflect.New(et)
+		err = bson.Unmarshal(doc, item.Interface())
+		if err != nil {
+			return
+		}
+		slice.Set(reflect.Append(slice, reflect.Indirect(item)))
+	}
+	return
+}
+
+type sortKey struct {
+	path string
+	asc  bool
+}
+
+func parseSort(s interface{}) (keys []sortKey, err error) {
+	if s == nil {
+		return
+	}
+
+	doc, err := toRaw(s)
+	if err != nil {
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	for _, e := range elements {
+		v := e.Value()
+		if !v.IsNumber() || !truthy(v) {
+			err = fmt.Errorf("sort direction of %s must be 1 or -1", e.Key())
+			return
+		}
+		keys = append(keys, sortKey{path: e.Key(), asc: !isNegative(v)})
+	}
+	return
+}
+
+func isNegative(v bson.RawValue) bool {
+	switch v.Type {
+	case bsontype.Int32:
+		return v.Int32() < 0
+	case bsontype.Int64:
+		return v.Int64() < 0
+	case bsontype.Double:
+		return v.Double() < 0
+	default:
+		return false
+	}
+}
+
+// sortValue returns the value of path used for sorting,
+// like mongo, the min element of arrays is used for ascending and the max for descending.
+func sortValue(doc bson.Raw, key sortKey) (result bson.RawValue) {
+	values := resolvePath(doc, key.path)
+	var found bool
+	for _, v := range values {
+		if v.Type == bsontype.Array {
+			elements, err := v.Array().Values()
+			if err == nil && len(elements) > 0 {
+				for _, e := range elements {
+					if !found || (dbson.Compare(e, result) < 0) == key.asc {
+						result, found = e, true
+					}
+				}
+				continue
+			}
+		}
+		if !found || (dbson.Compare(v, result) < 0) == key.asc {
+			result, found = v, true
+		}
+	}
+	if !found {
+		result = bson.RawValue{Type: bsontype.Null}
+	}
+	return
+}
+
+func sortDocs(docs []cursorDoc, keys []sortKey) {
+	values := make([][]bson.RawValue, len(docs))
+	for i, d := range docs {
+		values[i] = make([]bson.RawValue, len(keys))
+		for j, key := range keys {
+			values[i][j] = sortValue(d.doc, key)
+		}
+	}
+
+	sort.Stable(&docSorter{docs: docs, values: values, keys: keys})
+}
+
+type docSorter struct {
+	docs   []cursorDoc
+	values [][]bson.RawValue
+	keys   []sortKey
+}
+
+func (s *docSorter) Len() int {
+	return len(s.docs)
+}
+
+func (s *docSorter) Less(i, j int) bool {
+	for k, key := range s.keys {
+		c := dbson.Compare(s.values[i][k], s.values[j][k])
+		if c == 0 {
+			continue
+		}
+		return (c < 0) == key.asc
+	}
+	return false
+}
+
+func (s *docSorter) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// projection is a tree of projected paths
+type projection struct {
+	include bool
+	fields  map[string]*projection
+}
+
+// parseProjection parses an inclusion or exclusion projection,
+// _id is included unless excluded explicitly, which can be mixed with inclusion.
+func parseProjection(p interface{}) (proj *projection, err error) {
+	if p == nil {
+		return
+	}
+
+	doc, err := toRaw(p)
+	if err != nil {
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+	if len(elements) == 0 {
+		return
+	}
+
+	proj = &projection{fields: make(map[string]*projection)}
+	var (
+		modeSet   bool
+		idSet     bool
+		idInclude bool
+	)
+	for _, e := range elements {
+		include := truthy(e.Value())
+		if e.Key() == idField {
+			idSet, idInclude = true, include
+			continue
+		}
+		if !modeSet {
+			proj.include, modeSet = include, true
+		} else if include != proj.include {
+			err = ErrMixedProjection
+			return
+		}
+
+		node := proj
+		for _, part := range strings.Split(e.Key(), ".") {
+			child := node.fields[part]
+			if child == nil {
+				child = &projection{include: include, fields: make(map[string]*projection)}
+				node.fields[part] = child
+			}
+			node = child
+		}
+	}
+
+	if !modeSet {
+		// _id is the only field
+		proj.include = idInclude
+	}
+	if !idSet {
+		idInclude = true
+	}
+	if idInclude == proj.include {
+		proj.fields[idField] = &projection{include: idInclude, fields: make(map[string]*projection)}
+	}
+	return
+}
+
+// apply returns the projected document
+func (p *projection) apply(doc bson.Raw) (bson.Raw, error) {
+	idx, result := bsoncore.AppendDocumentStart(nil)
+	result, err := p.appendFields(result, doc)
+	if err != nil {
+		return nil, err
+	}
+	result, err = bsoncore.AppendDocumentEnd(result, idx)
+	return bson.Raw(result), err
+}
+
+func (p *projection) appendFields(dst []byte, doc bson.Raw) ([]byte, error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range elements {
+		child, ok := p.fields[e.Key()]
+		switch {
+		case !ok:
+			if !p.include {
+				dst = append(dst, e...)
+			}
+		case len(child.fields) == 0:
+			if p.include {
+				dst = append(dst, e...)
+			}
+		default:
+			dst, err = child.appendNested(dst, e.Key(), e.Value())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dst, nil
+}
+
+// appendNested projects into embedded documents and documents inside arrays
+func (p *projection) appendNested(dst []byte, key string, v bson.RawValue) ([]byte, error) {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		idx, dst := bsoncore.AppendDocumentElementStart(dst, key)
+		dst, err := p.appendFields(dst, v.Document())
+		if err != nil {
+			return nil, err
+		}
+		return bsoncore.AppendDocumentEnd(dst, idx)
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		idx, dst := bsoncore.AppendArrayElementStart(dst, key)
+		i := 0
+		for _, value := range values {
+			if value.Type != bsontype.EmbeddedDocument {
+				if !p.include {
+					dst = bsoncore.AppendValueElement(dst, fmt.Sprint(i), bsoncore.Value{Type: value.Type, Data: value.Value})
+					i++
+				}
+				continue
+			}
+			dst, err = p.appendNested(dst, fmt.Sprint(i), value)
+			if err != nil {
+				return nil, err
+			}
+			i++
+		}
+		return bsoncore.AppendArrayEnd(dst, idx)
+	default:
+		// nothing to project into for inclusion
+		if !p.include {
+			return bsoncore.AppendValueElement(dst, key, bsoncore.Value{Type: v.Type, Data: v.Value}), nil
+		}
+		return dst, nil
+	}
+}
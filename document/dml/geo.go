@@ -0,0 +1,554 @@
+package dml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+var (
+	// ErrGeoIndexRequired when $near is used without a geo index on the path
+	ErrGeoIndexRequired = errors.New("$near requires a 2d index")
+	// ErrNearNotTopLevel when $near is nested in $and or $or
+	ErrNearNotTopLevel = errors.New("$near must be at the top level of filter")
+	// ErrInvalidGeoPoint when an indexed point is malformed or out of bounds
+	ErrInvalidGeoPoint = errors.New("invalid geo point")
+	// ErrGeoIndexLookup when Lookup is called on a 2d index
+	ErrGeoIndexLookup = errors.New("2d index can only be used by $near and $geoWithin")
+)
+
+// bounds of 2d index, points are [lng, lat] or {lng: x, lat: y}
+const (
+	geoMinX = -180.0
+	geoMaxX = 180.0
+	geoMinY = -90.0
+	geoMaxY = 90.0
+)
+
+const (
+	// geoMaxCells bounds the number of cells covering a region
+	geoMaxCells = 64
+	// geoBits is the precision of each dimension
+	geoBits = 32
+)
+
+// shapes of geoQuery
+const (
+	geoNear = iota
+	geoBox
+	geoCenter
+)
+
+type geoPoint struct {
+	x, y float64
+}
+
+// geoQuery is the parsed form of $near and $geoWithin,
+// distances are planar in the unit of coordinates like mongo 2d index.
+type geoQuery struct {
+	shape int
+	// min and max of $box
+	min, max geoPoint
+	// center and radius of $center or $near, radius < 0 means unbounded
+	center geoPoint
+	radius float64
+}
+
+// parsePoint accepts [x, y] or a document whose first two fields are x and y
+func parsePoint(v bson.RawValue) (p geoPoint, ok bool) {
+	var values []bson.RawValue
+	var err error
+	switch v.Type {
+	case bsontype.Array:
+		values, err = v.Array().Values()
+	case bsontype.EmbeddedDocument:
+		values, err = v.Document().Values()
+	default:
+		return
+	}
+	if err != nil || len(values) < 2 || !isArithNumber(values[0]) || !isArithNumber(values[1]) {
+		return
+	}
+	p = geoPoint{x: floatOf(values[0]), y: floatOf(values[1])}
+	ok = !math.IsNaN(p.x) && !math.IsNaN(p.y)
+	return
+}
+
+func (p geoPoint) inBounds() bool {
+	return p.x >= geoMinX && p.x <= geoMaxX && p.y >= geoMinY && p.y <= geoMaxY
+}
+
+func (p geoPoint) distance(o geoPoint) float64 {
+	return math.Hypot(p.x-o.x, p.y-o.y)
+}
+
+func parseNear(v bson.RawValue) (gq *geoQuery, err error) {
+	center, ok := parsePoint(v)
+	if !ok {
+		err = fmt.Errorf("%s needs a point", opNear)
+		return
+	}
+	gq = &geoQuery{shape: geoNear, center: center, radius: -1}
+	return
+}
+
+// parseGeoWithin parses {$box: [[x1, y1], [x2, y2]]} or {$center: [[x, y], r]}
+func parseGeoWithin(v bson.RawValue) (gq *geoQuery, err error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		err = fmt.Errorf("%s needs a document", opGeoWithin)
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+	if len(elements) != 1 {
+		err = fmt.Errorf("%s needs exactly one shape", opGeoWithin)
+		return
+	}
+
+	shape := elements[0]
+	arr, ok := shape.Value().ArrayOK()
+	var values []bson.RawValue
+	if ok {
+		values, err = arr.Values()
+		if err != nil {
+			return
+		}
+	}
+	if len(values) != 2 {
+		err = fmt.Errorf("%s needs 2 elements", shape.Key())
+		return
+	}
+
+	switch shape.Key() {
+	case "$box":
+		var a, b geoPoint
+		a, ok = parsePoint(values[0])
+		if ok {
+			b, ok = parsePoint(values[1])
+		}
+		if !ok {
+			err = fmt.Errorf("$box needs 2 points")
+			return
+		}
+		gq = &geoQuery{
+			shape: geoBox,
+			min:   geoPoint{x: math.Min(a.x, b.x), y: math.Min(a.y, b.y)},
+			max:   geoPoint{x: math.Max(a.x, b.x), y: math.Max(a.y, b.y)},
+		}
+	case "$center":
+		var center geoPoint
+		center, ok = parsePoint(values[0])
+		if !ok || !isArithNumber(values[1]) || floatOf(values[1]) < 0 {
+			err = fmt.Errorf("$center needs a point and a radius")
+			return
+		}
+		gq = &geoQuery{shape: geoCenter, center: center, radius: floatOf(values[1])}
+	default:
+		err = fmt.Errorf("unknown shape %s", shape.Key())
+	}
+	return
+}
+
+// contains returns true if p is in the region of gq
+func (gq *geoQuery) contains(p geoPoint) bool {
+	if gq.shape == geoBox {
+		return p.x >= gq.min.x && p.x <= gq.max.x && p.y >= gq.min.y && p.y <= gq.max.y
+	}
+	return gq.radius < 0 || p.distance(gq.center) <= gq.radius
+}
+
+// bound returns the bounding box of gq in the space of 2d index
+func (gq *geoQuery) bound() (min, max geoPoint) {
+	switch {
+	case gq.shape == geoBox:
+		min, max = gq.min, gq.max
+	case gq.radius < 0:
+		min, max = geoPoint{x: geoMinX, y: geoMinY}, geoPoint{x: geoMaxX, y: geoMaxY}
+	default:
+		min = geoPoint{x: gq.center.x - gq.radius, y: gq.center.y - gq.radius}
+		max = geoPoint{x: gq.center.x + gq.radius, y: gq.center.y + gq.radius}
+	}
+	return
+}
+
+// matchGeo returns true if any point of path is in the region of gq
+func matchGeo(values []bson.RawValue, gq *geoQuery) bool {
+	for _, v := range values {
+		if p, ok := parsePoint(v); ok && gq.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoCond returns the top level $near or $geoWithin of f
+func (f *filter) geoCond() *filter {
+	if f.geo != nil {
+		return f
+	}
+	if f.op == opAnd {
+		for _, child := range f.children {
+			if child.geo != nil {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// geoPlan uses the first public 2d index on the path of the geo condition
+func geoPlan(ci *model.CollectionInfo, f *filter, cond *filter) (p *queryPlan, err error) {
+	for _, name := range ci.IndexOrder {
+		iif := ci.Indices[name]
+		if iif == nil || iif.Kind != model.IndexKindGeo2d || iif.State != osc.StatePublic || iif.Columns[0] != cond.path || !impliesIndexed(f, iif) {
+			continue
+		}
+		p = &queryPlan{iif: iif, geo: cond.geo}
+		return
+	}
+	if cond.op == opNear {
+		err = ErrGeoIndexRequired
+	}
+	return
+}
+
+// quantize maps v in [min, max] to [0, 2^geoBits)
+func quantize(v, min, max float64) uint32 {
+	f := (v - min) / (max - min) * (1 << geoBits)
+	switch {
+	case f <= 0:
+		return 0
+	case f >= 1<<geoBits-1:
+		return 1<<geoBits - 1
+	default:
+		return uint32(f)
+	}
+}
+
+// spread inserts a 0 bit before each bit of v
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// zOrder interleaves the bits of quantized x and y
+func zOrder(qx, qy uint32) uint64 {
+	return spread(qx)<<1 | spread(qy)
+}
+
+func geoZ(p geoPoint) uint64 {
+	return zOrder(quantize(p.x, geoMinX, geoMaxX), quantize(p.y, geoMinY, geoMaxY))
+}
+
+// geoEntries returns the entry of doc for 2d index iif, keyed by the z-order of the point,
+// documents without the column have no entry.
+func geoEntries(ci *model.CollectionInfo, iif *model.IndexInfo, did []byte, doc bson.Raw) (entries map[string][]byte, err error) {
+	v, err := doc.LookupErr(strings.Split(iif.Columns[0], ".")...)
+	if err != nil {
+		err = nil
+		return
+	}
+	p, ok := parsePoint(v)
+	if !ok || !p.inBounds() {
+		err = ErrInvalidGeoPoint
+		return
+	}
+
+	key := AppendCollectionIndexPrefix(nil, ci.ID, iif.ID)
+	key = memcomparable.EncodeUint64(key, geoZ(p))
+	key = append(key, did...)
+	var value []byte
+	if didInValue(ci, iif) {
+		value = did
+	}
+	entries = map[string][]byte{string(key): value}
+	return
+}
+
+// geoCell is the square of z-order values sharing the leading 2*level bits of lo
+type geoCell struct {
+	level  uint
+	qx, qy uint32
+}
+
+func (c geoCell) span() uint32 {
+	if c.level == 0 {
+		return 0
+	}
+	return 1<<(geoBits-c.level) - 1
+}
+
+// lo and hi are the first and last z-order values of c
+func (c geoCell) lo() uint64 {
+	return zOrder(c.qx, c.qy)
+}
+
+func (c geoCell) hi() uint64 {
+	if c.level == 0 {
+		return math.MaxUint64
+	}
+	return c.lo() | (1<<(2*(geoBits-c.level)) - 1)
+}
+
+func (c geoCell) last() (qx, qy uint32) {
+	if c.level == 0 {
+		return math.MaxUint32, math.MaxUint32
+	}
+	return c.qx + c.span(), c.qy + c.span()
+}
+
+func (c geoCell) children() []geoCell {
+	half := uint32(1) << (geoBits - c.level - 1)
+	l := c.level + 1
+	return []geoCell{
+		{level: l, qx: c.qx, qy: c.qy},
+		{level: l, qx: c.qx, qy: c.qy + half},
+		{level: l, qx: c.qx + half, qy: c.qy},
+		{level: l, qx: c.qx + half, qy: c.qy + half},
+	}
+}
+
+// geoRanges covers the bounding box of gq with at most about geoMaxCells cells,
+// cells are refined level by level and returned as merged key ranges in key order.
+func geoRanges(cid int64, iif *model.IndexInfo, gq *geoQuery) (ranges []kv.KeyRange) {
+	min, max := gq.bound()
+	if max.x < geoMinX || min.x > geoMaxX || max.y < geoMinY || min.y > geoMaxY {
+		return
+	}
+	x1, y1 := quantize(min.x, geoMinX, geoMaxX), quantize(min.y, geoMinY, geoMaxY)
+	x2, y2 := quantize(max.x, geoMinX, geoMaxX), quantize(max.y, geoMinY, geoMaxY)
+
+	var covering []geoCell
+	partial := []geoCell{{}}
+	for len(partial) > 0 {
+		if partial[0].level == geoBits || len(covering)+4*len(partial) > geoMaxCells {
+			covering = append(covering, partial...)
+			break
+		}
+
+		var next []geoCell
+		for _, cell := range partial {
+			for _, child := range cell.children() {
+				lx, ly := child.last()
+				switch {
+				case lx < x1 || child.qx > x2 || ly < y1 || child.qy > y2:
+				case child.qx >= x1 && lx <= x2 && child.qy >= y1 && ly <= y2:
+					covering = append(covering, child)
+				default:
+					next = append(next, child)
+				}
+			}
+		}
+		partial = next
+	}
+
+	sort.Slice(covering, func(i, j int) bool {
+		return covering[i].lo() < covering[j].lo()
+	})
+	prefix := AppendCollectionIndexPrefix(nil, cid, iif.ID)
+	for i := 0; i < len(covering); {
+		lo, hi := covering[i].lo(), covering[i].hi()
+		for i++; i < len(covering) && hi != math.MaxUint64 && covering[i].lo() == hi+1; i++ {
+			hi = covering[i].hi()
+		}
+
+		r := kv.KeyRange{StartKey: memcomparable.EncodeUint64(prefix.Clone(), lo)}
+		if hi == math.MaxUint64 {
+			r.EndKey = prefix.PrefixNext()
+		} else {
+			r.EndKey = memcomparable.EncodeUint64(prefix.Clone(), hi+1)
+		}
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+// scanGeo returns a fetch function for geo plan p,
+// documents of $near are in ascending order of distance.
+func scanGeo(t mondis.ProviderKVOP, ci *model.CollectionInfo, p *queryPlan, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	if p.geo.shape == geoNear {
+		return scanNear(t, ci, p, f, stats)
+	}
+
+	var (
+		dids [][]byte
+		done bool
+	)
+	return func() (docs []cursorDoc, err error) {
+		if !done {
+			dids, err = geoCandidates(t, ci, p.iif, p.geo, stats)
+			if err != nil {
+				return
+			}
+			done = true
+		}
+
+		for len(docs) == 0 && len(dids) > 0 {
+			batch := dids
+			if len(batch) > findBatchSize {
+				batch = batch[:findBatchSize]
+			}
+			dids = dids[len(batch):]
+
+			docs, err = fetchGeoDocs(t, ci.ID, batch, f, docs, stats)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+const (
+	// geoNearStartRadius is the radius of the first ring searched by $near
+	geoNearStartRadius = (geoMaxX - geoMinX) / 1024
+)
+
+// scanNear returns a fetch function for $near, which searches rings of doubling radius around the center.
+// Documents not seen after searching radius r are farther than r, so those within r are returned in order,
+// and the following rings are only searched when more documents are needed.
+func scanNear(t mondis.ProviderKVOP, ci *model.CollectionInfo, p *queryPlan, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	center := p.geo.center
+	// the farthest corner of the index space
+	maxRadius := 0.0
+	for _, corner := range []geoPoint{{geoMinX, geoMinY}, {geoMinX, geoMaxY}, {geoMaxX, geoMinY}, {geoMaxX, geoMaxY}} {
+		maxRadius = math.Max(maxRadius, center.distance(corner))
+	}
+	if p.geo.radius >= 0 {
+		maxRadius = math.Min(maxRadius, p.geo.radius)
+	}
+
+	var (
+		radius   float64
+		finished bool
+		// keyed by did
+		seen     = make(map[string]bool)
+		pending  []cursorDoc
+		distance = make(map[string]float64)
+	)
+	path := p.iif.Columns[0]
+	return func() (docs []cursorDoc, err error) {
+		for len(docs) == 0 && !finished {
+			if radius == 0 {
+				radius = math.Min(geoNearStartRadius, maxRadius)
+			} else {
+				radius = math.Min(2*radius, maxRadius)
+			}
+			finished = radius >= maxRadius
+
+			var dids [][]byte
+			dids, err = geoCandidates(t, ci, p.iif, &geoQuery{shape: geoNear, center: center, radius: radius}, stats)
+			if err != nil {
+				return
+			}
+			var unseen [][]byte
+			for _, did := range dids {
+				if !seen[string(did)] {
+					seen[string(did)] = true
+					unseen = append(unseen, did)
+				}
+			}
+			n := len(pending)
+			pending, err = fetchGeoDocs(t, ci.ID, unseen, f, pending, stats)
+			if err != nil {
+				return
+			}
+			for _, d := range pending[n:] {
+				distance[string(d.did)] = docDistance(d.doc, path, center)
+			}
+
+			sort.SliceStable(pending, func(i, j int) bool {
+				return distance[string(pending[i].did)] < distance[string(pending[j].did)]
+			})
+			i := len(pending)
+			if !finished {
+				i = sort.Search(len(pending), func(i int) bool {
+					return distance[string(pending[i].did)] > radius
+				})
+			}
+			docs = pending[:i:i]
+			pending = pending[i:]
+			for _, d := range docs {
+				delete(distance, string(d.did))
+			}
+		}
+		return
+	}
+}
+
+// fetchGeoDocs appends the documents of dids matching f to docs
+func fetchGeoDocs(t mondis.ProviderKVOP, cid int64, dids [][]byte, f *filter, docs []cursorDoc, stats *execStats) ([]cursorDoc, error) {
+	for _, did := range dids {
+		doc, _, err := t.Get(EncodeCollectionDocumentKey(nil, cid, did))
+		if err == kv.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.docsExamined++
+		if !f.match(doc) {
+			continue
+		}
+		docs = append(docs, cursorDoc{did: did, doc: doc})
+	}
+	return docs, nil
+}
+
+// geoCandidates returns the documents in the cells covering gq
+func geoCandidates(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, gq *geoQuery, stats *execStats) (dids [][]byte, err error) {
+	prefix := AppendCollectionIndexPrefix(nil, ci.ID, iif.ID)
+	for _, r := range geoRanges(ci.ID, iif, gq) {
+		var did []byte
+		end := r.EndKey
+		scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: r.StartKey}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+			if bytes.Compare(key, end) >= 0 {
+				return false
+			}
+			stats.keysExamined++
+			did, _, err = decodeIndexEntryDid(ci, iif, key, value)
+			if err != nil {
+				return false
+			}
+			dids = append(dids, did)
+			return true
+		})
+		if err == nil {
+			err = scanErr
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// docDistance returns the min distance from the points of path in doc to center
+func docDistance(doc bson.Raw, path string, center geoPoint) float64 {
+	distance := math.Inf(1)
+	for _, v := range resolvePath(doc, path) {
+		if p, ok := parsePoint(v); ok {
+			distance = math.Min(distance, p.distance(center))
+		}
+	}
+	return distance
+}
@@ -0,0 +1,114 @@
+package dml
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestZOrder(t *testing.T) {
+	assert.Equal(t, zOrder(0, 0), uint64(0))
+	assert.Equal(t, zOrder(1, 0), uint64(2))
+	assert.Equal(t, zOrder(0, 1), uint64(1))
+	assert.Equal(t, zOrder(0xffffffff, 0), uint64(0xaaaaaaaaaaaaaaaa))
+	assert.Equal(t, zOrder(0xffffffff, 0xffffffff), ^uint64(0))
+
+	assert.Equal(t, quantize(-180, geoMinX, geoMaxX), uint32(0))
+	assert.Equal(t, quantize(180, geoMinX, geoMaxX), uint32(0xffffffff))
+	assert.Equal(t, quantize(0, geoMinX, geoMaxX), uint32(1<<31))
+}
+
+func TestGeoRanges(t *testing.T) {
+	seed := time.Now().UnixNano()
+	r := rand.New(rand.NewSource(seed))
+	iif := &model.IndexInfo{ID: 1, Columns: []string{"loc"}, Kind: model.IndexKindGeo2d}
+	prefix := AppendCollectionIndexPrefix(nil, 1, iif.ID)
+
+	randPoint := func() geoPoint {
+		return geoPoint{x: r.Float64()*360 - 180, y: r.Float64()*180 - 90}
+	}
+	for i := 0; i < 50; i++ {
+		var gq *geoQuery
+		switch i % 3 {
+		case 0:
+			a, b := randPoint(), randPoint()
+			gq = &geoQuery{shape: geoBox, min: geoPoint{x: math.Min(a.x, b.x), y: math.Min(a.y, b.y)}, max: geoPoint{x: math.Max(a.x, b.x), y: math.Max(a.y, b.y)}}
+		case 1:
+			gq = &geoQuery{shape: geoCenter, center: randPoint(), radius: r.Float64() * 30}
+		default:
+			gq = &geoQuery{shape: geoNear, center: randPoint(), radius: r.Float64() * 3}
+		}
+
+		ranges := geoRanges(1, iif, gq)
+		assert.Assert(t, len(ranges) > 0 && len(ranges) <= geoMaxCells)
+		for j := 1; j < len(ranges); j++ {
+			assert.Assert(t, bytes.Compare(ranges[j-1].EndKey, ranges[j].StartKey) < 0)
+		}
+
+		// every point in the region is covered
+		for j := 0; j < 200; j++ {
+			p := randPoint()
+			if j%2 == 0 {
+				// close to the region
+				bmin, bmax := gq.bound()
+				p = geoPoint{x: bmin.x + r.Float64()*(bmax.x-bmin.x), y: bmin.y + r.Float64()*(bmax.y-bmin.y)}
+			}
+			if !p.inBounds() || !gq.contains(p) {
+				continue
+			}
+			key := memcomparable.EncodeUint64(prefix.Clone(), geoZ(p))
+			covered := false
+			for _, kr := range ranges {
+				if bytes.Compare(key, kr.StartKey) >= 0 && bytes.Compare(key, kr.EndKey) < 0 {
+					covered = true
+					break
+				}
+			}
+			assert.Assert(t, covered, fmt.Sprintf("seed %d: %+v not covered for %+v", seed, p, gq))
+		}
+	}
+
+	// unbounded $near covers the whole index
+	ranges := geoRanges(1, iif, &geoQuery{shape: geoNear, radius: -1})
+	assert.Assert(t, len(ranges) == 1 && bytes.Equal(ranges[0].EndKey, prefix.PrefixNext()))
+	assert.Assert(t, len(geoRanges(1, iif, &geoQuery{shape: geoBox, min: geoPoint{x: 200, y: 0}, max: geoPoint{x: 210, y: 1}})) == 0)
+}
+
+func TestParseGeo(t *testing.T) {
+	f, err := parseFilter(bson.M{"loc": bson.M{"$near": bson.A{1, 2}, "$maxDistance": 3}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, *f.geo == geoQuery{shape: geoNear, center: geoPoint{x: 1, y: 2}, radius: 3})
+
+	f, err = parseFilter(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{3, 4}, bson.A{1, 2}}}}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, *f.geo == geoQuery{shape: geoBox, min: geoPoint{x: 1, y: 2}, max: geoPoint{x: 3, y: 4}})
+
+	doc, err := bson.Marshal(bson.M{"loc": bson.D{{Key: "lng", Value: 1.5}, {Key: "lat", Value: 3}}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, f.match(doc))
+
+	f, err = parseFilter(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$center": bson.A{bson.A{0, 0}, 1}}}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, !f.match(doc))
+
+	_, err = parseFilter(bson.M{"$or": bson.A{bson.M{"loc": bson.M{"$near": bson.A{1, 2}}}}})
+	assert.Assert(t, err == ErrNearNotTopLevel)
+	for _, invalid := range []interface{}{
+		bson.M{"loc": bson.M{"$maxDistance": 1}},
+		bson.M{"loc": bson.M{"$near": "a"}},
+		bson.M{"loc": bson.M{"$near": bson.A{1, 2}, "$maxDistance": -1}},
+		bson.M{"loc": bson.M{"$geoWithin": bson.M{"$polygon": bson.A{1, 2}}}},
+		bson.M{"loc": bson.M{"$geoWithin": bson.M{"$center": bson.A{bson.A{0, 0}, "r"}}}},
+	} {
+		_, err = parseFilter(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+}
@@ -1,8 +1,15 @@
 package dml
 
 import (
+	"bytes"
+	"errors"
+
 	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/model"
 	"github.com/zhiqiangxu/mondis/document/schema"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/util/osc"
 )
 
 // Index model
@@ -13,11 +20,250 @@ type Index struct {
 	base
 }
 
+var (
+	// ErrIndexNotPublic used by Index
+	ErrIndexNotPublic = errors.New("index not public")
+	// ErrTooManyLookupValues used by Index
+	ErrTooManyLookupValues = errors.New("too many lookup values")
+	// ErrInvalidLookupCursor used by Index
+	ErrInvalidLookupCursor = errors.New("invalid lookup cursor")
+)
+
 func newIndex(dbName, collectionName, indexName string, kvdb mondis.KVDB, handle *schema.Handle) *Index {
 	return &Index{dbName: dbName, collectionName: collectionName, indexName: indexName, base: base{kvdb: kvdb, handle: handle}}
 }
 
-// Lookup by index
-func (idx *Index) Lookup() {
+type (
+	// Bound for one side of a lookup range
+	Bound struct {
+		Value     interface{}
+		Exclusive bool
+	}
+	// LookupOption for Lookup
+	// Eq matches the leading columns of the index,
+	// Lower/Upper restrict the column right after them, nil means unbounded.
+	LookupOption struct {
+		Eq      []interface{}
+		Lower   *Bound
+		Upper   *Bound
+		Reverse bool
+		// Limit is the max number of entries returned, 0 means no limit
+		Limit int
+		// Cursor is returned by the previous Lookup, for resuming
+		Cursor []byte
+	}
+)
+
+// Lookup by index, returns matching document ids in index order,
+// cursor is not nil when there may be more entries after Limit.
+// It's only supported for auto ids, LookupDocs works for typed ids as well.
+func (idx *Index) Lookup(option LookupOption, t *txn.Txn) (dids []int64, cursor []byte, err error) {
+	origT := t
+
+	if t == nil {
+		t = idx.Txn(false)
+		defer t.Discard()
+	}
+
+	ci, iif, err := idx.getInfo(t)
+	if err != nil {
+		return
+	}
+	if ci.IDType != model.IDTypeAuto {
+		err = ErrAutoIDRequired
+		return
+	}
+	if origT != nil {
+		origT.ReferredCollections(ci.ID)
+	}
+
+	encDids, cursor, err := lookup(t, ci, iif, option)
+	if err != nil {
+		return
+	}
+	var n int64
+	for _, did := range encDids {
+		n, err = decodeDid(did)
+		if err != nil {
+			return
+		}
+		dids = append(dids, n)
+	}
+	return
+}
+
+// lookup returns the dids of Lookup
+func lookup(t *txn.Txn, ci *model.CollectionInfo, iif *model.IndexInfo, option LookupOption) (dids [][]byte, cursor []byte, err error) {
+	switch iif.Kind {
+	case model.IndexKindText:
+		err = ErrTextIndexLookup
+		return
+	case model.IndexKindGeo2d:
+		err = ErrGeoIndexLookup
+		return
+	}
+
+	start, end, err := lookupRange(ci.ID, iif, &option)
+	if err != nil {
+		return
+	}
+
+	var (
+		did     []byte
+		lastKey []byte
+		// multikey index may have multiple entries for a document, keyed by did
+		seen = make(map[string]bool)
+	)
+	fn := func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if option.Reverse {
+			if bytes.Compare(key, end) >= 0 {
+				return true
+			}
+			if bytes.Compare(key, start) < 0 {
+				return false
+			}
+		} else if bytes.Compare(key, end) >= 0 {
+			return false
+		}
+
+		if option.Limit > 0 && len(dids) >= option.Limit {
+			cursor = append([]byte(nil), lastKey...)
+			return false
+		}
+
+		did, _, err = decodeIndexEntryDid(ci, iif, key, value)
+		if err != nil {
+			return false
+		}
+		lastKey = append(lastKey[:0], key...)
+		if seen[string(did)] {
+			return true
+		}
+		seen[string(did)] = true
+		dids = append(dids, did)
+		return true
+	}
+
+	var scanErr error
+	if option.Reverse {
+		scanErr = t.Scan(mondis.ProviderScanOption{Reverse: true, Offset: end}, fn)
+	} else {
+		scanErr = t.Scan(mondis.ProviderScanOption{Prefix: AppendCollectionIndexPrefix(nil, ci.ID, iif.ID), Offset: start}, fn)
+	}
+	if err != nil {
+		return
+	}
+	err = scanErr
+	return
+}
+
+// LookupDocs is like Lookup, but returns the documents instead of document ids
+func (idx *Index) LookupDocs(option LookupOption, slicePtr interface{}, t *txn.Txn) (cursor []byte, err error) {
+	origT := t
+
+	if t == nil {
+		t = idx.Txn(false)
+		defer t.Discard()
+	}
+
+	ci, iif, err := idx.getInfo(t)
+	if err != nil {
+		return
+	}
+	if origT != nil {
+		origT.ReferredCollections(ci.ID)
+	}
+
+	dids, cursor, err := lookup(t, ci, iif, option)
+	if err != nil {
+		return
+	}
+
+	err = getMany(t, ci.ID, dids, slicePtr)
+	return
+}
+
+func (idx *Index) getInfo(t *txn.Txn) (ci *model.CollectionInfo, iif *model.IndexInfo, err error) {
+	ci = t.StartMetaCache().CollectionInfo(idx.dbName, idx.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	iif = ci.IndexInfo(idx.indexName)
+	if iif == nil {
+		err = ErrIndexNotExists
+		return
+	}
+	if iif.State != osc.StatePublic {
+		err = ErrIndexNotPublic
+		return
+	}
+	return
+}
+
+// lookupRange computes the key range [start, end) to scan for option
+func lookupRange(cid int64, iif *model.IndexInfo, option *LookupOption) (start, end kv.Key, err error) {
+	nEq := len(option.Eq)
+	if nEq > len(iif.Columns) || (nEq == len(iif.Columns) && (option.Lower != nil || option.Upper != nil)) {
+		err = ErrTooManyLookupValues
+		return
+	}
+
+	prefix := AppendCollectionIndexPrefix(nil, cid, iif.ID)
+	prefix, err = encodeLookupValues(prefix, iif, 0, option.Eq)
+	if err != nil {
+		return
+	}
+
+	// for descending column, the lower bound of value is the upper bound of key
+	lower, upper := option.Lower, option.Upper
+	desc := iif.IsDesc(nEq)
+	if desc {
+		lower, upper = upper, lower
+	}
+
+	if lower != nil {
+		start, err = encodeLookupValues(prefix.Clone(), iif, nEq, []interface{}{lower.Value})
+		if err != nil {
+			return
+		}
+		if lower.Exclusive {
+			start = start.PrefixNext()
+		}
+	} else {
+		start = prefix
+	}
+
+	if upper != nil {
+		end, err = encodeLookupValues(prefix.Clone(), iif, nEq, []interface{}{upper.Value})
+		if err != nil {
+			return
+		}
+		if !upper.Exclusive {
+			end = end.PrefixNext()
+		}
+	} else {
+		end = prefix.PrefixNext()
+	}
+
+	if len(option.Cursor) > 0 {
+		cursor := kv.Key(option.Cursor)
+		if !cursor.HasPrefix(prefix) {
+			err = ErrInvalidLookupCursor
+			return
+		}
+		if option.Reverse {
+			if cursor.Cmp(end) < 0 {
+				end = cursor.Clone()
+			}
+		} else {
+			next := cursor.Next()
+			if next.Cmp(start) > 0 {
+				start = next
+			}
+		}
+	}
 
+	return
 }
@@ -0,0 +1,380 @@
+package dml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrParallelArrays when more than one column of a compound index is an array
+	ErrParallelArrays = errors.New("cannot index parallel arrays")
+)
+
+// DuplicateKeyError when a write violates an unique index
+type DuplicateKeyError struct {
+	// Index name
+	Index string
+	// Did of the conflicting document, 0 for typed ids
+	Did int64
+	// ID is the _id of the conflicting document for typed ids
+	ID interface{}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	if e.ID != nil {
+		return fmt.Sprintf("duplicate key for index %s, conflicts with document %v", e.Index, e.ID)
+	}
+	return fmt.Sprintf("duplicate key for index %s, conflicts with document %d", e.Index, e.Did)
+}
+
+func newDuplicateKeyError(ci *model.CollectionInfo, index string, did []byte) error {
+	if ci.IDType == model.IDTypeAuto {
+		return &DuplicateKeyError{Index: index, Did: publicDid(ci.IDType, did)}
+	}
+
+	id, err := idOf(ci, did)
+	if err != nil {
+		return err
+	}
+	return &DuplicateKeyError{Index: index, ID: id}
+}
+
+// writeIndices replaces the index entries of document did from oldDoc to newDoc,
+// oldDoc is nil for insert, newDoc is nil for delete.
+func writeIndices(t mondis.ProviderKVOP, ci *model.CollectionInfo, did []byte, oldDoc, newDoc bson.Raw) (err error) {
+	for _, name := range ci.IndexOrder {
+		iif := ci.Indices[name]
+		if iif == nil {
+			continue
+		}
+
+		err = writeIndex(t, ci, iif, did, oldDoc, newDoc)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeIndex follows the online schema change rules:
+// delete only index only takes removals,
+// write only, write reorganization and public index take all writes.
+func writeIndex(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, did []byte, oldDoc, newDoc bson.Raw) (err error) {
+	switch iif.State {
+	case osc.StateDeleteOnly:
+		newDoc = nil
+	case osc.StateWriteOnly, osc.StateWriteReorganization, osc.StatePublic:
+	default:
+		return
+	}
+
+	var oldEntries, newEntries map[string][]byte
+	if oldDoc != nil {
+		oldEntries, _, err = indexEntries(ci, iif, did, oldDoc)
+		if err != nil {
+			return
+		}
+	}
+	var multikey bool
+	if newDoc != nil {
+		newEntries, multikey, err = indexEntries(ci, iif, did, newDoc)
+		if err != nil {
+			return
+		}
+	}
+
+	if iif.Kind == model.IndexKindText {
+		err = updateTextDocCount(t, ci.ID, iif, did, oldEntries, newEntries)
+		if err != nil {
+			return
+		}
+	}
+
+	// only the difference is written
+	for key := range oldEntries {
+		if _, ok := newEntries[key]; ok {
+			continue
+		}
+		if iif.Unique {
+			// the entry may belong to another document if oldDoc was written while the index was delete only
+			var owned bool
+			owned, err = ownsUniqueEntry(t, ci, []byte(key), did)
+			if err != nil {
+				return
+			}
+			if !owned {
+				continue
+			}
+		}
+		err = t.Delete([]byte(key))
+		if err != nil {
+			return
+		}
+	}
+	for key, value := range newEntries {
+		if oldValue, ok := oldEntries[key]; ok && bytes.Equal(oldValue, value) {
+			continue
+		}
+		if iif.Unique {
+			err = checkUnique(t, ci, iif, []byte(key), did)
+			if err != nil {
+				return
+			}
+		}
+		err = t.Set([]byte(key), value, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	if multikey {
+		err = markMultikey(t, ci.ID, iif.ID)
+	}
+	return
+}
+
+// indexEntries returns the deduplicated entries of doc for iif, keyed by index key,
+// multikey is true if some column is an array, in which case there's an entry per element.
+// There is no entry if doc is skipped by a sparse or partial index.
+func indexEntries(ci *model.CollectionInfo, iif *model.IndexInfo, did []byte, doc bson.Raw) (entries map[string][]byte, multikey bool, err error) {
+	ok, err := indexed(iif, doc)
+	if err != nil || !ok {
+		return
+	}
+	switch iif.Kind {
+	case model.IndexKindText:
+		entries, err = textEntries(ci, iif, did, doc)
+		return
+	case model.IndexKindGeo2d:
+		entries, err = geoEntries(ci, iif, did, doc)
+		return
+	}
+
+	columnValues := make([][]bson.RawValue, len(iif.Columns))
+	var isArray bool
+	for i, column := range iif.Columns {
+		columnValues[i], isArray = indexColumnValues(doc, column)
+		if isArray {
+			if multikey {
+				err = ErrParallelArrays
+				return
+			}
+			multikey = true
+		}
+	}
+
+	entries = make(map[string][]byte)
+	prefix := AppendCollectionIndexPrefix(nil, ci.ID, iif.ID)
+	var addEntries func(i int, buf []byte, types []byte) error
+	addEntries = func(i int, buf []byte, types []byte) (err error) {
+		if i == len(iif.Columns) {
+			var key, value []byte
+			if iif.Unique {
+				key = buf
+			} else {
+				key = append(kv.Key(buf).Clone(), did...)
+			}
+			if didInValue(ci, iif) {
+				value = append(value, did...)
+			}
+			// covered queries can't be served by multikey entries
+			if !multikey {
+				value = append(value, types...)
+			}
+			entries[string(key)] = value
+			return
+		}
+
+		for _, v := range columnValues[i] {
+			var next []byte
+			next, err = encodeIndexValue(kv.Key(buf).Clone(), v, iif.IsDesc(i))
+			if err != nil {
+				return
+			}
+			err = addEntries(i+1, next, append(types[:i:i], byte(v.Type)))
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	err = addEntries(0, prefix, nil)
+	return
+}
+
+// markMultikey marks index iid as multikey, it's never cleared until the index is dropped
+func markMultikey(t mondis.ProviderKVOP, cid, iid int64) (err error) {
+	key := EncodeCollectionIndexMultikeyKey(nil, cid, iid)
+	exists, err := t.Exists(key)
+	if err != nil || exists {
+		return
+	}
+	err = t.Set(key, nil, nil)
+	return
+}
+
+// isMultikey returns true if index iid has multikey entries
+func isMultikey(t mondis.ProviderKVOP, cid, iid int64) (bool, error) {
+	return t.Exists(EncodeCollectionIndexMultikeyKey(nil, cid, iid))
+}
+
+// didInValue returns true if the did is stored at the start of the values of index entries,
+// which is the case for unique indexes whose keys have no did,
+// and for typed ids since a variable sized did can't be split from the end of key.
+func didInValue(ci *model.CollectionInfo, iif *model.IndexInfo) bool {
+	return iif.Unique || ci.IDType != model.IDTypeAuto
+}
+
+// checkUnique returns *DuplicateKeyError if key is taken by another document
+func checkUnique(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, key []byte, did []byte) (err error) {
+	v, _, err := t.Get(key)
+	if err == kv.ErrKeyNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	existingDid, _, err := splitDid(ci, v)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(existingDid, did) {
+		err = newDuplicateKeyError(ci, iif.Name, existingDid)
+	}
+	return
+}
+
+// ownsUniqueEntry returns true if the unique index entry key exists and points to did
+func ownsUniqueEntry(t mondis.ProviderKVOP, ci *model.CollectionInfo, key []byte, did []byte) (owned bool, err error) {
+	v, _, err := t.Get(key)
+	if err == kv.ErrKeyNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	existingDid, _, err := splitDid(ci, v)
+	if err != nil {
+		return
+	}
+	owned = bytes.Equal(existingDid, did)
+	return
+}
+
+// decodeIndexEntryTypes returns the column types stored in rest of the value of an index entry,
+// nil for entries written without them.
+func decodeIndexEntryTypes(iif *model.IndexInfo, rest []byte) []byte {
+	if len(rest) != len(iif.Columns) {
+		return nil
+	}
+	return rest
+}
+
+// decodeIndexEntryDid returns a copy of the did of an index entry, and the rest of value after the did
+func decodeIndexEntryDid(ci *model.CollectionInfo, iif *model.IndexInfo, key, value []byte) (did, rest []byte, err error) {
+	if !didInValue(ci, iif) {
+		did, err = DecodeCollectionIndexDataKeyDid(key)
+		rest = value
+		return
+	}
+
+	did, rest, err = splitDid(ci, value)
+	if err == nil {
+		did = append([]byte(nil), did...)
+	}
+	return
+}
+
+// BackfillIndex adds index entries for documents from key start, nil means from the first document,
+// at most batchSize documents are processed, next is the key to resume from.
+// Documents written meanwhile are indexed by the writes, so backfilling them again is harmless.
+func BackfillIndex(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, start kv.Key, batchSize int) (next kv.Key, done bool, err error) {
+	var (
+		did []byte
+		n   int
+	)
+	prefix := AppendCollectionDocumentPrefix(nil, ci.ID)
+	if start == nil {
+		start = prefix
+	}
+	next = start
+	done = true
+	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: start}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if n >= batchSize {
+			done = false
+			return false
+		}
+		_, did, err = DecodeCollectionDocumentKey(key)
+		if err != nil {
+			return false
+		}
+
+		err = writeIndex(t, ci, iif, did, nil, value)
+		if err != nil {
+			return false
+		}
+		n++
+		next = kv.Key(key).Next()
+		return true
+	})
+	if err != nil {
+		return
+	}
+	err = scanErr
+	return
+}
+
+// DeleteIndexData deletes at most batchSize entries of index iid,
+// done is true when all entries are deleted.
+func DeleteIndexData(t mondis.ProviderKVOP, cid, iid int64, batchSize int) (done bool, err error) {
+	done, err = deletePrefix(t, AppendCollectionIndexPrefix(nil, cid, iid), batchSize)
+	if err != nil || !done {
+		return
+	}
+	done, err = deletePrefix(t, AppendCollectionTextDocCountPrefix(nil, cid, iid), batchSize)
+	if err != nil || !done {
+		return
+	}
+	err = t.Delete(EncodeCollectionIndexMultikeyKey(nil, cid, iid))
+	return
+}
+
+// DeleteCollectionData deletes at most batchSize documents or index entries of collection cid,
+// done is true when all data is deleted.
+func DeleteCollectionData(t mondis.ProviderKVOP, cid int64, batchSize int) (done bool, err error) {
+	done, err = deletePrefix(t, AppendCollectionPrefix(nil, cid), batchSize)
+	return
+}
+
+func deletePrefix(t mondis.ProviderKVOP, prefix []byte, batchSize int) (done bool, err error) {
+	var n int
+	done = true
+	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: prefix}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		if n >= batchSize {
+			done = false
+			return false
+		}
+		err = t.Delete(append([]byte(nil), key...))
+		if err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return
+	}
+	err = scanErr
+	return
+}
@@ -0,0 +1,57 @@
+package dml
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/provider"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func openTestKV(t *testing.T) (kvdb mondis.KVDB, closeFunc func()) {
+	dir, err := ioutil.TempDir("", "mondis_dml")
+	assert.Assert(t, err == nil)
+	kvdb = provider.NewBadger()
+	err = kvdb.Open(mondis.KVOption{Dir: dir})
+	assert.Assert(t, err == nil)
+	closeFunc = func() {
+		kvdb.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func TestWriteUniqueIndexKeepsOthersEntry(t *testing.T) {
+	kvdb, closeFunc := openTestKV(t)
+	defer closeFunc()
+
+	ci := &model.CollectionInfo{ID: 1}
+	iif := &model.IndexInfo{ID: 2, Name: "idx_u", Columns: []string{"u"}, Unique: true, State: osc.StateDeleteOnly}
+	doc1, _ := bson.Marshal(bson.M{"u": 1})
+	doc2, _ := bson.Marshal(bson.M{"u": 1})
+
+	// doc1 is written while the index is delete only, so it has no entry
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(1), nil, doc1) == nil)
+
+	iif.State = osc.StateWriteReorganization
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(2), nil, doc2) == nil)
+
+	// deleting doc1 must not remove the entry of doc2
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(1), doc1, nil) == nil)
+	entries, _, err := indexEntries(ci, iif, encodeDid(2), doc2)
+	assert.Assert(t, err == nil && len(entries) == 1)
+	for key := range entries {
+		owned, err := ownsUniqueEntry(kvdb, ci, []byte(key), encodeDid(2))
+		assert.Assert(t, err == nil && owned)
+	}
+
+	// a duplicate is still rejected
+	err = writeIndex(kvdb, ci, iif, encodeDid(3), nil, doc1)
+	_, ok := err.(*DuplicateKeyError)
+	assert.Assert(t, ok)
+}
@@ -0,0 +1,79 @@
+package dml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"gotest.tools/assert"
+)
+
+func TestLookupRange(t *testing.T) {
+	iif := &model.IndexInfo{ID: 2, Columns: []string{"a", "b"}}
+
+	keyOf := func(a, b interface{}, did int64) []byte {
+		values, err := encodeLookupValues(nil, iif, 0, []interface{}{a, b})
+		assert.Assert(t, err == nil)
+		return EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(did))
+	}
+	in := func(key, start, end []byte) bool {
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+
+	{
+		// a == 1 and 2 < b <= 3
+		start, end, err := lookupRange(1, iif, &LookupOption{
+			Eq:    []interface{}{1},
+			Lower: &Bound{Value: 2, Exclusive: true},
+			Upper: &Bound{Value: 3},
+		})
+		assert.Assert(t, err == nil)
+		assert.Assert(t, !in(keyOf(1, 2, 100), start, end))
+		assert.Assert(t, in(keyOf(1, 2.5, 100), start, end))
+		assert.Assert(t, in(keyOf(1, int64(3), 100), start, end))
+		assert.Assert(t, !in(keyOf(1, 3.5, 1), start, end))
+		assert.Assert(t, !in(keyOf(2, 2.5, 1), start, end))
+		assert.Assert(t, !in(keyOf(1, "3", 1), start, end))
+	}
+
+	{
+		// cursor resumes right after itself
+		cursor := keyOf(1, 2, 100)
+		start, end, err := lookupRange(1, iif, &LookupOption{Eq: []interface{}{1}, Cursor: cursor})
+		assert.Assert(t, err == nil)
+		assert.Assert(t, !in(cursor, start, end))
+		assert.Assert(t, in(keyOf(1, 2, 101), start, end))
+
+		start, end, err = lookupRange(1, iif, &LookupOption{Eq: []interface{}{1}, Cursor: cursor, Reverse: true})
+		assert.Assert(t, err == nil)
+		assert.Assert(t, !in(cursor, start, end))
+		assert.Assert(t, in(keyOf(1, 2, 99), start, end))
+	}
+
+	{
+		_, _, err := lookupRange(1, iif, &LookupOption{Eq: []interface{}{1, 2, 3}})
+		assert.Assert(t, err == ErrTooManyLookupValues)
+	}
+
+	{
+		// b descending, a == 1 and 2 < b <= 3
+		iif := &model.IndexInfo{ID: 2, Columns: []string{"a", "b"}, Desc: []bool{false, true}}
+		keyOf := func(a, b interface{}, did int64) []byte {
+			values, err := encodeLookupValues(nil, iif, 0, []interface{}{a, b})
+			assert.Assert(t, err == nil)
+			return EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(did))
+		}
+		assert.Assert(t, bytes.Compare(keyOf(1, 3, 1), keyOf(1, 2, 1)) < 0)
+
+		start, end, err := lookupRange(1, iif, &LookupOption{
+			Eq:    []interface{}{1},
+			Lower: &Bound{Value: 2, Exclusive: true},
+			Upper: &Bound{Value: 3},
+		})
+		assert.Assert(t, err == nil)
+		assert.Assert(t, !in(keyOf(1, 2, 100), start, end))
+		assert.Assert(t, in(keyOf(1, 2.5, 100), start, end))
+		assert.Assert(t, in(keyOf(1, int64(3), 100), start, end))
+		assert.Assert(t, !in(keyOf(1, 3.5, 1), start, end))
+	}
+}
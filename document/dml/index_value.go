@@ -0,0 +1,120 @@
+package dml
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+var (
+	// ErrIndexValueTypeNotSupported when value type can not be indexed
+	ErrIndexValueTypeNotSupported = errors.New("index value type not supported")
+)
+
+// encodeIndexValue appends memcomparable-format of v to buf, in descending order if desc
+func encodeIndexValue(buf []byte, v bson.RawValue, desc bool) (_ []byte, err error) {
+	if desc {
+		buf, err = dbson.EncodeDesc(buf, v)
+	} else {
+		buf, err = dbson.Encode(buf, v)
+	}
+	if err == dbson.ErrTypeNotSupported {
+		err = ErrIndexValueTypeNotSupported
+	}
+	return buf, err
+}
+
+// decodeIndexValue decodes a value encoded by encodeIndexValue back to type t
+func decodeIndexValue(b []byte, t bsontype.Type, desc bool) ([]byte, bson.RawValue, error) {
+	if desc {
+		return dbson.DecodeDesc(b, t)
+	}
+	return dbson.Decode(b, t)
+}
+
+// encodeLookupValues encodes go values for the columns of iif starting from first
+func encodeLookupValues(buf []byte, iif *model.IndexInfo, first int, values []interface{}) (_ []byte, err error) {
+	var rv bson.RawValue
+	for i, v := range values {
+		rv, err = dbson.ToRawValue(v)
+		if err != nil {
+			return
+		}
+		buf, err = encodeIndexValue(buf, rv, iif.IsDesc(first+i))
+		if err != nil {
+			return
+		}
+	}
+	return buf, nil
+}
+
+// indexColumnValues returns the values of a (possibly dotted) column in doc for indexing,
+// arrays are expanded to their elements and multikey is true if any array is met,
+// a missing column is a single value of type 0 which is encoded as null.
+func indexColumnValues(doc bson.Raw, column string) (values []bson.RawValue, multikey bool) {
+	collectIndexValues(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}, strings.Split(column, "."), &values, &multikey)
+	if len(values) == 0 {
+		values = append(values, bson.RawValue{})
+	}
+	return
+}
+
+func collectIndexValues(v bson.RawValue, parts []string, values *[]bson.RawValue, multikey *bool) {
+	if len(parts) == 0 {
+		if v.Type != bsontype.Array {
+			*values = append(*values, v)
+			return
+		}
+
+		*multikey = true
+		elements, err := v.Array().Values()
+		if err != nil {
+			return
+		}
+		if len(elements) == 0 {
+			// empty array is indexed as null
+			*values = append(*values, bson.RawValue{Type: bsontype.Null})
+		}
+		*values = append(*values, elements...)
+		return
+	}
+
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		child, err := v.Document().LookupErr(parts[0])
+		if err == nil {
+			collectIndexValues(child, parts[1:], values, multikey)
+		}
+	case bsontype.Array:
+		elements, err := v.Array().Values()
+		if err != nil {
+			return
+		}
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(elements) {
+			collectIndexValues(elements[i], parts[1:], values, multikey)
+		}
+		for _, e := range elements {
+			if e.Type == bsontype.EmbeddedDocument {
+				*multikey = true
+				collectIndexValues(e, parts, values, multikey)
+			}
+		}
+	}
+}
+
+// typeBracket returns the encoded range [lower, upper) of all values with the same type order as v
+func typeBracket(v bson.RawValue, desc bool) (lower, upper []byte, err error) {
+	encoded, err := encodeIndexValue(nil, v, desc)
+	if err != nil {
+		return
+	}
+	lower = encoded[:1]
+	upper = kv.Key(lower).PrefixNext()
+	return
+}
@@ -0,0 +1,298 @@
+package dml
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zhiqiangxu/mondis/document/meta/sequence"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrUnorderedInTxn when InsertMany is called with both Unordered and a txn,
+	// a failed document can't be taken back from the txn without failing it.
+	ErrUnorderedInTxn = errors.New("unordered insert many is not supported in txn")
+)
+
+// InsertManyOptions for InsertMany
+type InsertManyOptions struct {
+	// Unordered keeps inserting the remaining documents after a document failed,
+	// by default InsertMany stops at the first failed document.
+	Unordered bool
+}
+
+// InsertManyError for documents InsertMany failed to insert
+type InsertManyError struct {
+	// Errors by index of the document
+	Errors map[int]error
+}
+
+func (e *InsertManyError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("%d documents failed to insert, document %d: %v", len(e.Errors), first, e.Errors[first])
+}
+
+// InsertMany for insert documents into collection with ids allocated in ranges,
+// capped collections allocate ids in the transactions to keep insertion order instead.
+// dids[i] is the id of docs[i], or 0 if docs[i] is not inserted or the collection has typed ids.
+// Failed documents are reported by *InsertManyError, in ordered mode the documents after the first failed one are skipped.
+// When t is nil, documents are committed in as many transactions as needed to avoid kv.ErrTxnTooBig,
+// those committed stay inserted when a later transaction fails.
+// When t is not nil, Unordered is rejected with ErrUnorderedInTxn,
+// documents that failed to marshal are reported by *InsertManyError and leave t usable,
+// while a document that failed to write fails t with the error of the document.
+func (c *Collection) InsertMany(docs []interface{}, opts *InsertManyOptions, t *txn.Txn) (dids []int64, err error) {
+	if opts == nil {
+		opts = &InsertManyOptions{}
+	}
+	if t != nil && opts.Unordered {
+		err = ErrUnorderedInTxn
+		return
+	}
+
+	docErrs := make(map[int]error)
+	datas := make([]bson.Raw, len(docs))
+	for i, doc := range docs {
+		datas[i], err = bson.Marshal(doc)
+		if err != nil {
+			docErrs[i] = err
+			err = nil
+			if !opts.Unordered {
+				datas = datas[:i]
+				break
+			}
+		}
+	}
+
+	defer func() {
+		if err == nil && len(docErrs) > 0 {
+			err = &InsertManyError{Errors: docErrs}
+		}
+	}()
+
+	if t != nil {
+		var ids []int64
+		ids, err = c.insertManyWithTxn(datas, t)
+		if err != nil {
+			return
+		}
+		dids = make([]int64, len(docs))
+		copy(dids, ids)
+		return
+	}
+
+	ci := c.handle.Get().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+	dids = make([]int64, len(docs))
+	var ids []int64
+	if ci.Capped != nil || ci.IDType != model.IDTypeAuto {
+		// allocated by insertRange in the txn, or keyed by _id
+		ids = make([]int64, len(datas))
+	} else {
+		seq := GetSequence(ci.ID)
+		if seq == nil {
+			err = ErrSequenceNotExists
+			return
+		}
+		ids, err = allocateIDs(seq, datas)
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			var unused []int64
+			for i, id := range ids {
+				if id != 0 && dids[i] == 0 {
+					unused = append(unused, id)
+				}
+			}
+			seq.PutBack(unused...)
+		}()
+	}
+
+	start, end := 0, len(datas)
+	conflicts := 0
+	for start < len(datas) {
+		var (
+			stop   int
+			docErr error
+		)
+		stop, docErr, err = c.insertRange(ci.ID, ids, datas, start, end)
+		if err == kv.ErrTxnTooBig && stop-start > 1 {
+			// change events are written on commit
+			end = start + (stop-start)/2
+			continue
+		}
+		if err == kv.ErrConflict && ci.Capped != nil && conflicts < cappedInsertRetries {
+			conflicts++
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if docErr == nil {
+			copy(dids[start:stop], ids[start:stop])
+			start, end = stop, len(datas)
+			continue
+		}
+		if stop > start {
+			// commit the documents before the failed one by themselves
+			end = stop
+			continue
+		}
+
+		docErrs[start] = docErr
+		start, end = start+1, len(datas)
+		if !opts.Unordered {
+			break
+		}
+	}
+
+	return
+}
+
+// insertManyWithTxn inserts datas in t, nil datas are skipped
+func (c *Collection) insertManyWithTxn(datas []bson.Raw, t *txn.Txn) (dids []int64, err error) {
+	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+	t.ReferredCollections(ci.ID)
+
+	if ci.Capped != nil || ci.IDType != model.IDTypeAuto {
+		dids = make([]int64, len(datas))
+		for i, data := range datas {
+			if data == nil {
+				continue
+			}
+			if ci.Capped != nil {
+				dids[i], err = nextCappedDid(t, ci.ID)
+				if err != nil {
+					return
+				}
+			}
+			err = insertDoc(t, ci, dids[i], data)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	seq := GetSequence(ci.ID)
+	if seq == nil {
+		err = ErrSequenceNotExists
+		return
+	}
+	ids, err := allocateIDs(seq, datas)
+	if err != nil {
+		return
+	}
+	t.AddCancelFunc(func() {
+		for _, id := range ids {
+			if id != 0 {
+				seq.PutBack(id)
+			}
+		}
+	})
+
+	for i, data := range datas {
+		if data == nil {
+			continue
+		}
+		err = insertDoc(t, ci, ids[i], data)
+		if err != nil {
+			return
+		}
+	}
+
+	dids = ids
+	return
+}
+
+// insertRange writes datas[start:end) in a new transaction,
+// stopping at the first document that failed with docErr, in which case nothing is committed.
+func (c *Collection) insertRange(cid int64, ids []int64, datas []bson.Raw, start, end int) (stop int, docErr, err error) {
+	t := c.Txn(true)
+	defer t.Discard()
+
+	ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil || ci.ID != cid {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	for stop = start; stop < end; stop++ {
+		if datas[stop] == nil {
+			continue
+		}
+		if ci.Capped != nil {
+			ids[stop], err = nextCappedDid(t, ci.ID)
+			if err != nil {
+				return
+			}
+		}
+		docErr = insertDoc(t, ci, ids[stop], datas[stop])
+		if docErr != nil {
+			return
+		}
+	}
+
+	err = t.Commit()
+	return
+}
+
+// insertDoc inserts data as document did, which is ignored for typed ids since the document is keyed by its _id
+func insertDoc(t *txn.Txn, ci *model.CollectionInfo, did int64, data bson.Raw) (err error) {
+	if ci.IDType == model.IDTypeAuto {
+		err = writeDoc(t, ci, encodeDid(did), nil, data, nil)
+		return
+	}
+
+	encDid, doc, err := prepareInsertID(t, ci, data)
+	if err != nil {
+		return
+	}
+	err = writeDoc(t, ci, encDid, nil, doc, nil)
+	return
+}
+
+// allocateIDs allocates an id for each non nil data
+func allocateIDs(seq *sequence.Hash, datas []bson.Raw) (ids []int64, err error) {
+	var n int64
+	for _, data := range datas {
+		if data != nil {
+			n++
+		}
+	}
+
+	ranges, err := seq.NextN(n)
+	if err != nil {
+		return
+	}
+
+	ids = make([]int64, len(datas))
+	i := 0
+	for _, r := range ranges {
+		for id := r.Start + 1; id <= r.End; id++ {
+			for datas[i] == nil {
+				i++
+			}
+			ids[i] = id
+			i++
+		}
+	}
+	return
+}
@@ -16,6 +16,11 @@ const (
 	documentPrefixLen         = len(documentPrefix)
 	indexDataPrefix           = "_id" // stores all collection index data
 	columnsIndexedPrefix      = "_ci" // stores all columns with index
+	multikeyPrefix            = "_mk" // marks indexes with multikey entries
+	textDocCountPrefix        = "_tc" // stores the number of documents in text indexes, sharded by did
+	changeLogPrefix           = "_cl" // stores change events in commit order
+	changeLogTruncatedPrefix  = "_ct" // stores the max seq of truncated change events
+	cappedStatePrefix         = "_cs" // stores the last did, count and bytes of capped collection
 	indexNamePrefix           = "_in" // stores index name => index id
 	indexNamePrefixLen        = len(indexNamePrefix)
 	sequencePrefix            = "_s" // stores latest sequence id of all keywords
@@ -40,25 +45,35 @@ var (
 	documentPrefixBytes            = []byte(documentPrefix)
 )
 
+// AppendCollectionPrefix appends c[cid] to buf
+func AppendCollectionPrefix(buf []byte, cid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8)
+	}
+	buf = append(buf, keyspace.CollectionPrefix...)
+	buf = memcomparable.EncodeInt64(buf, cid)
+	return buf
+}
+
 // AppendCollectionDocumentPrefix appends c[cid]_d to buf
 func AppendCollectionDocumentPrefix(buf []byte, cid int64) kv.Key {
 	if buf == nil {
 		buf = make([]byte, 0, collectionPrefixLen+8+len(documentPrefix))
 	}
-	buf = append(buf, keyspace.CollectionPrefix...)
-	buf = memcomparable.EncodeInt64(buf, cid)
+	buf = AppendCollectionPrefix(buf, cid)
 	buf = append(buf, documentPrefix...)
 	return buf
 }
 
 // EncodeCollectionDocumentKey returns c[cid]_d[did]
-func EncodeCollectionDocumentKey(buf []byte, cid, did int64) kv.Key {
+// did should be encoded by encodeDid or encodeID
+func EncodeCollectionDocumentKey(buf []byte, cid int64, did []byte) kv.Key {
 	if buf == nil {
-		buf = make([]byte, 0, collectionPrefixLen+8+len(documentPrefix)+8)
+		buf = make([]byte, 0, collectionPrefixLen+8+len(documentPrefix)+len(did))
 	}
 
 	buf = AppendCollectionDocumentPrefix(buf, cid)
-	buf = memcomparable.EncodeInt64(buf, did)
+	buf = append(buf, did...)
 	return buf
 }
 
@@ -73,6 +88,128 @@ func AppendCollectionIndexDataPrefix(buf []byte, cid int64) kv.Key {
 	return buf
 }
 
+// AppendCollectionIndexPrefix appends c[cid]_id[iid] to buf
+func AppendCollectionIndexPrefix(buf []byte, cid, iid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(indexDataPrefix)+8)
+	}
+	buf = AppendCollectionIndexDataPrefix(buf, cid)
+	buf = memcomparable.EncodeInt64(buf, iid)
+	return buf
+}
+
+// EncodeCollectionIndexDataKey returns c[cid]_id[iid][values][did]
+// values should be encoded by encodeIndexValues
+func EncodeCollectionIndexDataKey(buf []byte, cid, iid int64, values []byte, did []byte) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(indexDataPrefix)+8+len(values)+len(did))
+	}
+	buf = AppendCollectionIndexPrefix(buf, cid, iid)
+	buf = append(buf, values...)
+	buf = append(buf, did...)
+	return buf
+}
+
+// EncodeCollectionUniqueIndexDataKey returns c[cid]_id[iid][values]
+// the did is stored as value for unique index
+func EncodeCollectionUniqueIndexDataKey(buf []byte, cid, iid int64, values []byte) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(indexDataPrefix)+8+len(values))
+	}
+	buf = AppendCollectionIndexPrefix(buf, cid, iid)
+	buf = append(buf, values...)
+	return buf
+}
+
+// EncodeCollectionIndexMultikeyKey returns c[cid]_mk[iid]
+func EncodeCollectionIndexMultikeyKey(buf []byte, cid, iid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(multikeyPrefix)+8)
+	}
+	buf = AppendCollectionPrefix(buf, cid)
+	buf = append(buf, multikeyPrefix...)
+	buf = memcomparable.EncodeInt64(buf, iid)
+	return buf
+}
+
+// AppendCollectionTextDocCountPrefix appends c[cid]_tc[iid] to buf
+func AppendCollectionTextDocCountPrefix(buf []byte, cid, iid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(textDocCountPrefix)+8+8)
+	}
+	buf = AppendCollectionPrefix(buf, cid)
+	buf = append(buf, textDocCountPrefix...)
+	buf = memcomparable.EncodeInt64(buf, iid)
+	return buf
+}
+
+// EncodeCollectionTextDocCountKey returns c[cid]_tc[iid][shard]
+func EncodeCollectionTextDocCountKey(buf []byte, cid, iid, shard int64) kv.Key {
+	buf = AppendCollectionTextDocCountPrefix(buf, cid, iid)
+	buf = memcomparable.EncodeInt64(buf, shard)
+	return buf
+}
+
+// AppendCollectionChangeLogPrefix appends c[cid]_cl to buf
+func AppendCollectionChangeLogPrefix(buf []byte, cid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(changeLogPrefix)+8)
+	}
+	buf = AppendCollectionPrefix(buf, cid)
+	buf = append(buf, changeLogPrefix...)
+	return buf
+}
+
+// EncodeCollectionChangeLogKey returns c[cid]_cl[seq]
+func EncodeCollectionChangeLogKey(buf []byte, cid, seq int64) kv.Key {
+	buf = AppendCollectionChangeLogPrefix(buf, cid)
+	buf = memcomparable.EncodeInt64(buf, seq)
+	return buf
+}
+
+// DecodeCollectionChangeLogKeySeq returns the seq part of key encoded by EncodeCollectionChangeLogKey
+func DecodeCollectionChangeLogKeySeq(key kv.Key) (seq int64, err error) {
+	if len(key) != collectionPrefixLen+8+len(changeLogPrefix)+8 {
+		err = fmt.Errorf("invalid collection change log key - %q", key)
+		return
+	}
+
+	_, seq, err = memcomparable.DecodeInt64(key[len(key)-8:])
+	return
+}
+
+// EncodeCollectionChangeLogTruncatedKey returns c[cid]_ct
+func EncodeCollectionChangeLogTruncatedKey(buf []byte, cid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(changeLogTruncatedPrefix))
+	}
+	buf = AppendCollectionPrefix(buf, cid)
+	buf = append(buf, changeLogTruncatedPrefix...)
+	return buf
+}
+
+// EncodeCollectionCappedStateKey returns c[cid]_cs
+func EncodeCollectionCappedStateKey(buf []byte, cid int64) kv.Key {
+	if buf == nil {
+		buf = make([]byte, 0, collectionPrefixLen+8+len(cappedStatePrefix))
+	}
+	buf = AppendCollectionPrefix(buf, cid)
+	buf = append(buf, cappedStatePrefix...)
+	return buf
+}
+
+// DecodeCollectionIndexDataKeyDid returns the did part of key encoded by EncodeCollectionIndexDataKey,
+// it only works for auto ids since typed ids are not fixed sized.
+func DecodeCollectionIndexDataKeyDid(key kv.Key) (did []byte, err error) {
+	if len(key) < collectionPrefixLen+8+len(indexDataPrefix)+8+8 {
+		err = fmt.Errorf("invalid collection index data key - %q", key)
+		return
+	}
+
+	did = append([]byte(nil), key[len(key)-8:]...)
+	return
+}
+
 // EncodeMetaSequenceKey returns m_s[keyword]
 func EncodeMetaSequenceKey(buf, keyword []byte) kv.Key {
 	if buf == nil {
@@ -138,9 +275,9 @@ func hasDocumentPrefix(key kv.Key) bool {
 	return bytes.HasPrefix(key, documentPrefixBytes)
 }
 
-// DecodeCollectionDocumentKey is reverse of EncodeCollectionDocumentKey
-func DecodeCollectionDocumentKey(key kv.Key) (cid, did int64, err error) {
-	if len(key) < collectionPrefixLen+8+len(documentPrefix)+8 {
+// DecodeCollectionDocumentKey is reverse of EncodeCollectionDocumentKey, did is a copy
+func DecodeCollectionDocumentKey(key kv.Key) (cid int64, did []byte, err error) {
+	if len(key) <= collectionPrefixLen+8+len(documentPrefix) {
 		err = fmt.Errorf("invalid collection document key - %q", key)
 		return
 	}
@@ -161,12 +298,7 @@ func DecodeCollectionDocumentKey(key kv.Key) (cid, did int64, err error) {
 		return
 	}
 
-	key = key[documentPrefixLen:]
-	key, did, err = memcomparable.DecodeInt64(key)
-	if err != nil {
-		err = fmt.Errorf("invalid collection name to id key - %q", key)
-		return
-	}
+	did = append([]byte(nil), key[documentPrefixLen:]...)
 	return
 }
 
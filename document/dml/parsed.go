@@ -0,0 +1,60 @@
+package dml
+
+import (
+	"bytes"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parsedCache caches what's parsed from the meta of collections or indices by their global ids,
+// so that writes don't parse it again, an entry is parsed again only after the raw meta changed.
+// Entries are deleted by ForgetCollection and ForgetIndex once the owner is dropped.
+type parsedCache struct {
+	m sync.Map // id => *parsedEntry
+}
+
+type parsedEntry struct {
+	raw   bson.Raw
+	value interface{}
+}
+
+var (
+	parsedValidators     parsedCache // cid => *jsonSchema
+	parsedPartialFilters parsedCache // iid => *filter
+)
+
+func (c *parsedCache) load(id int64, raw bson.Raw, parse func(bson.Raw) (interface{}, error)) (value interface{}, err error) {
+	if v, ok := c.m.Load(id); ok {
+		e := v.(*parsedEntry)
+		if bytes.Equal(e.raw, raw) {
+			value = e.value
+			return
+		}
+	}
+
+	value, err = parse(raw)
+	if err != nil {
+		return
+	}
+	c.m.Store(id, &parsedEntry{raw: raw, value: value})
+	return
+}
+
+func (c *parsedCache) delete(id int64) {
+	c.m.Delete(id)
+}
+
+// ForgetCollection drops what's parsed from the meta of collection cid and its indices iids,
+// it's called after the collection is dropped or truncated to a new id.
+func ForgetCollection(cid int64, iids ...int64) {
+	parsedValidators.delete(cid)
+	for _, iid := range iids {
+		ForgetIndex(iid)
+	}
+}
+
+// ForgetIndex drops what's parsed from the meta of index iid, it's called after the index is dropped.
+func ForgetIndex(iid int64) {
+	parsedPartialFilters.delete(iid)
+}
@@ -0,0 +1,54 @@
+package dml
+
+import (
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestParsedCache(t *testing.T) {
+	validator, err := ValidatorSchema(bson.M{"required": bson.A{"name"}})
+	assert.Assert(t, err == nil)
+	partial, err := PartialFilter(bson.M{"n": bson.M{"$gt": 0}})
+	assert.Assert(t, err == nil)
+	iif := &model.IndexInfo{ID: 200, Name: "idx_a", Columns: []string{"a"}, PartialFilter: partial}
+	ci := &model.CollectionInfo{ID: 199, Validator: &model.ValidatorInfo{Schema: validator}}
+	ci.AddIndexInfo(iif)
+
+	s1, err := validatorSchema(ci)
+	assert.Assert(t, err == nil)
+	f1, err := partialFilterOf(iif)
+	assert.Assert(t, err == nil)
+
+	// cloned meta shares the parsed values
+	clone := ci.Clone()
+	s2, err := validatorSchema(clone)
+	assert.Assert(t, err == nil && s2 == s1)
+	f2, err := partialFilterOf(clone.IndexInfo(iif.Name))
+	assert.Assert(t, err == nil && f2 == f1)
+
+	// parsed again after the meta changed
+	ci.Validator.Schema, err = ValidatorSchema(bson.M{"required": bson.A{"age"}})
+	assert.Assert(t, err == nil)
+	s2, err = validatorSchema(ci)
+	assert.Assert(t, err == nil && s2 != s1 && s2.required[0] == "age")
+	iif.PartialFilter, err = PartialFilter(bson.M{"n": bson.M{"$lt": 0}})
+	assert.Assert(t, err == nil)
+	f2, err = partialFilterOf(iif)
+	assert.Assert(t, err == nil && f2 != f1 && f2.op == opLt)
+
+	// entries of dropped collections and indices are deleted
+	ForgetCollection(ci.ID, iif.ID)
+	_, ok := parsedValidators.m.Load(ci.ID)
+	assert.Assert(t, !ok)
+	_, ok = parsedPartialFilters.m.Load(iif.ID)
+	assert.Assert(t, !ok)
+
+	_, err = partialFilterOf(iif)
+	assert.Assert(t, err == nil)
+	ForgetIndex(iif.ID)
+	_, ok = parsedPartialFilters.m.Load(iif.ID)
+	assert.Assert(t, !ok)
+}
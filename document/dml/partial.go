@@ -0,0 +1,205 @@
+package dml
+
+import (
+	"errors"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+var (
+	// ErrPartialFilterNotSupported when partial filter uses operators other than $and, equality, ranges and $exists: true
+	ErrPartialFilterNotSupported = errors.New("partial filter only supports $and, equality, ranges and $exists: true")
+)
+
+// PartialFilter validates a partial filter expression like bson.M{"a": bson.M{"$exists": true}}
+// and returns it marshalled for IndexInfo.
+func PartialFilter(filter interface{}) (raw bson.Raw, err error) {
+	raw, err = toRaw(filter)
+	if err != nil {
+		return
+	}
+	f, err := parseFilterDoc(raw)
+	if err != nil {
+		return
+	}
+	if !supportedByPartial(f) {
+		err = ErrPartialFilterNotSupported
+	}
+	return
+}
+
+func supportedByPartial(f *filter) bool {
+	switch f.op {
+	case opAnd:
+		for _, child := range f.children {
+			if !supportedByPartial(child) {
+				return false
+			}
+		}
+		return true
+	case opEq, opGt, opGte, opLt, opLte:
+		return true
+	case opExists:
+		return f.exists
+	default:
+		return false
+	}
+}
+
+// partialFilterOf returns the parsed partial filter of iif, it's parsed again only after the filter changed
+func partialFilterOf(iif *model.IndexInfo) (f *filter, err error) {
+	v, err := parsedPartialFilters.load(iif.ID, iif.PartialFilter, func(raw bson.Raw) (interface{}, error) {
+		return parseFilterDoc(raw)
+	})
+	if err != nil {
+		return
+	}
+	f = v.(*filter)
+	return
+}
+
+// indexed returns true if doc belongs to the subset indexed by iif
+func indexed(iif *model.IndexInfo, doc bson.Raw) (ok bool, err error) {
+	if iif.Sparse {
+		// like mongo, a sparse compound index skips only documents missing all columns
+		for _, column := range iif.Columns {
+			if len(resolvePath(doc, column)) > 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+
+	if len(iif.PartialFilter) > 0 {
+		var f *filter
+		f, err = partialFilterOf(iif)
+		if err != nil {
+			return
+		}
+		ok = f.match(doc)
+		return
+	}
+
+	ok = true
+	return
+}
+
+// impliesIndexed returns true if every document matching f is indexed by iif,
+// otherwise the index can't serve the query.
+func impliesIndexed(f *filter, iif *model.IndexInfo) bool {
+	conds := []*filter{f}
+	if f.op == opAnd {
+		conds = f.children
+	}
+
+	if iif.Sparse {
+		ok := false
+		for _, column := range iif.Columns {
+			for _, cond := range conds {
+				if cond.path == column && excludesMissing(cond) {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(iif.PartialFilter) > 0 {
+		partial, err := partialFilterOf(iif)
+		if err != nil {
+			return false
+		}
+		var required []*filter
+		flattenAnd(partial, &required)
+		for _, p := range required {
+			ok := false
+			for _, cond := range conds {
+				if cond.path == p.path && implies(cond, p) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func flattenAnd(f *filter, conds *[]*filter) {
+	if f.op != opAnd {
+		*conds = append(*conds, f)
+		return
+	}
+	for _, child := range f.children {
+		flattenAnd(child, conds)
+	}
+}
+
+// excludesMissing returns true if cond never matches documents missing its path
+func excludesMissing(cond *filter) bool {
+	switch cond.op {
+	case opEq, opGt, opGte, opLt, opLte:
+		return !isNull(cond.value)
+	case opIn:
+		for _, v := range cond.values {
+			if isNull(v) {
+				return false
+			}
+		}
+		return true
+	case opExists:
+		return cond.exists
+	default:
+		return false
+	}
+}
+
+// implies returns true if every document matching cond also matches p on the same path,
+// it's conservative and only recognizes the simple cases.
+func implies(cond, p *filter) bool {
+	switch p.op {
+	case opExists:
+		return excludesMissing(cond)
+	case opEq:
+		return cond.op == opEq && dbson.Equal(cond.value, p.value)
+	}
+
+	// p is a range
+	switch cond.op {
+	case opEq:
+		return cond.value.Type != bsontype.Array && matchRange([]bson.RawValue{cond.value}, p.op, p.value)
+	case opIn:
+		for _, v := range cond.values {
+			if v.Type == bsontype.Array || !matchRange([]bson.RawValue{v}, p.op, p.value) {
+				return false
+			}
+		}
+		return len(cond.values) > 0
+	case opGt, opGte, opLt, opLte:
+		if lowerBound(cond.op) != lowerBound(p.op) || dbson.TypeOrder(cond.value.Type) != dbson.TypeOrder(p.value.Type) {
+			return false
+		}
+		c := dbson.Compare(cond.value, p.value)
+		if !lowerBound(p.op) {
+			c = -c
+		}
+		return c > 0 || c == 0 && (p.op == opGte || p.op == opLte || cond.op == p.op)
+	default:
+		return false
+	}
+}
+
+func lowerBound(op string) bool {
+	return op == opGt || op == opGte
+}
@@ -0,0 +1,74 @@
+package dml
+
+import (
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestImpliesIndexed(t *testing.T) {
+	partial, err := PartialFilter(bson.M{"n": bson.M{"$gte": 10}, "s": "on"})
+	assert.Assert(t, err == nil)
+	partialIndex := &model.IndexInfo{Columns: []string{"n"}, PartialFilter: partial}
+	sparseIndex := &model.IndexInfo{Columns: []string{"a", "b"}, Sparse: true}
+
+	for _, c := range []struct {
+		iif     *model.IndexInfo
+		filter  interface{}
+		implies bool
+	}{
+		{partialIndex, bson.M{"n": 10, "s": "on"}, true},
+		{partialIndex, bson.M{"n": bson.M{"$gt": 10}, "s": "on"}, true},
+		{partialIndex, bson.M{"n": bson.M{"$gte": 20, "$lt": 30}, "s": "on", "x": 1}, true},
+		{partialIndex, bson.M{"n": bson.M{"$in": bson.A{10, 11.5}}, "s": "on"}, true},
+		{partialIndex, bson.M{"n": bson.M{"$gte": 9}, "s": "on"}, false},
+		{partialIndex, bson.M{"n": bson.M{"$lt": 20}, "s": "on"}, false},
+		{partialIndex, bson.M{"n": "20", "s": "on"}, false},
+		{partialIndex, bson.M{"n": 20}, false},
+		{partialIndex, bson.M{"$or": bson.A{bson.M{"n": 20, "s": "on"}}}, false},
+		{sparseIndex, bson.M{"b": 1}, true},
+		{sparseIndex, bson.M{"a": bson.M{"$exists": true}}, true},
+		{sparseIndex, bson.M{"a": nil}, false},
+		{sparseIndex, bson.M{"a": bson.M{"$in": bson.A{1, nil}}}, false},
+		{sparseIndex, bson.M{"c": 1}, false},
+		{sparseIndex, nil, false},
+	} {
+		f, err := parseFilter(c.filter)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, impliesIndexed(f, c.iif), c.implies, "%v", c.filter)
+	}
+
+	for _, unsupported := range []interface{}{
+		bson.M{"a": bson.M{"$ne": 1}},
+		bson.M{"a": bson.M{"$exists": false}},
+		bson.M{"$or": bson.A{bson.M{"a": 1}}},
+	} {
+		_, err = PartialFilter(unsupported)
+		assert.Assert(t, err == ErrPartialFilterNotSupported, "%v", unsupported)
+	}
+}
+
+func TestIndexedSubset(t *testing.T) {
+	partial, err := PartialFilter(bson.M{"n": bson.M{"$gt": 0}})
+	assert.Assert(t, err == nil)
+
+	for _, c := range []struct {
+		iif     *model.IndexInfo
+		doc     bson.M
+		entries int
+	}{
+		{&model.IndexInfo{ID: 1, Columns: []string{"a", "b"}, Sparse: true}, bson.M{"c": 1}, 0},
+		{&model.IndexInfo{ID: 1, Columns: []string{"a", "b"}, Sparse: true}, bson.M{"b": nil}, 1},
+		{&model.IndexInfo{ID: 1, Columns: []string{"a"}}, bson.M{"c": 1}, 1},
+		{&model.IndexInfo{ID: 1, Columns: []string{"a"}, PartialFilter: partial}, bson.M{"a": 1, "n": 0}, 0},
+		{&model.IndexInfo{ID: 1, Columns: []string{"a"}, PartialFilter: partial}, bson.M{"a": 1, "n": 1}, 1},
+	} {
+		doc, err := bson.Marshal(c.doc)
+		assert.Assert(t, err == nil)
+		entries, _, err := indexEntries(&model.CollectionInfo{ID: 1}, c.iif, encodeDid(10), doc)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, len(entries), c.entries, "%v", c.doc)
+	}
+}
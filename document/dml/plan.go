@@ -0,0 +1,655 @@
+package dml
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/zhiqiangxu/mondis"
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const (
+	// planProbeLimit is the max number of index entries counted when estimating an index plan,
+	// documents are counted up to collectionProbeFactor times of it, so that an index plan
+	// which hits the limit still wins over a full scan of a much larger collection.
+	planProbeLimit        = 1000
+	collectionProbeFactor = 4
+)
+
+// names of plans in Explanation
+const (
+	PlanCollectionScan = "COLLSCAN"
+	PlanIndexScan      = "IXSCAN"
+	PlanText           = "TEXT"
+	PlanGeo            = "GEO_2D"
+)
+
+type (
+	// Explanation of how a query is executed
+	Explanation struct {
+		// Plan is PlanCollectionScan, PlanIndexScan, PlanText or PlanGeo
+		Plan string
+		// Index used by PlanIndexScan
+		Index string
+		// Covered is true when documents are never read
+		Covered bool
+		// SortFromIndex is true when the sort is served by index order
+		SortFromIndex         bool
+		EstimatedKeysExamined int
+		// KeysExamined is the number of index entries or documents scanned
+		KeysExamined int
+		// DocsExamined is the number of documents read
+		DocsExamined int
+		NReturned    int
+		// Rejected are the candidate plans not chosen
+		Rejected []PlanSummary
+	}
+	// PlanSummary of a candidate plan
+	PlanSummary struct {
+		Plan                  string
+		Index                 string
+		EstimatedKeysExamined int
+		Cost                  int
+	}
+)
+
+// queryPlan describes how to fetch the documents of a query
+type queryPlan struct {
+	// iif is nil for collection scan
+	iif *model.IndexInfo
+	// [start, end) of index entries
+	start, end    kv.Key
+	reverse       bool
+	sortFromIndex bool
+	covered       bool
+	// multikey index may have multiple entries for a document
+	multikey bool
+	// text is not nil for $text served by text index iif
+	text *textSearch
+	// geo is not nil for $near or $geoWithin served by 2d index iif
+	geo *geoQuery
+	// nEq is the number of leading columns bound by equality
+	nEq           int
+	estimatedKeys int
+	cost          int
+}
+
+// execStats are collected while executing a queryPlan
+type execStats struct {
+	keysExamined int
+	docsExamined int
+}
+
+func (p *queryPlan) summary() PlanSummary {
+	s := PlanSummary{Plan: PlanCollectionScan, EstimatedKeysExamined: p.estimatedKeys, Cost: p.cost}
+	if p.iif != nil {
+		s.Plan = PlanIndexScan
+		s.Index = p.iif.Name
+	}
+	if p.text != nil {
+		s.Plan = PlanText
+	}
+	if p.geo != nil {
+		s.Plan = PlanGeo
+	}
+	return s
+}
+
+// planQuery chooses the cheapest plan among a full scan and the public indices of ci,
+// rejected are the other candidates.
+// $text is always served by text index, and geo conditions by 2d index if any.
+func planQuery(t mondis.ProviderKVOP, ci *model.CollectionInfo, f *filter, proj *projection, sortKeys []sortKey, opts *FindOptions) (best *queryPlan, rejected []*queryPlan, err error) {
+	if ts := f.textSearch(); ts != nil {
+		best, err = textPlan(ci, f, ts)
+		return
+	}
+	if cond := f.geoCond(); cond != nil {
+		best, err = geoPlan(ci, f, cond)
+		if err != nil || best != nil {
+			return
+		}
+	}
+
+	preds := indexablePredicates(f)
+	exact := f.op == opAnd && len(preds) == len(f.children) || f.op != opAnd && len(preds) == 1
+
+	var (
+		filterPaths []string
+		candidates  []*queryPlan
+		// whether each candidate consumes all predicates of an exact filter
+		consumesAll []bool
+	)
+	f.collectPaths(&filterPaths)
+	for _, name := range ci.IndexOrder {
+		iif := ci.Indices[name]
+		if iif == nil || iif.Kind != model.IndexKindRegular || iif.State != osc.StatePublic || !impliesIndexed(f, iif) {
+			continue
+		}
+
+		var (
+			p        *queryPlan
+			consumed int
+			multikey bool
+		)
+		multikey, err = isMultikey(t, ci.ID, iif.ID)
+		if err != nil {
+			return
+		}
+		p, consumed, err = indexPlan(ci.ID, iif, preds, sortKeys, multikey)
+		if err != nil {
+			return
+		}
+		if p == nil {
+			continue
+		}
+		p.covered = !multikey && coversQuery(iif, filterPaths, proj, sortKeys)
+		candidates = append(candidates, p)
+		consumesAll = append(consumesAll, exact && consumed == len(preds))
+	}
+
+	best = &queryPlan{}
+	if len(candidates) == 0 {
+		// the full scan is the only plan, no need to estimate
+		return
+	}
+
+	n, err := countKeys(t, AppendCollectionDocumentPrefix(nil, ci.ID), nil, nil, planProbeLimit*collectionProbeFactor)
+	if err != nil {
+		return
+	}
+	best.estimatedKeys, best.cost = n, n
+	if len(sortKeys) > 0 {
+		// penalty of the blocking sort
+		best.cost += n
+	}
+
+	for i, p := range candidates {
+		p.estimatedKeys, err = countKeys(t, AppendCollectionIndexPrefix(nil, ci.ID, p.iif.ID), p.start, p.end, planProbeLimit)
+		if err != nil {
+			return
+		}
+
+		keys := p.estimatedKeys
+		if p.sortFromIndex && consumesAll[i] && opts.Limit > 0 && opts.Skip+opts.Limit < keys {
+			// scan stops early
+			keys = opts.Skip + opts.Limit
+		}
+		p.cost = keys
+		if !p.covered {
+			p.cost += keys
+		}
+		if len(sortKeys) > 0 && !p.sortFromIndex {
+			p.cost += keys
+		}
+
+		if p.cost < best.cost || p.cost == best.cost && best.iif != nil && p.nEq > best.nEq {
+			rejected = append(rejected, best)
+			best = p
+		} else {
+			rejected = append(rejected, p)
+		}
+	}
+	return
+}
+
+// indexablePredicates returns the top level conditions that can bound an index scan
+func indexablePredicates(f *filter) (preds []*filter) {
+	conds := []*filter{f}
+	if f.op == opAnd {
+		conds = f.children
+	}
+	for _, cond := range conds {
+		switch cond.op {
+		case opEq:
+		case opGt, opGte, opLt, opLte:
+			if isNull(cond.value) {
+				continue
+			}
+		default:
+			continue
+		}
+		// index entries of arrays are their elements
+		if cond.value.Type == bsontype.Array {
+			continue
+		}
+		if _, err := encodeIndexValue(nil, cond.value, false); err != nil {
+			continue
+		}
+		preds = append(preds, cond)
+	}
+	return
+}
+
+// indexPlan binds leading columns of iif by equality and the next column by range,
+// nil is returned if no predicate or sort key can use iif.
+// Like mongo, range conditions are not intersected for multikey index since they may be
+// satisfied by different elements, and the sort is not served by it.
+func indexPlan(cid int64, iif *model.IndexInfo, preds []*filter, sortKeys []sortKey, multikey bool) (p *queryPlan, consumed int, err error) {
+	prefix := AppendCollectionIndexPrefix(nil, cid, iif.ID)
+	p = &queryPlan{iif: iif, multikey: multikey}
+	eqColumns := make(map[string]bool)
+
+	var hasRange bool
+	for i, column := range iif.Columns {
+		var eq *filter
+		var ranges []*filter
+		for _, pred := range preds {
+			if pred.path != column {
+				continue
+			}
+			if pred.op == opEq {
+				if eq == nil {
+					eq = pred
+				}
+			} else {
+				ranges = append(ranges, pred)
+			}
+		}
+
+		if eq != nil {
+			prefix, err = encodeIndexValue(prefix, eq.value, iif.IsDesc(i))
+			if err != nil {
+				return
+			}
+			p.nEq++
+			consumed++
+			eqColumns[column] = true
+			continue
+		}
+
+		if len(ranges) > 0 {
+			if multikey {
+				ranges = ranges[:1]
+			}
+			p.start, p.end, err = rangeBounds(prefix, ranges, iif.IsDesc(i))
+			if err != nil {
+				return
+			}
+			hasRange = true
+			consumed += len(ranges)
+		}
+		break
+	}
+
+	if !hasRange {
+		p.start = prefix
+		p.end = prefix.PrefixNext()
+	}
+
+	if !multikey {
+		p.sortFromIndex, p.reverse = sortFromIndex(iif, p.nEq, eqColumns, sortKeys)
+	}
+	if consumed == 0 && !p.sortFromIndex {
+		p = nil
+	}
+	return
+}
+
+// rangeBounds intersects range conditions on the column right after prefix,
+// mongo only compares values of the same type order, so each bound is limited to its type bracket.
+// For descending column, the lower bound of value is the upper bound of key.
+func rangeBounds(prefix kv.Key, ranges []*filter, desc bool) (start, end kv.Key, err error) {
+	start, end = prefix, prefix.PrefixNext()
+	var (
+		lower, upper []byte
+		bound        kv.Key
+	)
+	for _, r := range ranges {
+		lower, upper, err = typeBracket(r.value, desc)
+		if err != nil {
+			return
+		}
+		start = maxKey(start, append(prefix.Clone(), lower...))
+		end = minKey(end, append(prefix.Clone(), upper...))
+
+		bound, err = encodeIndexValue(prefix.Clone(), r.value, desc)
+		if err != nil {
+			return
+		}
+		op := r.op
+		if desc {
+			op = reversedOps[op]
+		}
+		switch op {
+		case opGt:
+			start = maxKey(start, bound.PrefixNext())
+		case opGte:
+			start = maxKey(start, bound)
+		case opLt:
+			end = minKey(end, bound)
+		case opLte:
+			end = minKey(end, bound.PrefixNext())
+		}
+	}
+	return
+}
+
+// reversedOps maps range operators for descending column
+var reversedOps = map[string]string{opGt: opLt, opGte: opLte, opLt: opGt, opLte: opGte}
+
+func maxKey(a, b kv.Key) kv.Key {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+func minKey(a, b kv.Key) kv.Key {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// sortFromIndex checks whether sortKeys follow the index columns after the equality bound ones,
+// sort keys on equality bound columns are constant and ignored.
+func sortFromIndex(iif *model.IndexInfo, nEq int, eqColumns map[string]bool, sortKeys []sortKey) (ok, reverse bool) {
+	if len(sortKeys) == 0 {
+		return
+	}
+
+	i := nEq
+	first := true
+	for _, key := range sortKeys {
+		if eqColumns[key.path] {
+			continue
+		}
+		if i >= len(iif.Columns) || iif.Columns[i] != key.path {
+			return
+		}
+		// scan backward when the sort direction is opposite to the column's
+		backward := key.asc == iif.IsDesc(i)
+		if first {
+			reverse = backward
+			first = false
+		} else if reverse != backward {
+			return
+		}
+		i++
+	}
+	ok = true
+	return
+}
+
+// coversQuery returns true if all paths needed by the query are index columns,
+// so that documents can be rebuilt from index entries.
+func coversQuery(iif *model.IndexInfo, filterPaths []string, proj *projection, sortKeys []sortKey) bool {
+	if proj == nil || !proj.include {
+		return false
+	}
+
+	columns := make(map[string]bool)
+	for _, column := range iif.Columns {
+		columns[column] = true
+	}
+
+	var projPaths []string
+	proj.collectPaths("", &projPaths)
+	paths := append(append([]string(nil), filterPaths...), projPaths...)
+	for _, key := range sortKeys {
+		paths = append(paths, key.path)
+	}
+	for _, path := range paths {
+		if !columns[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// collectPaths appends all paths referred by f
+func (f *filter) collectPaths(paths *[]string) {
+	if f.op == opAnd || f.op == opOr {
+		for _, child := range f.children {
+			child.collectPaths(paths)
+		}
+		return
+	}
+	if f.op == opText {
+		return
+	}
+	*paths = append(*paths, f.path)
+}
+
+// collectPaths appends the full paths of the leaves of p
+func (p *projection) collectPaths(prefix string, paths *[]string) {
+	for name, child := range p.fields {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if len(child.fields) == 0 {
+			*paths = append(*paths, path)
+			continue
+		}
+		child.collectPaths(path, paths)
+	}
+}
+
+// countKeys counts keys with prefix in [start, end) up to limit, nil start or end means unbounded
+func countKeys(t mondis.ProviderKVOP, prefix, start, end kv.Key, limit int) (n int, err error) {
+	if start == nil {
+		start = prefix
+	}
+	err = t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: start, KeyOnly: true}, func(key []byte, _ []byte, _ mondis.VMetaResp) bool {
+		if end != nil && bytes.Compare(key, end) >= 0 || n >= limit {
+			return false
+		}
+		n++
+		return true
+	})
+	return
+}
+
+// fetch returns a fetch function executing the plan,
+// documents not matching f are skipped.
+func (p *queryPlan) fetch(t mondis.ProviderKVOP, ci *model.CollectionInfo, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	if p.iif == nil {
+		return scanDocs(t, ci.ID, f, stats)
+	}
+	if p.text != nil {
+		return scanText(t, ci, p, f, stats)
+	}
+	if p.geo != nil {
+		return scanGeo(t, ci, p, f, stats)
+	}
+	return scanIndex(t, ci, p, f, stats)
+}
+
+// scanIndex returns a fetch function that scans the index entries of p in batches
+func scanIndex(t mondis.ProviderKVOP, ci *model.CollectionInfo, p *queryPlan, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	prefix := AppendCollectionIndexPrefix(nil, ci.ID, p.iif.ID)
+	start, end := p.start, p.end
+	finished := start.Cmp(end) >= 0
+	// keyed by did
+	var seen map[string]bool
+	if p.multikey {
+		seen = make(map[string]bool)
+	}
+
+	type entry struct {
+		did   []byte
+		key   []byte
+		types []byte
+	}
+	return func() (docs []cursorDoc, err error) {
+		for len(docs) == 0 && !finished {
+			var (
+				entries []entry
+				did     []byte
+				rest    []byte
+			)
+			fn := func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+				if p.reverse {
+					if bytes.Compare(key, end) >= 0 {
+						return true
+					}
+					if bytes.Compare(key, start) < 0 {
+						return false
+					}
+				} else if bytes.Compare(key, end) >= 0 {
+					return false
+				}
+				if len(entries) >= findBatchSize {
+					return false
+				}
+
+				did, rest, err = decodeIndexEntryDid(ci, p.iif, key, value)
+				if err != nil {
+					return false
+				}
+				stats.keysExamined++
+				if seen != nil {
+					if seen[string(did)] {
+						return true
+					}
+					seen[string(did)] = true
+				}
+				entries = append(entries, entry{
+					did:   did,
+					key:   append([]byte(nil), key...),
+					types: append([]byte(nil), decodeIndexEntryTypes(p.iif, rest)...),
+				})
+				return true
+			}
+
+			var scanErr error
+			if p.reverse {
+				scanErr = t.Scan(mondis.ProviderScanOption{Reverse: true, Offset: end}, fn)
+			} else {
+				scanErr = t.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: start}, fn)
+			}
+			if err == nil {
+				err = scanErr
+			}
+			if err != nil {
+				return
+			}
+
+			if len(entries) < findBatchSize {
+				finished = true
+			} else if p.reverse {
+				end = entries[len(entries)-1].key
+			} else {
+				start = kv.Key(entries[len(entries)-1].key).Next()
+			}
+
+			var doc bson.Raw
+			for _, e := range entries {
+				doc = nil
+				if p.covered && len(e.types) > 0 {
+					doc, err = rebuildDoc(p.iif, e.key[len(prefix):], e.types)
+					if err != nil {
+						return
+					}
+				}
+				if doc == nil {
+					doc, _, err = t.Get(EncodeCollectionDocumentKey(nil, ci.ID, e.did))
+					if err == kv.ErrKeyNotFound {
+						err = nil
+						continue
+					}
+					if err != nil {
+						return
+					}
+					stats.docsExamined++
+				}
+				if !f.match(doc) {
+					continue
+				}
+				docs = append(docs, cursorDoc{did: e.did, doc: doc})
+			}
+		}
+		return
+	}
+}
+
+// rebuildDoc rebuilds a document containing the index columns from encoded values,
+// nil is returned if some value is not decodable.
+func rebuildDoc(iif *model.IndexInfo, values []byte, types []byte) (doc bson.Raw, err error) {
+	var (
+		d  bson.D
+		rv bson.RawValue
+	)
+	for i, column := range iif.Columns {
+		values, rv, err = decodeIndexValue(values, bsontype.Type(types[i]), iif.IsDesc(i))
+		if err == dbson.ErrNotDecodable {
+			// fall back to reading the document
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if rv.Type == 0 {
+			continue
+		}
+		d = setPath(d, strings.Split(column, "."), rv)
+	}
+	return bson.Marshal(d)
+}
+
+// setPath sets the value of a dotted path in d
+func setPath(d bson.D, parts []string, v bson.RawValue) bson.D {
+	for i, e := range d {
+		if e.Key != parts[0] {
+			continue
+		}
+		if len(parts) > 1 {
+			if sub, ok := e.Value.(bson.D); ok {
+				d[i].Value = setPath(sub, parts[1:], v)
+			}
+		}
+		return d
+	}
+
+	if len(parts) == 1 {
+		return append(d, bson.E{Key: parts[0], Value: v})
+	}
+	return append(d, bson.E{Key: parts[0], Value: setPath(nil, parts[1:], v)})
+}
+
+// Explain runs the query and returns how it's executed
+func (c *Collection) Explain(filter interface{}, opts *FindOptions, t *txn.Txn) (ex *Explanation, err error) {
+	cursor, err := c.Find(filter, opts, t)
+	if err != nil {
+		return
+	}
+
+	ex, err = explainCursor(cursor)
+	return
+}
+
+// explainCursor drains and closes cursor, then returns how it's executed
+func explainCursor(cursor *Cursor) (ex *Explanation, err error) {
+	defer cursor.Close()
+
+	for cursor.Next() {
+	}
+	err = cursor.Err()
+	if err != nil {
+		return
+	}
+
+	p := cursor.plan
+	ex = &Explanation{
+		Covered:               p.covered,
+		SortFromIndex:         p.sortFromIndex,
+		EstimatedKeysExamined: p.estimatedKeys,
+		KeysExamined:          cursor.stats.keysExamined,
+		DocsExamined:          cursor.stats.docsExamined,
+		NReturned:             cursor.n,
+	}
+	s := p.summary()
+	ex.Plan, ex.Index = s.Plan, s.Index
+	for _, r := range cursor.rejected {
+		ex.Rejected = append(ex.Rejected, r.summary())
+	}
+	return
+}
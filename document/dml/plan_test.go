@@ -0,0 +1,210 @@
+package dml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestIndexPlan(t *testing.T) {
+	iif := &model.IndexInfo{ID: 2, Name: "idx", Columns: []string{"a", "b"}}
+
+	keyOf := func(a, b interface{}, did int64) []byte {
+		values, err := encodeLookupValues(nil, iif, 0, []interface{}{a, b})
+		assert.Assert(t, err == nil)
+		return EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(did))
+	}
+	planOf := func(filter interface{}, sort interface{}) (*queryPlan, int) {
+		f, err := parseFilter(filter)
+		assert.Assert(t, err == nil)
+		keys, err := parseSort(sort)
+		assert.Assert(t, err == nil)
+		p, consumed, err := indexPlan(1, iif, indexablePredicates(f), keys, false)
+		assert.Assert(t, err == nil)
+		return p, consumed
+	}
+	in := func(p *queryPlan, key []byte) bool {
+		return bytes.Compare(key, p.start) >= 0 && bytes.Compare(key, p.end) < 0
+	}
+
+	{
+		// a == 1 and 2 < b <= 3
+		p, consumed := planOf(bson.M{"a": 1, "b": bson.M{"$gt": 2, "$lte": 3}}, nil)
+		assert.Assert(t, p != nil && p.nEq == 1 && consumed == 3)
+		assert.Assert(t, !in(p, keyOf(1, 2, 100)))
+		assert.Assert(t, in(p, keyOf(1, 2.5, 100)))
+		assert.Assert(t, in(p, keyOf(1, int64(3), 100)))
+		assert.Assert(t, !in(p, keyOf(1, 3.5, 1)))
+		assert.Assert(t, !in(p, keyOf(2, 2.5, 1)))
+	}
+
+	{
+		// range bounds stay inside the type bracket
+		p, _ := planOf(bson.M{"a": bson.M{"$gt": 1}}, nil)
+		assert.Assert(t, in(p, keyOf(2, nil, 1)))
+		assert.Assert(t, !in(p, keyOf("2", nil, 1)))
+		assert.Assert(t, !in(p, keyOf(true, nil, 1)))
+
+		p, _ = planOf(bson.M{"a": bson.M{"$gt": 1, "$lt": "z"}}, nil)
+		assert.Assert(t, p.start.Cmp(p.end) >= 0)
+	}
+
+	{
+		// b alone can't use the index
+		p, _ := planOf(bson.M{"b": 1}, nil)
+		assert.Assert(t, p == nil)
+
+		// but sort on a can
+		p, _ = planOf(bson.M{"b": 1}, bson.D{{Key: "a", Value: -1}})
+		assert.Assert(t, p != nil && p.sortFromIndex && p.reverse)
+
+		// sort key on an equality bound column is ignored
+		p, _ = planOf(bson.M{"a": 1}, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}})
+		assert.Assert(t, p.sortFromIndex && !p.reverse)
+
+		// mixed directions can't be served unless the column is equality bound
+		p, _ = planOf(bson.M{"a": 1}, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: -1}})
+		assert.Assert(t, p.sortFromIndex && p.reverse)
+		p, _ = planOf(nil, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: -1}})
+		assert.Assert(t, p == nil)
+	}
+}
+
+func TestIndexPlanDesc(t *testing.T) {
+	iif := &model.IndexInfo{ID: 2, Name: "idx", Columns: []string{"a", "b"}, Desc: []bool{false, true}}
+
+	keyOf := func(a, b interface{}, did int64) []byte {
+		values, err := encodeLookupValues(nil, iif, 0, []interface{}{a, b})
+		assert.Assert(t, err == nil)
+		return EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(did))
+	}
+	planOf := func(filter interface{}, sort interface{}) *queryPlan {
+		f, err := parseFilter(filter)
+		assert.Assert(t, err == nil)
+		keys, err := parseSort(sort)
+		assert.Assert(t, err == nil)
+		p, _, err := indexPlan(1, iif, indexablePredicates(f), keys, false)
+		assert.Assert(t, err == nil)
+		return p
+	}
+	in := func(p *queryPlan, key []byte) bool {
+		return bytes.Compare(key, p.start) >= 0 && bytes.Compare(key, p.end) < 0
+	}
+
+	p := planOf(bson.M{"a": 1, "b": bson.M{"$gt": 2, "$lte": 3}}, nil)
+	assert.Assert(t, !in(p, keyOf(1, 2, 100)))
+	assert.Assert(t, in(p, keyOf(1, 2.5, 100)))
+	assert.Assert(t, in(p, keyOf(1, 3, 100)))
+	assert.Assert(t, !in(p, keyOf(1, 3.5, 100)))
+	assert.Assert(t, !in(p, keyOf(1, "3", 100)))
+
+	// {a: 1, b: -1} is served forward, {a: -1, b: 1} backward
+	p = planOf(nil, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: -1}})
+	assert.Assert(t, p.sortFromIndex && !p.reverse)
+	p = planOf(nil, bson.D{{Key: "a", Value: -1}, {Key: "b", Value: 1}})
+	assert.Assert(t, p.sortFromIndex && p.reverse)
+	p = planOf(nil, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}})
+	assert.Assert(t, p == nil)
+}
+
+func TestPlanQueryEstimation(t *testing.T) {
+	kvdb, closeFunc := openTestKV(t)
+	defer closeFunc()
+
+	for did := int64(1); did <= 10; did++ {
+		doc, err := bson.Marshal(bson.M{"a": did})
+		assert.Assert(t, err == nil)
+		assert.Assert(t, kvdb.Set(EncodeCollectionDocumentKey(nil, 1, encodeDid(did)), doc, nil) == nil)
+	}
+	n, err := countKeys(kvdb, AppendCollectionDocumentPrefix(nil, 1), nil, nil, 100)
+	assert.Assert(t, err == nil && n == 10)
+
+	f, err := parseFilter(bson.M{"a": 1})
+	assert.Assert(t, err == nil)
+
+	// the full scan is not estimated without index candidates
+	ci := &model.CollectionInfo{ID: 1}
+	best, rejected, err := planQuery(kvdb, ci, f, nil, nil, &FindOptions{})
+	assert.Assert(t, err == nil && best.iif == nil && best.estimatedKeys == 0 && len(rejected) == 0)
+
+	iif := &model.IndexInfo{ID: 2, Name: "idx_a", Columns: []string{"a"}, State: osc.StatePublic}
+	ci.AddIndexInfo(iif)
+	best, rejected, err = planQuery(kvdb, ci, f, nil, nil, &FindOptions{})
+	assert.Assert(t, err == nil && best.iif != nil && best.iif.Name == iif.Name && len(rejected) == 1 && rejected[0].estimatedKeys == 10)
+}
+
+func TestMultikey(t *testing.T) {
+	iif := &model.IndexInfo{ID: 2, Columns: []string{"a", "tags"}}
+	entriesOf := func(doc interface{}) (map[string][]byte, bool, error) {
+		raw, err := bson.Marshal(doc)
+		assert.Assert(t, err == nil)
+		return indexEntries(&model.CollectionInfo{ID: 1}, iif, encodeDid(10), raw)
+	}
+	keyOf := func(a, tag interface{}) string {
+		values, err := encodeLookupValues(nil, iif, 0, []interface{}{a, tag})
+		assert.Assert(t, err == nil)
+		return string(EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(10)))
+	}
+
+	// one entry per distinct element, without types for covering
+	entries, multikey, err := entriesOf(bson.M{"a": 1, "tags": bson.A{"x", "y", "x"}})
+	assert.Assert(t, err == nil && multikey && len(entries) == 2)
+	for _, key := range []string{keyOf(1, "x"), keyOf(1, "y")} {
+		value, ok := entries[key]
+		assert.Assert(t, ok && decodeIndexEntryTypes(iif, value) == nil)
+	}
+
+	// empty array is indexed as null
+	entries, _, err = entriesOf(bson.M{"a": 1, "tags": bson.A{}})
+	assert.Assert(t, err == nil && len(entries) == 1)
+	_, ok := entries[keyOf(1, nil)]
+	assert.Assert(t, ok)
+
+	// arrays of documents are traversed
+	iif.Columns = []string{"a", "tags.n"}
+	entries, multikey, err = entriesOf(bson.M{"a": 1, "tags": bson.A{bson.M{"n": 1}, bson.M{"n": 2}}})
+	assert.Assert(t, err == nil && multikey && len(entries) == 2)
+
+	_, _, err = entriesOf(bson.M{"a": bson.A{1}, "tags": bson.A{bson.M{"n": 1}}})
+	assert.Assert(t, err == ErrParallelArrays)
+
+	// ranges are not intersected and sort is not served by multikey index
+	f, err := parseFilter(bson.M{"a": 1, "tags.n": bson.M{"$gt": 1, "$lt": 3}})
+	assert.Assert(t, err == nil)
+	keys, err := parseSort(bson.D{{Key: "tags.n", Value: 1}})
+	assert.Assert(t, err == nil)
+	p, consumed, err := indexPlan(1, iif, indexablePredicates(f), keys, true)
+	assert.Assert(t, err == nil && consumed == 2 && !p.sortFromIndex)
+	values, err := encodeLookupValues(nil, iif, 0, []interface{}{1, 2})
+	assert.Assert(t, err == nil)
+	key := EncodeCollectionIndexDataKey(nil, 1, iif.ID, values, encodeDid(10))
+	assert.Assert(t, bytes.Compare(key, p.start) >= 0 && bytes.Compare(key, p.end) < 0)
+}
+
+func TestRebuildDoc(t *testing.T) {
+	iif := &model.IndexInfo{Columns: []string{"a", "b.c", "b.d", "e"}, Desc: []bool{false, true, false, true}}
+	doc, err := bson.Marshal(bson.D{
+		{Key: "a", Value: int64(1)},
+		{Key: "b", Value: bson.D{{Key: "c", Value: "x"}, {Key: "d", Value: int32(2)}}},
+		{Key: "z", Value: 1},
+	})
+	assert.Assert(t, err == nil)
+
+	entries, multikey, err := indexEntries(&model.CollectionInfo{ID: 1}, iif, encodeDid(10), doc)
+	assert.Assert(t, err == nil && len(entries) == 1 && !multikey)
+	prefix := AppendCollectionIndexPrefix(nil, 1, iif.ID)
+	var rebuilt bson.Raw
+	for key, value := range entries {
+		rebuilt, err = rebuildDoc(iif, []byte(key)[len(prefix):], decodeIndexEntryTypes(iif, value))
+		assert.Assert(t, err == nil)
+	}
+
+	var m bson.M
+	assert.Assert(t, bson.Unmarshal(rebuilt, &m) == nil)
+	// types are kept and missing columns stay missing
+	assert.DeepEqual(t, m, bson.M{"a": int64(1), "b": bson.M{"c": "x", "d": int32(2)}})
+}
@@ -0,0 +1,83 @@
+package dml
+
+import (
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/mondis/kv"
+)
+
+// ScanOptions for Scan
+type ScanOptions struct {
+	// BatchSize is the number of documents read at a time, 0 means 100
+	BatchSize int
+	// AfterID resumes a scan after the document with this _id, which is the did for auto ids,
+	// nil means from the beginning
+	AfterID interface{}
+}
+
+// Scan for iterate over all documents of collection in _id order, the returned cursor must be closed after use.
+// When t is nil, each batch is read in a new transaction resuming after the last document,
+// so there's no transaction size limit, but documents changed during the scan may or may not be seen.
+func (c *Collection) Scan(opts *ScanOptions, t *txn.Txn) (cursor *Cursor, err error) {
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = findBatchSize
+	}
+
+	startT := t
+	if t == nil {
+		startT = c.Txn(false)
+		defer startT.Discard()
+	}
+
+	ci := startT.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	if t != nil {
+		t.ReferredCollections(ci.ID)
+	}
+
+	cid := ci.ID
+	prefix := AppendCollectionDocumentPrefix(nil, cid)
+	next := kv.Key(prefix)
+	if opts.AfterID != nil {
+		var did []byte
+		did, err = marshalID(ci, opts.AfterID)
+		if err != nil {
+			return
+		}
+		next = kv.Key(EncodeCollectionDocumentKey(nil, cid, did)).Next()
+	}
+	f, _ := parseFilter(nil)
+	stats := &execStats{}
+
+	fetch := func() (docs []cursorDoc, err error) {
+		if next == nil {
+			return
+		}
+
+		batchT := t
+		if batchT == nil {
+			batchT = c.Txn(false)
+			defer batchT.Discard()
+
+			ci := batchT.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+			if ci == nil || ci.ID != cid {
+				err = ErrCollectionNotExists
+				return
+			}
+		}
+
+		docs, next, err = scanBatch(batchT, prefix, next, f, batchSize, stats)
+		return
+	}
+
+	cursor = newCursor(fetch, 0, 0, nil, nil)
+	cursor.idType = ci.IDType
+	return
+}
@@ -5,7 +5,6 @@ import (
 	"sync"
 
 	"github.com/zhiqiangxu/mondis"
-	"github.com/zhiqiangxu/mondis/document/config"
 	"github.com/zhiqiangxu/mondis/document/meta"
 	"github.com/zhiqiangxu/mondis/document/meta/sequence"
 )
@@ -26,7 +25,8 @@ func GetSequence(cid int64) *sequence.Hash {
 	return ret
 }
 
-// CreateSequence by cid, non thread safe
+// CreateSequence by cid, non thread safe,
+// the sequence of change events is created along with it
 func CreateSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (err error) {
 	_, exists := sequenceMap.Load(cid)
 	if exists {
@@ -38,6 +38,10 @@ func CreateSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (err error) {
 	if err != nil {
 		return
 	}
+	err = createChangeLogSequence(kvdb, dbID, cid, bandwidth)
+	if err != nil {
+		return
+	}
 
 	_, loaded := sequenceMap.LoadOrStore(cid, seq)
 	if loaded {
@@ -47,7 +51,8 @@ func CreateSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (err error) {
 	return
 }
 
-// DropSequence by cid, non thread safe
+// DropSequence by cid, non thread safe,
+// remaining ids are not released since the collection is dropped
 func DropSequence(cid int64) (err error) {
 	v, exists := sequenceMap.Load(cid)
 	if !exists {
@@ -57,7 +62,11 @@ func DropSequence(cid int64) (err error) {
 
 	sequenceMap.Delete(cid)
 
-	err = v.(*sequence.Hash).Close(config.Load().Lease == 0)
+	err = v.(*sequence.Hash).Close(false)
+	if err != nil {
+		return
+	}
+	err = dropChangeLogSequence(cid)
 	return
 }
 
@@ -70,6 +79,10 @@ func DropSequenceIfExists(cid int64) (err error) {
 
 	sequenceMap.Delete(cid)
 
-	err = v.(*sequence.Hash).Close(config.Load().Lease == 0)
+	err = v.(*sequence.Hash).Close(false)
+	if err != nil {
+		return
+	}
+	err = dropChangeLogSequence(cid)
 	return
 }
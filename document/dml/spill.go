@@ -0,0 +1,150 @@
+package dml
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/keyspace"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+)
+
+const (
+	spillBatchSize = 100
+	dropBatchSize  = 1000
+	seqLen         = 8
+)
+
+// ids of spills, seeded by time so that leftovers of previous processes don't collide
+var spillID = time.Now().UnixNano()
+
+// spill stores temporary entries under t[id] in the kv,
+// entries are read back in the order of keys, entries with the same key in the order they're put.
+type spill struct {
+	kvdb   mondis.KVDB
+	prefix kv.Key
+	seq    int64
+	wb     mondis.ProviderWriteBatch
+	n      int
+}
+
+type spillEntry struct {
+	key   []byte
+	value []byte
+}
+
+func newSpill(kvdb mondis.KVDB) *spill {
+	prefix := append(kv.Key(nil), keyspace.TempPrefixBytes...)
+	prefix = memcomparable.EncodeInt64(prefix, atomic.AddInt64(&spillID, 1))
+	return &spill{kvdb: kvdb, prefix: prefix}
+}
+
+// put appends an entry, it's visible after flush
+func (s *spill) put(key, value []byte) (err error) {
+	if s.wb == nil {
+		s.wb = s.kvdb.WriteBatch()
+	}
+
+	k := append(s.prefix.Clone(), key...)
+	k = memcomparable.EncodeInt64(k, s.seq)
+	s.seq++
+	err = s.wb.Set(k, value)
+	if err != nil {
+		return
+	}
+	s.n++
+	return
+}
+
+func (s *spill) flush() (err error) {
+	if s.wb == nil {
+		return
+	}
+	err = s.wb.Commit()
+	s.wb = nil
+	return
+}
+
+// reader returns a function that reads entries in batches, an empty batch means the end.
+func (s *spill) reader() func() ([]spillEntry, error) {
+	next := s.prefix.Clone()
+	return func() (entries []spillEntry, err error) {
+		if next == nil {
+			return
+		}
+
+		var lastKey kv.Key
+		err = s.kvdb.Scan(mondis.ProviderScanOption{Prefix: s.prefix, Offset: next}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+			if len(entries) >= spillBatchSize {
+				return false
+			}
+			lastKey = append(lastKey[:0], key...)
+			entries = append(entries, spillEntry{
+				key:   append([]byte(nil), key[len(s.prefix):len(key)-seqLen]...),
+				value: append([]byte(nil), value...),
+			})
+			return true
+		})
+		if err != nil {
+			return
+		}
+
+		if len(entries) < spillBatchSize {
+			next = nil
+		} else {
+			next = lastKey.Next()
+		}
+		return
+	}
+}
+
+// drop deletes all entries of s
+func (s *spill) drop() (err error) {
+	if s.wb != nil {
+		s.wb.Discard()
+		s.wb = nil
+	}
+	if s.n == 0 {
+		return
+	}
+
+	err = dropPrefix(s.kvdb, s.prefix)
+	if err != nil {
+		return
+	}
+	s.n = 0
+	return
+}
+
+// DropTempData deletes temporary data left by previous processes
+func DropTempData(kvdb mondis.KVDB) error {
+	return dropPrefix(kvdb, keyspace.TempPrefixBytes)
+}
+
+// dropPrefix deletes all keys with prefix by write batches
+func dropPrefix(kvdb mondis.KVDB, prefix []byte) (err error) {
+	for {
+		var keys [][]byte
+		err = kvdb.Scan(mondis.ProviderScanOption{Prefix: prefix, Offset: prefix}, func(key []byte, _ []byte, _ mondis.VMetaResp) bool {
+			keys = append(keys, append([]byte(nil), key...))
+			return len(keys) < dropBatchSize
+		})
+		if err != nil || len(keys) == 0 {
+			return
+		}
+
+		wb := kvdb.WriteBatch()
+		for _, key := range keys {
+			err = wb.Delete(key)
+			if err != nil {
+				wb.Discard()
+				return
+			}
+		}
+		err = wb.Commit()
+		if err != nil {
+			return
+		}
+	}
+}
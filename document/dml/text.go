@@ -0,0 +1,376 @@
+package dml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/analysis"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrTextIndexRequired when $text is used on a collection without a usable text index
+	ErrTextIndexRequired = errors.New("$text requires a text index")
+	// ErrTextNotTopLevel when $text is nested in $and or $or
+	ErrTextNotTopLevel = errors.New("$text must be at the top level of filter")
+	// ErrTextIndexLookup when Lookup is called on a text index
+	ErrTextIndexLookup = errors.New("text index can only be used by $text")
+	// ErrAnalyzerNotFound when the analyzer of text index is not registered
+	ErrAnalyzerNotFound = errors.New("analyzer not found")
+)
+
+// modes of $text
+const (
+	textModeOr  = "or"
+	textModeAnd = "and"
+)
+
+// textSearch is the parsed form of {$text: {$search: "some words", $mode: "and"}},
+// by default documents matching any term are returned.
+type textSearch struct {
+	search string
+	and    bool
+}
+
+func parseText(v bson.RawValue) (f *filter, err error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		err = fmt.Errorf("%s needs a document", opText)
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	ts := &textSearch{}
+	var hasSearch bool
+	for _, e := range elements {
+		switch e.Key() {
+		case "$search":
+			ts.search, ok = e.Value().StringValueOK()
+			if !ok {
+				err = fmt.Errorf("$search needs a string")
+				return
+			}
+			hasSearch = true
+		case "$mode":
+			mode, _ := e.Value().StringValueOK()
+			switch mode {
+			case textModeOr:
+			case textModeAnd:
+				ts.and = true
+			default:
+				err = fmt.Errorf("$mode must be %s or %s", textModeOr, textModeAnd)
+				return
+			}
+		default:
+			err = fmt.Errorf("unknown %s option %s", opText, e.Key())
+			return
+		}
+	}
+	if !hasSearch {
+		err = fmt.Errorf("%s needs $search", opText)
+		return
+	}
+
+	f = &filter{op: opText, text: ts}
+	return
+}
+
+// textSearch returns the top level $text of f
+func (f *filter) textSearch() *textSearch {
+	if f.op == opText {
+		return f.text
+	}
+	if f.op == opAnd {
+		for _, child := range f.children {
+			if child.op == opText {
+				return child.text
+			}
+		}
+	}
+	return nil
+}
+
+// has returns true if op is used by f or its descendants
+func (f *filter) has(op string) bool {
+	if f.op == op {
+		return true
+	}
+	for _, child := range f.children {
+		if child.has(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// textPlan uses the first public text index that can serve f
+func textPlan(ci *model.CollectionInfo, f *filter, ts *textSearch) (p *queryPlan, err error) {
+	for _, name := range ci.IndexOrder {
+		iif := ci.Indices[name]
+		if iif == nil || iif.Kind != model.IndexKindText || iif.State != osc.StatePublic || !impliesIndexed(f, iif) {
+			continue
+		}
+		p = &queryPlan{iif: iif, text: ts}
+		return
+	}
+	err = ErrTextIndexRequired
+	return
+}
+
+// appendTextTermPrefix appends the term part of text index entries
+func appendTextTermPrefix(buf []byte, term string) kv.Key {
+	return memcomparable.EncodeBytes(buf, []byte(term))
+}
+
+// textEntries returns the entries of doc for text index iif,
+// there's an entry for each term of the string columns, with the term frequency as value.
+func textEntries(ci *model.CollectionInfo, iif *model.IndexInfo, did []byte, doc bson.Raw) (entries map[string][]byte, err error) {
+	analyzer := analysis.Get(iif.Analyzer)
+	if analyzer == nil {
+		err = ErrAnalyzerNotFound
+		return
+	}
+
+	tf := make(map[string]uint64)
+	for _, column := range iif.Columns {
+		values, _ := indexColumnValues(doc, column)
+		for _, v := range values {
+			s, ok := v.StringValueOK()
+			if !ok {
+				continue
+			}
+			for _, term := range analyzer.Analyze(s) {
+				if term != "" {
+					tf[term]++
+				}
+			}
+		}
+	}
+
+	entries = make(map[string][]byte, len(tf))
+	prefix := AppendCollectionIndexPrefix(nil, ci.ID, iif.ID)
+	for term, n := range tf {
+		key := appendTextTermPrefix(prefix.Clone(), term)
+		key = append(key, did...)
+		var value []byte
+		if didInValue(ci, iif) {
+			value = append(value, did...)
+		}
+		entries[string(key)] = memcomparable.EncodeUint64(value, n)
+	}
+	return
+}
+
+const (
+	// the doc count of text index is sharded so that concurrent writes rarely conflict
+	textDocCountShards = 16
+)
+
+// updateTextDocCount maintains the number of documents with entries in text index iif,
+// it's called before the entries of did are replaced from oldEntries to newEntries.
+// Entries of a document are written all or none, so whether it's counted is known by any of them,
+// which may be missing even for oldEntries if it was written while the index was delete only.
+func updateTextDocCount(t mondis.ProviderKVOP, cid int64, iif *model.IndexInfo, did []byte, oldEntries, newEntries map[string][]byte) (err error) {
+	var before bool
+	for _, entries := range []map[string][]byte{oldEntries, newEntries} {
+		for key := range entries {
+			before, err = t.Exists([]byte(key))
+			if err != nil {
+				return
+			}
+			break
+		}
+		if before {
+			break
+		}
+	}
+	after := len(newEntries) > 0
+	if before == after {
+		return
+	}
+
+	key := EncodeCollectionTextDocCountKey(nil, cid, iif.ID, int64(crc32.ChecksumIEEE(did)%textDocCountShards))
+	var n int64
+	v, _, err := t.Get(key)
+	switch err {
+	case nil:
+		_, n, err = memcomparable.DecodeInt64(v)
+		if err != nil {
+			return
+		}
+	case kv.ErrKeyNotFound:
+	default:
+		return
+	}
+	if after {
+		n++
+	} else {
+		n--
+	}
+	err = t.Set(key, memcomparable.EncodeInt64(nil, n), nil)
+	return
+}
+
+// textDocCount returns the number of documents with entries in text index iif
+func textDocCount(t mondis.ProviderKVOP, cid int64, iif *model.IndexInfo) (n int64, err error) {
+	var shard int64
+	scanErr := t.Scan(mondis.ProviderScanOption{Prefix: AppendCollectionTextDocCountPrefix(nil, cid, iif.ID)}, func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+		_, shard, err = memcomparable.DecodeInt64(value)
+		if err != nil {
+			return false
+		}
+		n += shard
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	return
+}
+
+type scoredDid struct {
+	did   []byte
+	score float64
+}
+
+// rankText scores the documents matching ts by tf-idf, in descending order of score,
+// idf is based on the number of documents in the text index.
+func rankText(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, ts *textSearch, stats *execStats) (ranked []scoredDid, err error) {
+	analyzer := analysis.Get(iif.Analyzer)
+	if analyzer == nil {
+		err = ErrAnalyzerNotFound
+		return
+	}
+
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range analyzer.Analyze(ts.search) {
+		if term != "" && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return
+	}
+
+	n, err := textDocCount(t, ci.ID, iif)
+	if err != nil {
+		return
+	}
+
+	prefix := AppendCollectionIndexPrefix(nil, ci.ID, iif.ID)
+	// keyed by did
+	scores := make(map[string]float64)
+	hits := make(map[string]int)
+	for _, term := range terms {
+		type posting struct {
+			did []byte
+			tf  uint64
+		}
+		var postings []posting
+		fn := func(key []byte, value []byte, _ mondis.VMetaResp) bool {
+			stats.keysExamined++
+			var (
+				p    posting
+				rest []byte
+			)
+			p.did, rest, err = decodeIndexEntryDid(ci, iif, key, value)
+			if err != nil {
+				return false
+			}
+			_, p.tf, err = memcomparable.DecodeUint64(rest)
+			if err != nil {
+				return false
+			}
+			postings = append(postings, p)
+			return true
+		}
+		termPrefix := appendTextTermPrefix(prefix.Clone(), term)
+		scanErr := t.Scan(mondis.ProviderScanOption{Prefix: termPrefix, Offset: termPrefix}, fn)
+		if err == nil {
+			err = scanErr
+		}
+		if err != nil {
+			return
+		}
+		if len(postings) == 0 {
+			continue
+		}
+
+		idf := math.Log(1 + float64(n)/float64(len(postings)))
+		for _, p := range postings {
+			scores[string(p.did)] += float64(p.tf) * idf
+			hits[string(p.did)]++
+		}
+	}
+
+	for did, score := range scores {
+		if ts.and && hits[did] < len(terms) {
+			continue
+		}
+		ranked = append(ranked, scoredDid{did: []byte(did), score: score})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return bytes.Compare(ranked[i].did, ranked[j].did) < 0
+	})
+	return
+}
+
+// scanText returns a fetch function for text plan p, documents are in descending order of score
+func scanText(t mondis.ProviderKVOP, ci *model.CollectionInfo, p *queryPlan, f *filter, stats *execStats) func() ([]cursorDoc, error) {
+	var (
+		ranked []scoredDid
+		done   bool
+	)
+	return func() (docs []cursorDoc, err error) {
+		if !done {
+			ranked, err = rankText(t, ci, p.iif, p.text, stats)
+			if err != nil {
+				return
+			}
+			done = true
+		}
+
+		var doc bson.Raw
+		for len(docs) == 0 && len(ranked) > 0 {
+			batch := ranked
+			if len(batch) > findBatchSize {
+				batch = batch[:findBatchSize]
+			}
+			ranked = ranked[len(batch):]
+
+			for _, r := range batch {
+				doc, _, err = t.Get(EncodeCollectionDocumentKey(nil, ci.ID, r.did))
+				if err == kv.ErrKeyNotFound {
+					err = nil
+					continue
+				}
+				if err != nil {
+					return
+				}
+				stats.docsExamined++
+				if !f.match(doc) {
+					continue
+				}
+				docs = append(docs, cursorDoc{did: r.did, doc: doc, score: r.score})
+			}
+		}
+		return
+	}
+}
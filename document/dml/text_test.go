@@ -0,0 +1,109 @@
+package dml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/kv/memcomparable"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+func TestParseText(t *testing.T) {
+	f, err := parseFilter(bson.M{"$text": bson.M{"$search": "a b", "$mode": "and"}, "n": 1})
+	assert.Assert(t, err == nil)
+	ts := f.textSearch()
+	assert.Assert(t, ts != nil && ts.search == "a b" && ts.and)
+
+	var paths []string
+	f.collectPaths(&paths)
+	assert.DeepEqual(t, paths, []string{"n"})
+
+	f, err = parseFilter(bson.M{"$text": bson.M{"$search": "a"}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, f.textSearch() != nil && !f.textSearch().and)
+
+	_, err = parseFilter(bson.M{"$or": bson.A{bson.M{"$text": bson.M{"$search": "a"}}}})
+	assert.Assert(t, err == ErrTextNotTopLevel)
+	for _, invalid := range []interface{}{
+		bson.M{"$text": "a"},
+		bson.M{"$text": bson.M{"$mode": "and"}},
+		bson.M{"$text": bson.M{"$search": 1}},
+		bson.M{"$text": bson.M{"$search": "a", "$mode": "xor"}},
+		bson.M{"$text": bson.M{"$search": "a", "$language": "en"}},
+	} {
+		_, err = parseFilter(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+}
+
+func TestTextEntries(t *testing.T) {
+	iif := &model.IndexInfo{ID: 3, Columns: []string{"title", "tags"}, Kind: model.IndexKindText}
+	doc, err := bson.Marshal(bson.M{"title": "Running dogs and a running cat", "tags": bson.A{"Dog", 1}})
+	assert.Assert(t, err == nil)
+
+	ci := &model.CollectionInfo{ID: 1}
+	entries, multikey, err := indexEntries(ci, iif, encodeDid(10), doc)
+	assert.Assert(t, err == nil && !multikey)
+
+	prefix := AppendCollectionIndexPrefix(nil, 1, iif.ID)
+	tf := make(map[string]uint64)
+	for term, n := range map[string]uint64{"run": 2, "dog": 2, "cat": 1} {
+		key := memcomparable.EncodeInt64(appendTextTermPrefix(prefix.Clone(), term), 10)
+		value, ok := entries[string(key)]
+		assert.Assert(t, ok, term)
+		did, rest, err := decodeIndexEntryDid(ci, iif, key, value)
+		assert.Assert(t, err == nil && bytes.Equal(did, encodeDid(10)))
+		_, tf[term], err = memcomparable.DecodeUint64(rest)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, tf[term], n, term)
+	}
+	assert.Equal(t, len(entries), 3)
+
+	iif.Analyzer = "unknown"
+	_, _, err = indexEntries(ci, iif, encodeDid(10), doc)
+	assert.Assert(t, err == ErrAnalyzerNotFound)
+}
+
+func TestTextDocCount(t *testing.T) {
+	kvdb, closeFunc := openTestKV(t)
+	defer closeFunc()
+
+	iif := &model.IndexInfo{ID: 3, Columns: []string{"title"}, Kind: model.IndexKindText, State: osc.StateDeleteOnly}
+	marshal := func(title interface{}) bson.Raw {
+		doc, err := bson.Marshal(bson.M{"title": title})
+		assert.Assert(t, err == nil)
+		return doc
+	}
+	ci := &model.CollectionInfo{ID: 1}
+	count := func() int64 {
+		n, err := textDocCount(kvdb, 1, iif)
+		assert.Assert(t, err == nil)
+		return n
+	}
+
+	// written while delete only, so not counted
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(1), nil, marshal("a dog")) == nil)
+	iif.State = osc.StateWriteReorganization
+	for did := int64(2); did <= 20; did++ {
+		assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(did), nil, marshal("a cat")) == nil)
+	}
+	assert.Equal(t, count(), int64(19))
+
+	// deleting the document without entries, backfilling and updating terms keep the count
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(1), marshal("a dog"), nil) == nil)
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(2), nil, marshal("a cat")) == nil)
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(3), marshal("a cat"), marshal("a dog")) == nil)
+	assert.Equal(t, count(), int64(19))
+
+	// documents without terms are not counted
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(4), marshal("a cat"), marshal(1)) == nil)
+	assert.Assert(t, writeIndex(kvdb, ci, iif, encodeDid(5), marshal("a cat"), nil) == nil)
+	assert.Equal(t, count(), int64(17))
+
+	done, err := DeleteIndexData(kvdb, 1, iif.ID, 100)
+	assert.Assert(t, err == nil && done)
+	assert.Equal(t, count(), int64(0))
+}
@@ -0,0 +1,95 @@
+package dml
+
+import (
+	"time"
+
+	"github.com/zhiqiangxu/mondis"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeleteExpired deletes at most limit documents expired by the ttl indexes of collection,
+// like mongo, a document expires when any date of the ttl column is older than ExpireAfter.
+// Index entries are removed in the same transaction.
+func (c *Collection) DeleteExpired(now time.Time, limit int, t *txn.Txn) (n int, err error) {
+
+	origT := t
+
+	deleteFunc := func(t *txn.Txn) (err error) {
+		n = 0
+		ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+		if ci == nil {
+			err = ErrCollectionNotExists
+			return
+		}
+
+		if origT != nil {
+			origT.ReferredCollections(ci.ID)
+		}
+
+		for _, name := range ci.IndexOrder {
+			iif := ci.Indices[name]
+			if iif == nil || !iif.TTL || iif.State != osc.StatePublic || n >= limit {
+				continue
+			}
+
+			var docs []cursorDoc
+			docs, err = expiredDocs(t, ci, iif, now, limit-n)
+			if err != nil {
+				return
+			}
+			for _, doc := range docs {
+				err = deleteDoc(t, ci, doc.did, doc.doc)
+				if err != nil {
+					return
+				}
+				n++
+			}
+		}
+		return
+	}
+
+	if t == nil {
+		err = c.RunInNewUpdateTxn(deleteFunc)
+	} else {
+		err = deleteFunc(t)
+	}
+	return
+}
+
+// expiredDocs scans the ttl index for at most limit documents expired at now
+func expiredDocs(t mondis.ProviderKVOP, ci *model.CollectionInfo, iif *model.IndexInfo, now time.Time, limit int) (docs []cursorDoc, err error) {
+	cutoff := primitive.NewDateTimeFromTime(now.Add(-iif.ExpireAfter))
+	f, err := parseFilter(bson.M{iif.Columns[0]: bson.M{"$lt": cutoff}})
+	if err != nil {
+		return
+	}
+	multikey, err := isMultikey(t, ci.ID, iif.ID)
+	if err != nil {
+		return
+	}
+	p, _, err := indexPlan(ci.ID, iif, indexablePredicates(f), nil, multikey)
+	if err != nil || p == nil {
+		return
+	}
+
+	next := scanIndex(t, ci, p, f, &execStats{})
+	for len(docs) < limit {
+		var batch []cursorDoc
+		batch, err = next()
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+		docs = append(docs, batch...)
+	}
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	return
+}
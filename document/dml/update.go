@@ -0,0 +1,785 @@
+package dml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// update operators
+const (
+	opSet         = "$set"
+	opUnset       = "$unset"
+	opInc         = "$inc"
+	opMul         = "$mul"
+	opMin         = "$min"
+	opMax         = "$max"
+	opRename      = "$rename"
+	opPush        = "$push"
+	opPull        = "$pull"
+	opAddToSet    = "$addToSet"
+	opCurrentDate = "$currentDate"
+)
+
+var (
+	// ErrMixedUpdate used by update
+	ErrMixedUpdate = errors.New("update can not mix operators and fields")
+	// ErrUpdateRequired used by UpdateMany and FindOneAndUpdate
+	ErrUpdateRequired = errors.New("update document with operators required")
+	// ErrNumericOverflow used by $inc and $mul
+	ErrNumericOverflow = errors.New("numeric overflow")
+)
+
+type (
+	// updateOp is a single operator on a path
+	updateOp struct {
+		op    string
+		path  string
+		value bson.RawValue
+	}
+	// update is the parsed form of an update document,
+	// it's either a replacement document or a list of operators.
+	update struct {
+		replacement bson.Raw
+		ops         []updateOp
+	}
+)
+
+// parseUpdate parses an update document like bson.M{"$set": bson.M{"a": 1}},
+// documents without operators are replacements.
+func parseUpdate(u interface{}) (result *update, err error) {
+	doc, err := toRaw(u)
+	if err != nil {
+		return
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	result = &update{}
+	if len(elements) == 0 {
+		result.replacement = doc
+		return
+	}
+	for i, e := range elements {
+		isOp := strings.HasPrefix(e.Key(), "$")
+		if i > 0 && isOp != (result.replacement == nil) {
+			err = ErrMixedUpdate
+			return
+		}
+		if !isOp {
+			result.replacement = doc
+			continue
+		}
+
+		err = result.parseOperator(e.Key(), e.Value())
+		if err != nil {
+			return
+		}
+	}
+
+	err = result.checkConflicts()
+	return
+}
+
+func (u *update) parseOperator(op string, v bson.RawValue) (err error) {
+	switch op {
+	case opSet, opUnset, opInc, opMul, opMin, opMax, opRename, opPush, opPull, opAddToSet, opCurrentDate:
+	default:
+		err = fmt.Errorf("unknown update operator %s", op)
+		return
+	}
+
+	fields, ok := v.DocumentOK()
+	if !ok {
+		err = fmt.Errorf("%s needs a document", op)
+		return
+	}
+	elements, err := fields.Elements()
+	if err != nil {
+		return
+	}
+
+	for _, e := range elements {
+		value := e.Value()
+		switch op {
+		case opInc, opMul:
+			if !isArithNumber(value) {
+				err = fmt.Errorf("%s needs a number for %s", op, e.Key())
+				return
+			}
+		case opRename:
+			if value.Type != bsontype.String || value.StringValue() == "" {
+				err = fmt.Errorf("%s needs a non empty string for %s", op, e.Key())
+				return
+			}
+		case opCurrentDate:
+			if value.Type != bsontype.Boolean && currentDateType(value) == "" {
+				err = fmt.Errorf("%s needs true or {$type: \"date\"|\"timestamp\"} for %s", op, e.Key())
+				return
+			}
+		}
+		u.ops = append(u.ops, updateOp{op: op, path: e.Key(), value: value})
+	}
+	return
+}
+
+func currentDateType(v bson.RawValue) string {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return ""
+	}
+	t, ok := doc.Lookup("$type").StringValueOK()
+	if !ok || (t != "date" && t != "timestamp") {
+		return ""
+	}
+	return t
+}
+
+// paths returns all paths modified by u, nil for replacement
+func (u *update) paths() (paths []string) {
+	for _, op := range u.ops {
+		paths = append(paths, op.path)
+		if op.op == opRename {
+			paths = append(paths, op.value.StringValue())
+		}
+	}
+	return
+}
+
+// checkConflicts rejects updates modifying the same path twice like mongo does
+func (u *update) checkConflicts() error {
+	paths := u.paths()
+	for i := range paths {
+		for j := i + 1; j < len(paths); j++ {
+			if pathsOverlap(paths[i], paths[j]) {
+				return fmt.Errorf("updating the path %s would create a conflict at %s", paths[j], paths[i])
+			}
+		}
+	}
+	return nil
+}
+
+// pathsOverlap returns true if a and b are the same or one contains the other
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// apply returns the updated document of doc, doc is nil for new documents
+func (u *update) apply(doc bson.Raw, now time.Time) (result bson.Raw, err error) {
+	if u.replacement != nil {
+		return u.replacement, nil
+	}
+
+	var d bson.D
+	if doc != nil {
+		err = bson.Unmarshal(doc, &d)
+		if err != nil {
+			return
+		}
+	}
+
+	var node interface{} = d
+	for _, op := range u.ops {
+		node, err = op.apply(node, now)
+		if err != nil {
+			return
+		}
+	}
+
+	if d = node.(bson.D); d == nil {
+		d = bson.D{}
+	}
+	return bson.Marshal(d)
+}
+
+func (op *updateOp) apply(node interface{}, now time.Time) (interface{}, error) {
+	parts := strings.Split(op.path, ".")
+	switch op.op {
+	case opSet:
+		return setValue(node, parts, op.value)
+	case opUnset:
+		return updatePath(node, parts, false, func(interface{}, bool) (interface{}, bool, error) {
+			return nil, true, nil
+		})
+	case opRename:
+		var (
+			value  interface{}
+			exists bool
+		)
+		node, err := updatePath(node, parts, false, func(old interface{}, ok bool) (interface{}, bool, error) {
+			value, exists = old, ok
+			return nil, true, nil
+		})
+		if err != nil || !exists {
+			return node, err
+		}
+		return setValue(node, strings.Split(op.value.StringValue(), "."), value)
+	case opCurrentDate:
+		var value interface{} = primitive.NewDateTimeFromTime(now)
+		if currentDateType(op.value) == "timestamp" {
+			value = primitive.Timestamp{T: uint32(now.Unix()), I: 1}
+		}
+		return setValue(node, parts, value)
+	case opPull:
+		return updatePath(node, parts, false, func(old interface{}, exists bool) (interface{}, bool, error) {
+			return pull(old, op.value)
+		})
+	}
+
+	return updatePath(node, parts, true, func(old interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			return op.initial()
+		}
+		return op.modify(old)
+	})
+}
+
+// initial returns the value of a missing field after op
+func (op *updateOp) initial() (value interface{}, remove bool, err error) {
+	switch op.op {
+	case opMul:
+		// missing field is multiplied as 0
+		value, err = arith(opMul, bson.RawValue{Type: bsontype.Int32, Value: []byte{0, 0, 0, 0}}, op.value)
+	case opPush, opAddToSet:
+		arr := bson.A{}
+		for _, e := range eachValues(op.value) {
+			if op.op == opAddToSet && contains(arr, e) {
+				continue
+			}
+			arr = append(arr, e)
+		}
+		value = arr
+	default:
+		// $inc, $min, $max
+		value = op.value
+	}
+	return
+}
+
+// modify returns the value of an existing field after op
+func (op *updateOp) modify(old interface{}) (value interface{}, remove bool, err error) {
+	oldRaw, err := dbson.ToRawValue(old)
+	if err != nil {
+		return
+	}
+
+	switch op.op {
+	case opInc, opMul:
+		if !isArithNumber(oldRaw) {
+			err = fmt.Errorf("can not apply %s to non number field %s", op.op, op.path)
+			return
+		}
+		value, err = arith(op.op, oldRaw, op.value)
+	case opMin, opMax:
+		c := dbson.Compare(op.value, oldRaw)
+		if op.op == opMin && c < 0 || op.op == opMax && c > 0 {
+			value = op.value
+		} else {
+			value = old
+		}
+	case opPush, opAddToSet:
+		arr, ok := old.(bson.A)
+		if !ok {
+			err = fmt.Errorf("can not apply %s to non array field %s", op.op, op.path)
+			return
+		}
+		for _, e := range eachValues(op.value) {
+			if op.op == opAddToSet && contains(arr, e) {
+				continue
+			}
+			arr = append(arr, e)
+		}
+		value = arr
+	}
+	return
+}
+
+// eachValues returns the values of {$each: [...]} or v itself
+func eachValues(v bson.RawValue) []bson.RawValue {
+	if doc, ok := v.DocumentOK(); ok {
+		if each, err := doc.LookupErr("$each"); err == nil {
+			if arr, ok := each.ArrayOK(); ok {
+				values, _ := arr.Values()
+				return values
+			}
+		}
+	}
+	return []bson.RawValue{v}
+}
+
+func contains(arr bson.A, v bson.RawValue) bool {
+	for _, e := range arr {
+		rv, err := dbson.ToRawValue(e)
+		if err == nil && dbson.Equal(rv, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// pull removes elements of old matching cond, cond is either a value or a query on elements
+func pull(old interface{}, cond bson.RawValue) (value interface{}, remove bool, err error) {
+	arr, ok := old.(bson.A)
+	if !ok {
+		err = fmt.Errorf("can not apply %s to non array field", opPull)
+		return
+	}
+
+	// elements are wrapped as {v: element} for matching
+	const wrapKey = "v"
+	f := &filter{op: opAnd}
+	switch {
+	case isOperatorDoc(cond):
+		err = parseField(f, wrapKey, cond)
+	case cond.Type == bsontype.EmbeddedDocument:
+		var child *filter
+		child, err = parseFilterDoc(cond.Document())
+		if err == nil {
+			prefixPaths(child, wrapKey+".")
+			f.children = append(f.children, child)
+		}
+	default:
+		f.children = append(f.children, &filter{op: opEq, path: wrapKey, value: cond})
+	}
+	if err != nil {
+		return
+	}
+
+	result := bson.A{}
+	var wrapped []byte
+	for _, e := range arr {
+		wrapped, err = bson.Marshal(bson.D{{Key: wrapKey, Value: e}})
+		if err != nil {
+			return
+		}
+		if !f.match(wrapped) {
+			result = append(result, e)
+		}
+	}
+	value = result
+	return
+}
+
+func prefixPaths(f *filter, prefix string) {
+	if f.op == opAnd || f.op == opOr {
+		for _, child := range f.children {
+			prefixPaths(child, prefix)
+		}
+		return
+	}
+	f.path = prefix + f.path
+}
+
+// arith applies $inc or $mul, ints stay ints unless overflowed
+func arith(op string, a, b bson.RawValue) (interface{}, error) {
+	ia, aIsInt := intOf(a)
+	ib, bIsInt := intOf(b)
+	if !aIsInt || !bIsInt {
+		fa, fb := floatOf(a), floatOf(b)
+		if op == opInc {
+			return fa + fb, nil
+		}
+		return fa * fb, nil
+	}
+
+	var result int64
+	if op == opInc {
+		result = ia + ib
+		if (ib > 0 && result < ia) || (ib < 0 && result > ia) {
+			return nil, ErrNumericOverflow
+		}
+	} else {
+		result = ia * ib
+		if ia != 0 && (result/ia != ib || (ia == -1 && ib == math.MinInt64)) {
+			return nil, ErrNumericOverflow
+		}
+	}
+
+	if a.Type == bsontype.Int32 && b.Type == bsontype.Int32 && result >= math.MinInt32 && result <= math.MaxInt32 {
+		return int32(result), nil
+	}
+	return result, nil
+}
+
+func isArithNumber(v bson.RawValue) bool {
+	return v.Type == bsontype.Int32 || v.Type == bsontype.Int64 || v.Type == bsontype.Double
+}
+
+func intOf(v bson.RawValue) (int64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	default:
+		return 0, false
+	}
+}
+
+func floatOf(v bson.RawValue) float64 {
+	if i, ok := intOf(v); ok {
+		return float64(i)
+	}
+	return v.Double()
+}
+
+func setValue(node interface{}, parts []string, value interface{}) (interface{}, error) {
+	return updatePath(node, parts, true, func(interface{}, bool) (interface{}, bool, error) {
+		return value, false, nil
+	})
+}
+
+// updatePath replaces the value at parts with the result of fn and returns the updated node,
+// missing embedded documents are created if create, otherwise fn is not called for missing paths.
+// Removing an array element sets it to null as mongo does.
+func updatePath(node interface{}, parts []string, create bool, fn func(old interface{}, exists bool) (value interface{}, remove bool, err error)) (interface{}, error) {
+	last := len(parts) == 1
+	switch n := node.(type) {
+	case bson.D:
+		for i, e := range n {
+			if e.Key != parts[0] {
+				continue
+			}
+			if !last {
+				child, err := updatePath(e.Value, parts[1:], create, fn)
+				if err != nil {
+					return nil, err
+				}
+				n[i].Value = child
+				return n, nil
+			}
+			value, remove, err := fn(e.Value, true)
+			if err != nil {
+				return nil, err
+			}
+			if remove {
+				return append(n[:i:i], n[i+1:]...), nil
+			}
+			n[i].Value = value
+			return n, nil
+		}
+
+		if !create {
+			return n, nil
+		}
+		var value interface{}
+		if last {
+			v, remove, err := fn(nil, false)
+			if err != nil || remove {
+				return n, err
+			}
+			value = v
+		} else {
+			child, err := updatePath(bson.D{}, parts[1:], create, fn)
+			if err != nil {
+				return nil, err
+			}
+			value = child
+		}
+		return append(n, bson.E{Key: parts[0], Value: value}), nil
+	case bson.A:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 {
+			if !create {
+				return n, nil
+			}
+			return nil, fmt.Errorf("can not create field %s in array", parts[0])
+		}
+		if i >= len(n) {
+			if !create {
+				return n, nil
+			}
+			// pad with null like mongo
+			for len(n) <= i {
+				n = append(n, nil)
+			}
+			if last {
+				value, remove, err := fn(nil, false)
+				if err != nil {
+					return nil, err
+				}
+				if !remove {
+					n[i] = value
+				}
+				return n, nil
+			}
+			n[i] = bson.D{}
+		}
+		if !last {
+			child, err := updatePath(n[i], parts[1:], create, fn)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = child
+			return n, nil
+		}
+		value, remove, err := fn(n[i], true)
+		if err != nil {
+			return nil, err
+		}
+		if remove {
+			value = nil
+		}
+		n[i] = value
+		return n, nil
+	}
+
+	if !create {
+		return node, nil
+	}
+	return nil, fmt.Errorf("can not create field %s in non document value", parts[0])
+}
+
+// FindOneAndUpdateOptions for FindOneAndUpdate
+type FindOneAndUpdateOptions struct {
+	// Sort decides which document is updated if multiple match
+	Sort       interface{}
+	Projection interface{}
+	// ReturnAfter returns the updated document instead of the original one
+	ReturnAfter bool
+}
+
+// UpdateMany applies update to all documents matching filter,
+// update must be a document with operators.
+func (c *Collection) UpdateMany(filter, update interface{}, t *txn.Txn) (matched, modified int, err error) {
+	u, err := parseUpdate(update)
+	if err != nil {
+		return
+	}
+	if u.replacement != nil {
+		err = ErrUpdateRequired
+		return
+	}
+
+	updateFunc := func(t *txn.Txn) (err error) {
+		cursor, err := c.Find(filter, nil, t)
+		if err != nil {
+			return
+		}
+		// collect first since the scan may run over the indices being updated
+		var docs []cursorDoc
+		for cursor.Next() {
+			docs = append(docs, cursorDoc{did: cursor.did, doc: cursor.Current})
+		}
+		err = cursor.Err()
+		cursor.Close()
+		if err != nil {
+			return
+		}
+
+		ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+		now := time.Now()
+		var changed bool
+		for _, d := range docs {
+			changed, err = c.updateDoc(t, ci, d.did, d.doc, u, now, nil)
+			if err != nil {
+				return
+			}
+			matched++
+			if changed {
+				modified++
+			}
+		}
+		return
+	}
+
+	if t == nil {
+		err = c.RunInNewUpdateTxn(updateFunc)
+	} else {
+		err = updateFunc(t)
+	}
+	return
+}
+
+// FindOneAndUpdate applies update to the first document matching filter,
+// the original or updated document is decoded into result, found is false if no document matches.
+func (c *Collection) FindOneAndUpdate(filter, update interface{}, opts *FindOneAndUpdateOptions, result interface{}, t *txn.Txn) (found bool, err error) {
+	if opts == nil {
+		opts = &FindOneAndUpdateOptions{}
+	}
+	u, err := parseUpdate(update)
+	if err != nil {
+		return
+	}
+	if u.replacement != nil {
+		err = ErrUpdateRequired
+		return
+	}
+	proj, err := parseProjection(opts.Projection)
+	if err != nil {
+		return
+	}
+
+	updateFunc := func(t *txn.Txn) (err error) {
+		cursor, err := c.Find(filter, &FindOptions{Sort: opts.Sort, Limit: 1}, t)
+		if err != nil {
+			return
+		}
+		found = cursor.Next()
+		did, doc := cursor.did, cursor.Current
+		err = cursor.Err()
+		cursor.Close()
+		if err != nil || !found {
+			return
+		}
+
+		ci := t.StartMetaCache().CollectionInfo(c.dbName, c.collectionName)
+		var after bson.Raw
+		_, err = c.updateDoc(t, ci, did, doc, u, time.Now(), &after)
+		if err != nil {
+			return
+		}
+		if opts.ReturnAfter {
+			doc = after
+		}
+		if proj != nil {
+			doc, err = proj.apply(doc)
+			if err != nil {
+				return
+			}
+		}
+		if result != nil {
+			err = bson.Unmarshal(doc, result)
+		}
+		return
+	}
+
+	if t == nil {
+		err = c.RunInNewUpdateTxn(updateFunc)
+	} else {
+		err = updateFunc(t)
+	}
+	return
+}
+
+// updateDoc applies u to the existing document did, after is set to the updated document if not nil
+func (c *Collection) updateDoc(t *txn.Txn, ci *model.CollectionInfo, did []byte, doc bson.Raw, u *update, now time.Time, after *bson.Raw) (changed bool, err error) {
+	newDoc, err := u.apply(doc, now)
+	if err != nil {
+		return
+	}
+	newDoc, err = prepareDocID(ci, did, doc, newDoc)
+	if err != nil {
+		return
+	}
+	if after != nil {
+		*after = newDoc
+	}
+	if bytes.Equal(doc, newDoc) {
+		return
+	}
+
+	changed = true
+	err = writeDoc(t, ci, did, doc, newDoc, u.paths())
+	return
+}
+
+// writeDoc writes the updated document and maintains the indices whose columns are modified,
+// paths is nil for replacement which may modify any column, oldDoc is nil for insert.
+// _id of newDoc is prepared by prepareDocID and newDoc is checked by the validator of ci,
+// the change is appended to the change log when t commits.
+func writeDoc(t *txn.Txn, ci *model.CollectionInfo, did []byte, oldDoc, newDoc bson.Raw, paths []string) (err error) {
+	newDoc, err = prepareDocID(ci, did, oldDoc, newDoc)
+	if err != nil {
+		return
+	}
+	err = checkValidator(ci, did, newDoc)
+	if err != nil {
+		return
+	}
+	if ci.Capped != nil {
+		err = capDoc(t, ci, did, oldDoc, newDoc)
+		if err != nil {
+			return
+		}
+	}
+
+	err = t.Set(EncodeCollectionDocumentKey(nil, ci.ID, did), newDoc, nil)
+	if err != nil {
+		return
+	}
+
+	op := ChangeUpdate
+	if paths == nil || oldDoc == nil {
+		err = writeIndices(t, ci, did, oldDoc, newDoc)
+		if err != nil {
+			return
+		}
+		op = ChangeReplace
+		if oldDoc == nil {
+			op = ChangeInsert
+		}
+		err = logChange(t, ci, op, did, newDoc)
+		return
+	}
+
+	for _, name := range ci.IndexOrder {
+		iif := ci.Indices[name]
+		if iif == nil || !columnsModified(iif, paths) {
+			continue
+		}
+		err = writeIndex(t, ci, iif, did, oldDoc, newDoc)
+		if err != nil {
+			return
+		}
+	}
+	err = logChange(t, ci, op, did, newDoc)
+	return
+}
+
+// deleteDoc deletes the document with its index entries,
+// the change is appended to the change log when t commits.
+func deleteDoc(t *txn.Txn, ci *model.CollectionInfo, did []byte, doc bson.Raw) (err error) {
+	err = t.Delete(EncodeCollectionDocumentKey(nil, ci.ID, did))
+	if err != nil {
+		return
+	}
+	if ci.Capped != nil {
+		err = uncapDoc(t, ci, doc)
+		if err != nil {
+			return
+		}
+	}
+
+	err = writeIndices(t, ci, did, doc, nil)
+	if err != nil {
+		return
+	}
+	err = logChange(t, ci, ChangeDelete, did, nil)
+	return
+}
+
+// columnsModified returns true if paths may change the entries of iif,
+// paths of the partial filter count since they decide whether the document is indexed.
+func columnsModified(iif *model.IndexInfo, paths []string) bool {
+	columns := iif.Columns
+	if len(iif.PartialFilter) > 0 {
+		f, err := partialFilterOf(iif)
+		if err != nil {
+			return true
+		}
+		columns = append([]string(nil), columns...)
+		f.collectPaths(&columns)
+	}
+	for _, column := range columns {
+		for _, path := range paths {
+			if pathsOverlap(column, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package dml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestUpdateApply(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{Key: "a", Value: int32(1)},
+		{Key: "b", Value: bson.D{{Key: "c", Value: int64(2)}}},
+		{Key: "tags", Value: bson.A{"x", "y", "x"}},
+		{Key: "items", Value: bson.A{bson.D{{Key: "n", Value: 1}}, bson.D{{Key: "n", Value: 5}}}},
+		{Key: "max", Value: int32(1) << 30},
+	})
+	assert.Assert(t, err == nil)
+	now := time.Unix(100, 0)
+
+	apply := func(u interface{}) bson.M {
+		parsed, err := parseUpdate(u)
+		assert.Assert(t, err == nil, "%v", u)
+		updated, err := parsed.apply(doc, now)
+		assert.Assert(t, err == nil, "%v", u)
+		var m bson.M
+		assert.Assert(t, bson.Unmarshal(updated, &m) == nil)
+		return m
+	}
+
+	m := apply(bson.M{"$set": bson.M{"a": "s", "b.d": 3, "new.x": true}})
+	assert.DeepEqual(t, m["a"], "s")
+	assert.DeepEqual(t, m["b"], bson.M{"c": int64(2), "d": int32(3)})
+	assert.DeepEqual(t, m["new"], bson.M{"x": true})
+
+	m = apply(bson.M{"$unset": bson.M{"a": "", "b.c": "", "missing.x": "", "tags.1": ""}})
+	_, ok := m["a"]
+	assert.Assert(t, !ok)
+	assert.DeepEqual(t, m["b"], bson.M{})
+	assert.DeepEqual(t, m["tags"], bson.A{"x", nil, "x"})
+
+	m = apply(bson.M{"$inc": bson.M{"a": 2, "b.c": 1.5, "z": int64(1), "max": int32(1) << 30, "tags.5": 1}})
+	assert.DeepEqual(t, m["a"], int32(3))
+	assert.DeepEqual(t, m["b"], bson.M{"c": 3.5})
+	assert.DeepEqual(t, m["z"], int64(1))
+	// int32 overflow is promoted to int64
+	assert.DeepEqual(t, m["max"], int64(1)<<31)
+	assert.DeepEqual(t, m["tags"], bson.A{"x", "y", "x", nil, nil, int32(1)})
+
+	m = apply(bson.M{"$mul": bson.M{"a": 3, "z": 2.0}})
+	assert.DeepEqual(t, m["a"], int32(3))
+	assert.DeepEqual(t, m["z"], 0.0)
+
+	m = apply(bson.M{"$min": bson.M{"a": 0, "z": 1}, "$max": bson.M{"b.c": 1}})
+	assert.DeepEqual(t, m["a"], int32(0))
+	assert.DeepEqual(t, m["z"], int32(1))
+	assert.DeepEqual(t, m["b"], bson.M{"c": int64(2)})
+
+	m = apply(bson.M{"$rename": bson.M{"a": "r.a", "missing": "x"}})
+	assert.DeepEqual(t, m["r"], bson.M{"a": int32(1)})
+	_, ok = m["x"]
+	assert.Assert(t, !ok)
+
+	m = apply(bson.M{"$push": bson.M{"tags": "z", "list": bson.M{"$each": bson.A{1, 2}}}})
+	assert.DeepEqual(t, m["tags"], bson.A{"x", "y", "x", "z"})
+	assert.DeepEqual(t, m["list"], bson.A{int32(1), int32(2)})
+
+	m = apply(bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": bson.A{"y", "w", "w"}}}})
+	assert.DeepEqual(t, m["tags"], bson.A{"x", "y", "x", "w"})
+
+	m = apply(bson.M{"$pull": bson.M{"tags": "x", "items": bson.M{"n": bson.M{"$gt": 2}}}})
+	assert.DeepEqual(t, m["tags"], bson.A{"y"})
+	assert.DeepEqual(t, m["items"], bson.A{bson.M{"n": int32(1)}})
+	m = apply(bson.M{"$pull": bson.M{"tags": bson.M{"$in": bson.A{"y", "x"}}}})
+	assert.DeepEqual(t, m["tags"], bson.A{})
+
+	m = apply(bson.M{"$currentDate": bson.M{"d": true, "ts": bson.M{"$type": "timestamp"}}})
+	assert.DeepEqual(t, m["d"], primitive.NewDateTimeFromTime(now))
+	assert.DeepEqual(t, m["ts"], primitive.Timestamp{T: 100, I: 1})
+
+	// replacement
+	m = apply(bson.M{"only": 1})
+	assert.DeepEqual(t, m, bson.M{"only": int32(1)})
+
+	for _, invalid := range []interface{}{
+		bson.M{"$set": bson.M{"a": 1}, "b": 1},
+		bson.M{"$set": bson.M{"a": 1}, "$inc": bson.M{"a": 1}},
+		bson.M{"$set": bson.M{"b": 1}, "$unset": bson.M{"b.c": 1}},
+		bson.M{"$inc": bson.M{"a": "x"}},
+		bson.M{"$foo": bson.M{"a": 1}},
+	} {
+		_, err = parseUpdate(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+
+	for _, failing := range []interface{}{
+		bson.M{"$inc": bson.M{"tags": 1}},
+		bson.M{"$push": bson.M{"a": 1}},
+		bson.M{"$set": bson.M{"a.x": 1}},
+		bson.M{"$inc": bson.M{"b.c": int64(1<<63 - 1)}},
+	} {
+		parsed, err := parseUpdate(failing)
+		assert.Assert(t, err == nil)
+		_, err = parsed.apply(doc, now)
+		assert.Assert(t, err != nil, "%v", failing)
+	}
+}
+
+func TestColumnsModified(t *testing.T) {
+	iif := &model.IndexInfo{Columns: []string{"a", "b.c"}}
+	assert.Assert(t, columnsModified(iif, []string{"a"}))
+	assert.Assert(t, columnsModified(iif, []string{"b"}))
+	assert.Assert(t, columnsModified(iif, []string{"b.c.d"}))
+	assert.Assert(t, !columnsModified(iif, []string{"b.d", "ab"}))
+
+	u, err := parseUpdate(bson.M{"$rename": bson.M{"x": "a"}})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, columnsModified(iif, u.paths()))
+
+	iif.PartialFilter, err = PartialFilter(bson.M{"active": true})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, columnsModified(iif, []string{"active"}))
+	assert.Assert(t, !columnsModified(iif, []string{"inactive"}))
+
+	// the cached partial filter is used instead of parsing it again
+	iif.ID = 101
+	cached, err := parseFilter(bson.M{"inactive": true})
+	assert.Assert(t, err == nil)
+	parsedPartialFilters.m.Store(iif.ID, &parsedEntry{raw: iif.PartialFilter, value: cached})
+	assert.Assert(t, columnsModified(iif, []string{"inactive"}))
+	assert.Assert(t, !columnsModified(iif, []string{"active"}))
+	ForgetIndex(iif.ID)
+}
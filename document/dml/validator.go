@@ -0,0 +1,504 @@
+package dml
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	dbson "github.com/zhiqiangxu/mondis/document/bson"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
+	"github.com/zhiqiangxu/util/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.uber.org/zap"
+)
+
+// DocumentValidationError when a document violates the validator of collection
+type DocumentValidationError struct {
+	// Path of the invalid field, empty for the document itself
+	Path   string
+	Reason string
+}
+
+func (e *DocumentValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("document failed validation: %s", e.Reason)
+	}
+	return fmt.Sprintf("document failed validation at %s: %s", e.Path, e.Reason)
+}
+
+var bsonTypes = map[string][]bsontype.Type{
+	"double":     {bsontype.Double},
+	"string":     {bsontype.String},
+	"object":     {bsontype.EmbeddedDocument},
+	"array":      {bsontype.Array},
+	"binData":    {bsontype.Binary},
+	"objectId":   {bsontype.ObjectID},
+	"bool":       {bsontype.Boolean},
+	"date":       {bsontype.DateTime},
+	"null":       {bsontype.Null},
+	"regex":      {bsontype.Regex},
+	"javascript": {bsontype.JavaScript},
+	"int":        {bsontype.Int32},
+	"timestamp":  {bsontype.Timestamp},
+	"long":       {bsontype.Int64},
+	"decimal":    {bsontype.Decimal128},
+	"minKey":     {bsontype.MinKey},
+	"maxKey":     {bsontype.MaxKey},
+	"number":     {bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128},
+}
+
+// jsonSchema is the parsed form of a json schema document like
+//
+//	bson.M{
+//		"bsonType": "object",
+//		"required": bson.A{"name"},
+//		"properties": bson.M{
+//			"name": bson.M{"bsonType": "string", "pattern": "^[a-z]+$"},
+//			"age":  bson.M{"bsonType": "int", "minimum": 0, "maximum": 200},
+//		},
+//	}
+//
+// supported keywords are bsonType, required, properties, additionalProperties,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern,
+// enum, items, minItems, maxItems, title and description.
+type jsonSchema struct {
+	types                []bsontype.Type
+	typeNames            []string
+	required             []string
+	properties           map[string]*jsonSchema
+	propertyOrder        []string
+	noAdditional         bool
+	minimum, maximum     *bson.RawValue
+	exclusiveMin         bool
+	exclusiveMax         bool
+	minLength, maxLength int
+	pattern              *regexp.Regexp
+	enum                 []bson.RawValue
+	items                *jsonSchema
+	minItems, maxItems   int
+}
+
+// ValidatorSchema validates a json schema document for ValidatorInfo and returns it marshalled
+func ValidatorSchema(schema interface{}) (raw bson.Raw, err error) {
+	raw, err = toRaw(schema)
+	if err != nil {
+		return
+	}
+	_, err = parseJSONSchema(raw)
+	return
+}
+
+func parseJSONSchema(doc bson.Raw) (s *jsonSchema, err error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+
+	s = &jsonSchema{minLength: -1, maxLength: -1, minItems: -1, maxItems: -1}
+	for _, e := range elements {
+		key, v := e.Key(), e.Value()
+		switch key {
+		case "bsonType":
+			var names []string
+			switch v.Type {
+			case bsontype.String:
+				names = []string{v.StringValue()}
+			case bsontype.Array:
+				names, err = stringsOf(v)
+				if err != nil {
+					return
+				}
+			}
+			if len(names) == 0 {
+				err = fmt.Errorf("bsonType must be a type name or an array of them")
+				return
+			}
+			for _, name := range names {
+				types, ok := bsonTypes[name]
+				if !ok {
+					err = fmt.Errorf("unknown bsonType %s", name)
+					return
+				}
+				s.types = append(s.types, types...)
+			}
+			s.typeNames = names
+		case "required":
+			s.required, err = stringsOf(v)
+			if err != nil || len(s.required) == 0 {
+				err = fmt.Errorf("required must be a nonempty array of field names")
+				return
+			}
+		case "properties":
+			props, ok := v.DocumentOK()
+			if !ok {
+				err = fmt.Errorf("properties must be a document")
+				return
+			}
+			var propElements []bson.RawElement
+			propElements, err = props.Elements()
+			if err != nil {
+				return
+			}
+			s.properties = make(map[string]*jsonSchema)
+			for _, pe := range propElements {
+				sub, ok := pe.Value().DocumentOK()
+				if !ok {
+					err = fmt.Errorf("property %s must be a schema document", pe.Key())
+					return
+				}
+				s.properties[pe.Key()], err = parseJSONSchema(sub)
+				if err != nil {
+					return
+				}
+				s.propertyOrder = append(s.propertyOrder, pe.Key())
+			}
+		case "additionalProperties":
+			b, ok := v.BooleanOK()
+			if !ok {
+				err = fmt.Errorf("additionalProperties must be a bool")
+				return
+			}
+			s.noAdditional = !b
+		case "minimum", "maximum":
+			if !isArithNumber(v) {
+				err = fmt.Errorf("%s must be a number", key)
+				return
+			}
+			bound := v
+			if key == "minimum" {
+				s.minimum = &bound
+			} else {
+				s.maximum = &bound
+			}
+		case "exclusiveMinimum", "exclusiveMaximum":
+			b, ok := v.BooleanOK()
+			if !ok {
+				err = fmt.Errorf("%s must be a bool", key)
+				return
+			}
+			if key == "exclusiveMinimum" {
+				s.exclusiveMin = b
+			} else {
+				s.exclusiveMax = b
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			n, ok := intOf(v)
+			if !ok || n < 0 {
+				err = fmt.Errorf("%s must be a non negative integer", key)
+				return
+			}
+			switch key {
+			case "minLength":
+				s.minLength = int(n)
+			case "maxLength":
+				s.maxLength = int(n)
+			case "minItems":
+				s.minItems = int(n)
+			default:
+				s.maxItems = int(n)
+			}
+		case "pattern":
+			p, ok := v.StringValueOK()
+			if !ok {
+				err = fmt.Errorf("pattern must be a string")
+				return
+			}
+			s.pattern, err = regexp.Compile(p)
+			if err != nil {
+				return
+			}
+		case "enum":
+			arr, ok := v.ArrayOK()
+			if !ok {
+				err = fmt.Errorf("enum must be an array")
+				return
+			}
+			s.enum, err = arr.Values()
+			if err != nil {
+				return
+			}
+			if len(s.enum) == 0 {
+				err = fmt.Errorf("enum must be a nonempty array")
+				return
+			}
+		case "items":
+			sub, ok := v.DocumentOK()
+			if !ok {
+				err = fmt.Errorf("items must be a schema document")
+				return
+			}
+			s.items, err = parseJSONSchema(sub)
+			if err != nil {
+				return
+			}
+		case "title", "description":
+		default:
+			err = fmt.Errorf("unknown schema keyword %s", key)
+			return
+		}
+	}
+	if s.exclusiveMin && s.minimum == nil || s.exclusiveMax && s.maximum == nil {
+		err = fmt.Errorf("exclusiveMinimum and exclusiveMaximum need minimum and maximum")
+	}
+	return
+}
+
+func stringsOf(v bson.RawValue) (strs []string, err error) {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		err = fmt.Errorf("array of strings expected")
+		return
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return
+	}
+	for _, value := range values {
+		str, ok := value.StringValueOK()
+		if !ok {
+			err = fmt.Errorf("array of strings expected")
+			return
+		}
+		strs = append(strs, str)
+	}
+	return
+}
+
+// validate returns *DocumentValidationError for the first violation of v at path
+func (s *jsonSchema) validate(path string, v bson.RawValue) error {
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if v.Type == t {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("type %s is not %v", v.Type, s.typeNames)}
+		}
+	}
+
+	if len(s.enum) > 0 {
+		ok := false
+		for _, e := range s.enum {
+			if dbson.Compare(v, e) == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("%v is not in enum", v)}
+		}
+	}
+
+	switch v.Type {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		if s.minimum != nil {
+			c := dbson.Compare(v, *s.minimum)
+			if c < 0 || c == 0 && s.exclusiveMin {
+				return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("%v is less than minimum %v", v, *s.minimum)}
+			}
+		}
+		if s.maximum != nil {
+			c := dbson.Compare(v, *s.maximum)
+			if c > 0 || c == 0 && s.exclusiveMax {
+				return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("%v is greater than maximum %v", v, *s.maximum)}
+			}
+		}
+	case bsontype.String:
+		str := v.StringValue()
+		n := utf8.RuneCountInString(str)
+		if s.minLength >= 0 && n < s.minLength || s.maxLength >= 0 && n > s.maxLength {
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("length %d is out of range", n)}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("%q does not match pattern %s", str, s.pattern)}
+		}
+	case bsontype.EmbeddedDocument:
+		return s.validateDocument(path, v.Document())
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return err
+		}
+		if s.minItems >= 0 && len(values) < s.minItems || s.maxItems >= 0 && len(values) > s.maxItems {
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("%d items is out of range", len(values))}
+		}
+		if s.items != nil {
+			for i, item := range values {
+				err = s.items.validate(joinPath(path, fmt.Sprint(i)), item)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateDocument(path string, doc bson.Raw) error {
+	for _, field := range s.required {
+		if _, err := doc.LookupErr(field); err != nil {
+			return &DocumentValidationError{Path: joinPath(path, field), Reason: "required field is missing"}
+		}
+	}
+
+	for _, field := range s.propertyOrder {
+		v, err := doc.LookupErr(field)
+		if err != nil {
+			continue
+		}
+		err = s.properties[field].validate(joinPath(path, field), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.noAdditional {
+		elements, err := doc.Elements()
+		if err != nil {
+			return err
+		}
+		var additional []string
+		for _, e := range elements {
+			// _id is always allowed like mongo
+			if s.properties[e.Key()] == nil && e.Key() != "_id" {
+				additional = append(additional, e.Key())
+			}
+		}
+		if len(additional) > 0 {
+			sort.Strings(additional)
+			return &DocumentValidationError{Path: path, Reason: fmt.Sprintf("additional properties %v are not allowed", additional)}
+		}
+	}
+	return nil
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// validatorSchema returns the parsed validator of ci, it's parsed again only after the validator changed
+func validatorSchema(ci *model.CollectionInfo) (s *jsonSchema, err error) {
+	v, err := parsedValidators.load(ci.ID, ci.Validator.Schema, func(raw bson.Raw) (interface{}, error) {
+		return parseJSONSchema(raw)
+	})
+	if err != nil {
+		return
+	}
+	s = v.(*jsonSchema)
+	return
+}
+
+// checkValidator validates doc against the validator of ci if any,
+// violations of a ValidationWarn validator are only logged.
+func checkValidator(ci *model.CollectionInfo, did []byte, doc bson.Raw) (err error) {
+	if ci.Validator == nil {
+		return
+	}
+
+	s, err := validatorSchema(ci)
+	if err != nil {
+		return
+	}
+	err = s.validate("", bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc})
+	if err != nil && ci.Validator.Action == model.ValidationWarn {
+		docField := zap.Int64("did", publicDid(ci.IDType, did))
+		if ci.IDType != model.IDTypeAuto {
+			docField = zap.Stringer("_id", doc.Lookup(idField))
+		}
+		logger.Instance().Warn("document failed validation", zap.String("collection", ci.Name), docField, zap.Error(err))
+		err = nil
+	}
+	return
+}
+
+// ValidateOptions for Validate
+type ValidateOptions struct {
+	// Schema to check against instead of the validator of collection, e.g. before SetValidator
+	Schema interface{}
+	// Limit is the max number of violations returned, 0 means no limit
+	Limit int
+}
+
+// Violation of a document found by Validate
+type Violation struct {
+	// Did of the document, 0 for typed ids
+	Did int64
+	// ID is the _id of the document for typed ids
+	ID  interface{}
+	Err *DocumentValidationError
+}
+
+// Validate scans documents of collection for violations of its validator, in batches by Scan when t is nil.
+// Nothing is checked if there's neither opts.Schema nor a validator.
+func (c *Collection) Validate(opts *ValidateOptions, t *txn.Txn) (violations []Violation, err error) {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+
+	metaCache := c.handle.Get()
+	if t != nil {
+		metaCache = t.StartMetaCache()
+	}
+	ci := metaCache.CollectionInfo(c.dbName, c.collectionName)
+	if ci == nil {
+		err = ErrCollectionNotExists
+		return
+	}
+
+	var schema bson.Raw
+	if opts.Schema != nil {
+		schema, err = toRaw(opts.Schema)
+		if err != nil {
+			return
+		}
+	} else {
+		if ci.Validator == nil {
+			return
+		}
+		schema = ci.Validator.Schema
+	}
+	s, err := parseJSONSchema(schema)
+	if err != nil {
+		return
+	}
+
+	cursor, err := c.Scan(nil, t)
+	if err != nil {
+		return
+	}
+	defer cursor.Close()
+
+	for cursor.Next() {
+		verr := s.validate("", bson.RawValue{Type: bsontype.EmbeddedDocument, Value: cursor.Current})
+		if verr == nil {
+			continue
+		}
+		dverr, ok := verr.(*DocumentValidationError)
+		if !ok {
+			err = verr
+			return
+		}
+		v := Violation{Did: cursor.Did, Err: dverr}
+		if ci.IDType != model.IDTypeAuto {
+			v.ID, err = idOf(ci, cursor.did)
+			if err != nil {
+				return
+			}
+		}
+		violations = append(violations, v)
+		if opts.Limit > 0 && len(violations) >= opts.Limit {
+			return
+		}
+	}
+	err = cursor.Err()
+	return
+}
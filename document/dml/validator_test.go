@@ -0,0 +1,81 @@
+package dml
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"gotest.tools/assert"
+)
+
+func TestJSONSchema(t *testing.T) {
+	raw, err := ValidatorSchema(bson.M{
+		"bsonType":             "object",
+		"required":             bson.A{"name", "age"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"name":   bson.M{"bsonType": "string", "pattern": "^[a-z]+$", "maxLength": 5},
+			"age":    bson.M{"bsonType": "number", "minimum": 0, "maximum": 150, "exclusiveMaximum": true},
+			"status": bson.M{"enum": bson.A{"on", "off", 1}},
+			"tags":   bson.M{"bsonType": "array", "maxItems": 2, "items": bson.M{"bsonType": "string"}},
+			"address": bson.M{
+				"bsonType":   "object",
+				"required":   bson.A{"city"},
+				"properties": bson.M{"city": bson.M{"bsonType": bson.A{"string", "null"}, "minLength": 2}},
+			},
+		},
+	})
+	assert.Assert(t, err == nil)
+	s, err := parseJSONSchema(raw)
+	assert.Assert(t, err == nil)
+
+	validate := func(doc bson.M) *DocumentValidationError {
+		err := s.validate("", bson.RawValue{Type: bsontype.EmbeddedDocument, Value: mustMarshal(t, doc)})
+		if err == nil {
+			return nil
+		}
+		verr, ok := err.(*DocumentValidationError)
+		assert.Assert(t, ok, err)
+		return verr
+	}
+
+	assert.Assert(t, validate(bson.M{"_id": 1, "name": "bob", "age": 1.5, "status": 1.0, "tags": bson.A{"x"}, "address": bson.M{"city": nil}}) == nil)
+	for _, c := range []struct {
+		path string
+		doc  bson.M
+	}{
+		{"age", bson.M{"name": "bob"}},
+		{"name", bson.M{"name": "Bob", "age": 1}},
+		{"name", bson.M{"name": "bobbie", "age": 1}},
+		{"age", bson.M{"name": "bob", "age": 150}},
+		{"age", bson.M{"name": "bob", "age": -1}},
+		{"status", bson.M{"name": "bob", "age": 1, "status": "idle"}},
+		{"tags", bson.M{"name": "bob", "age": 1, "tags": bson.A{"x", "y", "z"}}},
+		{"tags.1", bson.M{"name": "bob", "age": 1, "tags": bson.A{"x", 1}}},
+		{"address", bson.M{"name": "bob", "age": 1, "address": "nowhere"}},
+		{"address.city", bson.M{"name": "bob", "age": 1, "address": bson.M{}}},
+		{"address.city", bson.M{"name": "bob", "age": 1, "address": bson.M{"city": "a"}}},
+		{"address.city", bson.M{"name": "bob", "age": 1, "address": bson.M{"city": 1}}},
+		{"", bson.M{"name": "bob", "age": 1, "extra": true}},
+	} {
+		verr := validate(c.doc)
+		assert.Assert(t, verr != nil && verr.Path == c.path, "%v %v", c.doc, verr)
+	}
+
+	for _, invalid := range []bson.M{
+		{"bsonType": "integer"},
+		{"bsonType": bson.A{}},
+		{"required": bson.A{}},
+		{"properties": bson.M{"a": 1}},
+		{"minimum": "1"},
+		{"exclusiveMinimum": true},
+		{"maxLength": -1},
+		{"pattern": "("},
+		{"enum": bson.A{}},
+		{"items": 1},
+		{"$jsonSchema": bson.M{}},
+	} {
+		_, err = ValidatorSchema(invalid)
+		assert.Assert(t, err != nil, "%v", invalid)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/zhiqiangxu/mondis/document/model"
 	"github.com/zhiqiangxu/mondis/document/schema"
 	"github.com/zhiqiangxu/util/logger"
+	"github.com/zhiqiangxu/util/osc"
 	"go.uber.org/zap"
 )
 
@@ -42,6 +43,12 @@ func (do *Domain) Init() (err error) {
 		return
 	}
 
+	err = dml.DropTempData(do.kvdb)
+	if err != nil {
+		logger.Instance().Error("Domain.Init DropTempData", zap.Error(err))
+		return
+	}
+
 	callback := ddl.Callback{OnChanged: do.onChange}
 	ddl := ddl.New(do.kvdb, ddl.Options{Callback: callback})
 	err = ddl.Init()
@@ -51,6 +58,8 @@ func (do *Domain) Init() (err error) {
 	}
 	do.ddl = ddl
 	go do.reloadInLoop()
+	go do.ttlInLoop()
+	go do.changeLogGCInLoop()
 	return
 }
 
@@ -95,6 +104,111 @@ func (do *Domain) reloadInLoop() {
 	}
 }
 
+func (do *Domain) ttlInLoop() {
+	conf := config.Load()
+	if conf.TTLMonitorInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(conf.TTLMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			do.deleteExpired(conf)
+		}
+	}
+}
+
+// deleteExpired deletes expired documents of all collections with ttl index,
+// at most conf.TTLMaxBatches transactions per collection each round.
+func (do *Domain) deleteExpired(conf *config.Value) {
+	type collection struct {
+		db, name string
+	}
+	var collections []collection
+	do.handle.Get().ForEachCollection(func(dbName string, ci *model.CollectionInfo) {
+		for _, iif := range ci.Indices {
+			if iif.TTL && iif.State == osc.StatePublic {
+				collections = append(collections, collection{db: dbName, name: ci.Name})
+				return
+			}
+		}
+	})
+
+	for _, c := range collections {
+		db, err := do.DB(c.db)
+		if err != nil {
+			continue
+		}
+		coll, err := db.Collection(c.name)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < conf.TTLMaxBatches; i++ {
+			n, err := coll.DeleteExpired(time.Now(), conf.TTLBatchSize, nil)
+			if err != nil {
+				logger.Instance().Error("deleteExpired DeleteExpired", zap.String("db", c.db), zap.String("collection", c.name), zap.Error(err))
+				break
+			}
+			if n < conf.TTLBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func (do *Domain) changeLogGCInLoop() {
+	conf := config.Load()
+	if conf.ChangeLogGCInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(conf.ChangeLogGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			do.truncateChangeLogs(conf)
+		}
+	}
+}
+
+// truncateChangeLogs deletes change events older than conf.ChangeLogRetention of all collections
+func (do *Domain) truncateChangeLogs(conf *config.Value) {
+	type collection struct {
+		db, name string
+	}
+	var collections []collection
+	do.handle.Get().ForEachCollection(func(dbName string, ci *model.CollectionInfo) {
+		collections = append(collections, collection{db: dbName, name: ci.Name})
+	})
+
+	before := time.Now().Add(-conf.ChangeLogRetention)
+	for _, c := range collections {
+		db, err := do.DB(c.db)
+		if err != nil {
+			continue
+		}
+		coll, err := db.Collection(c.name)
+		if err != nil {
+			continue
+		}
+		for {
+			n, err := coll.TruncateChangeLog(before, conf.ChangeLogGCBatchSize, nil)
+			if err != nil {
+				logger.Instance().Error("truncateChangeLogs TruncateChangeLog", zap.String("db", c.db), zap.String("collection", c.name), zap.Error(err))
+				break
+			}
+			if n < conf.ChangeLogGCBatchSize {
+				break
+			}
+		}
+	}
+}
+
 func (do *Domain) reload() (err error) {
 
 	do.reloadMu.Lock()
@@ -132,12 +246,13 @@ func (do *Domain) reloadSchema() (err error) {
 	if ok {
 		newMetaCache := metaCache.Clone()
 		err = newMetaCache.ApplyDiffs(diffs)
-		if err != nil {
+		if err == nil {
+			err = do.handle.Update(context.Background(), newMetaCache)
 			return
 		}
 
-		err = do.handle.Update(context.Background(), newMetaCache)
-		return
+		// fallback to full reload
+		logger.Instance().Warn("ApplyDiffs", zap.Error(err))
 	}
 
 	dbInfos, err := do.fetchAllDBs(m)
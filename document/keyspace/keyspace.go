@@ -7,6 +7,8 @@ const (
 	MetaPrefix = BasePrefix + "m"
 	// CollectionPrefix for collection
 	CollectionPrefix = BasePrefix + "c"
+	// TempPrefix for temporary data like spilled sort runs
+	TempPrefix = BasePrefix + "t"
 )
 
 var (
@@ -14,4 +16,6 @@ var (
 	MetaPrefixBytes = []byte(MetaPrefix)
 	// CollectionPrefixBytes for collection
 	CollectionPrefixBytes = []byte(CollectionPrefix)
+	// TempPrefixBytes for temporary data
+	TempPrefixBytes = []byte(TempPrefix)
 )
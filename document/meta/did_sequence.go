@@ -5,7 +5,10 @@ import (
 	"github.com/zhiqiangxu/mondis/document/meta/sequence"
 )
 
-const defaultDIDBandWidth = 1000
+const (
+	defaultDIDBandWidth       = 1000
+	defaultChangeLogBandWidth = 1000
+)
 
 // NewDocIDSequence creates a sequence for collection documents
 func NewDocIDSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (*sequence.Hash, error) {
@@ -18,3 +21,15 @@ func NewDocIDSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (*sequence.H
 
 	return sequence.NewHash(kvdb, dbKey, didSequenceKey, bandwidth)
 }
+
+// NewChangeLogSequence creates a sequence for change events of collection
+func NewChangeLogSequence(kvdb mondis.KVDB, dbID, cid, bandwidth int64) (*sequence.Hash, error) {
+	if bandwidth <= 0 {
+		bandwidth = defaultChangeLogBandWidth
+	}
+
+	dbKey := dbKeyByID(dbID)
+	changeLogSequenceKey := changeLogSequenceKeyByID(cid)
+
+	return sequence.NewHash(kvdb, dbKey, changeLogSequenceKey, bandwidth)
+}
@@ -41,18 +41,21 @@ var (
 //		collectionInfo:2 -> collection meta data []byte
 //		didSequence:1 -> int64
 //		didSequence:2 -> int64
+//		changeLogSequence:1 -> int64
+//		changeLogSequence:2 -> int64
 //	}
 //
 
 var (
-	schemaVersionKey     = []byte("schemaVersion")
-	schemaDiffPrefix     = []byte("schemaDiff")
-	bootstrapKey         = []byte("bootstrap")
-	globalIDKey          = []byte("globalID")
-	dbsKey               = []byte("dbs")
-	dbPrefix             = []byte("db")
-	collectionInfoPrefix = []byte("collectionInfo")
-	didSequencePrefix    = []byte("didSequence")
+	schemaVersionKey        = []byte("schemaVersion")
+	schemaDiffPrefix        = []byte("schemaDiff")
+	bootstrapKey            = []byte("bootstrap")
+	globalIDKey             = []byte("globalID")
+	dbsKey                  = []byte("dbs")
+	dbPrefix                = []byte("db")
+	collectionInfoPrefix    = []byte("collectionInfo")
+	didSequencePrefix       = []byte("didSequence")
+	changeLogSequencePrefix = []byte("changeLogSequence")
 )
 
 var (
@@ -93,6 +96,10 @@ func didSequenceKeyByID(collectionID int64) []byte {
 	return []byte(fmt.Sprintf("%s:%d", didSequencePrefix, collectionID))
 }
 
+func changeLogSequenceKeyByID(collectionID int64) []byte {
+	return []byte(fmt.Sprintf("%s:%d", changeLogSequencePrefix, collectionID))
+}
+
 func (m *Meta) checkDBExists(dbKey []byte) (err error) {
 	_, err = m.txn.HGet(dbsKey, dbKey)
 	if err == kv.ErrKeyNotFound {
@@ -259,6 +266,9 @@ func (m *Meta) DropCollection(dbID int64, collectionID int64, delAutoID bool) (e
 		if err = m.txn.HDel(dbKey, didSequenceKeyByID(collectionID)); err != nil {
 			return
 		}
+		if err = m.txn.HDel(dbKey, changeLogSequenceKeyByID(collectionID)); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -641,6 +651,13 @@ func (m *Meta) reorgJobEndHandle(id int64) []byte {
 	return b
 }
 
+func (m *Meta) reorgJobStartKey(id int64) []byte {
+	b := make([]byte, 0, 12)
+	b = numeric.Encode2Binary(uint64(id), b)
+	b = append(b, "_key"...)
+	return b
+}
+
 // UpdateDDLReorgStartHandle saves the job reorganization latest processed start handle for later resuming.
 func (m *Meta) UpdateDDLReorgStartHandle(job *model.Job, startHandle int64) (err error) {
 	err = m.txn.HSet(ddlJobReorgKey, m.reorgJobStartHandle(job.ID), numeric.Encode2Human(startHandle))
@@ -664,6 +681,22 @@ func (m *Meta) RemoveDDLReorgHandle(job *model.Job) (err error) {
 		return
 	}
 	err = m.txn.HDel(ddlJobReorgKey, m.reorgJobEndHandle(job.ID))
+	if err != nil {
+		return
+	}
+	err = m.txn.HDel(ddlJobReorgKey, m.reorgJobStartKey(job.ID))
+	return
+}
+
+// UpdateDDLReorgStartKey saves the key the job reorganization resumes from, for reorganizations over keys instead of handles.
+func (m *Meta) UpdateDDLReorgStartKey(job *model.Job, startKey []byte) (err error) {
+	err = m.txn.HSet(ddlJobReorgKey, m.reorgJobStartKey(job.ID), startKey)
+	return
+}
+
+// GetDDLReorgStartKey gets the key saved by UpdateDDLReorgStartKey.
+func (m *Meta) GetDDLReorgStartKey(job *model.Job) (startKey []byte, err error) {
+	startKey, err = m.txn.HGet(ddlJobReorgKey, m.reorgJobStartKey(job.ID))
 	return
 }
 
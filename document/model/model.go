@@ -2,8 +2,10 @@ package model
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/zhiqiangxu/util/osc"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type (
@@ -17,11 +19,42 @@ type (
 	}
 	// CollectionInfo for collection
 	CollectionInfo struct {
-		ID         int64
-		Name       string
-		Indices    map[string]*IndexInfo
-		IndexOrder []string
-		State      osc.SchemaState
+		ID   int64
+		Name string
+		// Redundant may be empty, only set for job
+		JobRedundant *CollectionInfoRedundant
+		Indices      map[string]*IndexInfo
+		IndexOrder   []string
+		// Validator is nil or checks documents written to collection
+		Validator *ValidatorInfo
+		IDType    IDType
+		// Capped is nil or bounds the documents kept in collection
+		Capped *CappedInfo
+		State  osc.SchemaState
+	}
+	// CappedInfo for capped collection, oldest documents are evicted when a limit is exceeded
+	CappedInfo struct {
+		// MaxDocs is the max number of documents, 0 means no limit
+		MaxDocs int64
+		// MaxBytes is the max total size of documents, 0 means no limit
+		MaxBytes int64
+	}
+	// ValidatorInfo for collection
+	ValidatorInfo struct {
+		// Schema is the marshalled json schema document
+		Schema bson.Raw
+		Action ValidationAction
+	}
+	// CollectionInfoRedundant stores some redundant info
+	CollectionInfoRedundant struct {
+		DB   string
+		DBID int64
+		// OldID is the collection id before truncate
+		OldID int64
+		// NewID is the collection id after truncate
+		NewID int64
+		// OldName is the collection name before rename
+		OldName string
 	}
 	// IndexInfo for index
 	IndexInfo struct {
@@ -30,8 +63,20 @@ type (
 		// Redundant may be empty, only set for job
 		JobRedundant *IndexInfoRedundant
 		Columns      []string
-		Unique       bool
-		State        osc.SchemaState
+		// Desc is empty or marks the descending columns
+		Desc   []bool
+		Unique bool
+		// TTL index expires documents whose date column is older than ExpireAfter
+		TTL         bool
+		ExpireAfter time.Duration
+		// Sparse index skips documents missing all columns
+		Sparse bool
+		// PartialFilter is empty or the marshalled filter of documents to index
+		PartialFilter bson.Raw
+		Kind          IndexKind
+		// Analyzer of text index, empty means analysis.Default
+		Analyzer string
+		State    osc.SchemaState
 	}
 	// IndexInfoRedundant stores some redundant info
 	IndexInfoRedundant struct {
@@ -44,7 +89,7 @@ type (
 		ID          int64
 		Type        ActionType
 		State       JobState
-		Error       error
+		Error       *JobError
 		ErrorCount  int64
 		Arg         interface{} `json:"-"`
 		RawArg      json.RawMessage
@@ -53,6 +98,10 @@ type (
 		// DependencyID is the job's ID that the current job depends on.
 		DependencyID int64
 	}
+	// JobError is the json serializable error of Job
+	JobError struct {
+		Msg string
+	}
 	// SchemaDiff contains the schema modification at a particular schema version.
 	SchemaDiff struct {
 		Version       int64      `json:"version"`
@@ -63,6 +112,45 @@ type (
 	}
 )
 
+// IndexKind is the kind of index.
+type IndexKind byte
+
+// List index kinds.
+const (
+	// IndexKindRegular indexes the values of columns
+	IndexKindRegular IndexKind = iota
+	// IndexKindText is an inverted index of the terms in string columns
+	IndexKindText
+	// IndexKindGeo2d indexes points in the z-order of their coordinates
+	IndexKindGeo2d
+)
+
+// IDType is the type of _id of documents in collection.
+type IDType byte
+
+// List id types.
+const (
+	// IDTypeAuto documents have no _id or the did as _id
+	IDTypeAuto IDType = iota
+	// IDTypeObjectID documents have an ObjectID _id, generated when missing
+	IDTypeObjectID
+	// IDTypeString documents have a string _id supplied by client
+	IDTypeString
+	// IDTypeBytes documents have a binary _id supplied by client
+	IDTypeBytes
+)
+
+// ValidationAction decides what happens to documents failing validation.
+type ValidationAction byte
+
+// List validation actions.
+const (
+	// ValidationStrict rejects invalid documents
+	ValidationStrict ValidationAction = iota
+	// ValidationWarn logs invalid documents and writes them anyway
+	ValidationWarn
+)
+
 // ActionType is the type for DDL action.
 type ActionType byte
 
@@ -77,6 +165,7 @@ const (
 	ActionDropIndex
 	ActionTruncateCollection
 	ActionRenameCollection
+	ActionSetValidator
 )
 
 var actionMap = map[ActionType]string{
@@ -88,6 +177,7 @@ var actionMap = map[ActionType]string{
 	ActionDropIndex:          "drop index",
 	ActionTruncateCollection: "truncate collection",
 	ActionRenameCollection:   "rename collection",
+	ActionSetValidator:       "set validator",
 }
 
 // String return current ddl action in string
@@ -151,6 +241,58 @@ func (db *DBInfo) UpdateCollectionInfo(ci *CollectionInfo) (ok bool) {
 	return
 }
 
+// AddCollectionInfo adds a collection to db
+func (db *DBInfo) AddCollectionInfo(ci *CollectionInfo) (ok bool) {
+	if db.Collections[ci.Name] != nil {
+		return
+	}
+
+	if db.Collections == nil {
+		db.Collections = make(map[string]*CollectionInfo)
+	}
+	db.Collections[ci.Name] = ci
+	db.CollectionOrder = append(db.CollectionOrder, ci.Name)
+	ok = true
+	return
+}
+
+// RemoveCollectionInfo removes a collection from db
+func (db *DBInfo) RemoveCollectionInfo(collectionName string) (ok bool) {
+	if db.Collections[collectionName] == nil {
+		return
+	}
+
+	delete(db.Collections, collectionName)
+	for i, cn := range db.CollectionOrder {
+		if cn == collectionName {
+			db.CollectionOrder = append(db.CollectionOrder[:i], db.CollectionOrder[i+1:]...)
+			break
+		}
+	}
+	ok = true
+	return
+}
+
+// RenameCollectionInfo renames a collection, its position in CollectionOrder is kept
+func (db *DBInfo) RenameCollectionInfo(oldName, newName string) (ok bool) {
+	ci := db.Collections[oldName]
+	if ci == nil || db.Collections[newName] != nil {
+		return
+	}
+
+	delete(db.Collections, oldName)
+	ci.Name = newName
+	db.Collections[newName] = ci
+	for i, cn := range db.CollectionOrder {
+		if cn == oldName {
+			db.CollectionOrder[i] = newName
+			break
+		}
+	}
+	ok = true
+	return
+}
+
 // CollectionExists check whether collection exists
 func (db *DBInfo) CollectionExists(collectionName string) bool {
 	return db.Collections[collectionName] != nil
@@ -175,9 +317,24 @@ func (db *DBInfo) Clone() *DBInfo {
 	return &clone
 }
 
+// ShallowClone DBInfo, collection infos are shared with db
+func (db *DBInfo) ShallowClone() *DBInfo {
+	clone := *db
+	clone.Collections = make(map[string]*CollectionInfo, len(db.Collections))
+	for cn, ci := range db.Collections {
+		clone.Collections[cn] = ci
+	}
+	clone.CollectionOrder = append(db.CollectionOrder[:0:0], db.CollectionOrder...)
+	return &clone
+}
+
 // Clone CollectionInfo
 func (c *CollectionInfo) Clone() *CollectionInfo {
 	clone := *c
+	if clone.JobRedundant != nil {
+		redundant := *clone.JobRedundant
+		clone.JobRedundant = &redundant
+	}
 	clone.Indices = make(map[string]*IndexInfo)
 	clone.IndexOrder = make([]string, len(c.IndexOrder))
 	for in, ii := range c.Indices {
@@ -186,6 +343,13 @@ func (c *CollectionInfo) Clone() *CollectionInfo {
 	for i, in := range c.IndexOrder {
 		clone.IndexOrder[i] = in
 	}
+	if c.Validator != nil {
+		clone.Validator = &ValidatorInfo{Schema: append(bson.Raw(nil), c.Validator.Schema...), Action: c.Validator.Action}
+	}
+	if c.Capped != nil {
+		capped := *c.Capped
+		clone.Capped = &capped
+	}
 	return &clone
 }
 
@@ -206,12 +370,32 @@ func (c *CollectionInfo) AddIndexInfo(iif *IndexInfo) (ok bool) {
 		return
 	}
 
+	if c.Indices == nil {
+		c.Indices = make(map[string]*IndexInfo)
+	}
 	c.Indices[iif.Name] = iif.Clone()
 	c.IndexOrder = append(c.IndexOrder, iif.Name)
 	ok = true
 	return
 }
 
+// RemoveIndexInfo removes an index from collection
+func (c *CollectionInfo) RemoveIndexInfo(indexName string) (ok bool) {
+	if c.Indices[indexName] == nil {
+		return
+	}
+
+	delete(c.Indices, indexName)
+	for i, in := range c.IndexOrder {
+		if in == indexName {
+			c.IndexOrder = append(c.IndexOrder[:i], c.IndexOrder[i+1:]...)
+			break
+		}
+	}
+	ok = true
+	return
+}
+
 // IndexInfo returns the index info by name
 func (c *CollectionInfo) IndexInfo(indexName string) *IndexInfo {
 	return c.Indices[indexName]
@@ -233,9 +417,34 @@ func (ii *IndexInfo) Clone() *IndexInfo {
 	for i, name := range ii.Columns {
 		clone.Columns[i] = name
 	}
+	if len(ii.Desc) > 0 {
+		clone.Desc = make([]bool, len(ii.Desc))
+		copy(clone.Desc, ii.Desc)
+	}
+	if len(ii.PartialFilter) > 0 {
+		clone.PartialFilter = append(bson.Raw(nil), ii.PartialFilter...)
+	}
 	return &clone
 }
 
+// IsDesc returns true if the ith column is descending
+func (ii *IndexInfo) IsDesc(i int) bool {
+	return i < len(ii.Desc) && ii.Desc[i]
+}
+
+// NewJobError converts err to *JobError
+func NewJobError(err error) *JobError {
+	if err == nil {
+		return nil
+	}
+	return &JobError{Msg: err.Error()}
+}
+
+// Error implements error interface
+func (e *JobError) Error() string {
+	return e.Msg
+}
+
 // Encode encodes job with json format.
 func (job *Job) Encode() (b []byte, err error) {
 	if len(job.RawArg) == 0 {
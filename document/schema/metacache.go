@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/util/osc"
 )
 
 const (
@@ -16,6 +17,9 @@ type MetaCache struct {
 	dbs              map[string]*model.DBInfo
 	schemaDiffs      [][]int64
 	diffStartVersion int64
+	// dbs and collections copied by this cache, others may be shared with the cache it's cloned from
+	ownedDBs         map[*model.DBInfo]bool
+	ownedCollections map[*model.CollectionInfo]bool
 }
 
 // NewMetaCache is ctor for MetaCache
@@ -35,44 +39,44 @@ func (c *MetaCache) Version() int64 {
 
 // CheckDBExists checks whether db exists
 func (c *MetaCache) CheckDBExists(dbName string) bool {
-	return c != nil && c.dbs[dbName] != nil
+	return c.dbInfo(dbName) != nil
 }
 
-// CollectionInfo retrieves the collection info by name
-func (c *MetaCache) CollectionInfo(dbName, collectionName string) (collectionInfo *model.CollectionInfo) {
+// dbInfo returns the db info by name, db being dropped is invisible
+func (c *MetaCache) dbInfo(dbName string) *model.DBInfo {
 	if c == nil {
-		return
+		return nil
 	}
 
 	dbInfo := c.dbs[dbName]
+	if dbInfo == nil || dbInfo.State != osc.StatePublic {
+		return nil
+	}
+	return dbInfo
+}
+
+// CollectionInfo retrieves the collection info by name, collection being dropped is invisible
+func (c *MetaCache) CollectionInfo(dbName, collectionName string) (collectionInfo *model.CollectionInfo) {
+	dbInfo := c.dbInfo(dbName)
 	if dbInfo == nil {
 		return
 	}
 
 	collectionInfo = dbInfo.CollectionInfo(collectionName)
+	if collectionInfo != nil && collectionInfo.State != osc.StatePublic {
+		collectionInfo = nil
+	}
 	return
 }
 
 // CheckCollectionExists checks whether collection exists
 func (c *MetaCache) CheckCollectionExists(dbName, collectionName string) bool {
-	if c == nil {
-		return false
-	}
-	dbInfo := c.dbs[dbName]
-	return dbInfo != nil && dbInfo.CollectionExists(collectionName)
+	return c.CollectionInfo(dbName, collectionName) != nil
 }
 
 // CheckIndexExists checks whether index exists
 func (c *MetaCache) CheckIndexExists(dbName, collectionName, indexName string) (exists bool) {
-	if c == nil {
-		return
-	}
-	dbInfo := c.dbs[dbName]
-	if dbInfo == nil {
-		return
-	}
-
-	ci := dbInfo.CollectionInfo(collectionName)
+	ci := c.CollectionInfo(dbName, collectionName)
 	if ci == nil {
 		return
 	}
@@ -81,25 +85,88 @@ func (c *MetaCache) CheckIndexExists(dbName, collectionName, indexName string) (
 	return
 }
 
-// Clone for deep copy
+// ForEachCollection calls fn for each public collection of public dbs
+func (c *MetaCache) ForEachCollection(fn func(dbName string, ci *model.CollectionInfo)) {
+	if c == nil {
+		return
+	}
+
+	for dbName := range c.dbs {
+		dbInfo := c.dbInfo(dbName)
+		if dbInfo == nil {
+			continue
+		}
+		for _, collectionName := range dbInfo.CollectionOrder {
+			ci := dbInfo.Collections[collectionName]
+			if ci == nil || ci.State != osc.StatePublic {
+				continue
+			}
+			fn(dbName, ci)
+		}
+	}
+}
+
+// Clone for copy on write, db and collection infos are shared until a diff touches them
 func (c *MetaCache) Clone() *MetaCache {
 	if c == nil {
 		return &MetaCache{diffStartVersion: 1}
 	}
 	clone := *c
-	clone.dbs = make(map[string]*model.DBInfo)
-	clone.schemaDiffs = make([][]int64, len(c.schemaDiffs))
+	clone.dbs = make(map[string]*model.DBInfo, len(c.dbs))
 	for dbName, dbInfo := range c.dbs {
-		clone.dbs[dbName] = dbInfo.Clone()
-	}
-	for i := 0; i < len(c.schemaDiffs); i++ {
-		diff := c.schemaDiffs[i]
-		clone.schemaDiffs[i] = append(diff[:0:0], diff...)
+		clone.dbs[dbName] = dbInfo
 	}
+	// the collection ids of a diff are never modified
+	clone.schemaDiffs = append(c.schemaDiffs[:0:0], c.schemaDiffs...)
+	clone.ownedDBs = nil
+	clone.ownedCollections = nil
 	return &clone
 }
 
-// ApplyDiffs for apply SchemaDiffs to MetaCache
+// writableDB returns the db info by name that's safe to modify, nil if not exists
+func (c *MetaCache) writableDB(dbName string) *model.DBInfo {
+	dbInfo := c.dbs[dbName]
+	if dbInfo == nil || c.ownedDBs[dbInfo] {
+		return dbInfo
+	}
+
+	dbInfo = dbInfo.ShallowClone()
+	c.dbs[dbName] = dbInfo
+	c.own(dbInfo, nil)
+	return dbInfo
+}
+
+// writableCollection returns the collection info by name of a writable db that's safe to modify, nil if not exists
+func (c *MetaCache) writableCollection(dbInfo *model.DBInfo, collectionName string) *model.CollectionInfo {
+	ci := dbInfo.CollectionInfo(collectionName)
+	if ci == nil || c.ownedCollections[ci] {
+		return ci
+	}
+
+	ci = ci.Clone()
+	dbInfo.UpdateCollectionInfo(ci)
+	c.own(nil, ci)
+	return ci
+}
+
+// own marks dbInfo and ci as copied by c, either can be nil
+func (c *MetaCache) own(dbInfo *model.DBInfo, ci *model.CollectionInfo) {
+	if dbInfo != nil {
+		if c.ownedDBs == nil {
+			c.ownedDBs = make(map[*model.DBInfo]bool)
+		}
+		c.ownedDBs[dbInfo] = true
+	}
+	if ci != nil {
+		if c.ownedCollections == nil {
+			c.ownedCollections = make(map[*model.CollectionInfo]bool)
+		}
+		c.ownedCollections[ci] = true
+	}
+}
+
+// ApplyDiffs for apply SchemaDiffs to MetaCache,
+// only the db and collection infos touched by diffs are copied, so it's applied to a Clone.
 func (c *MetaCache) ApplyDiffs(diffs []*model.SchemaDiff) (err error) {
 
 	err = c.validateDiffs(diffs)
@@ -118,6 +185,36 @@ func (c *MetaCache) ApplyDiffs(diffs []*model.SchemaDiff) (err error) {
 			if err != nil {
 				return
 			}
+		case model.ActionDropSchema:
+			err = c.onDropSchema(diff)
+			if err != nil {
+				return
+			}
+		case model.ActionCreateCollection:
+			err = c.onCreateCollection(diff)
+			if err != nil {
+				return
+			}
+		case model.ActionDropCollection:
+			err = c.onDropCollection(diff)
+			if err != nil {
+				return
+			}
+		case model.ActionTruncateCollection, model.ActionSetValidator:
+			err = c.onCollectionReplaced(diff)
+			if err != nil {
+				return
+			}
+		case model.ActionRenameCollection:
+			err = c.onRenameCollection(diff)
+			if err != nil {
+				return
+			}
+		case model.ActionAddIndex, model.ActionDropIndex:
+			err = c.onIndexChanged(diff)
+			if err != nil {
+				return
+			}
 		default:
 			err = fmt.Errorf("can not apply diff type %d", diff.Type)
 			return
@@ -165,5 +262,162 @@ func (c *MetaCache) onCreateSchema(diff *model.SchemaDiff) (err error) {
 	c.version = diff.Version
 
 	c.dbs[dbInfo.Name] = &dbInfo
+	c.own(&dbInfo, nil)
+	return
+}
+
+func (c *MetaCache) onDropSchema(diff *model.SchemaDiff) (err error) {
+	var dbInfo model.DBInfo
+	err = diff.DecodeArg(&dbInfo)
+	if err != nil {
+		return
+	}
+
+	if c.dbs[dbInfo.Name] == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", dbInfo.Name)
+		return
+	}
+
+	c.version = diff.Version
+
+	if dbInfo.State == osc.StateAbsent {
+		delete(c.dbs, dbInfo.Name)
+	} else {
+		c.dbs[dbInfo.Name] = &dbInfo
+		c.own(&dbInfo, nil)
+	}
+	return
+}
+
+func (c *MetaCache) onCreateCollection(diff *model.SchemaDiff) (err error) {
+	var ci model.CollectionInfo
+	err = diff.DecodeArg(&ci)
+	if err != nil {
+		return
+	}
+
+	dbInfo := c.writableDB(ci.JobRedundant.DB)
+	if dbInfo == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", ci.JobRedundant.DB)
+		return
+	}
+	ci.JobRedundant = nil
+	if !dbInfo.AddCollectionInfo(&ci) {
+		err = fmt.Errorf("collection %s exists in meta cache", ci.Name)
+		return
+	}
+	c.own(nil, &ci)
+
+	c.version = diff.Version
+	return
+}
+
+func (c *MetaCache) onDropCollection(diff *model.SchemaDiff) (err error) {
+	var ci model.CollectionInfo
+	err = diff.DecodeArg(&ci)
+	if err != nil {
+		return
+	}
+
+	dbInfo := c.writableDB(ci.JobRedundant.DB)
+	if dbInfo == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", ci.JobRedundant.DB)
+		return
+	}
+	ci.JobRedundant = nil
+
+	var ok bool
+	if ci.State == osc.StateAbsent {
+		ok = dbInfo.RemoveCollectionInfo(ci.Name)
+	} else {
+		ok = dbInfo.UpdateCollectionInfo(&ci)
+		c.own(nil, &ci)
+	}
+	if !ok {
+		err = fmt.Errorf("collection %s not exists in meta cache", ci.Name)
+		return
+	}
+
+	c.version = diff.Version
+	return
+}
+
+// onCollectionReplaced replaces the collection info of the same name
+func (c *MetaCache) onCollectionReplaced(diff *model.SchemaDiff) (err error) {
+	var ci model.CollectionInfo
+	err = diff.DecodeArg(&ci)
+	if err != nil {
+		return
+	}
+
+	dbInfo := c.writableDB(ci.JobRedundant.DB)
+	if dbInfo == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", ci.JobRedundant.DB)
+		return
+	}
+	ci.JobRedundant = nil
+	if !dbInfo.UpdateCollectionInfo(&ci) {
+		err = fmt.Errorf("collection %s not exists in meta cache", ci.Name)
+		return
+	}
+	c.own(nil, &ci)
+
+	c.version = diff.Version
+	return
+}
+
+func (c *MetaCache) onRenameCollection(diff *model.SchemaDiff) (err error) {
+	var ci model.CollectionInfo
+	err = diff.DecodeArg(&ci)
+	if err != nil {
+		return
+	}
+
+	dbInfo := c.writableDB(ci.JobRedundant.DB)
+	if dbInfo == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", ci.JobRedundant.DB)
+		return
+	}
+	// the name of the collection info is changed in place
+	c.writableCollection(dbInfo, ci.JobRedundant.OldName)
+	if !dbInfo.RenameCollectionInfo(ci.JobRedundant.OldName, ci.Name) {
+		err = fmt.Errorf("can not rename collection %s to %s in meta cache", ci.JobRedundant.OldName, ci.Name)
+		return
+	}
+
+	c.version = diff.Version
+	return
+}
+
+// onIndexChanged applies the index info in any state, absent index is removed
+func (c *MetaCache) onIndexChanged(diff *model.SchemaDiff) (err error) {
+	var iif model.IndexInfo
+	err = diff.DecodeArg(&iif)
+	if err != nil {
+		return
+	}
+
+	dbInfo := c.writableDB(iif.JobRedundant.DB)
+	if dbInfo == nil {
+		err = fmt.Errorf("db %s not exists in meta cache", iif.JobRedundant.DB)
+		return
+	}
+	ci := c.writableCollection(dbInfo, iif.JobRedundant.Collection)
+	if ci == nil || ci.ID != iif.JobRedundant.CID {
+		err = fmt.Errorf("collection %s not exists in meta cache", iif.JobRedundant.Collection)
+		return
+	}
+	iif.JobRedundant = nil
+
+	switch {
+	case iif.State == osc.StateAbsent:
+		ci.RemoveIndexInfo(iif.Name)
+	case ci.IndexExists(iif.Name):
+		ci.UpdateIndexInfo(&iif)
+	default:
+		ci.AddIndexInfo(&iif)
+	}
+
+	c.version = diff.Version
 	return
 }
@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/util/osc"
+	"gotest.tools/assert"
+)
+
+// applyDiff applies a diff of the next version after a json round trip
+func applyDiff(t *testing.T, c *MetaCache, tp model.ActionType, arg interface{}) {
+	version := c.Version() + 1
+	diff := &model.SchemaDiff{Version: version, Type: tp, Arg: arg}
+	b, err := diff.Encode()
+	assert.Assert(t, err == nil)
+	diff = &model.SchemaDiff{}
+	assert.Assert(t, diff.Decode(b) == nil)
+	assert.Assert(t, c.ApplyDiffs([]*model.SchemaDiff{diff}) == nil)
+	assert.Assert(t, c.Version() == version)
+}
+
+func TestApplyCollectionDiffs(t *testing.T) {
+	c := NewMetaCache(1, []*model.DBInfo{{ID: 1, Name: "db", State: osc.StatePublic}})
+
+	apply := func(tp model.ActionType, arg interface{}) {
+		applyDiff(t, c, tp, arg)
+	}
+	redundant := func(r model.CollectionInfoRedundant) *model.CollectionInfoRedundant {
+		r.DB = "db"
+		r.DBID = 1
+		return &r
+	}
+
+	apply(model.ActionCreateCollection, &model.CollectionInfo{ID: 2, Name: "c", State: osc.StatePublic, JobRedundant: redundant(model.CollectionInfoRedundant{})})
+	assert.Assert(t, c.CollectionInfo("db", "c").ID == 2)
+
+	apply(model.ActionRenameCollection, &model.CollectionInfo{ID: 2, Name: "c2", State: osc.StatePublic, JobRedundant: redundant(model.CollectionInfoRedundant{OldName: "c"})})
+	assert.Assert(t, !c.CheckCollectionExists("db", "c"))
+	assert.Assert(t, c.CollectionInfo("db", "c2").ID == 2)
+	assert.DeepEqual(t, c.dbs["db"].CollectionOrder, []string{"c2"})
+
+	apply(model.ActionTruncateCollection, &model.CollectionInfo{ID: 3, Name: "c2", State: osc.StatePublic, JobRedundant: redundant(model.CollectionInfoRedundant{OldID: 2})})
+	assert.Assert(t, c.CollectionInfo("db", "c2").ID == 3)
+
+	validator := &model.ValidatorInfo{Schema: []byte{5, 0, 0, 0, 0}, Action: model.ValidationWarn}
+	apply(model.ActionSetValidator, &model.CollectionInfo{ID: 3, Name: "c2", Validator: validator, State: osc.StatePublic, JobRedundant: redundant(model.CollectionInfoRedundant{})})
+	assert.DeepEqual(t, c.CollectionInfo("db", "c2").Validator, validator)
+
+	apply(model.ActionDropCollection, &model.CollectionInfo{ID: 3, Name: "c2", State: osc.StateWriteOnly, JobRedundant: redundant(model.CollectionInfoRedundant{})})
+	assert.Assert(t, !c.CheckCollectionExists("db", "c2"))
+	assert.Assert(t, c.dbs["db"].Collections["c2"] != nil)
+
+	apply(model.ActionDropCollection, &model.CollectionInfo{ID: 3, Name: "c2", State: osc.StateAbsent, JobRedundant: redundant(model.CollectionInfoRedundant{})})
+	assert.Assert(t, c.dbs["db"].Collections["c2"] == nil)
+	assert.Assert(t, len(c.dbs["db"].CollectionOrder) == 0)
+}
+
+func TestApplyIndexAndSchemaDiffs(t *testing.T) {
+	c := NewMetaCache(1, nil)
+
+	apply := func(tp model.ActionType, arg interface{}) {
+		applyDiff(t, c, tp, arg)
+	}
+	index := func(state osc.SchemaState) *model.IndexInfo {
+		return &model.IndexInfo{
+			ID:           3,
+			Name:         "idx",
+			Columns:      []string{"a"},
+			State:        state,
+			JobRedundant: &model.IndexInfoRedundant{DB: "db", Collection: "c", CID: 2},
+		}
+	}
+
+	apply(model.ActionCreateSchema, &model.DBInfo{
+		ID:              1,
+		Name:            "db",
+		Collections:     map[string]*model.CollectionInfo{"c": {ID: 2, Name: "c", State: osc.StatePublic}},
+		CollectionOrder: []string{"c"},
+		State:           osc.StatePublic,
+	})
+	assert.Assert(t, c.CheckCollectionExists("db", "c"))
+
+	for _, state := range []osc.SchemaState{osc.StateDeleteOnly, osc.StateWriteOnly, osc.StateWriteReorganization, osc.StatePublic} {
+		apply(model.ActionAddIndex, index(state))
+		assert.Assert(t, c.CollectionInfo("db", "c").IndexInfo("idx").State == state)
+	}
+	assert.DeepEqual(t, c.CollectionInfo("db", "c").IndexOrder, []string{"idx"})
+
+	for _, state := range []osc.SchemaState{osc.StateWriteOnly, osc.StateDeleteOnly, osc.StateAbsent} {
+		apply(model.ActionDropIndex, index(state))
+	}
+	assert.Assert(t, !c.CheckIndexExists("db", "c", "idx"))
+	assert.Assert(t, len(c.CollectionInfo("db", "c").IndexOrder) == 0)
+
+	apply(model.ActionDropSchema, &model.DBInfo{ID: 1, Name: "db", State: osc.StateWriteOnly})
+	assert.Assert(t, !c.CheckDBExists("db"))
+	apply(model.ActionDropSchema, &model.DBInfo{ID: 1, Name: "db", State: osc.StateAbsent})
+	assert.Assert(t, c.dbs["db"] == nil)
+}
+
+func TestApplyDiffsCopyOnWrite(t *testing.T) {
+	c := NewMetaCache(1, []*model.DBInfo{
+		{ID: 1, Name: "db", State: osc.StatePublic},
+		{ID: 2, Name: "other", State: osc.StatePublic},
+	})
+	applyDiff(t, c, model.ActionCreateCollection, &model.CollectionInfo{ID: 3, Name: "c", State: osc.StatePublic, JobRedundant: &model.CollectionInfoRedundant{DB: "db", DBID: 1}})
+	applyDiff(t, c, model.ActionCreateCollection, &model.CollectionInfo{ID: 4, Name: "d", State: osc.StatePublic, JobRedundant: &model.CollectionInfoRedundant{DB: "db", DBID: 1}})
+
+	clone := c.Clone()
+	applyDiff(t, clone, model.ActionAddIndex, &model.IndexInfo{
+		ID:           5,
+		Name:         "idx",
+		Columns:      []string{"a"},
+		State:        osc.StatePublic,
+		JobRedundant: &model.IndexInfoRedundant{DB: "db", Collection: "c", CID: 3},
+	})
+	applyDiff(t, clone, model.ActionRenameCollection, &model.CollectionInfo{ID: 4, Name: "e", State: osc.StatePublic, JobRedundant: &model.CollectionInfoRedundant{DB: "db", DBID: 1, OldName: "d"}})
+
+	// the original is untouched
+	assert.Assert(t, c.Version() == clone.Version()-2)
+	assert.Assert(t, !c.CheckIndexExists("db", "c", "idx"))
+	assert.Assert(t, c.CheckCollectionExists("db", "d") && !c.CheckCollectionExists("db", "e"))
+	assert.Assert(t, clone.CheckIndexExists("db", "c", "idx"))
+	assert.Assert(t, clone.CheckCollectionExists("db", "e") && !clone.CheckCollectionExists("db", "d"))
+
+	// only the touched infos are copied
+	assert.Assert(t, clone.dbs["other"] == c.dbs["other"])
+	assert.Assert(t, clone.dbs["db"] != c.dbs["db"])
+	assert.Assert(t, clone.CollectionInfo("db", "c") != c.CollectionInfo("db", "c"))
+}
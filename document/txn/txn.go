@@ -17,6 +17,8 @@ type Txn struct {
 	sequenceMap         map[int64]*sequence.Hash
 	referredCollections map[int64]struct{}
 	cancelFuncs         []func()
+	commitFuncs         []func() (done func(), err error)
+	values              map[interface{}]interface{}
 	update              bool
 }
 
@@ -63,10 +65,43 @@ func (txn *Txn) Commit() (err error) {
 		return
 	}
 
+	for _, commitFunc := range txn.commitFuncs {
+		var done func()
+		done, err = commitFunc()
+		if done != nil {
+			defer done()
+		}
+		if err != nil {
+			return
+		}
+	}
+
 	err = txn.ProviderTxn.Commit()
 	return
 }
 
+// AddCommitFunc adds a commitFunc to be called right before the underlying commit,
+// done is called after the commit no matter it succeeds or not.
+func (txn *Txn) AddCommitFunc(commitFunc func() (done func(), err error)) {
+	if !txn.update {
+		panic("AddCommitFunc called on read only txn")
+	}
+	txn.commitFuncs = append(txn.commitFuncs, commitFunc)
+}
+
+// Value returns the value associated with key by SetValue
+func (txn *Txn) Value(key interface{}) interface{} {
+	return txn.values[key]
+}
+
+// SetValue associates value with key for the lifetime of txn
+func (txn *Txn) SetValue(key, value interface{}) {
+	if txn.values == nil {
+		txn.values = make(map[interface{}]interface{})
+	}
+	txn.values[key] = value
+}
+
 // AddCancelFunc adds a cancelFunc to be called when Commit failed
 func (txn *Txn) AddCancelFunc(cancelFunc func()) {
 	if !txn.update {
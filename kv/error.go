@@ -7,4 +7,6 @@ var (
 	ErrTxnTooBig = errors.New("transaction too big")
 	// ErrKeyNotFound when key not found
 	ErrKeyNotFound = errors.New("key not found")
+	// ErrConflict when transaction conflicts with a concurrent one
+	ErrConflict = errors.New("transaction conflict")
 )
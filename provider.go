@@ -59,6 +59,8 @@ type (
 		// smallest key greater than the provided key if iterating in the forward direction.
 		// Behavior would be reversed if iterating backwards.
 		Offset []byte
+		// KeyOnly skips fetching values if the provider supports it, the value passed to fn should be ignored.
+		KeyOnly bool
 	}
 
 	// VMetaReq for set value meta
@@ -103,6 +103,7 @@ func (b *Badger) WriteBatch() mondis.ProviderWriteBatch {
 func scanByBadgerTxn(txn *badger.Txn, option mondis.ProviderScanOption, fn func(key []byte, value []byte, meta mondis.VMetaResp) bool) (err error) {
 	iterOpts := badger.DefaultIteratorOptions
 	iterOpts.Reverse = option.Reverse
+	iterOpts.PrefetchValues = !option.KeyOnly
 
 	if len(option.Prefix) > 0 {
 		iterOpts.Prefix = option.Prefix
@@ -121,6 +122,14 @@ func scanByBadgerTxn(txn *badger.Txn, option mondis.ProviderScanOption, fn func(
 	for ; iter.Valid(); iter.Next() {
 		item := iter.Item()
 
+		if option.KeyOnly {
+			goon = fn(item.Key(), nil, mondis.VMetaResp{ExpiresAt: item.ExpiresAt(), Tag: item.UserMeta()})
+			if !goon {
+				break
+			}
+			continue
+		}
+
 		err = item.Value(func(val []byte) error {
 			goon = fn(item.Key(), val, mondis.VMetaResp{ExpiresAt: item.ExpiresAt(), Tag: item.UserMeta()})
 			return nil
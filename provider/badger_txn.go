@@ -82,6 +82,9 @@ func (txn *Txn) StartTS() uint64 {
 // Commit for implement mondis.ProviderTxn
 func (txn *Txn) Commit() (err error) {
 	err = (*badger.Txn)(txn).Commit()
+	if err == badger.ErrConflict {
+		err = kv.ErrConflict
+	}
 	return
 }
 
@@ -3,8 +3,11 @@ package test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,14 +15,19 @@ import (
 
 	"github.com/zhiqiangxu/mondis"
 	"github.com/zhiqiangxu/mondis/client"
+	"github.com/zhiqiangxu/mondis/document/config"
 	"github.com/zhiqiangxu/mondis/document/ddl"
 	"github.com/zhiqiangxu/mondis/document/dml"
 	"github.com/zhiqiangxu/mondis/document/domain"
+	"github.com/zhiqiangxu/mondis/document/keyspace"
+	"github.com/zhiqiangxu/mondis/document/model"
+	"github.com/zhiqiangxu/mondis/document/txn"
 	"github.com/zhiqiangxu/mondis/kv"
 	"github.com/zhiqiangxu/mondis/provider"
 	"github.com/zhiqiangxu/mondis/server"
 	"github.com/zhiqiangxu/mondis/structure"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gotest.tools/assert"
 )
 
@@ -165,6 +173,8 @@ func TestDocument(t *testing.T) {
 	err := kvdb.Open(mondis.KVOption{Dir: dataDir})
 	assert.Assert(t, err == nil)
 
+	// let the ttl reaper run during the test
+	config.Load().TTLMonitorInterval = 100 * time.Millisecond
 	do := domain.NewDomain(kvdb)
 	assert.Assert(t, do.Init() == nil)
 	_, err = do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "db", Collections: []string{"c"}})
@@ -230,6 +240,30 @@ func TestDocument(t *testing.T) {
 	err = c.GetOne(did, nil, nil)
 	assert.Assert(t, err == dml.ErrDocNotFound)
 
+	testIndex(t, do)
+	testAddIndex(t, do)
+	testUniqueIndex(t, do)
+	testDropSchema(t, do, kvdb)
+	testCollectionDDL(t, do, kvdb)
+	testDropIndex(t, do, kvdb)
+	testTruncateRenameCollection(t, do, kvdb)
+	testFind(t, do)
+	testExplain(t, do)
+	testIndexEncoding(t, do)
+	testUpdate(t, do)
+	testMultikey(t, do)
+	testTTL(t, do)
+	testPartialIndex(t, do)
+	testTextIndex(t, do)
+	testGeoIndex(t, do)
+	testAggregate(t, do, kvdb)
+	testChangeStream(t, do)
+	testInsertMany(t, do)
+	testScan(t, do)
+	testValidator(t, do)
+	testDocIDTypes(t, do)
+	testCapped(t, do)
+
 	// {
 	// 	// test index
 	// 	c, err := db.Collection("i")
@@ -273,6 +307,1490 @@ func TestDocument(t *testing.T) {
 
 }
 
+func testIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "index_db",
+		Collections: []string{"c"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx", Columns: []string{"a", "b"}}}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("index_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	idx, err := c.Index("idx")
+	assert.Assert(t, err == nil)
+
+	var dids []int64
+	for i := 0; i < 10; i++ {
+		did, err := c.InsertOne(bson.M{"a": i % 2, "b": i}, nil)
+		assert.Assert(t, err == nil)
+		dids = append(dids, did)
+	}
+
+	// a == 1 and 3 <= b < 9
+	option := dml.LookupOption{Eq: []interface{}{1}, Lower: &dml.Bound{Value: 3}, Upper: &dml.Bound{Value: 9, Exclusive: true}}
+	result, cursor, err := idx.Lookup(option, nil)
+	assert.Assert(t, err == nil && cursor == nil)
+	assert.DeepEqual(t, result, []int64{dids[3], dids[5], dids[7]})
+
+	option.Reverse = true
+	result, _, err = idx.Lookup(option, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, result, []int64{dids[7], dids[5], dids[3]})
+
+	// paging
+	option.Reverse = false
+	option.Limit = 2
+	result, cursor, err = idx.Lookup(option, nil)
+	assert.Assert(t, err == nil && cursor != nil)
+	assert.DeepEqual(t, result, []int64{dids[3], dids[5]})
+	option.Cursor = cursor
+	result, cursor, err = idx.Lookup(option, nil)
+	assert.Assert(t, err == nil && cursor == nil)
+	assert.DeepEqual(t, result, []int64{dids[7]})
+
+	var docs []bson.M
+	_, err = idx.LookupDocs(dml.LookupOption{Eq: []interface{}{0, 4}}, &docs, nil)
+	assert.Assert(t, err == nil && len(docs) == 1 && docs[0]["b"] == int32(4))
+
+	// update moves the index entry
+	_, err = c.UpdateOne(dids[4], bson.M{"a": 0, "b": 40}, nil)
+	assert.Assert(t, err == nil)
+	result, _, err = idx.Lookup(dml.LookupOption{Eq: []interface{}{0, 4}}, nil)
+	assert.Assert(t, err == nil && len(result) == 0)
+	result, _, err = idx.Lookup(dml.LookupOption{Eq: []interface{}{0, 40}}, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, result, []int64{dids[4]})
+
+	// delete removes the index entry
+	err = c.DeleteOne(dids[4], nil)
+	assert.Assert(t, err == nil)
+	result, _, err = idx.Lookup(dml.LookupOption{Eq: []interface{}{0}}, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, result, []int64{dids[0], dids[2], dids[6], dids[8]})
+
+	_, err = c.DeleteAll(nil)
+	assert.Assert(t, err == nil)
+	result, _, err = idx.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(result) == 0)
+}
+
+func testAddIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "add_index_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("add_index_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	// more than one reorg batch
+	n := 2500
+	for i := 0; i < n; i++ {
+		_, err = c.InsertOne(bson.M{"a": i % 10}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	_, err = do.DDL().AddIndex(context.Background(), ddl.AddIndexInput{
+		DB:         "add_index_db",
+		Collection: "c",
+		IndexInfo:  ddl.IndexInfo{Name: "idx_a", Columns: []string{"a"}},
+	})
+	assert.Assert(t, err == nil)
+
+	idx, err := c.Index("idx_a")
+	assert.Assert(t, err == nil)
+	dids, _, err := idx.Lookup(dml.LookupOption{Eq: []interface{}{3}}, nil)
+	assert.Assert(t, err == nil && len(dids) == n/10)
+	dids, _, err = idx.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == n)
+}
+
+func testUniqueIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "unique_db",
+		Collections: []string{"c"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx_u", Columns: []string{"u"}, Unique: true}}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("unique_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	did1, err := c.InsertOne(bson.M{"u": 1, "v": 1}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"u": 1, "v": 2}, nil)
+	dupErr, ok := err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok && dupErr.Index == "idx_u" && dupErr.Did == did1)
+
+	did2, err := c.InsertOne(bson.M{"u": 2, "v": 2}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.UpdateOne(did2, bson.M{"u": 1}, nil)
+	dupErr, ok = err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok && dupErr.Did == did1)
+
+	// updating the owner itself is fine
+	_, err = c.UpdateOne(did1, bson.M{"u": 1, "v": 3}, nil)
+	assert.Assert(t, err == nil)
+
+	idx, err := c.Index("idx_u")
+	assert.Assert(t, err == nil)
+	dids, _, err := idx.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dids, []int64{did1, did2})
+
+	// the index is freed after delete
+	err = c.DeleteOne(did1, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.UpdateOne(did2, bson.M{"u": 1}, nil)
+	assert.Assert(t, err == nil)
+
+	// AddIndex rolls back when duplicates are found
+	_, err = c.InsertOne(bson.M{"u": 3, "v": 2}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"u": 4, "v": 2}, nil)
+	assert.Assert(t, err == nil)
+	_, err = do.DDL().AddIndex(context.Background(), ddl.AddIndexInput{
+		DB:         "unique_db",
+		Collection: "c",
+		IndexInfo:  ddl.IndexInfo{Name: "idx_v", Columns: []string{"v"}, Unique: true},
+	})
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), "duplicate key"))
+	_, err = c.Index("idx_v")
+	assert.Assert(t, err == dml.ErrIndexNotExists)
+}
+
+func testDropSchema(t *testing.T, do *domain.Domain, kvdb mondis.KVDB) {
+	job, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "drop_db",
+		Collections: []string{"c"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx_a", Columns: []string{"a"}}}},
+	})
+	assert.Assert(t, err == nil)
+	cid := job.Arg.(*model.DBInfo).Collections["c"].ID
+
+	db, err := do.DB("drop_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	for i := 0; i < 10; i++ {
+		_, err = c.InsertOne(bson.M{"a": i}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	countKeys := func() (n int) {
+		txn := kvdb.NewTransaction(false)
+		defer txn.Discard()
+		err := txn.Scan(mondis.ProviderScanOption{Prefix: dml.AppendCollectionPrefix(nil, cid)}, func(key []byte, value []byte, meta mondis.VMetaResp) bool {
+			n++
+			return true
+		})
+		assert.Assert(t, err == nil)
+		return
+	}
+	// documents, index entries and change events
+	assert.Assert(t, countKeys() == 30)
+
+	_, err = do.DDL().DropSchema(context.Background(), ddl.DropSchemaInput{DB: "drop_db"})
+	assert.Assert(t, err == nil)
+	_, err = do.DB("drop_db")
+	assert.Assert(t, err == dml.ErrDBNotExists)
+	assert.Assert(t, countKeys() == 0)
+
+	_, err = do.DDL().DropSchema(context.Background(), ddl.DropSchemaInput{DB: "drop_db"})
+	assert.Assert(t, err == ddl.ErrDBNotExists)
+
+	// the name can be reused
+	_, err = do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "drop_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err = do.DB("drop_db")
+	assert.Assert(t, err == nil)
+	c, err = db.Collection("c")
+	assert.Assert(t, err == nil)
+	n, err := c.Count(nil)
+	assert.Assert(t, err == nil && n == 0)
+}
+
+func testCollectionDDL(t *testing.T, do *domain.Domain, kvdb mondis.KVDB) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "collection_db"})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("collection_db")
+	assert.Assert(t, err == nil)
+	_, err = db.Collection("c")
+	assert.Assert(t, err == dml.ErrCollectionNotExists)
+
+	job, err := do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{
+		DB:         "collection_db",
+		Collection: "c",
+		Indices:    []ddl.IndexInfo{{Name: "idx_a", Columns: []string{"a"}}},
+	})
+	assert.Assert(t, err == nil)
+	cid := job.Arg.(*model.CollectionInfo).ID
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "collection_db", Collection: "c"})
+	assert.Assert(t, err == ddl.ErrCollectionAlreadyExists)
+
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	did, err := c.InsertOne(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+	idx, err := c.Index("idx_a")
+	assert.Assert(t, err == nil)
+	dids, _, err := idx.Lookup(dml.LookupOption{Eq: []interface{}{1}}, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dids, []int64{did})
+
+	_, err = do.DDL().DropCollection(context.Background(), ddl.DropCollectionInput{DB: "collection_db", Collection: "c"})
+	assert.Assert(t, err == nil)
+	_, err = db.Collection("c")
+	assert.Assert(t, err == dml.ErrCollectionNotExists)
+	_, err = c.InsertOne(bson.M{"a": 2}, nil)
+	assert.Assert(t, err == dml.ErrCollectionNotExists)
+	_, err = do.DDL().DropCollection(context.Background(), ddl.DropCollectionInput{DB: "collection_db", Collection: "c"})
+	assert.Assert(t, err == ddl.ErrCollectionNotExists)
+
+	txn := kvdb.NewTransaction(false)
+	defer txn.Discard()
+	err = txn.Scan(mondis.ProviderScanOption{Prefix: dml.AppendCollectionPrefix(nil, cid)}, func(key []byte, value []byte, meta mondis.VMetaResp) bool {
+		t.Fatal("collection data not deleted")
+		return false
+	})
+	assert.Assert(t, err == nil)
+}
+
+// testDropIndex drops the index built by testAddIndex
+func testDropIndex(t *testing.T, do *domain.Domain, kvdb mondis.KVDB) {
+	job, err := do.DDL().DropIndex(context.Background(), ddl.DropIndexInput{DB: "add_index_db", Collection: "c", IndexName: "idx_a"})
+	assert.Assert(t, err == nil)
+	iif := job.Arg.(*model.IndexInfo)
+
+	db, err := do.DB("add_index_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	_, err = c.Index("idx_a")
+	assert.Assert(t, err == dml.ErrIndexNotExists)
+	_, err = c.InsertOne(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+
+	txn := kvdb.NewTransaction(false)
+	defer txn.Discard()
+	err = txn.Scan(mondis.ProviderScanOption{Prefix: dml.AppendCollectionIndexPrefix(nil, iif.JobRedundant.CID, iif.ID)}, func(key []byte, value []byte, meta mondis.VMetaResp) bool {
+		t.Fatal("index data not deleted")
+		return false
+	})
+	assert.Assert(t, err == nil)
+
+	_, err = do.DDL().DropIndex(context.Background(), ddl.DropIndexInput{DB: "add_index_db", Collection: "c", IndexName: "idx_a"})
+	assert.Assert(t, err == ddl.ErrIndexNotExists)
+}
+
+func testTruncateRenameCollection(t *testing.T, do *domain.Domain, kvdb mondis.KVDB) {
+	job, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "truncate_db",
+		Collections: []string{"c", "d"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx_a", Columns: []string{"a"}}}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("truncate_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	for i := 0; i < 10; i++ {
+		_, err = c.InsertOne(bson.M{"a": i}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	_, err = do.DDL().TruncateCollection(context.Background(), ddl.TruncateCollectionInput{DB: "truncate_db", Collection: "c"})
+	assert.Assert(t, err == nil)
+
+	// data of the old collection id is deleted by the job
+	txn := kvdb.NewTransaction(false)
+	defer txn.Discard()
+	err = txn.Scan(mondis.ProviderScanOption{Prefix: dml.AppendCollectionPrefix(nil, job.Arg.(*model.DBInfo).Collections["c"].ID)}, func(key []byte, value []byte, meta mondis.VMetaResp) bool {
+		t.Fatal("collection data not deleted")
+		return false
+	})
+	assert.Assert(t, err == nil)
+
+	c, err = db.Collection("c")
+	assert.Assert(t, err == nil)
+	n, err := c.Count(nil)
+	assert.Assert(t, err == nil && n == 0)
+	did, err := c.InsertOne(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+	idx, err := c.Index("idx_a")
+	assert.Assert(t, err == nil)
+	dids, _, err := idx.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dids, []int64{did})
+
+	_, err = do.DDL().RenameCollection(context.Background(), ddl.RenameCollectionInput{DB: "truncate_db", Collection: "c", NewName: "d"})
+	assert.Assert(t, err == ddl.ErrCollectionAlreadyExists)
+	_, err = do.DDL().RenameCollection(context.Background(), ddl.RenameCollectionInput{DB: "truncate_db", Collection: "c", NewName: "e"})
+	assert.Assert(t, err == nil)
+	_, err = db.Collection("c")
+	assert.Assert(t, err == dml.ErrCollectionNotExists)
+	e, err := db.Collection("e")
+	assert.Assert(t, err == nil)
+	var doc bson.M
+	err = e.GetOne(did, &doc, nil)
+	assert.Assert(t, err == nil && doc["a"] == int32(1))
+}
+
+func testFind(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "find_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("find_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	// more than one scan batch
+	n := 250
+	for i := 0; i < n; i++ {
+		_, err = c.InsertOne(bson.M{"i": i, "mod": i % 5, "sub": bson.M{"even": i%2 == 0}}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	cursor, err := c.Find(bson.M{"mod": 1, "sub.even": true}, nil, nil)
+	assert.Assert(t, err == nil)
+	count := 0
+	for cursor.Next() {
+		var doc struct {
+			I   int
+			Mod int
+		}
+		assert.Assert(t, cursor.Decode(&doc) == nil)
+		assert.Assert(t, doc.Mod == 1 && doc.I%2 == 0)
+		count++
+	}
+	assert.Assert(t, cursor.Err() == nil)
+	cursor.Close()
+	assert.Assert(t, count == n/10)
+
+	cursor, err = c.Find(
+		bson.M{"$or": bson.A{bson.M{"i": bson.M{"$lt": 10}}, bson.M{"i": bson.M{"$gte": 240}}}},
+		&dml.FindOptions{
+			Projection: bson.M{"i": 1},
+			Sort:       bson.D{{Key: "i", Value: -1}},
+			Skip:       5,
+			Limit:      10,
+		}, nil)
+	assert.Assert(t, err == nil)
+	var docs []bson.M
+	assert.Assert(t, cursor.All(&docs) == nil)
+	assert.Assert(t, len(docs) == 10)
+	// 249..240, 9..0 skipping the first 5
+	expected := []int32{244, 243, 242, 241, 240, 9, 8, 7, 6, 5}
+	for j, doc := range docs {
+		assert.DeepEqual(t, doc, bson.M{"i": expected[j]})
+	}
+
+	_, err = c.Find(bson.M{"i": bson.M{"$regex": "x"}}, nil, nil)
+	assert.Assert(t, err != nil)
+}
+
+func testExplain(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "explain_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_mod_i", Columns: []string{"mod", "i"}},
+			{Name: "idx_i", Columns: []string{"i"}},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("explain_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	n := 500
+	for i := 0; i < n; i++ {
+		_, err = c.InsertOne(bson.M{"i": i, "mod": i % 50, "s": fmt.Sprint(i)}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	// equality on mod and range on i
+	filter := bson.M{"mod": 3, "i": bson.M{"$gte": 100}}
+	ex, err := c.Explain(filter, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanIndexScan && ex.Index == "idx_mod_i" && !ex.Covered, "%+v", ex)
+	assert.Assert(t, ex.EstimatedKeysExamined == 8 && ex.KeysExamined == 8 && ex.DocsExamined == 8 && ex.NReturned == 8, "%+v", ex)
+	assert.Assert(t, len(ex.Rejected) == 2)
+
+	// covered query never reads documents
+	ex, err = c.Explain(filter, &dml.FindOptions{Projection: bson.M{"i": 1, "_id": 0}}, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Covered && ex.DocsExamined == 0 && ex.NReturned == 8, "%+v", ex)
+	cursor, err := c.Find(filter, &dml.FindOptions{Projection: bson.M{"i": 1, "_id": 0}, Sort: bson.D{{Key: "i", Value: -1}}}, nil)
+	assert.Assert(t, err == nil)
+	var docs []bson.M
+	assert.Assert(t, cursor.All(&docs) == nil)
+	assert.DeepEqual(t, docs[0], bson.M{"i": int32(453)})
+	assert.DeepEqual(t, docs[7], bson.M{"i": int32(103)})
+
+	// sort served by index stops after limit
+	ex, err = c.Explain(nil, &dml.FindOptions{Sort: bson.D{{Key: "i", Value: -1}}, Limit: 3}, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanIndexScan && ex.Index == "idx_i" && ex.SortFromIndex && ex.NReturned == 3, "%+v", ex)
+	assert.Assert(t, ex.KeysExamined <= 100, "%+v", ex)
+
+	// unindexed field uses collection scan
+	ex, err = c.Explain(bson.M{"s": "7"}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanCollectionScan && ex.KeysExamined == n && ex.NReturned == 1, "%+v", ex)
+
+	// results are the same no matter which plan is chosen
+	var viaIndex, viaScan []bson.M
+	cursor, err = c.Find(bson.M{"i": bson.M{"$lt": 20}, "mod": bson.M{"$gt": 15}}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, cursor.All(&viaIndex) == nil)
+	cursor, err = c.Find(bson.M{"$or": bson.A{bson.M{"i": bson.M{"$lt": 20}}}, "mod": bson.M{"$gt": 15}}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, cursor.All(&viaScan) == nil)
+	assert.Assert(t, len(viaIndex) == 4)
+	assert.DeepEqual(t, viaIndex, viaScan)
+}
+
+func testIndexEncoding(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "encoding_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_at", Columns: []string{"at"}, Desc: []bool{true}},
+			{Name: "idx_oid", Columns: []string{"oid"}, Unique: true},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("encoding_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	oids := make([]primitive.ObjectID, 10)
+	for i := range oids {
+		oids[i] = primitive.NewObjectID()
+		_, err = c.InsertOne(bson.M{"at": base.Add(time.Duration(i) * time.Hour), "oid": oids[i], "i": i}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	// descending index serves the descending sort forward
+	filter := bson.M{"at": bson.M{"$gte": base.Add(3 * time.Hour), "$lt": base.Add(7 * time.Hour)}}
+	opts := &dml.FindOptions{Sort: bson.D{{Key: "at", Value: -1}}, Projection: bson.M{"at": 1, "_id": 0}}
+	ex, err := c.Explain(filter, opts, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Index == "idx_at" && ex.SortFromIndex && ex.Covered && ex.KeysExamined == 4, "%+v", ex)
+	cursor, err := c.Find(filter, opts, nil)
+	assert.Assert(t, err == nil)
+	var docs []struct{ At time.Time }
+	assert.Assert(t, cursor.All(&docs) == nil)
+	assert.Assert(t, len(docs) == 4)
+	for i, doc := range docs {
+		assert.Assert(t, doc.At.Equal(base.Add(time.Duration(6-i)*time.Hour)))
+	}
+
+	idx, err := c.Index("idx_oid")
+	assert.Assert(t, err == nil)
+	var found []bson.M
+	_, err = idx.LookupDocs(dml.LookupOption{Eq: []interface{}{oids[5]}}, &found, nil)
+	assert.Assert(t, err == nil && len(found) == 1 && found[0]["i"] == int32(5))
+	_, err = c.InsertOne(bson.M{"oid": oids[5]}, nil)
+	_, ok := err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok)
+}
+
+func testUpdate(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "update_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_n", Columns: []string{"n"}},
+			{Name: "idx_u", Columns: []string{"u"}, Unique: true},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("update_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	idxN, err := c.Index("idx_n")
+	assert.Assert(t, err == nil)
+
+	for i := 0; i < 10; i++ {
+		_, err = c.InsertOne(bson.M{"n": i, "u": i, "group": i % 2}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	did, err := c.InsertOne(bson.M{"n": 100, "u": 100}, nil)
+	assert.Assert(t, err == nil)
+	exists, err := c.UpdateOne(did, bson.M{"$inc": bson.M{"n": 1}, "$set": bson.M{"tag": "x"}}, nil)
+	assert.Assert(t, err == nil && exists)
+	var doc bson.M
+	assert.Assert(t, c.GetOne(did, &doc, nil) == nil)
+	assert.DeepEqual(t, doc, bson.M{"n": int32(101), "u": int32(100), "tag": "x"})
+	dids, _, err := idxN.Lookup(dml.LookupOption{Eq: []interface{}{101}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 1 && dids[0] == did)
+	dids, _, err = idxN.Lookup(dml.LookupOption{Eq: []interface{}{100}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 0)
+
+	// unique index is still checked
+	_, err = c.UpdateOne(did, bson.M{"$set": bson.M{"u": 3}}, nil)
+	_, ok := err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok)
+
+	matched, modified, err := c.UpdateMany(bson.M{"group": 0}, bson.M{"$mul": bson.M{"n": 10}}, nil)
+	assert.Assert(t, err == nil && matched == 5 && modified == 4, "%d %d", matched, modified)
+	cursor, err := c.Find(bson.M{"n": bson.M{"$gte": 10, "$lt": 100}}, &dml.FindOptions{Sort: bson.D{{Key: "n", Value: 1}}}, nil)
+	assert.Assert(t, err == nil)
+	var docs []struct{ N, U int }
+	assert.Assert(t, cursor.All(&docs) == nil)
+	assert.Assert(t, len(docs) == 4 && docs[0].N == 20 && docs[0].U == 2 && docs[3].N == 80)
+	_, _, err = c.UpdateMany(nil, bson.M{"n": 1}, nil)
+	assert.Assert(t, err == dml.ErrUpdateRequired)
+
+	var before, after bson.M
+	found, err := c.FindOneAndUpdate(bson.M{"group": 0}, bson.M{"$push": bson.M{"log": "a"}},
+		&dml.FindOneAndUpdateOptions{Sort: bson.D{{Key: "n", Value: -1}}, Projection: bson.M{"n": 1, "log": 1}}, &before, nil)
+	assert.Assert(t, err == nil && found)
+	assert.DeepEqual(t, before, bson.M{"n": int32(80)})
+	found, err = c.FindOneAndUpdate(bson.M{"n": 80}, bson.M{"$push": bson.M{"log": "b"}},
+		&dml.FindOneAndUpdateOptions{ReturnAfter: true, Projection: bson.M{"log": 1}}, &after, nil)
+	assert.Assert(t, err == nil && found)
+	assert.DeepEqual(t, after, bson.M{"log": bson.A{"a", "b"}})
+	found, err = c.FindOneAndUpdate(bson.M{"n": -1}, bson.M{"$set": bson.M{"x": 1}}, nil, nil, nil)
+	assert.Assert(t, err == nil && !found)
+}
+
+func testMultikey(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "multikey_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_tags", Columns: []string{"tags"}},
+			{Name: "idx_a_scores", Columns: []string{"a", "scores"}},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("multikey_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	idxTags, err := c.Index("idx_tags")
+	assert.Assert(t, err == nil)
+
+	did1, err := c.InsertOne(bson.M{"tags": bson.A{"x", "y", "x"}, "a": 1, "scores": bson.A{1, 10}}, nil)
+	assert.Assert(t, err == nil)
+	did2, err := c.InsertOne(bson.M{"tags": bson.A{"y", "z"}, "a": 1, "scores": bson.A{5}}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"tags": "x", "a": 2}, nil)
+	assert.Assert(t, err == nil)
+	for i := 0; i < 20; i++ {
+		_, err = c.InsertOne(bson.M{"tags": bson.A{fmt.Sprint(i)}, "a": 3}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	// lookup matches any element and returns each document once
+	dids, _, err := idxTags.Lookup(dml.LookupOption{Eq: []interface{}{"x"}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 2 && dids[0] == did1, "%v", dids)
+	dids, _, err = idxTags.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == 23, "%v", dids)
+
+	ex, err := c.Explain(bson.M{"tags": "y"}, &dml.FindOptions{Projection: bson.M{"tags": 1}}, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Index == "idx_tags" && !ex.Covered && ex.NReturned == 2, "%+v", ex)
+
+	// ranges are not intersected: 1 < 2 and 10 > 6 matches via different elements
+	cursor, err := c.Find(bson.M{"a": 1, "scores": bson.M{"$gt": 2, "$lt": 6}}, nil, nil)
+	assert.Assert(t, err == nil)
+	var docs []bson.M
+	assert.Assert(t, cursor.All(&docs) == nil)
+	assert.Assert(t, len(docs) == 2, "%v", docs)
+
+	// updates diff the element sets
+	exists, err := c.UpdateOne(did2, bson.M{"$pull": bson.M{"tags": "y"}}, nil)
+	assert.Assert(t, err == nil && exists)
+	exists, err = c.UpdateOne(did2, bson.M{"$push": bson.M{"tags": "w"}}, nil)
+	assert.Assert(t, err == nil && exists)
+	dids, _, err = idxTags.Lookup(dml.LookupOption{Eq: []interface{}{"y"}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 1 && dids[0] == did1, "%v", dids)
+	dids, _, err = idxTags.Lookup(dml.LookupOption{Eq: []interface{}{"w"}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 1 && dids[0] == did2, "%v", dids)
+
+	// compound index rejects two array columns
+	_, err = c.InsertOne(bson.M{"a": bson.A{1}, "scores": bson.A{1}}, nil)
+	assert.Assert(t, err == dml.ErrParallelArrays)
+	n, err := c.Count(nil)
+	assert.Assert(t, err == nil && n == 23)
+}
+
+func testTTL(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "ttl_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_at", Columns: []string{"at"}, TTL: true, ExpireAfter: time.Hour},
+			{Name: "idx_i", Columns: []string{"i"}},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	err = (&ddl.IndexInfo{Name: "idx", Columns: []string{"a", "b"}, TTL: true}).Validate()
+	assert.Assert(t, err != nil)
+
+	db, err := do.DB("ttl_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	idxI, err := c.Index("idx_i")
+	assert.Assert(t, err == nil)
+
+	// far in the future so that the background reaper leaves them alone
+	now := time.Now().Add(100 * time.Hour)
+	for i := 0; i < 5; i++ {
+		_, err = c.InsertOne(bson.M{"at": now.Add(-2 * time.Hour), "i": i}, nil)
+		assert.Assert(t, err == nil)
+	}
+	// expires by its earliest date
+	_, err = c.InsertOne(bson.M{"at": bson.A{now, now.Add(-3 * time.Hour)}, "i": 5}, nil)
+	assert.Assert(t, err == nil)
+	keep := []interface{}{now, now.Add(-30 * time.Minute), "not a date", nil}
+	for i, at := range keep {
+		_, err = c.InsertOne(bson.M{"at": at, "i": 10 + i}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	n, err := c.DeleteExpired(now, 4, nil)
+	assert.Assert(t, err == nil && n == 4, "%d", n)
+	n, err = c.DeleteExpired(now, 4, nil)
+	assert.Assert(t, err == nil && n == 2, "%d", n)
+	n, err = c.DeleteExpired(now, 4, nil)
+	assert.Assert(t, err == nil && n == 0, "%d", n)
+
+	n, err = c.Count(nil)
+	assert.Assert(t, err == nil && n == len(keep))
+	dids, _, err := idxI.Lookup(dml.LookupOption{Eq: []interface{}{5}}, nil)
+	assert.Assert(t, err == nil && len(dids) == 0)
+	dids, _, err = idxI.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == len(keep))
+
+	// background reaper
+	_, err = c.InsertOne(bson.M{"at": time.Now().Add(-2 * time.Hour)}, nil)
+	assert.Assert(t, err == nil)
+	for i := 0; ; i++ {
+		n, err = c.Count(nil)
+		assert.Assert(t, err == nil)
+		if n == len(keep) {
+			break
+		}
+		assert.Assert(t, i < 50, "expired document not deleted")
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func testPartialIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "partial_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_email", Columns: []string{"email"}, Unique: true, Sparse: true},
+			{Name: "idx_score", Columns: []string{"score"}, Unique: true, PartialFilter: bson.M{"active": true}},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	err = (&ddl.IndexInfo{Name: "idx", Columns: []string{"a"}, PartialFilter: bson.M{"a": bson.M{"$ne": 1}}}).Validate()
+	assert.Assert(t, err == dml.ErrPartialFilterNotSupported)
+
+	db, err := do.DB("partial_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+	idxEmail, err := c.Index("idx_email")
+	assert.Assert(t, err == nil)
+	idxScore, err := c.Index("idx_score")
+	assert.Assert(t, err == nil)
+
+	// unique checks apply only within the indexed subset
+	for i := 0; i < 30; i++ {
+		_, err = c.InsertOne(bson.M{"i": i, "score": i % 3, "active": false}, nil)
+		assert.Assert(t, err == nil)
+	}
+	did, err := c.InsertOne(bson.M{"email": "a@x", "score": 1, "active": true}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"email": "a@x"}, nil)
+	_, ok := err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok)
+	_, err = c.InsertOne(bson.M{"score": 1, "active": true}, nil)
+	_, ok = err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok)
+
+	dids, _, err := idxEmail.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == 1 && dids[0] == did)
+	dids, _, err = idxScore.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == 1 && dids[0] == did)
+
+	// leaving the subset removes the entry
+	exists, err := c.UpdateOne(did, bson.M{"$set": bson.M{"active": false}}, nil)
+	assert.Assert(t, err == nil && exists)
+	dids, _, err = idxScore.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == nil && len(dids) == 0)
+	exists, err = c.UpdateOne(did, bson.M{"$set": bson.M{"active": true}}, nil)
+	assert.Assert(t, err == nil && exists)
+
+	// the planner uses the indexes only when the filter implies the subset
+	ex, err := c.Explain(bson.M{"score": 1, "active": true}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Index == "idx_score" && ex.NReturned == 1, "%+v", ex)
+	ex, err = c.Explain(bson.M{"score": 1}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanCollectionScan && ex.NReturned == 11 && len(ex.Rejected) == 0, "%+v", ex)
+	ex, err = c.Explain(bson.M{"email": "a@x"}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Index == "idx_email" && ex.NReturned == 1, "%+v", ex)
+	ex, err = c.Explain(bson.M{"email": nil}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanCollectionScan && ex.NReturned == 30, "%+v", ex)
+}
+
+func testTextIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "text_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("text_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	texts := []string{
+		"The quick brown fox jumps over the lazy dog",
+		"A quick movement of the enemy will jeopardize six gunboats",
+		"Foxes are running, the fox runs",
+		"Nothing to see here",
+	}
+	dids := make([]int64, len(texts))
+	for i, text := range texts {
+		dids[i], err = c.InsertOne(bson.M{"body": text, "i": i}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	search := func(filter interface{}) (result []int64, scores []float64) {
+		cursor, err := c.Find(filter, nil, nil)
+		assert.Assert(t, err == nil)
+		defer cursor.Close()
+		for cursor.Next() {
+			result = append(result, cursor.Did)
+			scores = append(scores, cursor.Score)
+		}
+		assert.Assert(t, cursor.Err() == nil)
+		return
+	}
+
+	_, err = c.Find(bson.M{"$text": bson.M{"$search": "fox"}}, nil, nil)
+	assert.Assert(t, err == dml.ErrTextIndexRequired)
+
+	// built by the reorg of AddIndex
+	_, err = do.DDL().AddIndex(context.Background(), ddl.AddIndexInput{
+		DB:         "text_db",
+		Collection: "c",
+		IndexInfo:  ddl.IndexInfo{Name: "idx_body", Columns: []string{"body"}, Kind: model.IndexKindText},
+	})
+	assert.Assert(t, err == nil)
+
+	// more occurrences score higher
+	result, scores := search(bson.M{"$text": bson.M{"$search": "FOX"}})
+	assert.DeepEqual(t, result, []int64{dids[2], dids[0]})
+	assert.Assert(t, scores[0] > scores[1] && scores[1] > 0)
+
+	result, _ = search(bson.M{"$text": bson.M{"$search": "quick fox"}})
+	assert.DeepEqual(t, result, []int64{dids[0], dids[2], dids[1]})
+	result, _ = search(bson.M{"$text": bson.M{"$search": "quick fox", "$mode": "and"}})
+	assert.DeepEqual(t, result, []int64{dids[0]})
+	result, _ = search(bson.M{"$text": bson.M{"$search": "fox"}, "i": bson.M{"$lt": 1}})
+	assert.DeepEqual(t, result, []int64{dids[0]})
+	result, _ = search(bson.M{"$text": bson.M{"$search": "the"}})
+	assert.Assert(t, len(result) == 0)
+
+	ex, err := c.Explain(bson.M{"$text": bson.M{"$search": "fox"}}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanText && ex.Index == "idx_body" && ex.KeysExamined == 2 && ex.NReturned == 2, "%+v", ex)
+
+	// updates replace the terms
+	exists, err := c.UpdateOne(dids[3], bson.M{"$set": bson.M{"body": "a fox at last"}}, nil)
+	assert.Assert(t, err == nil && exists)
+	result, _ = search(bson.M{"$text": bson.M{"$search": "fox"}})
+	assert.Assert(t, len(result) == 3)
+	result, _ = search(bson.M{"$text": bson.M{"$search": "nothing"}})
+	assert.Assert(t, len(result) == 0)
+
+	idx, err := c.Index("idx_body")
+	assert.Assert(t, err == nil)
+	_, _, err = idx.Lookup(dml.LookupOption{}, nil)
+	assert.Assert(t, err == dml.ErrTextIndexLookup)
+}
+
+func testGeoIndex(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "geo_db",
+		Collections: []string{"c"},
+		Indices: map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{
+			{Name: "idx_loc", Columns: []string{"loc"}, Kind: model.IndexKindGeo2d},
+		}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("geo_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	// a grid of points from (-10, -10) to (10, 10)
+	for x := -10; x <= 10; x++ {
+		for y := -10; y <= 10; y++ {
+			_, err = c.InsertOne(bson.M{"loc": bson.A{x, y}, "x": x, "y": y}, nil)
+			assert.Assert(t, err == nil)
+		}
+	}
+	_, err = c.InsertOne(bson.M{"loc": bson.D{{Key: "lng", Value: 100.5}, {Key: "lat", Value: 30}}, "x": 100}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"name": "no location"}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"loc": bson.A{200, 0}}, nil)
+	assert.Assert(t, err == dml.ErrInvalidGeoPoint)
+
+	type point struct{ X, Y int }
+	find := func(filter interface{}, opts ...*dml.FindOptions) (points []point) {
+		var opt *dml.FindOptions
+		if len(opts) > 0 {
+			opt = opts[0]
+		}
+		cursor, err := c.Find(filter, opt, nil)
+		assert.Assert(t, err == nil)
+		assert.Assert(t, cursor.All(&points) == nil)
+		return
+	}
+
+	points := find(bson.M{"loc": bson.M{"$near": bson.A{2.1, 3.2}, "$maxDistance": 1}})
+	assert.DeepEqual(t, points, []point{{2, 3}, {2, 4}, {3, 3}})
+	points = find(bson.M{"loc": bson.M{"$near": bson.A{100, 30}}, "x": bson.M{"$gte": 10}}, &dml.FindOptions{Limit: 3})
+	assert.DeepEqual(t, points, []point{{100, 0}, {10, 10}, {10, 9}})
+
+	// unbounded $near only searches around the center until the limit is met
+	ex, err := c.Explain(bson.M{"loc": bson.M{"$near": bson.A{0.1, 0.2}}}, &dml.FindOptions{Limit: 1}, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanGeo && ex.NReturned == 1 && ex.DocsExamined < 10, "%+v", ex)
+	points = find(bson.M{"loc": bson.M{"$near": bson.A{0.1, 0.2}}}, &dml.FindOptions{Limit: 3})
+	assert.DeepEqual(t, points, []point{{0, 0}, {0, 1}, {1, 0}})
+
+	points = find(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{-1, -1}, bson.A{1, 0}}}}})
+	assert.Assert(t, len(points) == 6, "%v", points)
+	points = find(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$center": bson.A{bson.A{0, 0}, 1.5}}}})
+	assert.Assert(t, len(points) == 9, "%v", points)
+
+	ex, err = c.Explain(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$center": bson.A{bson.A{0, 0}, 1.5}}}}, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanGeo && ex.Index == "idx_loc" && ex.NReturned == 9, "%+v", ex)
+	assert.Assert(t, ex.KeysExamined < 100, "%+v", ex)
+
+	// $geoWithin works without index, $near doesn't
+	_, err = c.Find(bson.M{"other": bson.M{"$near": bson.A{0, 0}}}, nil, nil)
+	assert.Assert(t, err == dml.ErrGeoIndexRequired)
+	_, err = c.UpdateOne(1, bson.M{"$set": bson.M{"other": bson.A{1, 1}}}, nil)
+	assert.Assert(t, err == nil)
+	points = find(bson.M{"other": bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{0, 0}, bson.A{2, 2}}}}})
+	assert.Assert(t, len(points) == 1)
+}
+
+func testAggregate(t *testing.T, do *domain.Domain, kvdb mondis.KVDB) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "agg_db",
+		Collections: []string{"c"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx_k", Columns: []string{"k"}}}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("agg_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		_, err = c.InsertOne(bson.M{"k": i % 10, "v": i, "tags": bson.A{i % 2, i % 3}}, nil)
+		assert.Assert(t, err == nil)
+	}
+
+	countTemp := func() (count int) {
+		err := kvdb.Scan(mondis.ProviderScanOption{Prefix: keyspace.TempPrefixBytes}, func(key []byte, value []byte, meta mondis.VMetaResp) bool {
+			count++
+			return true
+		})
+		assert.Assert(t, err == nil)
+		return
+	}
+	aggregate := func(pipeline bson.A, opts *dml.AggregateOptions, result interface{}) {
+		cursor, err := c.Aggregate(pipeline, opts, nil)
+		assert.Assert(t, err == nil, err)
+		assert.Assert(t, cursor.All(result) == nil)
+		assert.Equal(t, countTemp(), 0)
+	}
+
+	// the leading $match uses index
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"k": 3}},
+		bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$count": bson.M{}}, "sum": bson.M{"$sum": "$v"}, "max": bson.M{"$max": "$v"}}},
+	}
+	var totals []struct{ N, Sum, Max int }
+	aggregate(pipeline, nil, &totals)
+	assert.DeepEqual(t, totals, []struct{ N, Sum, Max int }{{N: n / 10, Sum: (3 + 493) * n / 20, Max: 493}})
+	ex, err := c.ExplainAggregate(pipeline, nil, nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ex.Plan == dml.PlanIndexScan && ex.Index == "idx_k" && ex.DocsExamined == n/10 && ex.NReturned == 1, "%+v", ex)
+
+	// large sorts and groups spill with a small memory limit
+	type doc struct{ K, V int }
+	var sorted, spilled []doc
+	pipeline = bson.A{bson.M{"$sort": bson.D{{Key: "v", Value: -1}}}, bson.M{"$project": bson.M{"tags": 0}}}
+	aggregate(pipeline, nil, &sorted)
+	aggregate(pipeline, &dml.AggregateOptions{MemoryLimit: 1024}, &spilled)
+	assert.Assert(t, len(sorted) == n && sorted[0].V == n-1 && sorted[n-1].V == 0)
+	assert.DeepEqual(t, sorted, spilled)
+
+	type group struct {
+		ID   bson.M `bson:"_id"`
+		N    int
+		Avg  float64
+		Vs   []int
+		Last int
+	}
+	var groups, spilledGroups []group
+	pipeline = bson.A{
+		bson.M{"$unwind": "$tags"},
+		bson.M{"$match": bson.M{"v": bson.M{"$lt": 100}}},
+		bson.M{"$group": bson.M{
+			"_id":  bson.M{"k": "$k", "tag": "$tags"},
+			"n":    bson.M{"$sum": 1},
+			"avg":  bson.M{"$avg": "$v"},
+			"vs":   bson.M{"$push": "$v"},
+			"last": bson.M{"$max": "$v"},
+		}},
+		bson.M{"$sort": bson.D{{Key: "n", Value: -1}, {Key: "_id.k", Value: 1}, {Key: "_id.tag", Value: 1}}},
+		bson.M{"$skip": 1},
+		bson.M{"$limit": 5},
+	}
+	aggregate(pipeline, nil, &groups)
+	aggregate(pipeline, &dml.AggregateOptions{MemoryLimit: 512}, &spilledGroups)
+	assert.Assert(t, len(groups) == 5, "%v", groups)
+	assert.DeepEqual(t, groups, spilledGroups)
+	// v of k 1 are 1, 11, ..., 91, unwound tags of them are 1 and v%3
+	assert.DeepEqual(t, groups[0].ID, bson.M{"k": int32(1), "tag": int32(1)})
+	assert.Assert(t, groups[0].N == 14 && groups[0].Avg == 46 && groups[0].Last == 91 && len(groups[0].Vs) == 14 && groups[0].Vs[1] == 1, "%v", groups[0])
+
+	var counts []struct{ N int }
+	aggregate(bson.A{bson.M{"$match": bson.M{"k": bson.M{"$gte": 8}}}, bson.M{"$count": "n"}}, nil, &counts)
+	assert.Assert(t, len(counts) == 1 && counts[0].N == n/5)
+
+	_, err = c.Aggregate(bson.A{bson.M{"$limit": 1}, bson.M{"$match": bson.M{"$text": bson.M{"$search": "a"}}}}, nil, nil)
+	assert.Assert(t, err == dml.ErrSearchNotFirstStage)
+}
+
+func testChangeStream(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "cs_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("cs_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	_, err = c.InsertOne(bson.M{"a": 0}, nil)
+	assert.Assert(t, err == nil)
+	cs, err := c.Watch(nil, &dml.WatchOptions{FullDocument: true})
+	assert.Assert(t, err == nil)
+	defer cs.Close()
+
+	did, err := c.InsertOne(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.UpdateOne(did, bson.M{"$set": bson.M{"a": 2}}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.UpdateOne(did, bson.M{"a": 3}, nil)
+	assert.Assert(t, err == nil)
+	err = c.DeleteOne(did, nil)
+	assert.Assert(t, err == nil)
+	// changes of an aborted txn are not logged
+	err = c.RunInNewUpdateTxn(func(t *txn.Txn) error {
+		_, err := c.InsertOne(bson.M{"a": 4}, t)
+		if err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	assert.Assert(t, err != nil)
+	var dids []int64
+	err = c.RunInNewUpdateTxn(func(t *txn.Txn) error {
+		for i := 5; i < 7; i++ {
+			did, err := c.InsertOne(bson.M{"a": i}, t)
+			if err != nil {
+				return err
+			}
+			dids = append(dids, did)
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+
+	type change struct {
+		Op  string
+		Did int64
+		A   int
+	}
+	next := func(cs *dml.ChangeStream) (ch change) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Assert(t, cs.Next(ctx), cs.Err())
+		ch = change{Op: cs.Current.Op, Did: cs.Current.Did}
+		if cs.Current.FullDocument != nil {
+			ch.A = int(cs.Current.FullDocument.Lookup("a").Int32())
+		}
+		return
+	}
+	expected := []change{
+		{Op: dml.ChangeInsert, Did: did, A: 1},
+		{Op: dml.ChangeUpdate, Did: did, A: 2},
+		{Op: dml.ChangeReplace, Did: did, A: 3},
+		{Op: dml.ChangeDelete, Did: did},
+		{Op: dml.ChangeInsert, Did: dids[0], A: 5},
+		{Op: dml.ChangeInsert, Did: dids[1], A: 6},
+	}
+	var tokens []dml.ResumeToken
+	for _, ch := range expected {
+		assert.DeepEqual(t, next(cs), ch)
+		tokens = append(tokens, cs.Current.Token)
+	}
+
+	// no more changes
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	assert.Assert(t, !cs.Next(ctx) && cs.Err() == context.DeadlineExceeded)
+	cancel()
+
+	// resume after the replace without full document
+	resumed, err := c.Watch(tokens[2], nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, next(resumed), change{Op: dml.ChangeDelete, Did: did})
+	assert.DeepEqual(t, next(resumed), change{Op: dml.ChangeInsert, Did: dids[0]})
+	resumed.Close()
+	assert.Assert(t, !resumed.Next(context.Background()) && resumed.Err() == dml.ErrChangeStreamClosed)
+	_, err = c.Watch(dml.ResumeToken("bad"), nil)
+	assert.Assert(t, err == dml.ErrInvalidResumeToken)
+
+	// commits wake up waiting streams
+	tailing, err := c.Watch(nil, &dml.WatchOptions{PollInterval: time.Hour})
+	assert.Assert(t, err == nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.InsertOne(bson.M{"a": 7}, nil)
+	}()
+	start := time.Now()
+	ch := next(tailing)
+	assert.Assert(t, ch.Op == dml.ChangeInsert && time.Since(start) < time.Second)
+	tailing.Close()
+	assert.Assert(t, next(cs).Op == dml.ChangeInsert)
+
+	// truncated events expire resume tokens
+	// the first event is the insert before watching
+	n, err := c.TruncateChangeLog(time.Now().Add(time.Second), 4, nil)
+	assert.Assert(t, err == nil && n == 4)
+	n, err = c.TruncateChangeLog(time.Now().Add(-time.Hour), 100, nil)
+	assert.Assert(t, err == nil && n == 0)
+	_, err = c.Watch(tokens[1], nil)
+	assert.Assert(t, err == dml.ErrResumeTokenExpired)
+	resumed, err = c.Watch(tokens[2], nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, next(resumed).Op == dml.ChangeDelete)
+	resumed.Close()
+
+	_, err = do.DDL().TruncateCollection(context.Background(), ddl.TruncateCollectionInput{DB: "cs_db", Collection: "c"})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, !cs.Next(context.Background()) && cs.Err() == dml.ErrChangeStreamInvalidated)
+}
+
+func testInsertMany(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "insert_many_db",
+		Collections: []string{"c", "big"},
+		Indices:     map[string][]ddl.IndexInfo{"c": []ddl.IndexInfo{{Name: "idx_u", Columns: []string{"u"}, Unique: true}}},
+	})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("insert_many_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	// ordered stops at the first failed document
+	dids, err := c.InsertMany([]interface{}{bson.M{"u": 1}, bson.M{"u": 2}, bson.M{"u": 1}, bson.M{"u": 3}}, nil, nil)
+	manyErr, ok := err.(*dml.InsertManyError)
+	assert.Assert(t, ok && len(manyErr.Errors) == 1)
+	dupErr, ok := manyErr.Errors[2].(*dml.DuplicateKeyError)
+	assert.Assert(t, ok && dupErr.Did == dids[0])
+	assert.Assert(t, len(dids) == 4 && dids[0] > 0 && dids[1] == dids[0]+1 && dids[2] == 0 && dids[3] == 0)
+	n, err := c.Count(nil)
+	assert.Assert(t, err == nil && n == 2)
+
+	// ids of the failed and skipped documents are put back
+	did, err := c.InsertOne(bson.M{"u": 4}, nil)
+	assert.Assert(t, err == nil && (did == dids[1]+1 || did == dids[1]+2))
+
+	// unordered goes on after failed documents
+	dids, err = c.InsertMany([]interface{}{bson.M{"u": 5}, make(chan int), bson.M{"u": 5}, bson.M{"u": 6}}, &dml.InsertManyOptions{Unordered: true}, nil)
+	manyErr, ok = err.(*dml.InsertManyError)
+	assert.Assert(t, ok && len(manyErr.Errors) == 2 && manyErr.Errors[1] != nil)
+	_, ok = manyErr.Errors[2].(*dml.DuplicateKeyError)
+	assert.Assert(t, ok && dids[0] > 0 && dids[1] == 0 && dids[2] == 0 && dids[3] > 0)
+	var doc bson.M
+	assert.Assert(t, c.GetOne(dids[3], &doc, nil) == nil && doc["u"] == int32(6))
+	n, err = c.Count(nil)
+	assert.Assert(t, err == nil && n == 5)
+
+	// inside a transaction
+	txn := c.Txn(true)
+	_, err = c.InsertMany([]interface{}{bson.M{"u": 7}, bson.M{"u": 8}}, &dml.InsertManyOptions{Unordered: true}, txn)
+	assert.Assert(t, err == dml.ErrUnorderedInTxn)
+	dids, err = c.InsertMany([]interface{}{bson.M{"u": 7}, bson.M{"u": 8}}, nil, txn)
+	assert.Assert(t, err == nil && len(dids) == 2)
+	assert.Assert(t, txn.Commit() == nil)
+	txn.Discard()
+	n, err = c.Count(nil)
+	assert.Assert(t, err == nil && n == 7)
+
+	// too many documents for a single transaction
+	big, err := db.Collection("big")
+	assert.Assert(t, err == nil)
+	docs := make([]interface{}, 100000)
+	for i := range docs {
+		docs[i] = bson.M{"i": i}
+	}
+	dids, err = big.InsertMany(docs, nil, nil)
+	assert.Assert(t, err == nil, err)
+	seen := make(map[int64]bool)
+	for _, did := range dids {
+		assert.Assert(t, did > 0 && !seen[did])
+		seen[did] = true
+	}
+	n, err = big.Count(nil)
+	assert.Assert(t, err == nil && n == len(docs))
+	assert.Assert(t, big.GetOne(dids[len(dids)-1], &doc, nil) == nil && doc["i"] == int32(len(docs)-1))
+}
+
+func testScan(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "scan_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("scan_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	docs := make([]interface{}, 250)
+	for i := range docs {
+		docs[i] = bson.M{"i": i}
+	}
+	dids, err := c.InsertMany(docs, nil, nil)
+	assert.Assert(t, err == nil)
+
+	type doc struct {
+		I int `bson:"i"`
+	}
+	cursor, err := c.Scan(&dml.ScanOptions{BatchSize: 100}, nil)
+	assert.Assert(t, err == nil)
+	var n int
+	for cursor.Next() {
+		var d doc
+		assert.Assert(t, cursor.Decode(&d) == nil)
+		assert.Assert(t, d.I == n && cursor.Did == dids[n])
+		n++
+		if n == 120 {
+			break
+		}
+	}
+	assert.Assert(t, cursor.Err() == nil)
+	cursor.Close()
+
+	// batches are read by their own transactions, changes after the last batch are seen
+	lastDid := cursor.Did
+	assert.Assert(t, c.DeleteOne(dids[200], nil) == nil)
+	cursor, err = c.Scan(&dml.ScanOptions{BatchSize: 100, AfterID: lastDid}, nil)
+	assert.Assert(t, err == nil)
+	for cursor.Next() {
+		var d doc
+		assert.Assert(t, cursor.Decode(&d) == nil)
+		if d.I == 150 {
+			assert.Assert(t, c.DeleteOne(dids[249], nil) == nil)
+		}
+		assert.Assert(t, d.I != 200 && d.I != 249)
+		n++
+	}
+	assert.Assert(t, cursor.Err() == nil)
+	cursor.Close()
+	assert.Equal(t, n, 248)
+
+	var all []doc
+	assert.Assert(t, c.GetAll(&all, nil) == nil && len(all) == 248)
+
+	// a scan inside a transaction reads a single snapshot
+	txn := c.Txn(false)
+	cursor, err = c.Scan(&dml.ScanOptions{BatchSize: 10}, txn)
+	assert.Assert(t, err == nil)
+	n = 0
+	for cursor.Next() {
+		if n == 0 {
+			assert.Assert(t, c.DeleteOne(cursor.Did+100, nil) == nil)
+		}
+		n++
+	}
+	cursor.Close()
+	txn.Discard()
+	assert.Assert(t, cursor.Err() == nil && n == 248)
+}
+
+func testValidator(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "validator_db", Collections: []string{"c"}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("validator_db")
+	assert.Assert(t, err == nil)
+	c, err := db.Collection("c")
+	assert.Assert(t, err == nil)
+
+	legacy, err := c.InsertOne(bson.M{"name": 1}, nil)
+	assert.Assert(t, err == nil)
+
+	schema := bson.M{
+		"bsonType": "object",
+		"required": bson.A{"name"},
+		"properties": bson.M{
+			"name": bson.M{"bsonType": "string"},
+			"age":  bson.M{"bsonType": "int", "minimum": 0},
+		},
+	}
+	_, err = do.DDL().SetValidator(context.Background(), ddl.SetValidatorInput{DB: "validator_db", Collection: "c", Schema: bson.M{"bsonType": "integer"}})
+	assert.Assert(t, err != nil)
+	_, err = do.DDL().SetValidator(context.Background(), ddl.SetValidatorInput{DB: "validator_db", Collection: "c", Schema: schema})
+	assert.Assert(t, err == nil)
+
+	// strict rejects inserts and updates
+	_, err = c.InsertOne(bson.M{"age": 1}, nil)
+	verr, ok := err.(*dml.DocumentValidationError)
+	assert.Assert(t, ok && verr.Path == "name")
+	did, err := c.InsertOne(bson.M{"name": "a", "age": 1}, nil)
+	assert.Assert(t, err == nil)
+	_, err = c.UpdateOne(did, bson.M{"$inc": bson.M{"age": -2}}, nil)
+	verr, ok = err.(*dml.DocumentValidationError)
+	assert.Assert(t, ok && verr.Path == "age")
+	dids, err := c.InsertMany([]interface{}{bson.M{"name": "b"}, bson.M{"name": 2}}, &dml.InsertManyOptions{Unordered: true}, nil)
+	assert.Assert(t, err != nil && dids[0] > 0 && dids[1] == 0)
+
+	// existing documents are found by Validate
+	violations, err := c.Validate(nil, nil)
+	assert.Assert(t, err == nil && len(violations) == 1 && violations[0].Did == legacy && violations[0].Err.Path == "name")
+	violations, err = c.Validate(&dml.ValidateOptions{Schema: bson.M{"required": bson.A{"age"}}, Limit: 1}, nil)
+	assert.Assert(t, err == nil && len(violations) == 1 && violations[0].Did == legacy)
+
+	// warn only logs
+	_, err = do.DDL().SetValidator(context.Background(), ddl.SetValidatorInput{DB: "validator_db", Collection: "c", Schema: schema, Action: model.ValidationWarn})
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"age": "old"}, nil)
+	assert.Assert(t, err == nil)
+	violations, err = c.Validate(nil, nil)
+	assert.Assert(t, err == nil && len(violations) == 2)
+
+	// nil schema removes the validator
+	_, err = do.DDL().SetValidator(context.Background(), ddl.SetValidatorInput{DB: "validator_db", Collection: "c"})
+	assert.Assert(t, err == nil)
+	violations, err = c.Validate(nil, nil)
+	assert.Assert(t, err == nil && len(violations) == 0)
+}
+
+func testDocIDTypes(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{
+		DB:          "id_db",
+		Collections: []string{"oid", "str"},
+		IDTypes:     map[string]model.IDType{"oid": model.IDTypeObjectID, "str": model.IDTypeString},
+	})
+	assert.Assert(t, err == nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "id_db", Collection: "bin", IDType: model.IDTypeBytes})
+	assert.Assert(t, err == nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "id_db", Collection: "bad", IDType: 100})
+	assert.Assert(t, err != nil)
+	db, err := do.DB("id_db")
+	assert.Assert(t, err == nil)
+
+	// ObjectID is generated and kept by replacements
+	oid, err := db.Collection("oid")
+	assert.Assert(t, err == nil)
+	id, err := oid.InsertOneID(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+	var doc bson.M
+	assert.Assert(t, oid.GetOne(id, &doc, nil) == nil && doc["_id"] == id)
+	_, err = oid.UpdateOne(id, bson.M{"a": 2}, nil)
+	assert.Assert(t, err == nil)
+	doc = nil
+	assert.Assert(t, oid.GetOne(id, &doc, nil) == nil && doc["_id"] == id && doc["a"] == int32(2))
+	_, err = oid.UpdateOne(id, bson.M{"$set": bson.M{"_id": primitive.NewObjectID()}}, nil)
+	assert.Assert(t, err == dml.ErrIDImmutable)
+	_, err = oid.InsertOne(bson.M{"_id": id}, nil)
+	dupErr, ok := err.(*dml.DuplicateKeyError)
+	assert.Assert(t, ok && dupErr.Index == "_id" && dupErr.ID == id)
+	assert.Assert(t, oid.GetOne("x", &doc, nil) == dml.ErrInvalidID)
+
+	// string ids are supplied by client and freed on delete
+	str, err := db.Collection("str")
+	assert.Assert(t, err == nil)
+	_, err = str.InsertOne(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == dml.ErrIDRequired)
+	dids, err := str.InsertMany([]interface{}{bson.M{"_id": "x"}, bson.M{"_id": "y"}, bson.M{"_id": "x"}}, &dml.InsertManyOptions{Unordered: true}, nil)
+	manyErr, ok := err.(*dml.InsertManyError)
+	assert.Assert(t, ok && len(manyErr.Errors) == 1 && len(dids) == 3 && dids[0] == 0)
+	doc = nil
+	assert.Assert(t, str.GetOne("y", &doc, nil) == nil && doc["_id"] == "y")
+	assert.Assert(t, str.DeleteOne("x", nil) == nil)
+	assert.Assert(t, str.GetOne("x", &doc, nil) == dml.ErrDocNotFound)
+	id, err = str.InsertOneID(bson.M{"_id": "x"}, nil)
+	assert.Assert(t, err == nil && id == "x")
+	assert.Assert(t, str.GetMany([]int64{1}, &[]bson.M{}, nil) == dml.ErrAutoIDRequired)
+
+	// documents are scanned in _id order
+	cursor, err := str.Scan(&dml.ScanOptions{AfterID: "x"}, nil)
+	assert.Assert(t, err == nil)
+	var ids []interface{}
+	for cursor.Next() {
+		doc = nil
+		assert.Assert(t, cursor.Decode(&doc) == nil)
+		ids = append(ids, doc["_id"])
+	}
+	assert.Assert(t, cursor.Err() == nil)
+	cursor.Close()
+	assert.DeepEqual(t, ids, []interface{}{"y"})
+
+	bin, err := db.Collection("bin")
+	assert.Assert(t, err == nil)
+	_, err = bin.InsertOne(bson.M{"_id": "x"}, nil)
+	assert.Assert(t, err == dml.ErrInvalidID)
+	_, err = bin.InsertOne(bson.M{"_id": []byte{0, 1}}, nil)
+	assert.Assert(t, err == nil)
+	doc = nil
+	assert.Assert(t, bin.GetOne([]byte{0, 1}, &doc, nil) == nil)
+
+	// auto collections accept the did as _id only
+	auto, err := do.DB("db")
+	assert.Assert(t, err == nil)
+	c, err := auto.Collection("c")
+	assert.Assert(t, err == nil)
+	_, err = c.InsertOne(bson.M{"_id": "x"}, nil)
+	assert.Assert(t, err == dml.ErrInvalidID)
+	id, err = c.InsertOneID(bson.M{"a": 1}, nil)
+	assert.Assert(t, err == nil)
+	did, ok := id.(int64)
+	assert.Assert(t, ok && did > 0)
+	assert.Assert(t, c.GetOne(did, &doc, nil) == nil)
+	assert.Assert(t, c.DeleteOne(did, nil) == nil)
+
+	// capped collections evict in did order, so they need auto ids
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "id_db", Collection: "capped", IDType: model.IDTypeString, Capped: &model.CappedInfo{MaxDocs: 1}})
+	assert.Assert(t, err != nil)
+}
+
+func testCapped(t *testing.T, do *domain.Domain) {
+	_, err := do.DDL().CreateSchema(context.Background(), ddl.CreateSchemaInput{DB: "capped_db", Collections: []string{"plain"}})
+	assert.Assert(t, err == nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "capped_db", Collection: "bad", Capped: &model.CappedInfo{}})
+	assert.Assert(t, err != nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "capped_db", Collection: "bad", Capped: &model.CappedInfo{MaxDocs: -1}})
+	assert.Assert(t, err != nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "capped_db", Collection: "log", Capped: &model.CappedInfo{MaxDocs: 3}})
+	assert.Assert(t, err == nil)
+	_, err = do.DDL().CreateCollection(context.Background(), ddl.CreateCollectionInput{DB: "capped_db", Collection: "sized", Capped: &model.CappedInfo{MaxBytes: 100}})
+	assert.Assert(t, err == nil)
+	db, err := do.DB("capped_db")
+	assert.Assert(t, err == nil)
+
+	// the oldest documents are evicted by count
+	c, err := db.Collection("log")
+	assert.Assert(t, err == nil)
+	for i := 1; i <= 5; i++ {
+		did, err := c.InsertOne(bson.M{"i": i}, nil)
+		assert.Assert(t, err == nil && did == int64(i))
+	}
+	var all []bson.M
+	assert.Assert(t, c.GetAll(&all, nil) == nil && len(all) == 3 && all[0]["i"] == int32(3) && all[2]["i"] == int32(5))
+	dids, err := c.InsertMany([]interface{}{bson.M{"i": 6}, bson.M{"i": 7}}, nil, nil)
+	assert.Assert(t, err == nil && dids[0] == 6 && dids[1] == 7)
+	n, err := c.Count(nil)
+	assert.Assert(t, err == nil && n == 3)
+	err = c.GetOne(4, &bson.M{}, nil)
+	assert.Assert(t, err == dml.ErrDocNotFound)
+	assert.Assert(t, c.InsertOneManaged(2, bson.M{"i": 2}, nil) == dml.ErrCappedOutOfOrder)
+	assert.Assert(t, c.InsertOneManaged(10, bson.M{"i": 10}, nil) == nil)
+	did, err := c.InsertOne(bson.M{"i": 11}, nil)
+	assert.Assert(t, err == nil && did == 11)
+
+	// concurrent inserts keep the limit
+	var wg sync.WaitGroup
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				_, err := c.InsertOne(bson.M{"i": 0}, nil)
+				assert.Check(t, err == nil, err)
+			}
+		}()
+	}
+	wg.Wait()
+	n, err = c.Count(nil)
+	assert.Assert(t, err == nil && n == 3)
+
+	// the oldest documents are evicted by size
+	sized, err := db.Collection("sized")
+	assert.Assert(t, err == nil)
+	for i := 0; i < 10; i++ {
+		_, err = sized.InsertOne(bson.M{"s": strings.Repeat("x", 20)}, nil)
+		assert.Assert(t, err == nil)
+	}
+	var raws []bson.Raw
+	assert.Assert(t, sized.GetAll(&raws, nil) == nil && len(raws) > 0)
+	size := 0
+	for _, raw := range raws {
+		size += len(raw)
+	}
+	assert.Assert(t, size <= 100 && size+len(raws[0]) > 100)
+
+	// tail cursor waits for new documents
+	plain, err := db.Collection("plain")
+	assert.Assert(t, err == nil)
+	_, err = plain.Tail(nil)
+	assert.Assert(t, err == dml.ErrNotCapped)
+	tc, err := c.Tail(&dml.TailOptions{AfterDid: did})
+	assert.Assert(t, err == nil)
+	defer tc.Close()
+	var tailed []int64
+	for len(tailed) < 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		assert.Assert(t, tc.Next(ctx), tc.Err())
+		cancel()
+		tailed = append(tailed, tc.Did)
+	}
+	assert.Assert(t, tailed[0] > did && tailed[0] < tailed[1] && tailed[1] < tailed[2])
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	assert.Assert(t, !tc.Next(ctx) && tc.Err() == context.DeadlineExceeded)
+	cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := c.InsertOne(bson.M{"i": "new"}, nil)
+		assert.Check(t, err == nil, err)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	assert.Assert(t, tc.Next(ctx), tc.Err())
+	cancel()
+	var doc bson.M
+	assert.Assert(t, tc.Decode(&doc) == nil && doc["i"] == "new")
+	tc.Close()
+	assert.Assert(t, !tc.Next(context.Background()) && tc.Err() == dml.ErrTailCursorClosed)
+}
+
 func TestList(t *testing.T) {
 	kvdb := provider.NewBadger()
 	err := kvdb.Open(mondis.KVOption{Dir: dataDir})